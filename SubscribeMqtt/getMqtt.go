@@ -1,9 +1,10 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"os"
 	"sort"
 	"sync"
 	"time"
@@ -12,11 +13,10 @@ import (
 	"bitbucket.org/free5GC/util/mqttclient"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/sirupsen/logrus"
-)
 
-type MetricData struct {
-	Imsi string `json:"imsi"`
-}
+	"getMqtt/roster"
+	"getMqtt/schema"
+)
 
 var (
 	imsiCount      = make(map[string]int)
@@ -26,16 +26,28 @@ var (
 	maxLength      int
 	minLength      int
 	lock           sync.Mutex
+
+	// payload擷取規格（和抓包程式共用），預設只取 imsi 欄位
+	payloadSchema = schema.Default()
+	payloadGroups = schema.NewAggregator(payloadSchema, 0)
+	mismatchCount int64
+
+	// 預期IMSI名單（和抓包程式的 -roster 相同），未指定時為nil
+	rosterTracker *roster.Tracker
+	rosterWebhook string
+	rosterExit    bool
 )
 
+// 名單告警且指定了 -roster-exit 時的結束代碼，和抓包程式相同
+const rosterExitCode = 3
+
 func onConnect(client MQTT.Client) {
 	fmt.Println("已連線~ss")
 	client.Subscribe("FiveGC/metric", 0, onMessage)
 }
 
 func onMessage(client MQTT.Client, msg MQTT.Message) {
-	var data MetricData
-	err := json.Unmarshal(msg.Payload(), &data)
+	data, err := payloadSchema.Extract(msg.Topic(), msg.Payload())
 	if err != nil {
 		log.Printf("解析失敗: %v", err)
 		return
@@ -65,12 +77,19 @@ func onMessage(client MQTT.Client, msg MQTT.Message) {
 	if data.Imsi != "" {
 		imsiCount[data.Imsi]++
 	}
+
+	// 按擷取規格分組
+	if len(data.Mismatches) > 0 {
+		mismatchCount++
+	}
+	if payloadSchema.Grouped() {
+		payloadGroups.Add(data)
+	}
 	lock.Unlock()
 }
 
 func onMessage2(client MQTT.Client, msg MQTT.Message) {
-	var data MetricData
-	err := json.Unmarshal(msg.Payload(), &data)
+	_, err := payloadSchema.Extract(msg.Topic(), msg.Payload())
 	if err != nil {
 		log.Printf("解析失敗: %v", err)
 		return
@@ -154,6 +173,15 @@ func printAndReset() {
 	for {
 		time.Sleep(15 * time.Second)
 		lock.Lock()
+		// 和預期名單比對，要在IMSI統計重置前進行
+		var rosterResult *roster.Result
+		if rosterTracker != nil {
+			seen := make([]string, 0, len(imsiCount))
+			for imsi := range imsiCount {
+				seen = append(seen, imsi)
+			}
+			rosterResult = rosterTracker.Observe(seen)
+		}
 		if len(imsiCount) > 0 || messageCount > 0 {
 			fmt.Printf("這15秒統計:\n")
 			fmt.Printf("  - 不同IMSI數量: %d\n", len(imsiCount))
@@ -168,6 +196,10 @@ func printAndReset() {
 				q1, q2, q3 := calculateQuartiles(messageLengths)
 				fmt.Printf("  - 四分位數 (Q1/Q2/Q3): %.2f / %.2f / %.2f bytes\n", q1, q2, q3)
 			}
+			if mismatchCount > 0 {
+				fmt.Printf("  - 欄位型別不符: %d\n", mismatchCount)
+			}
+			schema.Print(os.Stdout, payloadSchema, payloadGroups.Snapshot())
 			fmt.Println()
 
 			// 重置統計數據
@@ -177,13 +209,34 @@ func printAndReset() {
 			messageLengths = []int{}
 			maxLength = 0
 			minLength = 0
+			mismatchCount = 0
 		} else {
 			fmt.Println("這15秒沒有收到訊息")
 		}
+		// 沒有收到訊息時名單中的IMSI全部缺席
+		if rosterResult != nil {
+			roster.Print(os.Stdout, rosterResult)
+			if len(rosterResult.Alerts) > 0 {
+				rosterAlert(rosterResult)
+			}
+		}
 		lock.Unlock()
 	}
 }
 
+// 名單中有IMSI連續缺席達到門檻：送出webhook，指定 -roster-exit 時以非0代碼結束
+func rosterAlert(result *roster.Result) {
+	log.Printf("!!! 警告: %d 個IMSI已連續 %d 個區間沒有出現", len(result.Alerts), result.Threshold)
+	if rosterWebhook != "" {
+		if err := roster.Notify(rosterWebhook, roster.NewAlert("SubscribeMqtt", time.Now(), result)); err != nil {
+			log.Printf("無法送出名單告警到 %s: %v", rosterWebhook, err)
+		}
+	}
+	if rosterExit {
+		os.Exit(rosterExitCode)
+	}
+}
+
 var MqttLog *logrus.Entry
 
 func init() {
@@ -192,6 +245,28 @@ func init() {
 }
 
 func main() {
+	schemaFile := flag.String("schema", "", "payload擷取規格檔（YAML），和抓包程式的 -schema 相同")
+	rosterSpec := flag.String("roster", "", "預期的IMSI名單：逗號分隔的檔案或範圍，和抓包程式的 -roster 相同")
+	rosterAbsent := flag.Int("roster-absent", 3, "名單中的IMSI連續缺席此數量的統計區間時告警，0表示不告警")
+	flag.StringVar(&rosterWebhook, "roster-webhook", "", "名單告警時以JSON POST到此URL")
+	flag.BoolVar(&rosterExit, "roster-exit", false, fmt.Sprintf("名單告警時以結束代碼 %d 結束", rosterExitCode))
+	flag.Parse()
+	if *schemaFile != "" {
+		spec, err := schema.Load(*schemaFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		payloadSchema = spec
+		payloadGroups = schema.NewAggregator(spec, 0)
+	}
+	if *rosterSpec != "" {
+		expected, err := roster.Load(*rosterSpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rosterTracker = roster.NewTracker(expected, *rosterAbsent)
+		fmt.Printf("已載入IMSI名單（%d 個IMSI）\n", expected.Len())
+	}
 
 	cfg := &mqttclient.MqttClientCfg{
 		Qos:        1,
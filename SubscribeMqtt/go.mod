@@ -6,6 +6,7 @@ toolchain go1.23.12
 
 require (
 	bitbucket.org/free5GC/util v0.0.0-20250807053044-dae7f7ade8cc
+	getMqtt v0.0.0-00010101000000-000000000000
 	github.com/eclipse/paho.mqtt.golang v1.5.0
 	github.com/sirupsen/logrus v1.9.3
 )
@@ -49,3 +50,6 @@ require (
 	google.golang.org/protobuf v1.34.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+// 和抓包程式共用payload擷取規格
+replace getMqtt => ../
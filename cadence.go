@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// 每個IMSI的回報週期分析：NF應該以固定週期回報每個UE的指標，
+// 依封包時間戳計算同一個IMSI相鄰兩次PUBLISH的間隔，找出一個週期內重複回報和超過數個週期沒有回報的IMSI。
+
+const (
+	// 每個IMSI保留最近幾個間隔，用來計算p95
+	cadenceSamples = 64
+	// 超過中斷門檻此倍數的時間沒有出現的IMSI不再追蹤
+	cadenceForgetGaps = 10
+	// 文字報告最多列出的不合規IMSI數
+	cadenceListLimit = 20
+)
+
+// 一個IMSI的回報間隔統計。最小、平均、最大和抖動從開始追蹤累計，p95為最近 cadenceSamples 個間隔
+type imsiCadence struct {
+	last      time.Time
+	messages  uint64
+	intervals uint64
+	min       time.Duration
+	max       time.Duration
+	sum       time.Duration
+	previous  time.Duration // 上一個間隔，用來計算抖動
+	jitter    float64       // RFC 3550的到達間隔抖動（秒）：相鄰兩個間隔差的平滑平均
+	samples   []uint32      // 最近的間隔（微秒），環狀緩衝
+	next      int
+
+	// 本統計區間的數值，報告後歸零
+	duplicates int
+	gaps       int
+}
+
+func (c *imsiCadence) addInterval(interval time.Duration) {
+	if c.intervals == 0 || interval < c.min {
+		c.min = interval
+	}
+	if interval > c.max {
+		c.max = interval
+	}
+	if c.intervals > 0 {
+		d := math.Abs((interval - c.previous).Seconds())
+		c.jitter += (d - c.jitter) / 16
+	}
+	c.previous = interval
+	c.sum += interval
+	c.intervals++
+
+	sample := uint32(math.MaxUint32)
+	if us := interval.Microseconds(); us < math.MaxUint32 {
+		sample = uint32(us)
+	}
+	if len(c.samples) < cadenceSamples {
+		c.samples = append(c.samples, sample)
+	} else {
+		c.samples[c.next] = sample
+		c.next = (c.next + 1) % cadenceSamples
+	}
+}
+
+func (c *imsiCadence) p95() float64 {
+	sorted := make([]float64, len(c.samples))
+	for i, s := range c.samples {
+		sorted[i] = float64(s) / 1e6
+	}
+	return percentile(sorted, 0.95)
+}
+
+// 數值的百分位數（最近秩法），會就地排序，沒有數值時為0
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	rank := int(math.Ceil(p*float64(len(values)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return values[rank]
+}
+
+// 追蹤所有IMSI的回報間隔，由 lock 保護。
+// 工作協程把PUBLISH時間記在分片，報告時依時間排序後才計算間隔，
+// 同一個IMSI經由不同連線（不同工作協程）送出時順序仍然正確。
+type cadenceTracker struct {
+	period         time.Duration
+	duplicateBelow time.Duration // 間隔小於此值算重複回報
+	gapAbove       time.Duration // 間隔超過此值算中斷
+
+	imsis   map[string]*imsiCadence
+	pending map[string][]time.Time // 已併入、還沒計算的PUBLISH時間
+
+	// 本統計區間的數值
+	intervals  []float64 // 所有IMSI的間隔（秒）
+	duplicates int
+	gaps       int
+}
+
+func newCadenceTracker(period time.Duration, gapPeriods int, dupRatio float64) *cadenceTracker {
+	return &cadenceTracker{
+		period:         period,
+		duplicateBelow: time.Duration(float64(period) * dupRatio),
+		gapAbove:       period * time.Duration(gapPeriods),
+		imsis:          make(map[string]*imsiCadence),
+		pending:        make(map[string][]time.Time),
+	}
+}
+
+// 併入一個分片記錄的PUBLISH時間
+func (t *cadenceTracker) merge(arrivals map[string][]time.Time) {
+	for imsi, times := range arrivals {
+		t.pending[imsi] = append(t.pending[imsi], times...)
+	}
+}
+
+func (t *cadenceTracker) observe(imsi string, ts time.Time) {
+	c := t.imsis[imsi]
+	if c == nil {
+		c = &imsiCadence{}
+		t.imsis[imsi] = c
+	}
+	c.messages++
+	if c.last.IsZero() {
+		c.last = ts
+		return
+	}
+	// 跨報告時間的封包可能比已計算的時間早（例如多個介面的封包交錯），只計數不計算間隔
+	if ts.Before(c.last) {
+		return
+	}
+	interval := ts.Sub(c.last)
+	c.last = ts
+	c.addInterval(interval)
+	t.intervals = append(t.intervals, interval.Seconds())
+	switch {
+	case interval < t.duplicateBelow:
+		c.duplicates++
+		t.duplicates++
+	case interval > t.gapAbove:
+		c.gaps++
+		t.gaps++
+	}
+}
+
+// 一個IMSI的回報間隔，時間單位為秒
+type cadenceStat struct {
+	Imsi          string    `json:"imsi"`
+	Messages      uint64    `json:"messages"` // 開始追蹤以來的PUBLISH數
+	MinSeconds    float64   `json:"minSeconds"`
+	AvgSeconds    float64   `json:"avgSeconds"`
+	P95Seconds    float64   `json:"p95Seconds"`
+	MaxSeconds    float64   `json:"maxSeconds"`
+	JitterSeconds float64   `json:"jitterSeconds"`
+	Duplicates    int       `json:"duplicates"`              // 本區間間隔小於重複門檻的次數
+	Gaps          int       `json:"gaps"`                    // 本區間間隔超過中斷門檻的次數
+	SilentSeconds float64   `json:"silentSeconds,omitempty"` // 到區間結束仍沒有回報的時間，超過中斷門檻時才有
+	LastSeen      time.Time `json:"lastSeen"`
+}
+
+// 一組時間（回報間隔或確認延遲）的分布，單位為秒
+type durationSummary struct {
+	Count      int     `json:"count"`
+	MinSeconds float64 `json:"minSeconds"`
+	AvgSeconds float64 `json:"avgSeconds"`
+	P95Seconds float64 `json:"p95Seconds"`
+	MaxSeconds float64 `json:"maxSeconds"`
+}
+
+// 計算分布，values 會被排序，沒有數值時為nil
+func newDurationSummary(values []float64) *durationSummary {
+	if len(values) == 0 {
+		return nil
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	summary := &durationSummary{
+		Count:      len(values),
+		AvgSeconds: sum / float64(len(values)),
+		P95Seconds: percentile(values, 0.95),
+	}
+	// percentile 已排序
+	summary.MinSeconds = values[0]
+	summary.MaxSeconds = values[len(values)-1]
+	return summary
+}
+
+func (s *durationSummary) String() string {
+	return fmt.Sprintf("最小 %s  平均 %s  p95 %s  最大 %s（%d 個）",
+		formatSeconds(s.MinSeconds), formatSeconds(s.AvgSeconds), formatSeconds(s.P95Seconds), formatSeconds(s.MaxSeconds), s.Count)
+}
+
+// 一個統計區間的回報週期摘要
+type cadenceReport struct {
+	PeriodSeconds float64          `json:"periodSeconds"`
+	Tracked       int              `json:"tracked"`   // 追蹤中的IMSI數
+	Reporting     int              `json:"reporting"` // 本區間有回報的IMSI數
+	Compliant     int              `json:"compliant"` // 本區間沒有重複、中斷或靜默的IMSI數
+	Duplicates    int              `json:"duplicates"`
+	Gaps          int              `json:"gaps"`
+	Silent        int              `json:"silent"`              // 到區間結束已超過中斷門檻沒有回報的IMSI數
+	Intervals     *durationSummary `json:"intervals,omitempty"` // 本區間所有IMSI的間隔分布
+	NonCompliant  []cadenceStat    `json:"nonCompliant,omitempty"`
+}
+
+// 計算到 end 為止的間隔並產生本區間的摘要，之後區間的數值歸零
+func (t *cadenceTracker) snapshot(end time.Time) *cadenceReport {
+	for imsi, times := range t.pending {
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		for _, ts := range times {
+			t.observe(imsi, ts)
+		}
+	}
+	report := &cadenceReport{
+		PeriodSeconds: t.period.Seconds(),
+		Reporting:     len(t.pending),
+		Duplicates:    t.duplicates,
+		Gaps:          t.gaps,
+		Intervals:     newDurationSummary(t.intervals),
+	}
+
+	for imsi, c := range t.imsis {
+		silent := end.Sub(c.last)
+		if silent > t.gapAbove*cadenceForgetGaps {
+			delete(t.imsis, imsi)
+			continue
+		}
+		if c.duplicates > 0 || c.gaps > 0 || silent > t.gapAbove {
+			stat := c.stat(imsi)
+			if silent > t.gapAbove {
+				stat.SilentSeconds = silent.Seconds()
+				report.Silent++
+			}
+			report.NonCompliant = append(report.NonCompliant, stat)
+		}
+		c.duplicates, c.gaps = 0, 0
+	}
+	report.Tracked = len(t.imsis)
+	report.Compliant = report.Tracked - len(report.NonCompliant)
+	// 問題最多的排前面
+	sort.Slice(report.NonCompliant, func(i, j int) bool {
+		a, b := report.NonCompliant[i], report.NonCompliant[j]
+		if a.Duplicates+a.Gaps != b.Duplicates+b.Gaps {
+			return a.Duplicates+a.Gaps > b.Duplicates+b.Gaps
+		}
+		if a.SilentSeconds != b.SilentSeconds {
+			return a.SilentSeconds > b.SilentSeconds
+		}
+		return a.Imsi < b.Imsi
+	})
+
+	t.pending = make(map[string][]time.Time)
+	t.intervals = nil
+	t.duplicates, t.gaps = 0, 0
+	return report
+}
+
+func (c *imsiCadence) stat(imsi string) cadenceStat {
+	stat := cadenceStat{
+		Imsi:       imsi,
+		Messages:   c.messages,
+		Duplicates: c.duplicates,
+		Gaps:       c.gaps,
+		LastSeen:   c.last,
+	}
+	if c.intervals > 0 {
+		stat.MinSeconds = c.min.Seconds()
+		stat.AvgSeconds = (c.sum / time.Duration(c.intervals)).Seconds()
+		stat.P95Seconds = c.p95()
+		stat.MaxSeconds = c.max.Seconds()
+		stat.JitterSeconds = c.jitter
+	}
+	return stat
+}
+
+// 秒數以Duration的格式顯示，例如 14.982s
+func formatSeconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Millisecond).String()
+}
+
+// 打印回報週期的摘要和不合規的IMSI
+func printCadence(report *cadenceReport) {
+	fmt.Printf("回報週期 %s: 追蹤 %d  本區間回報 %d  合規 %d  重複 %d  中斷 %d  靜默 %d\n",
+		formatSeconds(report.PeriodSeconds), report.Tracked, report.Reporting, report.Compliant,
+		report.Duplicates, report.Gaps, report.Silent)
+	if report.Intervals != nil {
+		fmt.Printf("  間隔: %s\n", report.Intervals)
+	}
+	if len(report.NonCompliant) == 0 {
+		return
+	}
+	fmt.Printf("  不合規的IMSI:\n")
+	for n, stat := range report.NonCompliant {
+		if n == cadenceListLimit {
+			fmt.Printf("    ...另有 %d 個\n", len(report.NonCompliant)-n)
+			break
+		}
+		fmt.Printf("    %s: 重複 %d  中斷 %d", stat.Imsi, stat.Duplicates, stat.Gaps)
+		if stat.SilentSeconds > 0 {
+			fmt.Printf("  已靜默 %s", formatSeconds(stat.SilentSeconds))
+		}
+		if stat.MaxSeconds > 0 {
+			fmt.Printf("  間隔 最小 %s 平均 %s p95 %s 最大 %s 抖動 %s",
+				formatSeconds(stat.MinSeconds), formatSeconds(stat.AvgSeconds), formatSeconds(stat.P95Seconds),
+				formatSeconds(stat.MaxSeconds), formatSeconds(stat.JitterSeconds))
+		}
+		fmt.Println()
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 相對 t0 的秒數
+func cadenceTimes(t0 time.Time, seconds ...float64) []time.Time {
+	times := make([]time.Time, len(seconds))
+	for i, s := range seconds {
+		times[i] = t0.Add(time.Duration(s * float64(time.Second)))
+	}
+	return times
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+// 週期10秒：間隔小於5秒為重複，超過30秒為中斷
+func TestCadenceTracker(t *testing.T) {
+	t0 := time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)
+	const regular, duplicate, gap, silent = "208930000000001", "208930000000002", "208930000000003", "208930000000004"
+	tracker := newCadenceTracker(10*time.Second, 3, 0.5)
+
+	// 同一個IMSI的PUBLISH分在兩個工作協程，各自的順序也不同
+	tracker.merge(map[string][]time.Time{
+		regular:   cadenceTimes(t0, 20, 0),
+		duplicate: cadenceTimes(t0, 12, 0),
+		silent:    cadenceTimes(t0, 0),
+	})
+	tracker.merge(map[string][]time.Time{
+		regular:   cadenceTimes(t0, 30, 10),
+		duplicate: cadenceTimes(t0, 22, 10),
+		gap:       cadenceTimes(t0, 45, 0, 10),
+	})
+	report := tracker.snapshot(t0.Add(50 * time.Second))
+
+	if report.PeriodSeconds != 10 || report.Tracked != 4 || report.Reporting != 4 || report.Compliant != 1 ||
+		report.Duplicates != 1 || report.Gaps != 1 || report.Silent != 1 {
+		t.Errorf("摘要 %+v", report)
+	}
+	// 所有IMSI的間隔：regular 10,10,10，duplicate 10,2,10，gap 10,35
+	if got, want := report.Intervals, (&durationSummary{Count: 8, MinSeconds: 2, AvgSeconds: 12.125, P95Seconds: 35, MaxSeconds: 35}); !reflect.DeepEqual(got, want) {
+		t.Errorf("間隔 %+v，應為 %+v", got, want)
+	}
+
+	// 重複和中斷各一次的排在靜默前面，次數相同時依IMSI排序
+	var imsis []string
+	for _, stat := range report.NonCompliant {
+		imsis = append(imsis, stat.Imsi)
+	}
+	if want := []string{duplicate, gap, silent}; !reflect.DeepEqual(imsis, want) {
+		t.Fatalf("不合規 %v，應為 %v", imsis, want)
+	}
+	dup := report.NonCompliant[0]
+	// 抖動：相鄰間隔差 8、8 的平滑平均，8/16 + (8-0.5)/16
+	if dup.Messages != 4 || dup.Duplicates != 1 || dup.Gaps != 0 || dup.MinSeconds != 2 || dup.MaxSeconds != 10 || dup.P95Seconds != 10 ||
+		!approxEqual(dup.AvgSeconds, 22.0/3) || !approxEqual(dup.JitterSeconds, 0.96875) || !dup.LastSeen.Equal(t0.Add(22*time.Second)) {
+		t.Errorf("重複 %+v", dup)
+	}
+	if stat := report.NonCompliant[1]; stat.Gaps != 1 || stat.Duplicates != 0 || stat.MaxSeconds != 35 || stat.SilentSeconds != 0 {
+		t.Errorf("中斷 %+v", stat)
+	}
+	// 只有一個PUBLISH，沒有間隔
+	if stat := report.NonCompliant[2]; stat.SilentSeconds != 50 || stat.Messages != 1 || stat.MaxSeconds != 0 {
+		t.Errorf("靜默 %+v", stat)
+	}
+
+	// 比已計算的時間早的PUBLISH只計數；本區間的重複和中斷已歸零
+	tracker.merge(map[string][]time.Time{regular: cadenceTimes(t0, 40, 25)})
+	report = tracker.snapshot(t0.Add(60 * time.Second))
+	if report.Reporting != 1 || report.Duplicates != 0 || report.Gaps != 0 || report.Silent != 2 || report.Compliant != 2 {
+		t.Errorf("第二個區間 %+v", report)
+	}
+	if got := report.Intervals; got == nil || got.Count != 1 || got.MaxSeconds != 10 {
+		t.Errorf("第二個區間的間隔 %+v", got)
+	}
+	if c := tracker.imsis[regular]; c.messages != 6 || c.intervals != 4 || !c.last.Equal(t0.Add(40*time.Second)) {
+		t.Errorf("regular: messages=%d intervals=%d last=%v", c.messages, c.intervals, c.last)
+	}
+
+	// 超過中斷門檻10倍（300秒）沒有出現的IMSI不再追蹤，gap 剛好300秒仍追蹤
+	report = tracker.snapshot(t0.Add(345 * time.Second))
+	if _, ok := tracker.imsis[gap]; !ok || report.Tracked != 1 || report.Silent != 1 || report.Intervals != nil {
+		t.Errorf("遺忘後 %+v", report)
+	}
+}
+
+// p95只看最近的間隔，最小、平均、最大和抖動從開始追蹤累計
+func TestImsiCadenceSamples(t *testing.T) {
+	c := &imsiCadence{}
+	for i := 1; i <= 100; i++ {
+		c.addInterval(time.Duration(i) * time.Millisecond)
+	}
+	stat := c.stat("208930000000001")
+	// 最近64個為37-100ms，最近秩法的p95為第61個
+	if len(c.samples) != cadenceSamples || !approxEqual(stat.P95Seconds, 0.097) {
+		t.Errorf("p95 %v（%d 個樣本）", stat.P95Seconds, len(c.samples))
+	}
+	if stat.MinSeconds != 0.001 || stat.MaxSeconds != 0.1 || !approxEqual(stat.AvgSeconds, 0.0505) {
+		t.Errorf("%+v", stat)
+	}
+	// 間隔每次多1ms，抖動趨近1ms
+	if math.Abs(stat.JitterSeconds-0.001) > 0.0001 {
+		t.Errorf("抖動 %v", stat.JitterSeconds)
+	}
+
+	// 固定間隔沒有抖動
+	c = &imsiCadence{}
+	for i := 0; i < 10; i++ {
+		c.addInterval(15 * time.Second)
+	}
+	if stat := c.stat(""); stat.JitterSeconds != 0 || stat.P95Seconds != 15 {
+		t.Errorf("固定間隔 %+v", stat)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		values []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 0.95, 0},
+		{[]float64{3}, 0.95, 3},
+		{[]float64{5, 1, 4, 2, 3}, 0.5, 3},
+		{[]float64{5, 1, 4, 2, 3}, 0.95, 5},
+		{[]float64{5, 1, 4, 2, 3}, 0, 1},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.values, tt.p); got != tt.want {
+			t.Errorf("percentile(%v, %v) = %v，應為 %v", tt.values, tt.p, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// 讀取逾時，讓抓包協程能及時發現介面被關閉
+	captureReadTimeout = 500 * time.Millisecond
+	// 抓包協程送往分派協程的佇列長度
+	packetQueueSize = 10000
+)
+
+// 抓包後端
+const (
+	captureBackendPcap     = "pcap"     // libpcap（cgo）
+	captureBackendAFPacket = "afpacket" // AF_PACKET TPACKET_V3 記憶體映射ring，只支援Linux
+)
+
+// 編譯時沒有包含libpcap（nopcap標籤）
+var errNoPcap = errors.New("編譯時使用了 nopcap 標籤，不支援libpcap")
+
+// 抓包後端的統計，從打開介面開始累計，或一個統計區間的差值
+type captureStats struct {
+	Received  uint64 `json:"received"`  // 後端收到的封包數，包含被丟棄的
+	Dropped   uint64 `json:"dropped"`   // 因緩衝區或ring滿被核心丟棄的數量
+	IfDropped uint64 `json:"ifDropped"` // 網卡或驅動丟棄的數量，afpacket沒有此統計
+}
+
+func (s captureStats) add(other captureStats) captureStats {
+	return captureStats{
+		Received:  s.Received + other.Received,
+		Dropped:   s.Dropped + other.Dropped,
+		IfDropped: s.IfDropped + other.IfDropped,
+	}
+}
+
+// 計數器重置（例如介面重新打開）時不會是負值
+func (s captureStats) sub(other captureStats) captureStats {
+	delta := func(a, b uint64) uint64 {
+		if a < b {
+			return a
+		}
+		return a - b
+	}
+	return captureStats{
+		Received:  delta(s.Received, other.Received),
+		Dropped:   delta(s.Dropped, other.Dropped),
+		IfDropped: delta(s.IfDropped, other.IfDropped),
+	}
+}
+
+// 遺失的封包數。網卡丟棄的封包沒有到達核心，不在收到的數量中
+func (s captureStats) lost() uint64 {
+	return s.Dropped + s.IfDropped
+}
+
+// 遺失比例，沒有收到封包時為0
+func (s captureStats) lossRatio() float64 {
+	offered := s.Received + s.IfDropped
+	if offered == 0 {
+		return 0
+	}
+	return float64(s.lost()) / float64(offered)
+}
+
+// 一個抓包來源：一個libpcap handle，或fanout群組中的一個AF_PACKET socket。
+// 讀取逾時由來源自己處理，ReadPacketData只回傳封包、錯誤或關閉後的io.EOF。
+type captureSource interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+	stats() (captureStats, error)
+	// 可以在其他協程中呼叫，讀取中的協程會在逾時內收到io.EOF
+	close()
+}
+
+// 系統的一個網路介面
+type captureDevice struct {
+	Name        string
+	Description string
+	Addresses   []net.IP
+}
+
+// 單一介面的抓包狀態
+type ifaceCapture struct {
+	name    string
+	sources []captureSource
+	packets uint64       // 本統計區間捕獲的封包數，原子操作
+	total   uint64       // 累計捕獲的封包數，原子操作
+	last    captureStats // 上次報告時的累計統計，由 captureManager.mu 保護
+}
+
+// 所有來源的統計總和
+func (c *ifaceCapture) stats() (captureStats, error) {
+	var total captureStats
+	for _, source := range c.sources {
+		stats, err := source.stats()
+		if err != nil {
+			return total, err
+		}
+		total = total.add(stats)
+	}
+	return total, nil
+}
+
+func (c *ifaceCapture) close() {
+	for _, source := range c.sources {
+		source.close()
+	}
+}
+
+// 管理多個介面的抓包協程，所有封包送入同一個處理佇列。
+// 同一條TCP連線可能在多個veth上出現，由重組器丟棄重複的段。
+type captureManager struct {
+	patterns []string
+	packets  chan gopacket.Packet
+
+	mu       sync.Mutex
+	captures map[string]*ifaceCapture
+}
+
+func newCaptureManager(patterns []string) *captureManager {
+	return &captureManager{
+		patterns: patterns,
+		packets:  make(chan gopacket.Packet, packetQueueSize),
+		captures: make(map[string]*ifaceCapture),
+	}
+}
+
+// 介面名稱是否符合任一個名稱或glob樣式（例如 cali*）
+func (m *captureManager) matches(name string) bool {
+	for _, pattern := range m.patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 重新掃描系統介面：新出現的介面開始抓包，消失的介面停止抓包。
+// 回傳目前正在抓包的介面數量。
+func (m *captureManager) rescan() int {
+	devices, err := captureDevices()
+	if err != nil {
+		log.Printf("無法獲取網路介面列表: %v", err)
+		return m.count()
+	}
+
+	present := make(map[string]bool)
+	for _, device := range devices {
+		if m.matches(device.Name) {
+			present[device.Name] = true
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name, c := range m.captures {
+		if !present[name] {
+			fmt.Fprintf(infoOut, "介面 %s 已消失，停止抓包\n", name)
+			// 關閉後抓包協程會讀到EOF並結束
+			c.close()
+			delete(m.captures, name)
+		}
+	}
+	for name := range present {
+		if m.captures[name] != nil {
+			continue
+		}
+		c, err := m.open(name)
+		if err != nil {
+			log.Printf("無法打開 %s 介面: %v", name, err)
+			continue
+		}
+		m.captures[name] = c
+		fmt.Fprintf(infoOut, "開始監控 %s 介面的MQTT流量\n", name)
+		for _, source := range c.sources {
+			go m.capture(c, source)
+		}
+	}
+	return len(m.captures)
+}
+
+func (m *captureManager) open(name string) (*ifaceCapture, error) {
+	if config.CaptureBackend == captureBackendAFPacket {
+		sources, err := openAFPacket(name)
+		if err != nil {
+			return nil, err
+		}
+		return &ifaceCapture{name: name, sources: sources}, nil
+	}
+	source, err := openPcap(name)
+	if err != nil {
+		return nil, err
+	}
+	return &ifaceCapture{name: name, sources: []captureSource{source}}, nil
+}
+
+// 單一來源的抓包協程，afpacket的每個fanout socket各一個
+func (m *captureManager) capture(c *ifaceCapture, source captureSource) {
+	packetSource := gopacket.NewPacketSource(source, source.LinkType())
+	for {
+		packet, err := packetSource.NextPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// 介面被刪除時會持續回報錯誤，等下一次掃描關閉來源
+			if debugOn() {
+				log.Printf("[%s] 讀取封包失敗: %v", c.name, err)
+			}
+			time.Sleep(captureReadTimeout)
+			continue
+		}
+		atomic.AddUint64(&c.packets, 1)
+		atomic.AddUint64(&c.total, 1)
+		m.packets <- packet
+	}
+	m.detach(c)
+}
+
+func (m *captureManager) detach(c *ifaceCapture) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.captures[c.name] == c {
+		c.close()
+		delete(m.captures, c.name)
+		fmt.Fprintf(infoOut, "介面 %s 停止抓包\n", c.name)
+	}
+}
+
+func (m *captureManager) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.captures)
+}
+
+// 定期重新掃描介面
+func (m *captureManager) watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		m.rescan()
+	}
+}
+
+// 取出各介面本區間的封包數並歸零，同時回傳各介面本區間抓包後端的收到和丟棄數
+func (m *captureManager) snapshot() (map[string]uint64, map[string]captureStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make(map[string]uint64, len(m.captures))
+	window := make(map[string]captureStats, len(m.captures))
+	for name, c := range m.captures {
+		counts[name] = atomic.SwapUint64(&c.packets, 0)
+		if stats, err := c.stats(); err == nil {
+			window[name] = stats.sub(c.last)
+			c.last = stats
+		} else if debugOn() {
+			log.Printf("[%s] 無法取得抓包統計: %v", name, err)
+		}
+	}
+	return counts, window
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 單一介面的累計抓包統計
+type ifaceStat struct {
+	Name     string
+	Captured uint64 // 送入處理佇列的封包數
+	captureStats
+}
+
+// 各介面的累計統計，抓包後端的數值從打開介面開始累計
+func (m *captureManager) interfaceStats() []ifaceStat {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]ifaceStat, 0, len(m.captures))
+	for _, name := range sortedKeys(m.captures) {
+		c := m.captures[name]
+		stat := ifaceStat{Name: name, Captured: atomic.LoadUint64(&c.total)}
+		if stats, err := c.stats(); err == nil {
+			stat.captureStats = stats
+		} else if debugOn() {
+			log.Printf("[%s] 無法取得抓包統計: %v", name, err)
+		}
+		result = append(result, stat)
+	}
+	return result
+}
+
+// 目前抓包後端可用的介面。afpacket直接列出核心的介面，沒有libpcap的any等虛擬介面
+func captureDevices() ([]captureDevice, error) {
+	if config.CaptureBackend == captureBackendPcap {
+		return pcapDevices()
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]captureDevice, 0, len(ifaces))
+	for _, iface := range ifaces {
+		device := captureDevice{Name: iface.Name, Description: iface.Flags.String()}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				device.Addresses = append(device.Addresses, ipnet.IP)
+			}
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
@@ -0,0 +1,170 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+const afpacketAvailable = true
+
+// TPACKET_V3的block大小，需為頁大小的整數倍，也要能容納GRO合併後的大封包
+const afpacketBlockSize = 1 << 20
+
+var afpacketFilterWarning sync.Once
+
+// 一個AF_PACKET socket，同一個介面的socket加入同一個fanout群組，
+// 核心依連線雜湊把封包分給各socket，每個socket由自己的抓包協程讀取。
+type afpacketSource struct {
+	mu      sync.Mutex // 保護handle的關閉，避免關閉後還讀取已解除映射的ring
+	handle  *afpacket.TPacket
+	closing int32 // 要求關閉，原子操作
+	closed  bool
+	promisc int // 維持混雜模式的socket，-1表示沒有
+}
+
+// 為一個介面打開 config.AFPacketFanout 個socket
+func openAFPacket(name string) ([]captureSource, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	// ring沒有snaplen，完整的封包都會複製到ring中
+	filter, err := compileFilter(layers.LinkTypeEthernet, config.bpfFilter())
+	if errors.Is(err, errNoPcap) {
+		afpacketFilterWarning.Do(func() {
+			log.Printf("nopcap版本無法編譯BPF過濾器，afpacket接收介面上所有封包，端口和目標IP在程序中過濾")
+		})
+	} else if err != nil {
+		return nil, fmt.Errorf("編譯BPF過濾器失敗: %v", err)
+	}
+
+	// 不同程序和不同介面使用不同的fanout群組，避免互相分走封包
+	group := uint16(os.Getpid() + iface.Index)
+	blocks := config.AFPacketRingMB * (1 << 20) / afpacketBlockSize / config.AFPacketFanout
+	if blocks < 1 {
+		blocks = 1
+	}
+
+	var opened []*afpacketSource
+	fail := func(err error) ([]captureSource, error) {
+		for _, source := range opened {
+			source.shutdown()
+		}
+		return nil, err
+	}
+	for i := 0; i < config.AFPacketFanout; i++ {
+		handle, err := afpacket.NewTPacket(
+			afpacket.OptInterface(name),
+			afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+			afpacket.OptBlockSize(afpacketBlockSize),
+			afpacket.OptNumBlocks(blocks),
+			afpacket.OptPollTimeout(captureReadTimeout),
+		)
+		if err != nil {
+			return fail(err)
+		}
+		source := &afpacketSource{handle: handle, promisc: -1}
+		opened = append(opened, source)
+		if filter != nil {
+			if err := handle.SetBPF(filter); err != nil {
+				return fail(fmt.Errorf("設置BPF過濾器失敗: %v", err))
+			}
+		}
+		if config.AFPacketFanout > 1 {
+			if err := handle.SetFanout(afpacket.FanoutHashWithDefrag, group); err != nil {
+				return fail(fmt.Errorf("加入fanout群組 %d 失敗: %v", group, err))
+			}
+		}
+		if i == 0 && config.Promiscuous {
+			if source.promisc, err = enablePromisc(iface.Index); err != nil {
+				return fail(fmt.Errorf("設置混雜模式失敗: %v", err))
+			}
+		}
+	}
+
+	sources := make([]captureSource, len(opened))
+	for i, source := range opened {
+		sources[i] = source
+	}
+	return sources, nil
+}
+
+// TPacket沒有提供設置混雜模式的方法，另外開一個不接收封包的socket加入混雜模式成員，
+// socket關閉時核心自動取消，程序異常結束也不會讓介面一直處在混雜模式
+func enablePromisc(ifindex int) (int, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return -1, err
+	}
+	mreq := unix.PacketMreq{Ifindex: int32(ifindex), Type: unix.PACKET_MR_PROMISC}
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// 讀取逾時時檢查是否要求關閉，由讀取的協程自己關閉handle
+func (s *afpacketSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		if atomic.LoadInt32(&s.closing) != 0 {
+			s.shutdown()
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		data, ci, err := s.handle.ReadPacketData()
+		if err == afpacket.ErrTimeout {
+			continue
+		}
+		return data, ci, err
+	}
+}
+
+// ring中是核心產生的乙太網路標頭
+func (s *afpacketSource) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// 核心的PACKET_STATISTICS讀取後會歸零，TPacket幫忙累計
+func (s *afpacketSource) stats() (captureStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return captureStats{}, io.EOF
+	}
+	_, v3, err := s.handle.SocketStats()
+	if err != nil {
+		return captureStats{}, err
+	}
+	return captureStats{Received: uint64(v3.Packets()), Dropped: uint64(v3.Drops())}, nil
+}
+
+// 其他協程關閉時只設定旗標，讀取的協程在逾時內自己關閉
+func (s *afpacketSource) close() {
+	atomic.StoreInt32(&s.closing, 1)
+}
+
+func (s *afpacketSource) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.handle.Close()
+	if s.promisc >= 0 {
+		unix.Close(s.promisc)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+const afpacketAvailable = false
+
+func openAFPacket(name string) ([]captureSource, error) {
+	return nil, errors.New("afpacket只支援Linux")
+}
@@ -0,0 +1,84 @@
+//go:build nopcap
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+)
+
+// 沒有libpcap時只能使用afpacket
+const defaultCaptureBackend = captureBackendAFPacket
+
+const pcapAvailable = false
+
+func openPcap(name string) (captureSource, error) {
+	return nil, errNoPcap
+}
+
+func pcapDevices() ([]captureDevice, error) {
+	return nil, errNoPcap
+}
+
+// 沒有libpcap無法編譯過濾器，afpacket socket不設過濾器，端口和目標IP在程序中過濾
+func compileFilter(linkType layers.LinkType, filter string) ([]bpf.RawInstruction, error) {
+	return nil, errNoPcap
+}
+
+var offlineFilterWarning sync.Once
+
+// pcapng區段標頭的block type
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// 用純Go的pcapgo讀取pcap/pcapng檔案，不支援BPF過濾器
+type pcapgoReader struct {
+	file *os.File
+	gopacket.PacketDataSource
+	linkType layers.LinkType
+}
+
+func openOffline(file, filter string) (offlineReader, error) {
+	offlineFilterWarning.Do(func() {
+		log.Printf("nopcap版本不套用BPF過濾器 %q，端口和目標IP在程序中過濾", filter)
+	})
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(len(pcapngMagic))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if bytes.Equal(magic, pcapngMagic) {
+		ng, err := pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &pcapgoReader{file: f, PacketDataSource: ng, linkType: ng.LinkType()}, nil
+	}
+	reader, err := pcapgo.NewReader(r)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &pcapgoReader{file: f, PacketDataSource: reader, linkType: reader.LinkType()}, nil
+}
+
+func (r *pcapgoReader) LinkType() layers.LinkType {
+	return r.linkType
+}
+
+func (r *pcapgoReader) Close() {
+	r.file.Close()
+}
@@ -0,0 +1,107 @@
+//go:build !nopcap
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// 未指定 -capture 時使用的抓包後端
+const defaultCaptureBackend = captureBackendPcap
+
+const pcapAvailable = true
+
+// libpcap抓包來源
+type pcapSource struct {
+	handle *pcap.Handle
+}
+
+func openPcap(name string) (captureSource, error) {
+	handle, err := pcap.OpenLive(name, int32(config.Snaplen), config.Promiscuous, captureReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.SetBPFFilter(config.bpfFilter()); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("設置BPF過濾器失敗: %v", err)
+	}
+	return &pcapSource{handle: handle}, nil
+}
+
+func (s *pcapSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := s.handle.ReadPacketData()
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		}
+		return data, ci, err
+	}
+}
+
+func (s *pcapSource) LinkType() layers.LinkType {
+	return s.handle.LinkType()
+}
+
+func (s *pcapSource) stats() (captureStats, error) {
+	ps, err := s.handle.Stats()
+	if err != nil {
+		return captureStats{}, err
+	}
+	return captureStats{
+		Received:  uint64(ps.PacketsReceived),
+		Dropped:   uint64(ps.PacketsDropped),
+		IfDropped: uint64(ps.PacketsIfDropped),
+	}, nil
+}
+
+// 關閉後讀取中的協程收到io.EOF
+func (s *pcapSource) close() {
+	s.handle.Close()
+}
+
+func pcapDevices() ([]captureDevice, error) {
+	interfaces, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]captureDevice, 0, len(interfaces))
+	for _, iface := range interfaces {
+		device := captureDevice{Name: iface.Name, Description: iface.Description}
+		for _, address := range iface.Addresses {
+			device.Addresses = append(device.Addresses, address.IP)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// 用libpcap把過濾器編譯成BPF程式，給afpacket socket使用
+func compileFilter(linkType layers.LinkType, filter string) ([]bpf.RawInstruction, error) {
+	instructions, err := pcap.CompileBPFFilter(linkType, config.Snaplen, filter)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]bpf.RawInstruction, len(instructions))
+	for i, ins := range instructions {
+		raw[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return raw, nil
+}
+
+// 打開離線分析的pcap/pcapng檔案並設置過濾器
+func openOffline(file, filter string) (offlineReader, error) {
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.SetBPFFilter(filter); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("設置BPF過濾器失敗: %v", err)
+	}
+	return handle, nil
+}
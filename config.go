@@ -0,0 +1,488 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"getMqtt/distinct"
+	"getMqtt/schema"
+)
+
+// 獨立IMSI的計算方式
+const (
+	distinctExact = "exact" // 保存完整的IMSI集合
+	distinctHLL   = "hll"   // HyperLogLog近似，記憶體固定
+)
+
+// 監控工具的配置，可由YAML配置檔和命令列參數設定（命令列優先）
+type Config struct {
+	Interfaces     []string      `yaml:"interfaces"`     // 介面名稱或glob樣式，例如 cali*
+	RescanInterval time.Duration `yaml:"rescanInterval"` // 重新掃描介面的間隔，0表示不掃描
+	BPFFilter      string        `yaml:"bpfFilter"`      // 留空時依端口和目標IP自動產生
+	BrokerPorts    []int         `yaml:"brokerPorts"`
+	TLSPorts       []int         `yaml:"tlsPorts"`       // MQTT over TLS的broker端口
+	KeyLogFile     string        `yaml:"keyLogFile"`     // SSLKEYLOGFILE格式的金鑰檔，用來解密TLS
+	WebSocketPorts []int         `yaml:"webSocketPorts"` // MQTT over WebSocket（ws://）的broker端口
+	TargetIPs      []string      `yaml:"targetIPs"`      // 留空時監控所有broker
+	Interval       time.Duration `yaml:"interval"`       // 統計間隔，也是報告的間隔
+	WindowType     string        `yaml:"windowType"`     // tumbling、hopping 或 sliding
+	WindowSize     time.Duration `yaml:"windowSize"`     // hopping/sliding的視窗長度，0表示等於統計間隔
+	DistinctMode   string        `yaml:"distinctMode"`   // 獨立IMSI的計算方式：exact 或 hll
+	HLLPrecision   int           `yaml:"hllPrecision"`   // hll模式的精度，暫存器數量為 2^precision
+	CaptureBackend string        `yaml:"captureBackend"` // pcap 或 afpacket
+	AFPacketFanout int           `yaml:"afpacketFanout"` // afpacket每個介面的socket和抓包協程數
+	AFPacketRingMB int           `yaml:"afpacketRingMB"` // afpacket每個介面的ring大小，平均分給各socket
+	Snaplen        int           `yaml:"snaplen"`
+	Promiscuous    bool          `yaml:"promiscuous"`
+	LossThreshold  float64       `yaml:"lossThreshold"` // 區間抓包遺失超過此百分比時警告，0表示不警告
+	Debug          bool          `yaml:"debug"`
+	MetricsAddr    string        `yaml:"metricsAddr"` // Prometheus指標的監聽位址，留空不啟用
+	Output         string        `yaml:"output"`      // text 或 json（NDJSON）
+	OutputFile     string        `yaml:"outputFile"`  // JSON輸出檔案，留空輸出到stdout
+	OutputMaxMB    int           `yaml:"outputMaxMB"` // 輸出檔案輪替大小，0表示不輪替
+	OutputMaxFiles int           `yaml:"outputMaxFiles"`
+	SchemaFile     string        `yaml:"schema"`         // payload擷取規格（YAML），留空只取 imsi 欄位
+	Topics         []string      `yaml:"topics"`         // 只統計符合這些MQTT主題過濾器的PUBLISH，留空統計全部
+	ExcludeTopics  []string      `yaml:"excludeTopics"`  // 不統計符合這些主題過濾器的PUBLISH
+	TopicPatterns  []string      `yaml:"topicPatterns"`  // 報告中另外按這些主題過濾器（例如 FiveGC/+/metric）彙總
+	Roster         string        `yaml:"roster"`         // 預期IMSI名單：逗號分隔的檔案或範圍
+	RosterAbsent   int           `yaml:"rosterAbsent"`   // 名單中的IMSI連續缺席幾個區間時告警，0表示不告警
+	RosterWebhook  string        `yaml:"rosterWebhook"`  // 告警時POST JSON的URL
+	RosterExit     bool          `yaml:"rosterExit"`     // 告警時以非0代碼結束
+	ImsiPeriod     time.Duration `yaml:"imsiPeriod"`     // 每個IMSI預期的回報週期，0表示不分析
+	ImsiGapPeriods int           `yaml:"imsiGapPeriods"` // 間隔超過此數量的週期算中斷
+	ImsiDupRatio   float64       `yaml:"imsiDupRatio"`   // 間隔小於週期的此比例算重複回報
+	QoSTimeout     time.Duration `yaml:"qosTimeout"`     // QoS 1/2的PUBLISH超過此時間沒有確認算未確認
+	FanoutTimeout  time.Duration `yaml:"fanoutTimeout"`  // broker轉發的等待時間，超過算訂閱者遺失，0表示不驗證轉發
+	PcapOut        string        `yaml:"pcapOut"`        // 把符合過濾條件的封包寫入此pcapng檔案，留空不寫入
+	PcapMaxMB      int           `yaml:"pcapMaxMB"`      // pcapng檔案輪替大小，0表示不依大小輪替
+	PcapRotate     time.Duration `yaml:"pcapRotate"`     // pcapng檔案輪替間隔（封包時間），0表示不依時間輪替
+	PcapMaxFiles   int           `yaml:"pcapMaxFiles"`   // 輪替時最多保留的舊檔數量
+	Recorder       time.Duration `yaml:"recorder"`       // flight recorder在記憶體保留的封包時間長度，0表示不啟用
+	RecorderDir    string        `yaml:"recorderDir"`    // 觸發時寫出pcapng檔案的目錄
+	TriggerImsi    string        `yaml:"triggerImsi"`    // 出現時觸發flight recorder的IMSI：逗號分隔的檔案或範圍
+	TriggerMinImsi int           `yaml:"triggerMinImsi"` // 區間的獨立IMSI數降到此值以下時觸發flight recorder，0表示不觸發
+	TUI            bool          `yaml:"tui"`            // 以終端介面顯示統計，取代逐筆和報告的文字輸出
+	Workers        int           `yaml:"workers"`        // 處理封包的工作協程數，預設為CPU數
+}
+
+func defaultConfig() Config {
+	return Config{
+		Interfaces:     []string{"cali62ed833be43"},
+		RescanInterval: 10 * time.Second,
+		BrokerPorts:    []int{1883},
+		TLSPorts:       []int{8883},
+		WebSocketPorts: []int{8080, 9001},
+		Interval:       15 * time.Second,
+		WindowType:     windowTumbling,
+		DistinctMode:   distinctExact,
+		HLLPrecision:   distinct.DefaultPrecision,
+		CaptureBackend: defaultCaptureBackend,
+		AFPacketFanout: runtime.NumCPU(),
+		AFPacketRingMB: 32,
+		Snaplen:        1600,
+		Promiscuous:    true,
+		LossThreshold:  1,
+		Output:         outputText,
+		OutputMaxMB:    100,
+		OutputMaxFiles: 5,
+		RosterAbsent:   3,
+		ImsiGapPeriods: 3,
+		ImsiDupRatio:   0.5,
+		QoSTimeout:     30 * time.Second,
+		PcapMaxMB:      100,
+		PcapMaxFiles:   5,
+		RecorderDir:    ".",
+		Workers:        runtime.NumCPU(),
+	}
+}
+
+// 逗號分隔的字串列表參數
+type stringListFlag struct {
+	list *[]string
+}
+
+func (f stringListFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f stringListFlag) Set(value string) error {
+	*f.list = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*f.list = append(*f.list, item)
+		}
+	}
+	return nil
+}
+
+// 逗號分隔的端口列表參數
+type portListFlag struct {
+	ports *[]int
+}
+
+func (f portListFlag) String() string {
+	if f.ports == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*f.ports))
+	for _, port := range *f.ports {
+		items = append(items, strconv.Itoa(port))
+	}
+	return strings.Join(items, ",")
+}
+
+func (f portListFlag) Set(value string) error {
+	*f.ports = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		port, err := strconv.Atoi(item)
+		if err != nil {
+			return fmt.Errorf("無效的端口 %q", item)
+		}
+		*f.ports = append(*f.ports, port)
+	}
+	return nil
+}
+
+// 解析命令列參數和配置檔，回傳剩餘的參數（離線分析的pcap檔案）
+func loadConfig(args []string) (Config, []string, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	configFile := fs.String("config", "", "YAML配置檔路徑")
+	fs.Var(stringListFlag{&cfg.Interfaces}, "iface", "抓包的網路介面，逗號分隔，可使用glob樣式（例如 cali*）")
+	fs.DurationVar(&cfg.RescanInterval, "rescan", cfg.RescanInterval, "重新掃描介面的間隔，0表示不掃描")
+	fs.StringVar(&cfg.BPFFilter, "filter", cfg.BPFFilter, "BPF過濾器（預設依端口和目標IP產生）")
+	fs.Var(portListFlag{&cfg.BrokerPorts}, "ports", "MQTT broker端口，逗號分隔")
+	fs.Var(portListFlag{&cfg.TLSPorts}, "tls-ports", "MQTT over TLS的broker端口，逗號分隔，空字串表示不分析TLS")
+	fs.Var(portListFlag{&cfg.WebSocketPorts}, "ws-ports", "MQTT over WebSocket的broker端口，逗號分隔，空字串表示不分析WebSocket")
+	fs.StringVar(&cfg.KeyLogFile, "keylog", cfg.KeyLogFile, "SSLKEYLOGFILE格式的金鑰檔，用來解密TLS 1.2/1.3")
+	fs.Var(stringListFlag{&cfg.TargetIPs}, "targets", "監控的broker IP，逗號分隔，空字串表示全部")
+	fs.DurationVar(&cfg.Interval, "interval", cfg.Interval, "統計間隔（報告間隔），報告時間對齊間隔的整數倍")
+	fs.StringVar(&cfg.WindowType, "window", cfg.WindowType, "統計視窗: tumbling、hopping 或 sliding（sliding的文字和NDJSON報告和hopping相同，只有Prometheus目標IP指標每秒更新）")
+	fs.DurationVar(&cfg.WindowSize, "window-size", cfg.WindowSize, "hopping/sliding的視窗長度（例如 60s），0表示等於統計間隔")
+	fs.StringVar(&cfg.DistinctMode, "distinct", cfg.DistinctMode, "獨立IMSI的計算方式: exact（精確，列出IMSI）或 hll（HyperLogLog近似）")
+	fs.IntVar(&cfg.HLLPrecision, "hll-precision", cfg.HLLPrecision, fmt.Sprintf("hll模式的精度（%d-%d），越大越準確也越佔記憶體", distinct.MinPrecision, distinct.MaxPrecision))
+	fs.StringVar(&cfg.CaptureBackend, "capture", cfg.CaptureBackend, "抓包後端: pcap（libpcap）或 afpacket（AF_PACKET TPACKET_V3 ring，只支援Linux）")
+	fs.IntVar(&cfg.AFPacketFanout, "afpacket-fanout", cfg.AFPacketFanout, "afpacket每個介面的socket數，核心依連線雜湊分給各socket，每個socket一個抓包協程")
+	fs.IntVar(&cfg.AFPacketRingMB, "afpacket-ring-mb", cfg.AFPacketRingMB, "afpacket每個介面的ring大小（MB），平均分給fanout的各socket")
+	fs.IntVar(&cfg.Snaplen, "snaplen", cfg.Snaplen, "每個封包最多捕獲的位元組數（afpacket捕獲完整封包）")
+	fs.BoolVar(&cfg.Promiscuous, "promisc", cfg.Promiscuous, "是否使用混雜模式")
+	fs.Float64Var(&cfg.LossThreshold, "loss-threshold", cfg.LossThreshold, "統計區間內抓包遺失（核心和網卡丟棄）超過此百分比時輸出警告，0表示不警告")
+	fs.BoolVar(&cfg.Debug, "debug", cfg.Debug, "調試模式")
+	fs.StringVar(&cfg.MetricsAddr, "metrics", cfg.MetricsAddr, "Prometheus指標的監聽位址（例如 :9100），留空不啟用")
+	fs.StringVar(&cfg.Output, "output", cfg.Output, "輸出格式: text 或 json（每個PUBLISH和每個統計區間一行JSON）")
+	fs.StringVar(&cfg.OutputFile, "output-file", cfg.OutputFile, "JSON輸出檔案，留空輸出到stdout")
+	fs.IntVar(&cfg.OutputMaxMB, "output-max-mb", cfg.OutputMaxMB, "輸出檔案超過此大小（MB）時輪替，0表示不輪替")
+	fs.IntVar(&cfg.OutputMaxFiles, "output-max-files", cfg.OutputMaxFiles, "輪替時最多保留的舊檔數量")
+	fs.Var(stringListFlag{&cfg.Topics}, "topics", "只統計符合這些MQTT主題過濾器（可使用 + 和 #）的PUBLISH，逗號分隔，留空統計全部")
+	fs.Var(stringListFlag{&cfg.ExcludeTopics}, "exclude-topics", "不統計符合這些MQTT主題過濾器的PUBLISH，逗號分隔")
+	fs.Var(stringListFlag{&cfg.TopicPatterns}, "topic-patterns", "報告中另外按這些MQTT主題過濾器（例如 FiveGC/+/metric）彙總，逗號分隔")
+	fs.StringVar(&cfg.SchemaFile, "schema", cfg.SchemaFile, "payload擷取規格檔（YAML），定義分組鍵和加總/平均的欄位")
+	fs.StringVar(&cfg.Roster, "roster", cfg.Roster, "預期的IMSI名單：逗號分隔的IMSI、檔案（每行一個IMSI或範圍）或範圍（例如 208930000000001-208930000001000）")
+	fs.IntVar(&cfg.RosterAbsent, "roster-absent", cfg.RosterAbsent, "名單中的IMSI連續缺席此數量的統計區間時告警，0表示不告警")
+	fs.StringVar(&cfg.RosterWebhook, "roster-webhook", cfg.RosterWebhook, "名單告警時以JSON POST到此URL")
+	fs.BoolVar(&cfg.RosterExit, "roster-exit", cfg.RosterExit, fmt.Sprintf("名單告警時以結束代碼 %d 結束", rosterExitCode))
+	fs.DurationVar(&cfg.ImsiPeriod, "imsi-period", cfg.ImsiPeriod, "每個IMSI預期的回報週期（例如 15s），依封包時間分析回報間隔、重複和中斷，0表示不分析")
+	fs.IntVar(&cfg.ImsiGapPeriods, "imsi-gap-periods", cfg.ImsiGapPeriods, "同一個IMSI的回報間隔超過此數量的週期時算中斷")
+	fs.Float64Var(&cfg.ImsiDupRatio, "imsi-dup-ratio", cfg.ImsiDupRatio, "同一個IMSI的回報間隔小於週期的此比例時算重複回報")
+	fs.DurationVar(&cfg.QoSTimeout, "qos-timeout", cfg.QoSTimeout, "QoS 1/2的PUBLISH超過此時間（封包時間）沒有收到PUBACK或PUBCOMP時記為未確認")
+	fs.DurationVar(&cfg.FanoutTimeout, "fanout-timeout", cfg.FanoutTimeout, "驗證broker轉發：送進broker的PUBLISH超過此時間（封包時間）沒有轉發給訂閱者時記為遺失，0表示不驗證")
+	fs.StringVar(&cfg.PcapOut, "pcap-out", cfg.PcapOut, "把通過目標IP和端口過濾的封包寫入此pcapng檔案，留空不寫入")
+	fs.IntVar(&cfg.PcapMaxMB, "pcap-max-mb", cfg.PcapMaxMB, "pcapng檔案超過此大小（MB）時輪替，0表示不依大小輪替")
+	fs.DurationVar(&cfg.PcapRotate, "pcap-rotate", cfg.PcapRotate, "pcapng檔案每隔此時間（封包時間）輪替，0表示不依時間輪替")
+	fs.IntVar(&cfg.PcapMaxFiles, "pcap-max-files", cfg.PcapMaxFiles, "pcapng輪替時最多保留的舊檔數量")
+	fs.DurationVar(&cfg.Recorder, "recorder", cfg.Recorder, "flight recorder：在記憶體保留最近此時間的封包，觸發條件成立時寫成pcapng檔案，0表示不啟用")
+	fs.StringVar(&cfg.RecorderDir, "recorder-dir", cfg.RecorderDir, "flight recorder寫出pcapng檔案的目錄")
+	fs.StringVar(&cfg.TriggerImsi, "trigger-imsi", cfg.TriggerImsi, "這些IMSI出現時觸發flight recorder：逗號分隔的IMSI、檔案或範圍，格式和 -roster 相同")
+	fs.IntVar(&cfg.TriggerMinImsi, "trigger-min-imsi", cfg.TriggerMinImsi, "統計區間的獨立IMSI數從此值以上降到此值以下時觸發flight recorder，0表示不觸發")
+	fs.BoolVar(&cfg.TUI, "tui", cfg.TUI, "以互動式終端介面顯示各目標IP、客戶端、主題的統計、趨勢圖和IMSI列表，只支援即時抓包")
+	fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "處理封包的工作協程數（TCP重組、MQTT和payload解析、統計），同一條連線固定由同一個協程處理")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "用法: %s [參數] [pcap檔案...]\n", fs.Name())
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	// 先讀配置檔，再重新解析一次命令列，讓明確指定的參數覆蓋配置檔
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("無法讀取配置檔: %v", err)
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return cfg, nil, fmt.Errorf("無法解析配置檔 %s: %v", *configFile, err)
+		}
+		fs.Parse(args)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return cfg, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+func (c *Config) validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("統計間隔必須大於0: %v", c.Interval)
+	}
+	if err := c.validateWindow(); err != nil {
+		return err
+	}
+	if c.Workers < 1 {
+		return fmt.Errorf("工作協程數至少為1: %d", c.Workers)
+	}
+	switch c.DistinctMode {
+	case distinctExact:
+	case distinctHLL:
+		if c.HLLPrecision < distinct.MinPrecision || c.HLLPrecision > distinct.MaxPrecision {
+			return fmt.Errorf("HyperLogLog精度必須在 %d 到 %d 之間: %d", distinct.MinPrecision, distinct.MaxPrecision, c.HLLPrecision)
+		}
+	default:
+		return fmt.Errorf("不支援的獨立IMSI計算方式: %q（exact、hll）", c.DistinctMode)
+	}
+	if c.RosterAbsent < 0 {
+		return fmt.Errorf("名單缺席門檻不可為負: %d", c.RosterAbsent)
+	}
+	if c.Roster == "" && (c.RosterWebhook != "" || c.RosterExit) {
+		return fmt.Errorf("名單告警需要以 -roster 指定IMSI名單")
+	}
+	if c.Roster != "" {
+		if c.DistinctMode != distinctExact {
+			return fmt.Errorf("IMSI名單比對需要精確的獨立IMSI計算（-distinct exact）")
+		}
+		if c.RosterAbsent == 0 && (c.RosterWebhook != "" || c.RosterExit) {
+			return fmt.Errorf("名單告警需要大於0的 -roster-absent")
+		}
+	}
+	for _, filters := range [][]string{c.Topics, c.ExcludeTopics, c.TopicPatterns} {
+		for _, filter := range filters {
+			if err := schema.ValidateTopicFilter(filter); err != nil {
+				return err
+			}
+		}
+	}
+	if c.QoSTimeout <= 0 {
+		return fmt.Errorf("QoS確認逾時必須大於0: %v", c.QoSTimeout)
+	}
+	if c.FanoutTimeout < 0 {
+		return fmt.Errorf("broker轉發等待時間不可為負: %v", c.FanoutTimeout)
+	}
+	if c.ImsiPeriod < 0 {
+		return fmt.Errorf("IMSI回報週期不可為負: %v", c.ImsiPeriod)
+	}
+	if c.ImsiGapPeriods < 1 {
+		return fmt.Errorf("中斷門檻至少為1個週期: %d", c.ImsiGapPeriods)
+	}
+	if c.ImsiDupRatio <= 0 || c.ImsiDupRatio >= 1 {
+		return fmt.Errorf("重複回報的比例必須在0到1之間: %v", c.ImsiDupRatio)
+	}
+	if len(c.Interfaces) == 0 {
+		return fmt.Errorf("至少需要一個網路介面")
+	}
+	for _, pattern := range c.Interfaces {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("無效的介面樣式 %q: %v", pattern, err)
+		}
+	}
+	switch c.CaptureBackend {
+	case captureBackendPcap:
+		if !pcapAvailable {
+			return fmt.Errorf("%v，請使用 -capture afpacket", errNoPcap)
+		}
+	case captureBackendAFPacket:
+		if !afpacketAvailable {
+			return fmt.Errorf("afpacket只支援Linux")
+		}
+		if c.AFPacketFanout < 1 {
+			return fmt.Errorf("afpacket的fanout socket數至少為1: %d", c.AFPacketFanout)
+		}
+		if c.AFPacketRingMB < 1 {
+			return fmt.Errorf("afpacket的ring大小至少為1MB: %d", c.AFPacketRingMB)
+		}
+		for _, pattern := range c.Interfaces {
+			if pattern == "any" {
+				return fmt.Errorf("afpacket不支援libpcap的 any 介面，請使用glob樣式（例如 *）")
+			}
+		}
+	default:
+		return fmt.Errorf("不支援的抓包後端: %q（pcap、afpacket）", c.CaptureBackend)
+	}
+	if c.LossThreshold < 0 || c.LossThreshold > 100 {
+		return fmt.Errorf("遺失警告門檻必須在0到100之間: %v", c.LossThreshold)
+	}
+	if c.RescanInterval < 0 {
+		return fmt.Errorf("介面掃描間隔不可為負: %v", c.RescanInterval)
+	}
+	if c.Snaplen <= 0 {
+		return fmt.Errorf("snaplen必須大於0: %d", c.Snaplen)
+	}
+	if len(c.mqttPorts()) == 0 {
+		return fmt.Errorf("至少需要一個MQTT端口")
+	}
+	for _, port := range c.mqttPorts() {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("無效的端口: %d", port)
+		}
+	}
+	seen := make(map[int]bool)
+	for _, port := range c.mqttPorts() {
+		if seen[port] {
+			return fmt.Errorf("端口 %d 重複指定（明文、TLS和WebSocket端口不能重疊）", port)
+		}
+		seen[port] = true
+	}
+	// IPv6位址統一成標準寫法，和封包中的位址字串比對
+	for i, target := range c.TargetIPs {
+		ip := net.ParseIP(target)
+		if ip == nil {
+			return fmt.Errorf("無效的目標IP: %q", target)
+		}
+		c.TargetIPs[i] = ip.String()
+	}
+	if c.Output != outputText && c.Output != outputJSON {
+		return fmt.Errorf("無效的輸出格式 %q，只支援 text 或 json", c.Output)
+	}
+	if c.OutputFile != "" && c.Output != outputJSON {
+		return fmt.Errorf("輸出檔案只支援 json 格式")
+	}
+	if c.TUI && c.Output == outputJSON && c.OutputFile == "" {
+		return fmt.Errorf("TUI模式佔用終端，JSON輸出需要以 -output-file 指定檔案")
+	}
+	if c.OutputMaxMB < 0 || c.OutputMaxFiles < 0 {
+		return fmt.Errorf("輸出檔案輪替參數不可為負")
+	}
+	if c.PcapMaxMB < 0 || c.PcapRotate < 0 || c.PcapMaxFiles < 0 {
+		return fmt.Errorf("pcapng檔案輪替參數不可為負")
+	}
+	if c.Recorder < 0 || c.TriggerMinImsi < 0 {
+		return fmt.Errorf("flight recorder參數不可為負")
+	}
+	hasTrigger := c.TriggerImsi != "" || c.TriggerMinImsi > 0
+	if c.Recorder > 0 && !hasTrigger {
+		return fmt.Errorf("flight recorder需要至少一個觸發條件（-trigger-imsi 或 -trigger-min-imsi）")
+	}
+	if c.Recorder == 0 && hasTrigger {
+		return fmt.Errorf("觸發條件需要以 -recorder 啟用flight recorder")
+	}
+	return nil
+}
+
+// IPv6封包的下一個標頭為 Hop-by-Hop(0)、Routing(43)、Fragment(44)、Destination Options(60)
+const ipv6ExtensionFilter = "(ip6 and (ip6 proto 0 or ip6 proto 43 or ip6 proto 44 or ip6 proto 60))"
+
+// 建立IMSI集合用的精度，精確模式為0
+func (c *Config) imsiPrecision() int {
+	if c.DistinctMode == distinctHLL {
+		return c.HLLPrecision
+	}
+	return 0
+}
+
+// 獨立IMSI數的相對標準誤差，精確模式為0
+func (c *Config) imsiStdError() float64 {
+	if precision := c.imsiPrecision(); precision != 0 {
+		return distinct.StdError(precision)
+	}
+	return 0
+}
+
+// 依配置產生BPF過濾器，兩個方向的流量都需要捕獲才能重組TCP流
+func (c *Config) bpfFilter() string {
+	if c.BPFFilter != "" {
+		return c.BPFFilter
+	}
+
+	mqttPorts := c.mqttPorts()
+	ports := make([]string, 0, len(mqttPorts))
+	for _, port := range mqttPorts {
+		ports = append(ports, fmt.Sprintf("port %d", port))
+	}
+	filter := "tcp " + ports[0]
+	if len(ports) > 1 {
+		filter = "(tcp and (" + strings.Join(ports, " or ") + "))"
+	}
+	// BPF的tcp只認得緊接在IPv6標頭後的TCP，帶延伸標頭（包含分片）的IPv6封包
+	// 全部抓進來，端口在程序中再過濾
+	filter += " or " + ipv6ExtensionFilter
+
+	if len(c.TargetIPs) > 0 {
+		hosts := make([]string, 0, len(c.TargetIPs))
+		for _, ip := range c.TargetIPs {
+			hosts = append(hosts, "host "+ip)
+		}
+		filter = "(" + filter + ") and (" + strings.Join(hosts, " or ") + ")"
+	}
+	return filter
+}
+
+// 明文、TLS和WebSocket的所有MQTT端口
+func (c *Config) mqttPorts() []int {
+	ports := append([]int(nil), c.BrokerPorts...)
+	ports = append(ports, c.TLSPorts...)
+	return append(ports, c.WebSocketPorts...)
+}
+
+func (c *Config) isBrokerPort(port uint16) bool {
+	return containsPort(c.BrokerPorts, port)
+}
+
+func (c *Config) isTLSPort(port uint16) bool {
+	return containsPort(c.TLSPorts, port)
+}
+
+func (c *Config) isWebSocketPort(port uint16) bool {
+	return containsPort(c.WebSocketPorts, port)
+}
+
+func containsPort(ports []int, port uint16) bool {
+	for _, p := range ports {
+		if uint16(p) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// 沒有指定目標IP時所有broker都監控
+func (c *Config) isTargetIP(ip string) bool {
+	if len(c.TargetIPs) == 0 {
+		return true
+	}
+	for _, target := range c.TargetIPs {
+		if target == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// 抓包後端的說明，用在啟動訊息
+func (c *Config) captureString() string {
+	if c.CaptureBackend == captureBackendAFPacket {
+		return fmt.Sprintf("afpacket（TPACKET_V3，每個介面 %d 個fanout socket，ring %dMB）", c.AFPacketFanout, c.AFPacketRingMB)
+	}
+	return "pcap"
+}
+
+func (c *Config) targetsString() string {
+	if len(c.TargetIPs) == 0 {
+		return "全部"
+	}
+	return strings.Join(c.TargetIPs, ", ")
+}
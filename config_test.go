@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// 配置檔覆蓋預設值，命令列明確指定的參數再覆蓋配置檔，和 -config 的位置無關
+func TestLoadConfigFlagsOverrideFile(t *testing.T) {
+	path := writeConfigFile(t, `
+interfaces: ["cali*", "eth0"]
+brokerPorts: [1884]
+targetIPs: ["10.1.153.153"]
+interval: 30s
+windowType: hopping
+windowSize: 2m
+topics: ["FiveGC/#"]
+qosTimeout: 10s
+workers: 3
+debug: true
+`)
+	for _, args := range [][]string{
+		{"-config", path, "-interval", "1m", "-ports", "1885, 1886", "-targets", "", "-debug=false", "a.pcap", "b.pcap"},
+		{"-interval", "1m", "-ports", "1885,1886", "-targets", "", "-debug=false", "-config", path, "a.pcap", "b.pcap"},
+	} {
+		cfg, files, err := loadConfig(args)
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		want := defaultConfig()
+		// 配置檔
+		want.Interfaces = []string{"cali*", "eth0"}
+		want.WindowType = windowHopping
+		want.WindowSize = 2 * time.Minute
+		want.Topics = []string{"FiveGC/#"}
+		want.QoSTimeout = 10 * time.Second
+		want.Workers = 3
+		// 命令列
+		want.Interval = time.Minute
+		want.BrokerPorts = []int{1885, 1886}
+		want.TargetIPs = nil
+		want.Debug = false
+		if !reflect.DeepEqual(cfg, want) {
+			t.Errorf("%v:\n%+v\n應為\n%+v", args, cfg, want)
+		}
+		if !reflect.DeepEqual(files, []string{"a.pcap", "b.pcap"}) {
+			t.Errorf("%v: pcap檔案 %v", args, files)
+		}
+	}
+
+	// 沒有配置檔時為預設值，IPv6目標統一成標準寫法
+	cfg, files, err := loadConfig([]string{"-targets", "FD00:0:0::1,10.1.153.153"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"fd00::1", "10.1.153.153"}; !reflect.DeepEqual(cfg.TargetIPs, want) || len(files) != 0 {
+		t.Errorf("目標 %v，應為 %v", cfg.TargetIPs, want)
+	}
+	if cfg.Interval != 15*time.Second || cfg.QoSTimeout != 30*time.Second || !reflect.DeepEqual(cfg.BrokerPorts, []int{1883}) {
+		t.Errorf("預設值 %+v", cfg)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, "無法讀取配置檔"},
+		{[]string{"-config", writeConfigFile(t, "interval: [15s")}, "無法解析配置檔"},
+		{[]string{"-config", writeConfigFile(t, "interval: soon")}, "無法解析配置檔"},
+		// 配置檔的值也要檢查
+		{[]string{"-config", writeConfigFile(t, "workers: 0")}, "工作協程數至少為1"},
+		// 命令列修正配置檔中的錯誤
+		{[]string{"-config", writeConfigFile(t, "workers: 0"), "-workers", "2"}, ""},
+	}
+	for _, tt := range tests {
+		_, _, err := loadConfig(tt.args)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%v: %v", tt.args, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: 錯誤 %v，應包含 %q", tt.args, err, tt.err)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		err    string
+	}{
+		{"統計間隔", func(c *Config) { c.Interval = 0 }, "統計間隔必須大於0"},
+		{"tumbling的長度", func(c *Config) { c.WindowSize = time.Minute }, "tumbling視窗的長度"},
+		{"視窗小於間隔", func(c *Config) { c.WindowType, c.WindowSize = windowHopping, 5*time.Second }, "不能小於統計間隔"},
+		{"視窗類型", func(c *Config) { c.WindowType = "session" }, "不支援的視窗類型"},
+		{"工作協程數", func(c *Config) { c.Workers = 0 }, "工作協程數至少為1"},
+		{"HyperLogLog精度", func(c *Config) { c.DistinctMode, c.HLLPrecision = distinctHLL, 3 }, "HyperLogLog精度"},
+		{"獨立IMSI計算方式", func(c *Config) { c.DistinctMode = "bloom" }, "不支援的獨立IMSI計算方式"},
+		{"名單和hll", func(c *Config) { c.DistinctMode, c.Roster = distinctHLL, "1-9" }, "需要精確的獨立IMSI計算"},
+		{"告警沒有名單", func(c *Config) { c.RosterWebhook = "http://alert" }, "需要以 -roster 指定"},
+		{"告警沒有門檻", func(c *Config) { c.Roster, c.RosterAbsent, c.RosterExit = "1-9", 0, true }, "大於0的 -roster-absent"},
+		{"缺席門檻", func(c *Config) { c.RosterAbsent = -1 }, "不可為負"},
+		{"主題過濾器", func(c *Config) { c.ExcludeTopics = []string{"a/#/b"} }, "#"},
+		{"QoS逾時", func(c *Config) { c.QoSTimeout = 0 }, "QoS確認逾時"},
+		{"轉發等待時間", func(c *Config) { c.FanoutTimeout = -time.Second }, "broker轉發等待時間"},
+		{"中斷門檻", func(c *Config) { c.ImsiGapPeriods = 0 }, "中斷門檻"},
+		{"重複比例", func(c *Config) { c.ImsiDupRatio = 1 }, "重複回報的比例"},
+		{"沒有介面", func(c *Config) { c.Interfaces = nil }, "至少需要一個網路介面"},
+		{"介面樣式", func(c *Config) { c.Interfaces = []string{"cali["} }, "無效的介面樣式"},
+		{"抓包後端", func(c *Config) { c.CaptureBackend = "dpdk" }, "不支援的抓包後端"},
+		{"遺失門檻", func(c *Config) { c.LossThreshold = 101 }, "遺失警告門檻"},
+		{"snaplen", func(c *Config) { c.Snaplen = 0 }, "snaplen"},
+		{"沒有端口", func(c *Config) { c.BrokerPorts, c.TLSPorts, c.WebSocketPorts = nil, nil, nil }, "至少需要一個MQTT端口"},
+		{"無效的端口", func(c *Config) { c.BrokerPorts = []int{70000} }, "無效的端口"},
+		{"端口重疊", func(c *Config) { c.TLSPorts = []int{1883} }, "重複指定"},
+		{"目標IP", func(c *Config) { c.TargetIPs = []string{"broker"} }, "無效的目標IP"},
+		{"輸出格式", func(c *Config) { c.Output = "xml" }, "無效的輸出格式"},
+		{"文字輸出檔案", func(c *Config) { c.OutputFile = "out.txt" }, "只支援 json"},
+		{"TUI和JSON", func(c *Config) { c.TUI, c.Output = true, outputJSON }, "-output-file"},
+		{"pcap輪替", func(c *Config) { c.PcapRotate = -time.Second }, "pcapng檔案輪替參數"},
+		{"recorder沒有觸發條件", func(c *Config) { c.Recorder = time.Minute }, "至少一個觸發條件"},
+		{"觸發條件沒有recorder", func(c *Config) { c.TriggerMinImsi = 10 }, "以 -recorder 啟用"},
+	}
+	for _, tt := range tests {
+		c := defaultConfig()
+		tt.modify(&c)
+		if err := c.validate(); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: 錯誤 %v，應包含 %q", tt.name, err, tt.err)
+		}
+	}
+
+	// 合法的組合
+	for name, modify := range map[string]func(c *Config){
+		"預設":        func(c *Config) {},
+		"hll":       func(c *Config) { c.DistinctMode, c.HLLPrecision = distinctHLL, 16 },
+		"名單":        func(c *Config) { c.Roster, c.RosterWebhook, c.RosterExit = "1-9", "http://alert", true },
+		"sliding":   func(c *Config) { c.WindowType, c.WindowSize = windowSliding, time.Minute },
+		"recorder":  func(c *Config) { c.Recorder, c.TriggerImsi = time.Minute, "208930000000001" },
+		"TUI和JSON檔": func(c *Config) { c.TUI, c.Output, c.OutputFile = true, outputJSON, "events.ndjson" },
+	} {
+		c := defaultConfig()
+		modify(&c)
+		if err := c.validate(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
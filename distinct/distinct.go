@@ -0,0 +1,82 @@
+// Package distinct 計算獨立IMSI的數量。
+//
+// 精確模式保存完整的IMSI集合，可以列出每個IMSI；每個統計區間有數十萬個UE時，
+// 可改用近似模式（HyperLogLog），每個集合最多佔用 2^precision 位元組，
+// 估計器可以跨介面、跨視窗合併，相對標準誤差為 StdError(precision)。
+package distinct
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Set 是精確或近似的獨立元素集合，不是並行安全的
+type Set struct {
+	members map[string]struct{} // 精確模式
+	sketch  *Sketch             // 近似模式
+}
+
+// New 建立一個空集合，precision為0時使用精確模式，否則使用該精度的HyperLogLog
+func New(precision int) *Set {
+	if precision == 0 {
+		return &Set{members: make(map[string]struct{})}
+	}
+	return &Set{sketch: NewSketch(precision)}
+}
+
+// Describe 說明集合的模式和誤差，用在報告
+func Describe(precision int) string {
+	if precision == 0 {
+		return "精確"
+	}
+	return fmt.Sprintf("HyperLogLog 近似（精度 %d，標準誤差 ±%.2f%%）", precision, StdError(precision)*100)
+}
+
+// Approximate 回傳是否為近似模式
+func (s *Set) Approximate() bool {
+	return s.sketch != nil
+}
+
+// Add 加入一個元素
+func (s *Set) Add(item string) {
+	if s.sketch != nil {
+		s.sketch.Add(item)
+		return
+	}
+	s.members[item] = struct{}{}
+}
+
+// Merge 把另一個集合併入。近似集合可以併入精確集合的元素，反過來則不行
+func (s *Set) Merge(other *Set) {
+	switch {
+	case other.sketch == nil:
+		for item := range other.members {
+			s.Add(item)
+		}
+	case s.sketch != nil:
+		s.sketch.Merge(other.sketch)
+	default:
+		panic("distinct: 不能把近似集合併入精確集合")
+	}
+}
+
+// Len 回傳獨立元素的數量，近似模式為估計值
+func (s *Set) Len() int {
+	if s.sketch != nil {
+		return int(s.sketch.Estimate())
+	}
+	return len(s.members)
+}
+
+// Members 回傳排序後的元素，近似模式沒有保存元素，回傳nil
+func (s *Set) Members() []string {
+	if s.sketch != nil {
+		return nil
+	}
+	items := make([]string, 0, len(s.members))
+	for item := range s.members {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+	return items
+}
@@ -0,0 +1,68 @@
+package distinct
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExactSet(t *testing.T) {
+	a := New(0)
+	for _, imsi := range []string{"208930000000002", "208930000000001", "208930000000002"} {
+		a.Add(imsi)
+	}
+	b := New(0)
+	b.Add("208930000000003")
+	b.Add("208930000000001")
+	a.Merge(b)
+	if a.Approximate() || a.Len() != 3 {
+		t.Errorf("Approximate=%v Len=%d", a.Approximate(), a.Len())
+	}
+	if got, want := a.Members(), []string{"208930000000001", "208930000000002", "208930000000003"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Members = %v，應為 %v", got, want)
+	}
+	if got := New(0).Members(); got == nil || len(got) != 0 {
+		t.Errorf("空集合的Members = %#v", got)
+	}
+}
+
+// 近似集合可以併入精確集合和其他近似集合，結果和直接加入所有元素相同
+func TestApproximateSetMerge(t *testing.T) {
+	exact := New(0)
+	for i := 0; i < 3000; i++ {
+		exact.Add(testImsi(0, i))
+	}
+	approx := New(DefaultPrecision)
+	for i := 2000; i < 6000; i++ {
+		approx.Add(testImsi(0, i))
+	}
+	merged := New(DefaultPrecision)
+	merged.Merge(exact)
+	merged.Merge(approx)
+
+	union := New(DefaultPrecision)
+	for i := 0; i < 6000; i++ {
+		union.Add(testImsi(0, i))
+	}
+	if !merged.Approximate() || merged.Members() != nil {
+		t.Error("近似集合不應列出元素")
+	}
+	if merged.Len() != union.Len() {
+		t.Errorf("合併後 %d，聯集 %d", merged.Len(), union.Len())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("近似集合併入精確集合應該panic")
+		}
+	}()
+	exact.Merge(approx)
+}
+
+func TestDescribe(t *testing.T) {
+	if got := Describe(0); got != "精確" {
+		t.Errorf("Describe(0) = %q", got)
+	}
+	if got, want := Describe(14), "HyperLogLog 近似（精度 14，標準誤差 ±0.81%）"; got != want {
+		t.Errorf("Describe(14) = %q，應為 %q", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+package distinct
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// 第 trial 組的第 i 個IMSI，不同組之間沒有重複
+func testImsi(trial, i int) string {
+	return fmt.Sprintf("2089%d%010d", trial, i)
+}
+
+func sketchOf(precision, trial, from, to int) *Sketch {
+	s := NewSketch(precision)
+	for i := from; i < to; i++ {
+		s.Add(testImsi(trial, i))
+	}
+	return s
+}
+
+// 完整表示的暫存器，用來比較稀疏和完整表示的估計器
+func (s *Sketch) dense() []uint8 {
+	if s.registers != nil {
+		return s.registers
+	}
+	registers := make([]uint8, 1<<s.precision)
+	for index, rank := range s.sparse {
+		registers[index] = rank
+	}
+	return registers
+}
+
+// 各精度在不同基數下的相對誤差：每次不超過4倍標準誤差，多次的均方根不超過1.5倍
+func TestSketchErrorBounds(t *testing.T) {
+	const trials = 5
+	cardinalities := []int{1, 10, 100, 1000, 5000, 10000, 100000}
+	for _, precision := range []int{10, DefaultPrecision, MaxPrecision} {
+		sigma := StdError(precision)
+		for _, n := range cardinalities {
+			sumSquares := 0.0
+			for trial := 0; trial < trials; trial++ {
+				estimate := float64(sketchOf(precision, trial, 0, n).Estimate())
+				relative := (estimate - float64(n)) / float64(n)
+				if math.Abs(relative) > 4*sigma {
+					t.Errorf("精度 %d 基數 %d 第%d組: 估計 %.0f，誤差 %.2f%% 超過 4σ (%.2f%%)", precision, n, trial, estimate, relative*100, 4*sigma*100)
+				}
+				sumSquares += relative * relative
+			}
+			if rms := math.Sqrt(sumSquares / trials); rms > 1.5*sigma {
+				t.Errorf("精度 %d 基數 %d: 均方根誤差 %.2f%% 超過 1.5σ (%.2f%%)", precision, n, rms*100, 1.5*sigma*100)
+			}
+		}
+	}
+}
+
+// 暫存器數量遠多於元素時幾乎沒有碰撞，估計值應和實際數量相同
+func TestSketchSmallCardinality(t *testing.T) {
+	if got := NewSketch(DefaultPrecision).Estimate(); got != 0 {
+		t.Errorf("空的估計器 = %d", got)
+	}
+	for n := 1; n <= 100; n++ {
+		if got := sketchOf(DefaultPrecision, 0, 0, n).Estimate(); got != uint64(n) {
+			t.Errorf("基數 %d 估計為 %d", n, got)
+		}
+	}
+	// 重複加入不影響
+	s := sketchOf(DefaultPrecision, 0, 0, 50)
+	for i := 0; i < 50; i++ {
+		s.Add(testImsi(0, i))
+	}
+	if got := s.Estimate(); got != 50 {
+		t.Errorf("重複加入後估計為 %d", got)
+	}
+}
+
+// 稀疏表示和一開始就用完整表示的估計器在換成完整表示前後都相同
+func TestSketchDensify(t *testing.T) {
+	const precision = 10
+	s := NewSketch(precision)
+	dense := NewSketch(precision)
+	dense.densify()
+	for i := 0; i < 1000; i++ {
+		s.Add(testImsi(0, i))
+		dense.Add(testImsi(0, i))
+		if !bytes.Equal(s.dense(), dense.registers) || s.Estimate() != dense.Estimate() {
+			t.Fatalf("加入 %d 個元素後和完整表示不同", i+1)
+		}
+		// 超過 2^precision/16 個暫存器時換成完整表示
+		if nonZero := len(s.sparse); s.registers == nil && nonZero > (1<<precision)/16 {
+			t.Fatalf("%d 個暫存器仍是稀疏表示", nonZero)
+		}
+	}
+	if s.registers == nil {
+		t.Error("應已換成完整表示")
+	}
+}
+
+// 合併的結果和直接把所有元素加入同一個估計器相同，稀疏和完整表示都一樣
+func TestSketchMergeEqualsUnion(t *testing.T) {
+	const precision = 12
+	ranges := []struct {
+		name   string
+		a, b   [2]int
+		sparse bool // 合併後仍是稀疏表示
+	}{
+		{"都是稀疏", [2]int{0, 100}, [2]int{50, 200}, true},
+		{"稀疏併入完整", [2]int{0, 20000}, [2]int{19950, 20050}, false},
+		{"完整併入稀疏", [2]int{0, 100}, [2]int{50, 30000}, false},
+		{"都是完整", [2]int{0, 60000}, [2]int{40000, 100000}, false},
+		{"沒有重疊", [2]int{0, 5000}, [2]int{5000, 10000}, false},
+	}
+	for _, tt := range ranges {
+		union := NewSketch(precision)
+		for i := min(tt.a[0], tt.b[0]); i < max(tt.a[1], tt.b[1]); i++ {
+			union.Add(testImsi(0, i))
+		}
+		// 兩個方向合併的結果都相同
+		for _, order := range [][2][2]int{{tt.a, tt.b}, {tt.b, tt.a}} {
+			merged := sketchOf(precision, 0, order[0][0], order[0][1])
+			merged.Merge(sketchOf(precision, 0, order[1][0], order[1][1]))
+			if !bytes.Equal(merged.dense(), union.dense()) {
+				t.Errorf("%s: 合併後的暫存器和聯集不同", tt.name)
+			}
+			if merged.Estimate() != union.Estimate() {
+				t.Errorf("%s: 合併估計 %d，聯集估計 %d", tt.name, merged.Estimate(), union.Estimate())
+			}
+			if sparse := merged.registers == nil; sparse != tt.sparse {
+				t.Errorf("%s: 稀疏表示 %v，應為 %v", tt.name, sparse, tt.sparse)
+			}
+		}
+	}
+
+	// 多個估計器依序合併（跨介面、跨視窗），和加入順序無關
+	union := sketchOf(precision, 1, 0, 40000)
+	merged := NewSketch(precision)
+	for from := 0; from < 40000; from += 7000 {
+		merged.Merge(sketchOf(precision, 1, from, min(from+7000, 40000)))
+	}
+	if !bytes.Equal(merged.dense(), union.dense()) {
+		t.Error("多個估計器合併後的暫存器和聯集不同")
+	}
+	// 合併自己的複本不改變結果
+	copied := sketchOf(precision, 1, 0, 40000)
+	merged.Merge(copied)
+	if !bytes.Equal(merged.dense(), union.dense()) {
+		t.Error("合併相同元素後暫存器改變")
+	}
+}
+
+func TestSketchPanics(t *testing.T) {
+	expectPanic := func(name string, fn func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s: 應該panic", name)
+			}
+		}()
+		fn()
+	}
+	expectPanic("精度過小", func() { NewSketch(MinPrecision - 1) })
+	expectPanic("精度過大", func() { NewSketch(MaxPrecision + 1) })
+	expectPanic("精度不同", func() { NewSketch(10).Merge(NewSketch(12)) })
+}
+
+func TestStdError(t *testing.T) {
+	if got := StdError(DefaultPrecision); math.Abs(got-0.008125) > 1e-9 {
+		t.Errorf("StdError(14) = %v，應為 0.008125", got)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import "sync"
+
+// 封包未被統計的原因
+const (
+	failNoNetworkLayer       = "no_network_layer"
+	failNotIP                = "not_ip"
+	failNotTarget            = "not_target"
+	failFragmentDropped      = "ipv6_fragment_dropped"
+	failNoTransportLayer     = "no_transport_layer"
+	failNotTCP               = "not_tcp"
+	failWrongPort            = "wrong_port"
+	failMqttMalformed        = "mqtt_malformed"
+	failTLSMalformed         = "tls_malformed"
+	failTLSDecrypt           = "tls_decrypt_error"
+	failWebSocketMalformed   = "websocket_malformed"
+	failWebSocketUnsupported = "websocket_unsupported"
+	failTopicFiltered        = "topic_filtered"
+	failEmptyPayload         = "empty_payload"
+	failJSON                 = "json_error"
+	failDecode               = "decode_error" // JSON以外的payload格式解碼失敗
+	failSchemaMismatch       = "schema_mismatch"
+)
+
+// 報告中各原因的說明
+var failureDescriptions = map[string]string{
+	failNoNetworkLayer:       "沒有網路層",
+	failNotIP:                "不是IPv4/IPv6",
+	failNotTarget:            "不是監控目標",
+	failFragmentDropped:      "IPv6分片無效或逾時",
+	failNoTransportLayer:     "沒有傳輸層",
+	failNotTCP:               "不是TCP",
+	failWrongPort:            "不是MQTT端口",
+	failMqttMalformed:        "MQTT格式錯誤",
+	failTLSMalformed:         "TLS格式錯誤",
+	failTLSDecrypt:           "TLS解密失敗",
+	failWebSocketMalformed:   "WebSocket格式錯誤",
+	failWebSocketUnsupported: "不支援的WebSocket功能",
+	failTopicFiltered:        "主題被 -topics 或 -exclude-topics 過濾",
+	failEmptyPayload:         "payload為空",
+	failJSON:                 "JSON解析失敗",
+	failDecode:               "payload解碼失敗",
+	failSchemaMismatch:       "不符合擷取規格",
+}
+
+// 按原因分類的失敗計數，同時保留本區間和累計的數量
+type failureCounter struct {
+	mu     sync.Mutex
+	window map[string]uint64
+	total  map[string]uint64
+}
+
+func newFailureCounter() *failureCounter {
+	return &failureCounter{
+		window: make(map[string]uint64),
+		total:  make(map[string]uint64),
+	}
+}
+
+func (f *failureCounter) add(reason string) {
+	f.mu.Lock()
+	f.window[reason]++
+	f.total[reason]++
+	f.mu.Unlock()
+}
+
+// 取出本區間的計數並歸零
+func (f *failureCounter) snapshot() map[string]uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	window := f.window
+	f.window = make(map[string]uint64)
+	return window
+}
+
+// 累計的計數（複本）
+func (f *failureCounter) totals() map[string]uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	totals := make(map[string]uint64, len(f.total))
+	for reason, n := range f.total {
+		totals[reason] = n
+	}
+	return totals
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"getMqtt/schema"
+)
+
+// broker轉發驗證：同時抓到發布者 -> broker 和 broker -> 訂閱者兩段時，
+// 依主題和payload雜湊把每個送進broker的PUBLISH配對到各訂閱者收到的PUBLISH，
+// 計算轉發延遲，找出訂閱者沒有收到的訊息和其中的IMSI。
+//
+// 兩段是不同的TCP連線，可能由不同的工作協程處理，所以工作協程只把事件記在分片，
+// 報告時才由 fanoutCorrelator 配對。PUBLISH送出後超過 -fanout-timeout 才判斷是否遺失。
+
+// 文字報告中每個訂閱者最多列出的遺失IMSI數
+const fanoutListLimit = 20
+
+// 配對用的鍵：broker轉發時主題和payload不變
+type fanoutKey struct {
+	topic string
+	hash  uint64
+}
+
+func newFanoutKey(topic string, payload []byte) fanoutKey {
+	h := fnv.New64a()
+	h.Write(payload)
+	return fanoutKey{topic: topic, hash: h.Sum64()}
+}
+
+// 送進broker的PUBLISH
+type fanoutInbound struct {
+	key       fanoutKey
+	imsi      string
+	at        time.Time
+	delivered map[string]time.Duration // 訂閱者 -> 轉發延遲
+}
+
+// broker送給訂閱者的PUBLISH
+type fanoutDelivery struct {
+	key        fanoutKey
+	subscriber string
+	at         time.Time
+}
+
+// 訂閱者的SUBSCRIBE或UNSUBSCRIBE
+type fanoutSubscription struct {
+	subscriber  string
+	filters     []string
+	unsubscribe bool
+	at          time.Time
+}
+
+// 一個工作協程在一個統計區間內記錄的事件
+type fanoutEvents struct {
+	inbound       []*fanoutInbound
+	deliveries    []fanoutDelivery
+	subscriptions []fanoutSubscription
+}
+
+// 記錄送進broker的PUBLISH
+func recordFanoutInbound(msg *mqttMessage, topic, imsi string) {
+	events := msg.conn.worker.shard.fanout
+	events.inbound = append(events.inbound, &fanoutInbound{
+		key:  newFanoutKey(topic, msg.packet.Payload),
+		imsi: imsi,
+		at:   msg.timestamp,
+	})
+}
+
+// 記錄broker送給訂閱者的PUBLISH。retain旗標表示是訂閱時送出的保留訊息，不是轉發
+func recordFanoutDelivery(msg *mqttMessage, topic string) {
+	if msg.packet.Retain || msg.conn.session == nil {
+		return
+	}
+	events := msg.conn.worker.shard.fanout
+	events.deliveries = append(events.deliveries, fanoutDelivery{
+		key:        newFanoutKey(topic, msg.packet.Payload),
+		subscriber: msg.conn.session.key(),
+		at:         msg.timestamp,
+	})
+}
+
+// 記錄客戶端的SUBSCRIBE或UNSUBSCRIBE
+func recordFanoutSubscription(msg *mqttMessage) {
+	if msg.conn.session == nil {
+		return
+	}
+	events := msg.conn.worker.shard.fanout
+	events.subscriptions = append(events.subscriptions, fanoutSubscription{
+		subscriber:  msg.conn.session.key(),
+		filters:     msg.packet.TopicFilters,
+		unsubscribe: msg.packet.Type == MQTT_UNSUBSCRIBE,
+		at:          msg.timestamp,
+	})
+}
+
+// 一個主題過濾器的訂閱期間
+type fanoutFilter struct {
+	since time.Time
+	until time.Time // UNSUBSCRIBE的時間，訂閱中為零值
+}
+
+// 一個訂閱者的訂閱
+type fanoutSubscriber struct {
+	// 主題過濾器的訂閱期間。抓包開始前的訂閱看不到SUBSCRIBE，
+	// 收到轉發時以該主題推定訂閱，開始時間為第一個配對到的PUBLISH。
+	// 取消訂閱後保留到超過等待時間，取消前送出還沒判斷的PUBLISH仍然預期收到
+	filters map[string]fanoutFilter
+	until   time.Time // session結束的時間，連線中為零值
+}
+
+// PUBLISH送出時此訂閱者是否應該收到
+func (s *fanoutSubscriber) expects(topic string, at time.Time) bool {
+	if !s.until.IsZero() && !at.Before(s.until) {
+		return false
+	}
+	for filter, f := range s.filters {
+		if !at.Before(f.since) && (f.until.IsZero() || at.Before(f.until)) && schema.MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// 一個訂閱者在統計區間內的轉發統計
+type fanoutSubscriberStats struct {
+	expected  int
+	delivered int
+	latencies []float64
+	missed    []string // 沒有收到的PUBLISH中的IMSI
+	lost      int
+}
+
+// 配對送進broker和送給訂閱者的PUBLISH，由 lock 保護
+type fanoutCorrelator struct {
+	timeout     time.Duration
+	subscribers map[string]*fanoutSubscriber
+	pending     map[fanoutKey][]*fanoutInbound // 還在等待轉發的PUBLISH，依時間排序
+	inbound     int                            // pending中的PUBLISH數
+
+	// 本統計區間的數值
+	stats        map[string]*fanoutSubscriberStats
+	messages     int
+	noSubscriber int
+	unmatched    int
+	latencies    []float64
+}
+
+func newFanoutCorrelator(timeout time.Duration) *fanoutCorrelator {
+	return &fanoutCorrelator{
+		timeout:     timeout,
+		subscribers: make(map[string]*fanoutSubscriber),
+		pending:     make(map[fanoutKey][]*fanoutInbound),
+		stats:       make(map[string]*fanoutSubscriberStats),
+	}
+}
+
+func (c *fanoutCorrelator) subscriber(name string) *fanoutSubscriber {
+	s := c.subscribers[name]
+	if s == nil {
+		s = &fanoutSubscriber{filters: make(map[string]fanoutFilter)}
+		c.subscribers[name] = s
+	}
+	return s
+}
+
+func (c *fanoutCorrelator) statsFor(subscriber string) *fanoutSubscriberStats {
+	stats := c.stats[subscriber]
+	if stats == nil {
+		stats = &fanoutSubscriberStats{}
+		c.stats[subscriber] = stats
+	}
+	return stats
+}
+
+// 訂閱者的session結束，之後送出的PUBLISH不再預期它收到。呼叫者需持有 lock。
+// 它的SUBSCRIBE可能還在分片中沒有併入，所以沒有記錄時也要建立
+func (c *fanoutCorrelator) ended(subscriber string, at time.Time) {
+	c.subscriber(subscriber).until = at
+}
+
+// 訂閱者在結束後又有活動，表示重新連線
+func (s *fanoutSubscriber) active(at time.Time) {
+	if !s.until.IsZero() && at.After(s.until) {
+		s.until = time.Time{}
+	}
+}
+
+// 併入一個分片記錄的事件，送進broker的PUBLISH先加入等待，再配對轉發
+func (c *fanoutCorrelator) merge(shards []*fanoutEvents) {
+	var inbound []*fanoutInbound
+	var deliveries []fanoutDelivery
+	var subscriptions []fanoutSubscription
+	for _, events := range shards {
+		inbound = append(inbound, events.inbound...)
+		deliveries = append(deliveries, events.deliveries...)
+		subscriptions = append(subscriptions, events.subscriptions...)
+	}
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].at.Before(subscriptions[j].at) })
+	for _, sub := range subscriptions {
+		s := c.subscriber(sub.subscriber)
+		s.active(sub.at)
+		for _, filter := range sub.filters {
+			f, ok := s.filters[filter]
+			switch {
+			case sub.unsubscribe:
+				if ok && f.until.IsZero() {
+					f.until = sub.at
+					s.filters[filter] = f
+				}
+			case !ok || !f.until.IsZero():
+				// 重新訂閱時只保留新的訂閱期間
+				s.filters[filter] = fanoutFilter{since: sub.at}
+			}
+		}
+	}
+
+	sort.Slice(inbound, func(i, j int) bool { return inbound[i].at.Before(inbound[j].at) })
+	for _, in := range inbound {
+		in.delivered = make(map[string]time.Duration)
+		c.pending[in.key] = append(c.pending[in.key], in)
+		c.inbound++
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].at.Before(deliveries[j].at) })
+	for _, d := range deliveries {
+		c.deliver(d)
+	}
+}
+
+// 配對一個轉發：同一個主題和payload中最早還沒送給此訂閱者的PUBLISH
+func (c *fanoutCorrelator) deliver(d fanoutDelivery) {
+	for _, in := range c.pending[d.key] {
+		if _, ok := in.delivered[d.subscriber]; ok || d.at.Before(in.at) {
+			continue
+		}
+		in.delivered[d.subscriber] = d.at.Sub(in.at)
+		s := c.subscriber(d.subscriber)
+		s.active(d.at)
+		if f, ok := s.filters[d.key.topic]; !ok || in.at.Before(f.since) {
+			f.since = in.at
+			s.filters[d.key.topic] = f
+		}
+		return
+	}
+	// 沒有看到發布者那一段，或QoS重送等重複的轉發
+	c.unmatched++
+}
+
+// 判斷送出超過等待時間的PUBLISH，now 為目前的封包時間
+func (c *fanoutCorrelator) evaluate(now time.Time) {
+	deadline := now.Add(-c.timeout)
+	for key, list := range c.pending {
+		n := 0
+		for n < len(list) && !list[n].at.After(deadline) {
+			c.evaluateInbound(list[n])
+			n++
+		}
+		c.inbound -= n
+		if n == len(list) {
+			delete(c.pending, key)
+		} else {
+			c.pending[key] = list[n:]
+		}
+	}
+}
+
+func (c *fanoutCorrelator) evaluateInbound(in *fanoutInbound) {
+	c.messages++
+	expected := 0
+	for name, s := range c.subscribers {
+		latency, delivered := in.delivered[name]
+		if !delivered && !s.expects(in.key.topic, in.at) {
+			continue
+		}
+		expected++
+		stats := c.statsFor(name)
+		stats.expected++
+		if delivered {
+			stats.delivered++
+			stats.latencies = append(stats.latencies, latency.Seconds())
+			c.latencies = append(c.latencies, latency.Seconds())
+			continue
+		}
+		stats.lost++
+		if in.imsi != "" {
+			stats.missed = append(stats.missed, in.imsi)
+		}
+	}
+	if expected == 0 {
+		c.noSubscriber++
+	}
+}
+
+// 一個訂閱者的轉發結果
+type fanoutSubscriberReport struct {
+	Subscriber  string           `json:"subscriber"`
+	Expected    int              `json:"expected"`
+	Delivered   int              `json:"delivered"`
+	Lost        int              `json:"lost"`
+	Latency     *durationSummary `json:"latency,omitempty"`
+	MissedImsis []string         `json:"missedImsis,omitempty"` // 沒有收到的PUBLISH中的IMSI，不重複
+}
+
+// 一個統計區間的轉發驗證結果，涵蓋本區間判斷的PUBLISH（送出後已超過等待時間）
+type fanoutReport struct {
+	Messages     int                      `json:"messages"`
+	Expected     int                      `json:"expected"` // 應該轉發的次數（PUBLISH × 訂閱者）
+	Delivered    int                      `json:"delivered"`
+	Lost         int                      `json:"lost"`
+	NoSubscriber int                      `json:"noSubscriber"`        // 沒有任何訂閱者的PUBLISH數
+	Unmatched    int                      `json:"unmatchedDeliveries"` // 找不到來源PUBLISH的轉發數
+	Pending      int                      `json:"pending"`             // 還在等待轉發的PUBLISH數
+	Latency      *durationSummary         `json:"latency,omitempty"`
+	Subscribers  []fanoutSubscriberReport `json:"subscribers,omitempty"`
+}
+
+// 判斷到 end 為止可以判斷的PUBLISH並產生本區間的結果，之後區間的數值歸零
+func (c *fanoutCorrelator) snapshot(end time.Time) *fanoutReport {
+	c.evaluate(end)
+	report := &fanoutReport{
+		Messages:     c.messages,
+		NoSubscriber: c.noSubscriber,
+		Unmatched:    c.unmatched,
+		Pending:      c.inbound,
+		Latency:      newDurationSummary(c.latencies),
+	}
+	for _, name := range sortedKeys(c.stats) {
+		stats := c.stats[name]
+		report.Expected += stats.expected
+		report.Delivered += stats.delivered
+		report.Lost += stats.lost
+		report.Subscribers = append(report.Subscribers, fanoutSubscriberReport{
+			Subscriber:  name,
+			Expected:    stats.expected,
+			Delivered:   stats.delivered,
+			Lost:        stats.lost,
+			Latency:     newDurationSummary(stats.latencies),
+			MissedImsis: distinctSorted(stats.missed),
+		})
+	}
+
+	// 結束或取消訂閱超過等待時間的訂閱者和過濾器不會再影響判斷
+	deadline := end.Add(-c.timeout)
+	for name, s := range c.subscribers {
+		if !s.until.IsZero() && s.until.Before(deadline) {
+			delete(c.subscribers, name)
+			continue
+		}
+		for filter, f := range s.filters {
+			if !f.until.IsZero() && f.until.Before(deadline) {
+				delete(s.filters, filter)
+			}
+		}
+	}
+
+	c.stats = make(map[string]*fanoutSubscriberStats)
+	c.messages, c.noSubscriber, c.unmatched = 0, 0, 0
+	c.latencies = nil
+	return report
+}
+
+// 排序並去除重複的字串
+func distinctSorted(values []string) []string {
+	sort.Strings(values)
+	n := 0
+	for i, v := range values {
+		if i == 0 || v != values[n-1] {
+			values[n] = v
+			n++
+		}
+	}
+	return values[:n]
+}
+
+// 打印轉發驗證的結果
+func printFanout(report *fanoutReport) {
+	fmt.Printf("broker轉發: PUBLISH %d  應轉發 %d  已轉發 %d  遺失 %d  沒有訂閱者 %d  無來源的轉發 %d  等待中 %d\n",
+		report.Messages, report.Expected, report.Delivered, report.Lost, report.NoSubscriber, report.Unmatched, report.Pending)
+	if report.Latency != nil {
+		fmt.Printf("  轉發延遲: %s\n", report.Latency)
+	}
+	for _, sub := range report.Subscribers {
+		fmt.Printf("  %s: 應轉發 %d  已轉發 %d  遺失 %d\n", sub.Subscriber, sub.Expected, sub.Delivered, sub.Lost)
+		if sub.Latency != nil {
+			fmt.Printf("    轉發延遲: %s\n", sub.Latency)
+		}
+		if len(sub.MissedImsis) == 0 {
+			continue
+		}
+		missed := sub.MissedImsis
+		more := ""
+		if len(missed) > fanoutListLimit {
+			more = fmt.Sprintf(" ...另有 %d 個", len(missed)-fanoutListLimit)
+			missed = missed[:fanoutListLimit]
+		}
+		fmt.Printf("    沒收到的IMSI: %v%s\n", missed, more)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 以合成事件測試配對，時間為相對 t0 的偏移
+type fanoutScenario struct {
+	t0 time.Time
+}
+
+func (s fanoutScenario) inbound(topic, payload, imsi string, at time.Duration) *fanoutInbound {
+	return &fanoutInbound{key: newFanoutKey(topic, []byte(payload)), imsi: imsi, at: s.t0.Add(at)}
+}
+
+func (s fanoutScenario) delivery(subscriber, topic, payload string, at time.Duration) fanoutDelivery {
+	return fanoutDelivery{key: newFanoutKey(topic, []byte(payload)), subscriber: subscriber, at: s.t0.Add(at)}
+}
+
+func (s fanoutScenario) subscription(subscriber string, unsubscribe bool, at time.Duration, filters ...string) fanoutSubscription {
+	return fanoutSubscription{subscriber: subscriber, filters: filters, unsubscribe: unsubscribe, at: s.t0.Add(at)}
+}
+
+// 比較報告，延遲另外檢查
+func checkFanoutReport(t *testing.T, name string, got, want *fanoutReport) {
+	t.Helper()
+	copied := *got
+	copied.Latency = nil
+	copied.Subscribers = append([]fanoutSubscriberReport(nil), got.Subscribers...)
+	for i := range copied.Subscribers {
+		copied.Subscribers[i].Latency = nil
+	}
+	if !reflect.DeepEqual(&copied, want) {
+		t.Errorf("%s: %+v，應為 %+v", name, copied, *want)
+	}
+}
+
+// 訂閱後沒有收到的PUBLISH在逾時後記為遺失；沒有看到SUBSCRIBE的訂閱者從第一個轉發推定訂閱；
+// 同一個PUBLISH重複轉發和找不到來源的轉發列為無來源的轉發
+func TestFanoutCorrelator(t *testing.T) {
+	s := fanoutScenario{t0: time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)}
+	c := newFanoutCorrelator(5 * time.Second)
+
+	// 事件分在兩個工作協程，各自的順序和時間順序不同
+	c.merge([]*fanoutEvents{
+		{
+			inbound: []*fanoutInbound{
+				s.inbound("t/usage", "p2", "208930000000002", 2*time.Second),
+				s.inbound("t/usage", "p0", "208930000000000", 500*time.Millisecond),
+			},
+			deliveries: []fanoutDelivery{
+				s.delivery("sub-b", "t/usage", "p1", 1020*time.Millisecond),
+				s.delivery("sub-a", "t/usage", "p1", 1500*time.Millisecond), // 重複的轉發
+				s.delivery("sub-a", "t/other", "x", 1600*time.Millisecond),  // 沒有抓到發布者
+			},
+		},
+		{
+			inbound: []*fanoutInbound{s.inbound("t/usage", "p1", "208930000000001", time.Second)},
+			deliveries: []fanoutDelivery{
+				s.delivery("sub-a", "t/usage", "p1", 1010*time.Millisecond),
+			},
+			subscriptions: []fanoutSubscription{s.subscription("sub-a", false, 0, "t/+")},
+		},
+	})
+
+	// 還沒超過等待時間的PUBLISH不判斷
+	checkFanoutReport(t, "等待中", c.snapshot(s.t0.Add(5*time.Second)), &fanoutReport{Unmatched: 2, Pending: 3})
+
+	report := c.snapshot(s.t0.Add(10 * time.Second))
+	checkFanoutReport(t, "逾時後", report, &fanoutReport{
+		Messages: 3, Expected: 5, Delivered: 2, Lost: 3,
+		Subscribers: []fanoutSubscriberReport{
+			// p0 在sub-b推定的訂閱開始前送出，不算sub-b遺失
+			{Subscriber: "sub-a", Expected: 3, Delivered: 1, Lost: 2, MissedImsis: []string{"208930000000000", "208930000000002"}},
+			{Subscriber: "sub-b", Expected: 2, Delivered: 1, Lost: 1, MissedImsis: []string{"208930000000002"}},
+		},
+	})
+	if l := report.Latency; l == nil || l.Count != 2 || l.MinSeconds != 0.01 || l.MaxSeconds != 0.02 {
+		t.Errorf("轉發延遲 %+v", l)
+	}
+	if l := report.Subscribers[1].Latency; l == nil || l.Count != 1 || l.MinSeconds != 0.02 {
+		t.Errorf("sub-b 轉發延遲 %+v", l)
+	}
+
+	// 區間的數值已歸零
+	checkFanoutReport(t, "下一個區間", c.snapshot(s.t0.Add(15*time.Second)), &fanoutReport{})
+}
+
+// UNSUBSCRIBE和session結束之後送出的PUBLISH不預期訂閱者收到，之前送出的仍然預期收到；重新連線後恢復
+func TestFanoutUnsubscribeAndSessionEnd(t *testing.T) {
+	s := fanoutScenario{t0: time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)}
+	c := newFanoutCorrelator(5 * time.Second)
+
+	c.merge([]*fanoutEvents{{
+		inbound: []*fanoutInbound{
+			s.inbound("t/usage", "p1", "208930000000001", time.Second),
+			s.inbound("t/usage", "p2", "208930000000002", 3*time.Second),
+			s.inbound("t/usage", "p3", "208930000000003", 5*time.Second),
+		},
+		subscriptions: []fanoutSubscription{
+			s.subscription("sub-a", false, 0, "t/#"),
+			s.subscription("sub-b", false, 0, "t/usage"),
+			s.subscription("sub-a", true, 2*time.Second, "t/#"),
+		},
+	}})
+	c.ended("sub-b", s.t0.Add(4*time.Second))
+
+	checkFanoutReport(t, "取消訂閱和結束", c.snapshot(s.t0.Add(10*time.Second)), &fanoutReport{
+		Messages: 3, Expected: 3, Lost: 3, NoSubscriber: 1,
+		Subscribers: []fanoutSubscriberReport{
+			{Subscriber: "sub-a", Expected: 1, Lost: 1, MissedImsis: []string{"208930000000001"}},
+			{Subscriber: "sub-b", Expected: 2, Lost: 2, MissedImsis: []string{"208930000000001", "208930000000002"}},
+		},
+	})
+	// 結束超過等待時間的訂閱者和取消的過濾器已移除
+	if _, ok := c.subscribers["sub-b"]; ok || len(c.subscribers) != 1 || len(c.subscribers["sub-a"].filters) != 0 {
+		t.Errorf("訂閱者 %+v", c.subscribers)
+	}
+
+	// sub-b 重新連線並訂閱
+	c.merge([]*fanoutEvents{{
+		inbound:       []*fanoutInbound{s.inbound("t/usage", "p4", "208930000000004", 12*time.Second)},
+		deliveries:    []fanoutDelivery{s.delivery("sub-b", "t/usage", "p4", 12005*time.Millisecond)},
+		subscriptions: []fanoutSubscription{s.subscription("sub-b", false, 11*time.Second, "t/usage")},
+	}})
+	checkFanoutReport(t, "重新連線", c.snapshot(s.t0.Add(20*time.Second)), &fanoutReport{
+		Messages: 1, Expected: 1, Delivered: 1,
+		Subscribers: []fanoutSubscriberReport{{Subscriber: "sub-b", Expected: 1, Delivered: 1}},
+	})
+
+	// 結束後在同一個區間又收到轉發，表示已重新連線
+	c.ended("sub-b", s.t0.Add(21*time.Second))
+	c.merge([]*fanoutEvents{{
+		inbound:    []*fanoutInbound{s.inbound("t/usage", "p5", "", 22*time.Second), s.inbound("t/usage", "p6", "", 23*time.Second)},
+		deliveries: []fanoutDelivery{s.delivery("sub-b", "t/usage", "p5", 22010*time.Millisecond)},
+	}})
+	checkFanoutReport(t, "結束後收到轉發", c.snapshot(s.t0.Add(30*time.Second)), &fanoutReport{
+		Messages: 2, Expected: 2, Delivered: 1, Lost: 1,
+		Subscribers: []fanoutSubscriberReport{{Subscriber: "sub-b", Expected: 2, Delivered: 1, Lost: 1}},
+	})
+}
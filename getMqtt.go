@@ -1,91 +1,194 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
-)
 
-type MetricData struct {
-	Imsi string `json:"imsi"`
-	IP   string `json:"ip,omitempty"`
-}
+	"getMqtt/distinct"
+	"getMqtt/roster"
+	"getMqtt/schema"
+)
 
 type PacketStats struct {
 	DestinationIP string
 	SourceIP      string
-	ImsiSet       map[string]bool
+	ImsiSet       *distinct.Set // 依 -distinct 設定為精確集合或HyperLogLog
 	Count         int
 }
 
+// 一個統計區間的報告資料
+type WindowReport struct {
+	Start      time.Time               // 視窗開始時間（離線模式下為封包時間）
+	End        time.Time               // 視窗結束時間
+	Stats      map[string]*PacketStats // 按目標IP分组的统计，涵蓋整個視窗
+	Clients    map[string]*ClientStats // 按client ID分組的統計，以下都是最近一個統計間隔的數值
+	Topics     map[string]*TopicStats  // 按主題的統計
+	Patterns   map[string]*TopicStats  // 按 -topic-patterns 樣式的統計，沒有指定樣式時為空
+	Groups     []*schema.Group         // 按擷取規格的分組鍵彙總，沒有規格檔時為空
+	Interfaces map[string]uint64       // 各介面本區間捕獲的封包數，離線模式為nil
+	Capture    map[string]captureStats // 各介面本區間抓包後端的收到和丟棄數，離線模式為nil
+	Failures   map[string]uint64       // 本區間未被統計的封包數（按原因）
+	Roster     *roster.Result          // 視窗內出現的IMSI和預期名單的比對，沒有名單時為nil
+	Cadence    *cadenceReport          // 本區間各IMSI的回報週期，沒有啟用時為nil
+	Fanout     *fanoutReport           // 本區間判斷的broker轉發結果，沒有啟用時為nil
+	Published  map[string]int          // 本區間按目標IP新增的PUBLISH數，視窗重疊時不重複計算
+}
+
+// 所有介面本區間的抓包統計總和
+func (r *WindowReport) captureTotal() captureStats {
+	var total captureStats
+	for _, stats := range r.Capture {
+		total = total.add(stats)
+	}
+	return total
+}
+
+// 視窗內所有目標IP合計的獨立IMSI數
+func (r *WindowReport) distinctImsi() int {
+	all := distinct.New(config.imsiPrecision())
+	for _, stat := range r.Stats {
+		all.Merge(stat.ImsiSet)
+	}
+	return all.Len()
+}
+
+// 視窗內每秒的封包數
+func (r *WindowReport) rate(stat *PacketStats) float64 {
+	seconds := r.End.Sub(r.Start).Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(stat.Count) / seconds
+}
+
 var (
-	// 按目標IP分组的统计
-	ipStats = make(map[string]*PacketStats)
+	// 按目標IP分组的统计，依視窗設定保留需要的時間。
+	// 工作協程的分片在報告時併入，由 lock 保護
+	windows *windowEngine
 	lock    sync.RWMutex
 
-	// 配置参数
-	targetIP      = "10.1.153.153" // 目標IP，根據需要修改
-	statsInterval = 15 * time.Second
-	debugMode     = false // 調試模式
+	// 配置参数，由命令列參數和配置檔設定
+	config = defaultConfig()
+
+	// 把封包依連線分給工作協程（TCP重組、MQTT和payload解析、統計）
+	pipeline *packetPipeline
+
+	// 即時模式的多介面抓包管理，離線模式為nil
+	captures *captureManager
+
+	// 封包未被統計的原因計數
+	failures = newFailureCounter()
+
+	// IPv6分片重組，只在分派封包的協程中存取
+	ipv6Fragments = newIPv6Defragmenter()
+
+	// payload擷取規格和按分組鍵的彙總，工作協程的分片在報告時併入，由 lock 保護
+	payloadSchema = schema.Default()
+	payloadGroups = schema.NewAggregator(payloadSchema, 0)
+
+	// Prometheus指標，未啟用時為nil
+	exporter *metricsExporter
+
+	// TLS金鑰，未指定key log時為nil
+	keyLog *tlsKeyLog
+
+	// 預期IMSI名單的追蹤，只在產生報告的協程中使用，未指定名單時為nil
+	rosterTracker *roster.Tracker
+
+	// 各IMSI的回報間隔，由 lock 保護，未指定 -imsi-period 時為nil
+	cadence *cadenceTracker
+
+	// 送進broker和轉發給訂閱者的PUBLISH配對，由 lock 保護，未指定 -fanout-timeout 時為nil
+	fanout *fanoutCorrelator
+
+	// 符合過濾條件的封包寫入的pcapng檔案和flight recorder，未啟用時為nil
+	pcapOut  *pcapWriter
+	recorder *flightRecorder
+
+	// 終端介面，未指定 -tui 時為nil
+	ui *tui
+
+	// 調試輸出，由 -debug 設定，TUI模式可以在執行中切換
+	debugMode atomic.Bool
 )
 
-func listInterfaces() []pcap.Interface {
-	devices, err := pcap.FindAllDevs()
+// 是否輸出調試訊息，各協程都會讀取
+func debugOn() bool {
+	return debugMode.Load()
+}
+
+// 是否在stdout逐筆輸出文字，JSON和TUI模式不輸出
+func textOutput() bool {
+	return events == nil && ui == nil
+}
+
+// 名單中的IMSI連續缺席達到門檻且指定了 -roster-exit 時的結束代碼
+const rosterExitCode = 3
+
+func listInterfaces() []captureDevice {
+	devices, err := captureDevices()
 	if err != nil {
 		log.Fatal("無法獲取網路介面列表:", err)
 	}
 
-	fmt.Println("可用的網路介面:")
+	fmt.Fprintln(infoOut, "可用的網路介面:")
 	for _, device := range devices {
-		fmt.Printf("  %s: %s\n", device.Name, device.Description)
+		fmt.Fprintf(infoOut, "  %s: %s\n", device.Name, device.Description)
 		for _, address := range device.Addresses {
-			fmt.Printf("    IP: %s\n", address.IP)
+			fmt.Fprintf(infoOut, "    IP: %s\n", address)
 		}
 	}
 	return devices
 }
 
 func capturePacketsOnAny() {
-	// 使用 "any" 介面捕獲所有網路流量
-	handle, err := pcap.OpenLive("cali62ed833be43", 1600, true, pcap.BlockForever)
-	if err != nil {
-		log.Printf("無法打開 any 介面: %v", err)
+	// 每個符合名稱或glob樣式的介面各一個抓包協程，封包送入同一個處理佇列
+	if captures.rescan() == 0 {
+		if ui != nil {
+			ui.close()
+		}
+		log.Printf("沒有可抓包的介面: %v", config.Interfaces)
 		log.Println("嘗試列出可用的網路介面...")
 		listInterfaces()
 		os.Exit(1)
 	}
-	defer handle.Close()
-
-	// 設置過濾器，只捕獲發送到目標IP的MQTT流量（端口1883）
-	// filter := fmt.Sprintf("tcp port 1883 and dst host %s", targetIP)
-	filter := fmt.Sprintf("tcp port 1883")
-	err = handle.SetBPFFilter(filter)
-	if err != nil {
-		log.Fatal("設置BPF過濾器失敗:", err)
+	if config.RescanInterval > 0 {
+		go captures.watch(config.RescanInterval)
 	}
 
-	fmt.Printf("開始監控 any 介面的MQTT流量\n")
-	fmt.Printf("監控目標IP: %s\n", targetIP)
-	fmt.Printf("統計間隔: %v\n", statsInterval)
-	fmt.Printf("過濾器: %s\n", filter)
+	fmt.Fprintf(infoOut, "監控目標IP: %s\n", config.targetsString())
+	fmt.Fprintf(infoOut, "統計視窗: %s\n", windows)
+	fmt.Fprintf(infoOut, "獨立IMSI計算: %s\n", distinct.Describe(config.imsiPrecision()))
+	fmt.Fprintf(infoOut, "抓包後端: %s\n", config.captureString())
+	fmt.Fprintf(infoOut, "過濾器: %s\n", config.bpfFilter())
+	fmt.Fprintf(infoOut, "工作協程: %d\n", config.Workers)
 
-	// 開始捕獲封包
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
 	packetCount := 0
 
-	for packet := range packetSource.Packets() {
-		packetCount++
-		if debugMode && packetCount%10 == 0 {
-			fmt.Printf("[any] 已處理 %d 個封包\n", packetCount)
+	// 所有介面的封包在這個協程中檢查和重組IPv6分片，再依連線分給工作協程
+	ticker := time.NewTicker(assemblyFlushTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case packet := <-captures.packets:
+			packetCount++
+			if debugOn() && packetCount%10 == 0 {
+				fmt.Fprintf(infoOut, "[any] 已處理 %d 個封包\n", packetCount)
+			}
+			processPacket(packet)
+		case now := <-ticker.C:
+			pipeline.flush(now)
 		}
-		processPacket(packet)
 	}
 }
 
@@ -93,165 +196,533 @@ func processPacket(packet gopacket.Packet) {
 	// 解析網路層
 	networkLayer := packet.NetworkLayer()
 	if networkLayer == nil {
-		if debugMode {
+		if debugOn() {
 			log.Println("[any] 無法解析網路層")
 		}
+		failures.add(failNoNetworkLayer)
 		return
 	}
 
-	// 檢查是否為IP封包
-	ipLayer, ok := networkLayer.(*layers.IPv4)
-	if !ok {
-		if debugMode {
-			log.Println("[any] 不是IPv4封包")
+	// 檢查是否為IP封包（IPv4或IPv6）
+	switch networkLayer.(type) {
+	case *layers.IPv4, *layers.IPv6:
+	default:
+		if debugOn() {
+			log.Println("[any] 不是IP封包")
+		}
+		failures.add(failNotIP)
+		return
+	}
+
+	// 檢查通訊的一端是否為監控目標（使用自訂過濾器時BPF不一定已過濾）
+	srcIP, dstIP := networkLayer.NetworkFlow().Endpoints()
+	if !config.isTargetIP(dstIP.String()) && !config.isTargetIP(srcIP.String()) {
+		if debugOn() {
+			log.Printf("[any] %s -> %s 不是監控目標 %s", srcIP, dstIP, config.targetsString())
 		}
+		failures.add(failNotTarget)
 		return
 	}
 
-	// 檢查目標IP是否為目標IP
-	// if ipLayer.DstIP.String() != targetIP {
-	// 	if debugMode {
-	// 		log.Printf("[any] 目標IP %s 不是監控目標 %s", ipLayer.DstIP.String(), targetIP)
-	// 	}
-	// 	return
-	// }
+	// IPv6分片要等全部到齊後重組，其他延伸標頭由gopacket直接跳過
+	if frag, ok := packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment); ok {
+		packet = ipv6Fragments.defrag(packet, networkLayer.(*layers.IPv6), frag)
+		if packet == nil {
+			return
+		}
+		networkLayer = packet.NetworkLayer()
+	}
 
 	// 解析傳輸層
 	transportLayer := packet.TransportLayer()
 	if transportLayer == nil {
-		if debugMode {
+		if debugOn() {
 			log.Println("[any] 無法解析傳輸層")
 		}
+		failures.add(failNoTransportLayer)
 		return
 	}
 
 	// 檢查是否為TCP封包
 	tcpLayer, ok := transportLayer.(*layers.TCP)
 	if !ok {
-		if debugMode {
+		if debugOn() {
 			log.Println("[any] 不是TCP封包")
 		}
+		failures.add(failNotTCP)
 		return
 	}
 
-	// 檢查是否為MQTT端口
-	if tcpLayer.DstPort != 1883 {
-		if debugMode {
-			log.Printf("[any] 目標端口 %d 不是MQTT端口 1883", tcpLayer.DstPort)
+	// 檢查是否為MQTT端口（兩個方向都需要送入重組器）
+	if !isMqttPort(uint16(tcpLayer.DstPort)) && !isMqttPort(uint16(tcpLayer.SrcPort)) {
+		if debugOn() {
+			log.Printf("[any] 端口 %d -> %d 不是MQTT端口 %v", tcpLayer.SrcPort, tcpLayer.DstPort, config.mqttPorts())
 		}
+		failures.add(failWrongPort)
 		return
 	}
 
-	// 印出MQTT封包的基本信息
-	sourceIP := ipLayer.SrcIP.String()
-	destIP := ipLayer.DstIP.String()
-	fmt.Printf("[MQTT] %s -> %s:%d\n", sourceIP, destIP, tcpLayer.DstPort)
+	if pcapOut != nil || recorder != nil {
+		savePacket(packet)
+	}
 
-	// 嘗試解析MQTT payload
-	payload := tcpLayer.Payload
-	if len(payload) == 0 {
-		if debugMode {
-			log.Println("[any] TCP payload為空")
+	// 依連線交給工作協程的TCP重組器，完整的MQTT封包會回呼 handleMqttPacket
+	ctx := &captureContext{ci: packet.Metadata().CaptureInfo}
+	pipeline.dispatch(networkLayer.NetworkFlow(), tcpLayer, ctx)
+}
+
+func isMqttPort(port uint16) bool {
+	return config.isBrokerPort(port) || config.isTLSPort(port) || config.isWebSocketPort(port)
+}
+
+// 處理一個完整的MQTT控制封包
+func handleMqttPacket(msg *mqttMessage) {
+	mqttPacket := msg.packet
+	sourceIP, destIP := msg.srcIP, msg.dstIP
+
+	if mqttPacket.Type == MQTT_CONNECT {
+		msg.conn.version = mqttPacket.ProtocolLevel
+	}
+	// 把連線綁定到CONNECT的client ID，追蹤到DISCONNECT或斷線
+	trackSession(msg)
+	// 兩個方向的QoS 1/2確認流程，不受主題過濾影響
+	trackQoS(msg)
+
+	switch mqttPacket.Type {
+	case MQTT_CONNECT:
+		if debugOn() {
+			log.Printf("[any] CONNECT client=%s 協議等級=%d keepalive=%d",
+				mqttPacket.ClientID, mqttPacket.ProtocolLevel, mqttPacket.KeepAlive)
+		}
+		return
+	case MQTT_PUBLISH:
+	default:
+		// 訂閱者的主題過濾器，用來判斷哪些訂閱者應該收到轉發
+		if fanout != nil && msg.toBroker && (mqttPacket.Type == MQTT_SUBSCRIBE || mqttPacket.Type == MQTT_UNSUBSCRIBE) {
+			recordFanoutSubscription(msg)
+		}
+		if debugOn() {
+			log.Printf("[any] %s %s -> %s", mqttPacketTypeName(mqttPacket.Type),
+				joinHostPort(sourceIP, msg.srcPort), joinHostPort(destIP, msg.dstPort))
 		}
 		return
 	}
 
-	// 嘗試解析JSON格式的MQTT消息
-	var data MetricData
-	err := json.Unmarshal(payload, &data)
-	if err != nil {
-		if debugMode {
-			log.Printf("[any] 無法解析MQTT payload為JSON: %v", err)
-			log.Printf("[any] Payload內容: %s", string(payload))
+	// MQTT 5.0 主題別名（每個方向各自維護）
+	topic := msg.conn.resolveTopic(mqttPacket, msg.toBroker)
+
+	// 只統計發往broker的PUBLISH，broker轉發給訂閱者的不重複計算，只用來驗證轉發
+	if !msg.toBroker {
+		if fanout != nil && config.topicAllowed(topic) {
+			recordFanoutDelivery(msg, topic)
+		}
+		if debugOn() {
+			log.Printf("[any] broker轉發 %s -> %s topic=%s", joinHostPort(sourceIP, msg.srcPort), joinHostPort(destIP, msg.dstPort), topic)
 		}
 		return
 	}
+	if !config.topicAllowed(topic) {
+		if debugOn() {
+			log.Printf("[any] 主題 %s 被過濾", topic)
+		}
+		failures.add(failTopicFiltered)
+		return
+	}
+	if textOutput() {
+		fmt.Printf("[MQTT] %s -> %s topic=%s qos=%d retain=%v id=%d\n",
+			sourceIP, joinHostPort(destIP, msg.dstPort), topic, mqttPacket.QoS, mqttPacket.Retain, mqttPacket.PacketID)
+	}
 
-	if data.Imsi != "" {
-		lock.Lock()
-		defer lock.Unlock()
+	// 依擷取規格解析MQTT消息（預設JSON，可依主題指定其他格式）
+	var record *schema.Record
+	payload := mqttPacket.Payload
+	if len(payload) == 0 {
+		if debugOn() {
+			log.Println("[any] MQTT payload為空")
+		}
+		failures.add(failEmptyPayload)
+	} else if parsed, err := payloadSchema.Extract(topic, payload); err != nil {
+		if debugOn() {
+			log.Printf("[any] %v", err)
+			log.Printf("[any] Payload內容: %q", payload)
+		}
+		var decodeErr *schema.DecodeError
+		if errors.As(err, &decodeErr) && decodeErr.Format == schema.FormatJSON {
+			failures.add(failJSON)
+		} else {
+			failures.add(failDecode)
+		}
+	} else {
+		record = parsed
+		if len(record.Mismatches) > 0 {
+			if debugOn() {
+				log.Printf("[any] payload欄位型別不符: %v", record.Mismatches)
+			}
+			failures.add(failSchemaMismatch)
+		}
+	}
+	imsi := ""
+	if record != nil {
+		imsi = record.Imsi
+	}
 
-		destinationIP := ipLayer.DstIP.String()
-		sourceIP := ipLayer.SrcIP.String()
+	// 每個PUBLISH都輸出一筆事件，沒有IMSI時imsi欄位為空
+	if events != nil {
+		events.publish(msg, topic, record)
+	}
 
-		// 初始化该IP的统计
-		if ipStats[destinationIP] == nil {
-			ipStats[destinationIP] = &PacketStats{
-				DestinationIP: destinationIP,
-				SourceIP:      sourceIP,
-				ImsiSet:       make(map[string]bool),
-				Count:         0,
-			}
+	// 統計寫入此工作協程自己的分片，不需要加鎖
+	shard := msg.conn.worker.shard
+
+	// 按客戶端的統計包含沒有IMSI的PUBLISH
+	countSessionPublish(shard, msg, imsi)
+	countTopicPublish(shard, topic, len(payload), imsi)
+	if fanout != nil {
+		recordFanoutInbound(msg, topic, imsi)
+	}
+	if record != nil && payloadSchema.Grouped() {
+		shard.groups.Add(record)
+	}
+
+	if imsi != "" {
+		destinationIP := destIP
+		if recorder != nil {
+			recorder.observeImsi(imsi, msg.timestamp)
+		}
+
+		// 依封包時間戳統計，跨越報告時間的封包算在正確的視窗
+		shard.windows.observe(destinationIP, sourceIP, imsi, msg.timestamp)
+		if shard.arrivals != nil {
+			shard.arrivals[imsi] = append(shard.arrivals[imsi], msg.timestamp)
 		}
 
-		// 更新统计
-		ipStats[destinationIP].ImsiSet[data.Imsi] = true
-		ipStats[destinationIP].Count++
+		if textOutput() {
+			fmt.Printf("[MQTT-IMSI] %s -> %s, IMSI: %s\n", sourceIP, destinationIP, imsi)
+		}
+	}
+}
+
+// MQTT over TLS連線的handshake資訊，每條連線輸出一次
+func handleTLSHandshake(msg *mqttMessage, info *tlsInfo) {
+	client, server := joinHostPort(msg.srcIP, msg.srcPort), joinHostPort(msg.dstIP, msg.dstPort)
+	if !msg.toBroker {
+		client, server = server, client
+	}
+	if exporter != nil {
+		exporter.observeTLS(server, info)
+	}
+	if events != nil {
+		events.tls(msg.timestamp, client, server, info)
+		return
+	}
+	if !textOutput() {
+		return
+	}
 
-		fmt.Printf("[MQTT-IMSI] %s -> %s, IMSI: %s\n", sourceIP, destinationIP, data.Imsi)
+	fmt.Printf("[TLS] %s -> %s sni=%s 版本=%s 加密套件=%s", client, server, info.ServerName, info.versionName(), info.cipherName())
+	if len(info.ALPN) > 0 {
+		fmt.Printf(" alpn=%s", strings.Join(info.ALPN, ","))
 	}
+	if info.CertSubject != "" {
+		fmt.Printf(" 憑證=%q 到期=%s", info.CertSubject, info.CertNotAfter.Format("2006-01-02"))
+		if info.CertNotAfter.Before(msg.timestamp) {
+			fmt.Print("（已過期）")
+		}
+	}
+	if keyLog != nil {
+		fmt.Printf(" 解密=%v", info.KeyFound)
+	}
+	fmt.Println()
 }
 
+// 在統計間隔整數倍的時間輸出報告。下一個報告時間由上一個推算，不會像固定的Sleep一樣累積誤差，
+// 處理太慢錯過的報告時間也會補上。
+// sliding視窗有Prometheus指標時，統計區間之間每個格子結束時也合併一次，發布給指標輸出
 func printAndReset() {
+	step := config.Interval
+	if exporter != nil && windows.kind == windowSliding {
+		step = windows.pane
+	}
+	end := time.Now().Truncate(step)
 	for {
-		time.Sleep(statsInterval)
-
-		lock.Lock()
-		stats := make(map[string]*PacketStats)
-		for ip, stat := range ipStats {
-			stats[ip] = &PacketStats{
-				DestinationIP: stat.DestinationIP,
-				SourceIP:      stat.SourceIP,
-				ImsiSet:       make(map[string]bool),
-				Count:         stat.Count,
-			}
-			// 复制IMSI集合
-			for imsi := range stat.ImsiSet {
-				stats[ip].ImsiSet[imsi] = true
-			}
+		end = end.Add(step)
+		time.Sleep(time.Until(end))
+		if end.Truncate(config.Interval).Equal(end) {
+			emitReport(snapshotAndReset(end))
+		} else {
+			exporter.observeSliding(slidingSnapshot(end))
 		}
+	}
+}
 
-		// 清空当前统计
-		ipStats = make(map[string]*PacketStats)
-		lock.Unlock()
-
-		// 打印统计结果
-		if len(stats) > 0 {
-			fmt.Printf("\n=== %s 統計報告 ===\n", time.Now().Format("2006-01-02 15:04:05"))
-			for ip, stat := range stats {
-				if stat.Count > 0 {
-					fmt.Printf("目標IP: %s\n", ip)
-					fmt.Printf("  封包總數: %d\n", stat.Count)
-					fmt.Printf("  獨立IMSI數量: %d\n", len(stat.ImsiSet))
-					fmt.Printf("  IMSI列表: ")
-					imsiList := make([]string, 0, len(stat.ImsiSet))
-					for imsi := range stat.ImsiSet {
-						imsiList = append(imsiList, imsi)
-					}
-					fmt.Printf("%v\n", imsiList)
-					fmt.Println()
+// sliding視窗到 end 為止的數值，先併入工作協程的分片
+func slidingSnapshot(end time.Time) *WindowReport {
+	collectShards()
+	lock.Lock()
+	defer lock.Unlock()
+	report := &WindowReport{End: end}
+	report.Start, report.Stats = windows.window(end)
+	return report
+}
+
+// 把一個統計區間的報告送往所有輸出
+func emitReport(report *WindowReport) {
+	if events != nil {
+		events.window(report)
+	}
+	switch {
+	case ui != nil:
+		ui.window(report)
+	case events == nil:
+		printReport(report)
+	}
+	warnCaptureLoss(report)
+	if pcapOut != nil {
+		pcapOut.flush()
+	}
+	if recorder != nil {
+		recorder.observeWindow(report)
+	}
+	if exporter != nil {
+		exporter.observeWindow(report)
+	}
+	if report.Roster != nil && len(report.Roster.Alerts) > 0 {
+		rosterAlert(report)
+	}
+}
+
+// 名單中有IMSI連續缺席達到門檻：送出webhook，指定 -roster-exit 時以非0代碼結束
+func rosterAlert(report *WindowReport) {
+	log.Printf("!!! 警告: %d 個IMSI已連續 %d 個區間沒有出現: %s",
+		len(report.Roster.Alerts), report.Roster.Threshold, strings.Join(report.Roster.Alerts, ", "))
+	if config.RosterWebhook != "" {
+		alert := roster.NewAlert("getMqtt", report.End, report.Roster)
+		if err := roster.Notify(config.RosterWebhook, alert); err != nil {
+			log.Printf("無法送出名單告警到 %s: %v", config.RosterWebhook, err)
+		}
+	}
+	if config.RosterExit {
+		if ui != nil {
+			ui.close()
+		}
+		if events != nil {
+			events.close()
+		}
+		closePcapOutputs()
+		os.Exit(rosterExitCode)
+	}
+}
+
+// 取出結束於 windowEnd 的視窗統計，其他統計取出後清空，供報告使用
+func snapshotAndReset(windowEnd time.Time) *WindowReport {
+	report := &WindowReport{End: windowEnd}
+	if captures != nil {
+		report.Interfaces, report.Capture = captures.snapshot()
+	}
+	report.Failures = failures.snapshot()
+	// 換出工作協程的分片，之後才處理到的封包算在下一個區間
+	collectShards()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	report.Start, report.Stats = windows.window(windowEnd)
+	report.Published = windows.advance(windowEnd)
+	report.Clients = snapshotClients()
+	report.Topics, report.Patterns = snapshotTopics()
+	report.Groups = payloadGroups.Snapshot()
+	if rosterTracker != nil {
+		var seen []string
+		for _, stat := range report.Stats {
+			seen = append(seen, stat.ImsiSet.Members()...)
+		}
+		report.Roster = rosterTracker.Observe(seen)
+	}
+	if cadence != nil {
+		report.Cadence = cadence.snapshot(windowEnd)
+	}
+	if fanout != nil {
+		report.Fanout = fanout.snapshot(windowEnd)
+	}
+	return report
+}
+
+// 打印一個統計區間的結果
+func printReport(report *WindowReport) {
+	stats := report.Stats
+	if len(stats) > 0 {
+		fmt.Printf("\n=== %s 統計報告 ===\n", report.End.Format("2006-01-02 15:04:05"))
+		if windows.kind != windowTumbling {
+			fmt.Printf("%s視窗: %s - %s\n", windows.kind, report.Start.Format("15:04:05"), report.End.Format("15:04:05"))
+		}
+		fmt.Printf("獨立IMSI計算: %s\n", distinct.Describe(config.imsiPrecision()))
+		for ip, stat := range stats {
+			if stat.Count > 0 {
+				fmt.Printf("目標IP: %s\n", ip)
+				fmt.Printf("  封包總數: %d\n", stat.Count)
+				fmt.Printf("  速率: %.2f 封包/秒\n", report.rate(stat))
+				if stat.ImsiSet.Approximate() {
+					// 近似模式沒有保存IMSI，不列出
+					fmt.Printf("  獨立IMSI數量: ~%d\n", stat.ImsiSet.Len())
+				} else {
+					fmt.Printf("  獨立IMSI數量: %d\n", stat.ImsiSet.Len())
+					fmt.Printf("  IMSI列表: %v\n", stat.ImsiSet.Members())
 				}
+				fmt.Println()
 			}
-		} else {
-			fmt.Printf("\n[%s] 這%d秒沒有捕獲到MQTT封包\n",
-				time.Now().Format("15:04:05"),
-				int(statsInterval.Seconds()))
+		}
+	} else {
+		fmt.Printf("\n[%s] 這%d秒沒有捕獲到MQTT封包\n",
+			report.End.Format("15:04:05"),
+			int(report.End.Sub(report.Start).Seconds()))
+	}
+
+	if report.Roster != nil {
+		roster.Print(os.Stdout, report.Roster)
+	}
+	if report.Cadence != nil {
+		printCadence(report.Cadence)
+	}
+	if report.Fanout != nil {
+		printFanout(report.Fanout)
+	}
+	schema.Print(os.Stdout, payloadSchema, report.Groups)
+	printTopicReport(report.Topics, report.Patterns)
+	printClientReport(report.Clients)
+
+	if len(report.Interfaces) > 0 {
+		fmt.Printf("各介面抓包統計:\n")
+		for _, name := range sortedKeys(report.Interfaces) {
+			stats := report.Capture[name]
+			fmt.Printf("  %s: 捕獲 %d  收到 %d  丟棄 %d  網卡丟棄 %d  遺失 %.2f%%\n",
+				name, report.Interfaces[name], stats.Received, stats.Dropped, stats.IfDropped, stats.lossRatio()*100)
+		}
+	}
+	if len(report.Failures) > 0 {
+		fmt.Printf("未統計的封包:\n")
+		for _, reason := range sortedKeys(report.Failures) {
+			fmt.Printf("  %s（%s）: %d\n", reason, failureDescriptions[reason], report.Failures[reason])
+		}
+	}
+}
+
+// 本區間抓包遺失超過門檻時在stderr輸出醒目的警告，遺失的封包中的IMSI不會被統計
+func warnCaptureLoss(report *WindowReport) {
+	if config.LossThreshold <= 0 {
+		return
+	}
+	total := report.captureTotal()
+	if total.lossRatio()*100 < config.LossThreshold {
+		return
+	}
+	log.Printf("!!! 警告: %s 的區間抓包遺失 %.2f%%（%d 個封包被丟棄，門檻 %.2f%%），獨立IMSI數可能偏低 !!!",
+		report.End.Format("15:04:05"), total.lossRatio()*100, total.lost(), config.LossThreshold)
+	for _, name := range sortedKeys(report.Capture) {
+		if stats := report.Capture[name]; stats.lost() > 0 {
+			log.Printf("!!!   %s: 收到 %d  丟棄 %d  網卡丟棄 %d  遺失 %.2f%%",
+				name, stats.Received, stats.Dropped, stats.IfDropped, stats.lossRatio()*100)
 		}
 	}
 }
 
 func main() {
-	fmt.Println("MQTT封包監控工具 (所有MQTT版本)")
-	fmt.Println("================================")
+	cfg, files, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal("配置錯誤: ", err)
+	}
+	config = cfg
+	debugMode.Store(config.Debug)
+	if config.TUI && len(files) > 0 {
+		log.Fatal("配置錯誤: TUI模式只支援即時抓包")
+	}
+	windows = newWindowEngine(&config, time.Now())
+	if err := setupOutput(&config); err != nil {
+		log.Fatal("輸出設定錯誤: ", err)
+	}
+	if events != nil {
+		defer events.close()
+	}
+
+	fmt.Fprintln(infoOut, "MQTT封包監控工具 (所有MQTT版本)")
+	fmt.Fprintln(infoOut, "================================")
+
+	if config.KeyLogFile != "" {
+		if keyLog, err = loadKeyLog(config.KeyLogFile); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(infoOut, "已載入key log %s（%d 條TLS連線）\n", config.KeyLogFile, keyLog.count())
+	}
+
+	if config.SchemaFile != "" {
+		if payloadSchema, err = schema.Load(config.SchemaFile); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(infoOut, "已載入擷取規格 %s（分組鍵 %d 個，數值欄位 %d 個）\n", config.SchemaFile,
+			len(payloadSchema.Keys()), len(payloadSchema.Values()))
+	}
+	payloadGroups = schema.NewAggregator(payloadSchema, config.imsiPrecision())
+	if config.Roster != "" {
+		expected, err := roster.Load(config.Roster)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rosterTracker = roster.NewTracker(expected, config.RosterAbsent)
+		if config.RosterAbsent > 0 {
+			fmt.Fprintf(infoOut, "已載入IMSI名單（%d 個IMSI，連續 %d 個區間缺席時告警）\n", expected.Len(), config.RosterAbsent)
+		} else {
+			fmt.Fprintf(infoOut, "已載入IMSI名單（%d 個IMSI）\n", expected.Len())
+		}
+	}
+	if len(config.Topics) > 0 || len(config.ExcludeTopics) > 0 {
+		fmt.Fprintf(infoOut, "主題過濾: 包含 %s  排除 %s\n", topicListString(config.Topics, "全部"), topicListString(config.ExcludeTopics, "無"))
+	}
+	if config.ImsiPeriod > 0 {
+		cadence = newCadenceTracker(config.ImsiPeriod, config.ImsiGapPeriods, config.ImsiDupRatio)
+		fmt.Fprintf(infoOut, "IMSI回報週期: %v（間隔小於 %v 為重複，超過 %v 為中斷）\n",
+			config.ImsiPeriod, cadence.duplicateBelow, cadence.gapAbove)
+	}
+	if config.FanoutTimeout > 0 {
+		fanout = newFanoutCorrelator(config.FanoutTimeout)
+		fmt.Fprintf(infoOut, "驗證broker轉發: PUBLISH送出後 %v 內沒有轉發給訂閱者算遺失\n", config.FanoutTimeout)
+	}
+	if err := setupPcapOutputs(); err != nil {
+		log.Fatal(err)
+	}
+	defer closePcapOutputs()
+	pipeline = newPacketPipeline(config.Workers)
+
+	// 指定了pcap檔案時離線分析，不需要root權限
+	if len(files) > 0 {
+		replayPcapFiles(files)
+		return
+	}
 
 	// 檢查是否為root權限
 	if os.Geteuid() != 0 {
-		fmt.Println("警告: 此程序需要root權限來捕獲網路封包")
-		fmt.Println("請使用 sudo 運行此程序")
+		fmt.Fprintln(infoOut, "警告: 此程序需要root權限來捕獲網路封包")
+		fmt.Fprintln(infoOut, "請使用 sudo 運行此程序")
 		os.Exit(1)
 	}
 
-	fmt.Println("開始監控所有MQTT封包...")
+	// TUI在其他協程啟動前建立，之後的狀態訊息和log都顯示在TUI中
+	if config.TUI {
+		if ui, err = startTUI(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if config.MetricsAddr != "" {
+		exporter = newMetricsExporter()
+		go exporter.serve(config.MetricsAddr)
+	}
+
+	fmt.Fprintln(infoOut, "開始監控所有MQTT封包...")
+
+	// 抓包管理器在報告協程啟動前建立，報告時才能取得各介面的統計
+	captures = newCaptureManager(config.Interfaces)
+	if ui != nil {
+		go ui.run()
+	}
 
 	// 啟動統計報告協程
 	go printAndReset()
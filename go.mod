@@ -4,9 +4,11 @@ go 1.21
 
 replace bitbucket.org/free5GC/util => ../util
 
-require github.com/google/gopacket v1.1.19
-
 require (
-	golang.org/x/net v0.8.0 // indirect
-	golang.org/x/sys v0.6.0 // indirect
+	github.com/google/gopacket v1.1.19
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.33.0
+	golang.org/x/sys v0.28.0
+	google.golang.org/protobuf v1.34.1
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// RFC 8200：第一個分片到達後60秒內未到齊則放棄
+	ipv6FragmentTimeout = 60 * time.Second
+	// 單一封包最多接受的分片數，避免被異常流量耗盡記憶體
+	maxIPv6Fragments = 64
+	// 同時等待重組的封包數上限
+	maxIPv6Reassemblies = 1024
+)
+
+type ipv6FragmentKey struct {
+	src, dst [16]byte
+	id       uint32
+}
+
+type ipv6Fragment struct {
+	offset int
+	data   []byte
+}
+
+// 一個等待重組的IPv6封包
+type ipv6FragmentList struct {
+	first      time.Time
+	header     []byte            // 最後收到的分片的IPv6固定標頭
+	nextHeader layers.IPProtocol // 偏移0的分片記錄的上層協議
+	haveFirst  bool
+	total      int // 收到最後一個分片前為-1
+	fragments  []ipv6Fragment
+}
+
+// IPv6分片重組。IPv6只在來源端分片，重組後的封包交回原本的處理流程。
+// 只在分派封包的協程中使用，不需要加鎖。
+type ipv6Defragmenter struct {
+	lists     map[ipv6FragmentKey]*ipv6FragmentList
+	lastSweep time.Time
+}
+
+func newIPv6Defragmenter() *ipv6Defragmenter {
+	return &ipv6Defragmenter{lists: make(map[ipv6FragmentKey]*ipv6FragmentList)}
+}
+
+// 加入一個分片。封包到齊時回傳重組後的封包，否則回傳nil。
+func (d *ipv6Defragmenter) defrag(packet gopacket.Packet, ip *layers.IPv6, frag *layers.IPv6Fragment) gopacket.Packet {
+	ci := packet.Metadata().CaptureInfo
+	d.sweep(ci.Timestamp)
+
+	key := ipv6FragmentKey{id: frag.Identification}
+	copy(key.src[:], ip.SrcIP.To16())
+	copy(key.dst[:], ip.DstIP.To16())
+
+	list := d.lists[key]
+	if list == nil {
+		if len(d.lists) >= maxIPv6Reassemblies {
+			failures.add(failFragmentDropped)
+			return nil
+		}
+		list = &ipv6FragmentList{first: ci.Timestamp, total: -1}
+		d.lists[key] = list
+	}
+
+	piece := ipv6Fragment{offset: int(frag.FragmentOffset) * 8, data: append([]byte(nil), frag.Payload...)}
+	end := piece.offset + len(piece.data)
+	for _, f := range list.fragments {
+		if f.offset == piece.offset && len(f.data) == len(piece.data) {
+			// 重複收到（例如同一封包出現在多個介面）
+			return nil
+		}
+		// RFC 5722：重疊的分片整個封包丟棄
+		if piece.offset < f.offset+len(f.data) && f.offset < end {
+			d.drop(key, "分片重疊")
+			return nil
+		}
+	}
+	if len(list.fragments) >= maxIPv6Fragments || end > 0xffff || (list.total >= 0 && end > list.total) {
+		d.drop(key, "分片數量或長度異常")
+		return nil
+	}
+
+	list.fragments = append(list.fragments, piece)
+	list.header = append(list.header[:0], ip.Contents[:40]...)
+	if piece.offset == 0 {
+		list.haveFirst = true
+		list.nextHeader = frag.NextHeader
+	}
+	if !frag.MoreFragments {
+		list.total = end
+	}
+	if !list.complete() {
+		return nil
+	}
+	delete(d.lists, key)
+	return list.assemble(ci)
+}
+
+func (l *ipv6FragmentList) complete() bool {
+	if !l.haveFirst || l.total < 0 {
+		return false
+	}
+	sort.Slice(l.fragments, func(i, j int) bool { return l.fragments[i].offset < l.fragments[j].offset })
+	next := 0
+	for _, f := range l.fragments {
+		if f.offset != next {
+			return false
+		}
+		next += len(f.data)
+	}
+	return next == l.total
+}
+
+// 以固定標頭加上重組後的資料建立新封包，不可分片部分的延伸標頭不保留
+func (l *ipv6FragmentList) assemble(ci gopacket.CaptureInfo) gopacket.Packet {
+	data := make([]byte, 40, 40+l.total)
+	copy(data, l.header[:40])
+	binary.BigEndian.PutUint16(data[4:6], uint16(l.total))
+	data[6] = byte(l.nextHeader)
+	for _, f := range l.fragments {
+		data = append(data, f.data...)
+	}
+
+	packet := gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.Default)
+	ci.CaptureLength = len(data)
+	ci.Length = len(data)
+	packet.Metadata().CaptureInfo = ci
+	return packet
+}
+
+func (d *ipv6Defragmenter) drop(key ipv6FragmentKey, reason string) {
+	if debugOn() {
+		log.Printf("[any] IPv6分片 id=%d %s，丟棄", key.id, reason)
+	}
+	delete(d.lists, key)
+	failures.add(failFragmentDropped)
+}
+
+// 清除逾時未到齊的封包，now 為封包時間
+func (d *ipv6Defragmenter) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < time.Second {
+		return
+	}
+	d.lastSweep = now
+	for key, list := range d.lists {
+		if now.Sub(list.first) > ipv6FragmentTimeout {
+			d.drop(key, "重組逾時")
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// 一個IPv6分片：固定標頭、分片標頭和分片資料
+func ipv6FragmentPacket(src, dst net.IP, id uint32, offset int, more bool, data []byte, ts time.Time) gopacket.Packet {
+	b := make([]byte, 48, 48+len(data))
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:6], uint16(8+len(data)))
+	b[6] = byte(layers.IPProtocolIPv6Fragment)
+	b[7] = 64
+	copy(b[8:24], src.To16())
+	copy(b[24:40], dst.To16())
+	b[40] = byte(layers.IPProtocolTCP)
+	flags := uint16(offset/8) << 3
+	if more {
+		flags |= 1
+	}
+	binary.BigEndian.PutUint16(b[42:44], flags)
+	binary.BigEndian.PutUint32(b[44:48], id)
+	b = append(b, data...)
+	packet := gopacket.NewPacket(b, layers.LayerTypeIPv6, gopacket.Default)
+	packet.Metadata().CaptureInfo = gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(b), Length: len(b)}
+	return packet
+}
+
+func feedFragment(d *ipv6Defragmenter, packet gopacket.Packet) gopacket.Packet {
+	ip := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	frag := packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment)
+	return d.defrag(packet, ip, frag)
+}
+
+// 一個帶MQTT PUBLISH的IPv6 TCP段，切成每片64位元組的分片
+type ipv6FragmentSet struct {
+	src, dst net.IP
+	segment  []byte // 原本的TCP標頭和payload
+	mqtt     []byte
+}
+
+func newIPv6FragmentSet(t0 time.Time) ipv6FragmentSet {
+	mqtt := testPublish("t/usage", `{"imsi":"208930000000001","pad":"`+strings.Repeat("x", 150)+`"}`)
+	packet := testSegment(net.IP{10, 0, 0, 1}, net.ParseIP("fd00::153"), 40001, 1883, 1, mqtt, t0)
+	ip := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	return ipv6FragmentSet{src: ip.SrcIP, dst: ip.DstIP, segment: ip.Payload, mqtt: mqtt}
+}
+
+// 第 i 片（每片64位元組），最後一片不設More Fragments
+func (s ipv6FragmentSet) piece(id uint32, i int, ts time.Time) gopacket.Packet {
+	const size = 64
+	start := i * size
+	end := min(start+size, len(s.segment))
+	return ipv6FragmentPacket(s.src, s.dst, id, start, end < len(s.segment), s.segment[start:end], ts)
+}
+
+func (s ipv6FragmentSet) count() int {
+	return (len(s.segment) + 63) / 64
+}
+
+// 檢查重組後的封包是原本的TCP段
+func (s ipv6FragmentSet) check(t *testing.T, name string, packet gopacket.Packet, ts time.Time) {
+	t.Helper()
+	if packet == nil {
+		t.Fatalf("%s: 沒有重組出封包", name)
+	}
+	ip, _ := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if ip == nil || tcp == nil {
+		t.Fatalf("%s: 無法解碼重組後的封包 %v", name, packet)
+	}
+	if !ip.SrcIP.Equal(s.src) || !ip.DstIP.Equal(s.dst) || int(ip.Length) != len(s.segment) {
+		t.Errorf("%s: %v -> %v 長度 %d", name, ip.SrcIP, ip.DstIP, ip.Length)
+	}
+	if !bytes.Equal(ip.Payload, s.segment) || !bytes.Equal(tcp.Payload, s.mqtt) {
+		t.Errorf("%s: TCP payload %x，應為 %x", name, tcp.Payload, s.mqtt)
+	}
+	if !packet.Metadata().Timestamp.Equal(ts) {
+		t.Errorf("%s: 時間 %v，應為最後一個分片的 %v", name, packet.Metadata().Timestamp, ts)
+	}
+}
+
+func TestIPv6Defrag(t *testing.T) {
+	t0 := time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)
+	set := newIPv6FragmentSet(t0)
+	if set.count() != 4 {
+		t.Fatalf("%d 個分片，應為 4", set.count())
+	}
+	last := set.count() - 1
+
+	tests := []struct {
+		name  string
+		order []int
+	}{
+		{"依序", []int{0, 1, 2, last}},
+		{"最後一片先到", []int{last, 2, 1, 0}},
+		{"亂序", []int{2, 0, last, 1}},
+		{"重複的分片", []int{0, 1, 1, 2, 0, last}},
+	}
+	for _, tt := range tests {
+		d := newIPv6Defragmenter()
+		before := failures.totals()[failFragmentDropped]
+		var got gopacket.Packet
+		var ts time.Time
+		for i, n := range tt.order {
+			if got != nil {
+				t.Fatalf("%s: 第 %d 個分片前已重組完成", tt.name, i)
+			}
+			ts = t0.Add(time.Duration(i) * time.Millisecond)
+			got = feedFragment(d, set.piece(7, n, ts))
+		}
+		set.check(t, tt.name, got, ts)
+		if len(d.lists) != 0 {
+			t.Errorf("%s: 重組後還有 %d 個等待中的封包", tt.name, len(d.lists))
+		}
+		if after := failures.totals()[failFragmentDropped]; after != before {
+			t.Errorf("%s: 丟棄 %d 個封包", tt.name, after-before)
+		}
+	}
+
+	// 不同來源或ID的分片各自重組
+	d := newIPv6Defragmenter()
+	other := set
+	other.src = net.ParseIP("fd00::2")
+	for i := 0; i < last; i++ {
+		feedFragment(d, set.piece(1, i, t0))
+		feedFragment(d, other.piece(1, i, t0))
+		feedFragment(d, set.piece(2, i, t0))
+	}
+	if len(d.lists) != 3 {
+		t.Fatalf("等待中的封包 %d，應為 3", len(d.lists))
+	}
+	ts := t0.Add(time.Millisecond)
+	set.check(t, "ID 1", feedFragment(d, set.piece(1, last, ts)), ts)
+	set.check(t, "ID 2", feedFragment(d, set.piece(2, last, ts)), ts)
+}
+
+func TestIPv6DefragDrop(t *testing.T) {
+	t0 := time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)
+	set := newIPv6FragmentSet(t0)
+	last := set.count() - 1
+	segment := set.segment
+
+	tests := []struct {
+		name      string
+		fragments []gopacket.Packet
+	}{
+		{
+			// RFC 5722：重疊的分片整個封包丟棄
+			"重疊",
+			[]gopacket.Packet{
+				set.piece(7, 0, t0),
+				ipv6FragmentPacket(set.src, set.dst, 7, 32, true, segment[32:96], t0),
+			},
+		},
+		{
+			"長度相同但偏移不同的重疊",
+			[]gopacket.Packet{
+				set.piece(7, 1, t0),
+				ipv6FragmentPacket(set.src, set.dst, 7, 72, true, segment[72:136], t0),
+			},
+		},
+		{
+			"超過最後一個分片的結尾",
+			[]gopacket.Packet{
+				set.piece(7, last, t0),
+				ipv6FragmentPacket(set.src, set.dst, 7, (len(segment)+15)/8*8, true, make([]byte, 8), t0),
+			},
+		},
+		{
+			"超過65535位元組",
+			[]gopacket.Packet{
+				ipv6FragmentPacket(set.src, set.dst, 7, 0xfff8, true, make([]byte, 16), t0),
+			},
+		},
+	}
+	for _, tt := range tests {
+		d := newIPv6Defragmenter()
+		before := failures.totals()[failFragmentDropped]
+		for _, packet := range tt.fragments {
+			if got := feedFragment(d, packet); got != nil {
+				t.Errorf("%s: 不應重組出封包", tt.name)
+			}
+		}
+		if len(d.lists) != 0 {
+			t.Errorf("%s: 應丟棄整個封包，還有 %d 個等待中", tt.name, len(d.lists))
+		}
+		if after := failures.totals()[failFragmentDropped]; after != before+1 {
+			t.Errorf("%s: 丟棄計數 %d，應為 %d", tt.name, after, before+1)
+		}
+	}
+
+	// 丟棄後剩下的分片重新開始等待，不會組出少了資料的封包
+	d := newIPv6Defragmenter()
+	feedFragment(d, set.piece(7, 0, t0))
+	feedFragment(d, ipv6FragmentPacket(set.src, set.dst, 7, 32, true, segment[32:96], t0))
+	for i := 1; i <= last; i++ {
+		if got := feedFragment(d, set.piece(7, i, t0)); got != nil {
+			t.Fatal("丟棄後不應重組出封包")
+		}
+	}
+
+	// 分片數量上限
+	d = newIPv6Defragmenter()
+	before := failures.totals()[failFragmentDropped]
+	for i := 0; i <= maxIPv6Fragments; i++ {
+		feedFragment(d, ipv6FragmentPacket(set.src, set.dst, 9, 8+i*8, true, make([]byte, 8), t0))
+	}
+	if len(d.lists) != 0 || failures.totals()[failFragmentDropped] != before+1 {
+		t.Errorf("超過 %d 個分片應丟棄整個封包", maxIPv6Fragments)
+	}
+}
+
+func TestIPv6DefragTimeout(t *testing.T) {
+	t0 := time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)
+	set := newIPv6FragmentSet(t0)
+	last := set.count() - 1
+	d := newIPv6Defragmenter()
+	before := failures.totals()[failFragmentDropped]
+
+	feedFragment(d, set.piece(1, 0, t0))
+	feedFragment(d, set.piece(2, 0, t0.Add(30*time.Second)))
+	// 剛好60秒還不算逾時
+	feedFragment(d, set.piece(3, 0, t0.Add(ipv6FragmentTimeout)))
+	if len(d.lists) != 3 {
+		t.Fatalf("等待中的封包 %d，應為 3", len(d.lists))
+	}
+
+	// 下一個分片的時間超過第一個封包的期限，只清除它
+	ts := t0.Add(ipv6FragmentTimeout + 2*time.Second)
+	feedFragment(d, set.piece(2, 1, ts))
+	if _, ok := d.lists[ipv6FragmentKey{id: 1, src: [16]byte(set.src.To16()), dst: [16]byte(set.dst.To16())}]; ok {
+		t.Error("逾時的封包應被清除")
+	}
+	if len(d.lists) != 2 {
+		t.Errorf("等待中的封包 %d，應為 2", len(d.lists))
+	}
+	if after := failures.totals()[failFragmentDropped]; after != before+1 {
+		t.Errorf("丟棄計數 %d，應為 %d", after, before+1)
+	}
+
+	// 逾時的封包之後的分片不會組出封包
+	for i := 1; i <= last; i++ {
+		if got := feedFragment(d, set.piece(1, i, ts)); got != nil {
+			t.Fatal("逾時後不應重組出封包")
+		}
+	}
+	// 沒有逾時的封包照常重組
+	for i := 2; i < last; i++ {
+		feedFragment(d, set.piece(2, i, ts))
+	}
+	set.check(t, "未逾時", feedFragment(d, set.piece(2, last, ts)), ts)
+}
+
+func TestIPv6DefragLimit(t *testing.T) {
+	t0 := time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)
+	set := newIPv6FragmentSet(t0)
+	d := newIPv6Defragmenter()
+	for id := 0; id < maxIPv6Reassemblies; id++ {
+		feedFragment(d, set.piece(uint32(id), 0, t0))
+	}
+	before := failures.totals()[failFragmentDropped]
+	if got := feedFragment(d, set.piece(maxIPv6Reassemblies, 0, t0)); got != nil || len(d.lists) != maxIPv6Reassemblies {
+		t.Errorf("超過上限時應丟棄新的封包，等待中 %d", len(d.lists))
+	}
+	if after := failures.totals()[failFragmentDropped]; after != before+1 {
+		t.Errorf("丟棄計數 %d，應為 %d", after, before+1)
+	}
+	// 已在等待中的封包不受影響
+	var got gopacket.Packet
+	for i := 1; i < set.count(); i++ {
+		got = feedFragment(d, set.piece(0, i, t0))
+	}
+	set.check(t, "上限", got, t0)
+	if len(d.lists) != maxIPv6Reassemblies-1 {
+		t.Errorf("等待中 %d，應為 %d", len(d.lists), maxIPv6Reassemblies-1)
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"getMqtt/roster"
+	"getMqtt/schema"
+)
+
+// 以Prometheus文字格式輸出的指標。
+// 計數器在每個統計區間結束時累加，量規為最近一個視窗的數值；sliding視窗的按目標IP量規在每個格子結束時更新。
+type metricsExporter struct {
+	mu sync.Mutex
+
+	publishTotal  map[string]uint64  // 按目標IP累計的PUBLISH數
+	windowPackets map[string]int     // 最近一個視窗按目標IP的PUBLISH數
+	windowImsi    map[string]int     // 最近一個視窗按目標IP的獨立IMSI數
+	windowRate    map[string]float64 // 最近一個視窗按目標IP每秒的PUBLISH數
+	windowLoss    map[string]float64 // 最近一個區間各介面的抓包遺失比例
+	roster        *roster.Result     // 最近一個區間和IMSI名單的比對，沒有名單時為nil
+	rosterAlerts  uint64             // 累計連續缺席達到門檻的次數
+	cadence       *cadenceReport     // 最近一個區間的回報週期摘要，沒有啟用時為nil
+	duplicates    uint64             // 累計重複回報的次數
+	gaps          uint64             // 累計回報中斷的次數
+	windowEnd     time.Time
+	windows       uint64
+
+	activeSessions int               // 最近一個區間結束時的連線中session數
+	sessionEnds    map[string]uint64 // 按結果（normal/abnormal）累計結束的session數
+
+	qosTotals  map[[2]string]*qosStats        // 按 (client ID, 方向) 累計的QoS 1/2統計，不含延遲
+	qosLatency map[[2]string]*durationSummary // 最近一個區間按 (方向, QoS) 的確認延遲
+
+	fanout            *fanoutReport                      // 最近一個區間的broker轉發結果，沒有啟用時為nil
+	fanoutSubscribers map[string]*fanoutSubscriberReport // 按訂閱者累計的轉發數，不含延遲和IMSI
+	fanoutMessages    uint64                             // 累計判斷的PUBLISH數
+	fanoutNoSub       uint64                             // 累計沒有任何訂閱者的PUBLISH數
+	fanoutUnmatched   uint64                             // 累計找不到來源PUBLISH的轉發數
+
+	groups []*schema.Group // 最近一個區間按擷取規格分組的彙總
+
+	topics   map[string]*TopicStats // 最近一個區間按主題的統計
+	patterns map[string]*TopicStats // 最近一個區間按主題樣式的統計
+
+	tlsHandshakes map[[2]string]uint64    // 按 (TLS版本, 加密套件) 累計的handshake數
+	certExpiry    map[[2]string]time.Time // 按 (broker位址, 憑證主體) 的憑證到期時間
+}
+
+func newMetricsExporter() *metricsExporter {
+	return &metricsExporter{
+		publishTotal:      make(map[string]uint64),
+		windowPackets:     make(map[string]int),
+		windowImsi:        make(map[string]int),
+		windowRate:        make(map[string]float64),
+		sessionEnds:       make(map[string]uint64),
+		qosTotals:         make(map[[2]string]*qosStats),
+		fanoutSubscribers: make(map[string]*fanoutSubscriberReport),
+		tlsHandshakes:     make(map[[2]string]uint64),
+		certExpiry:        make(map[[2]string]time.Time),
+	}
+}
+
+// 統計區間結束時更新指標
+func (e *metricsExporter) observeWindow(report *WindowReport) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for ip, count := range report.Published {
+		e.publishTotal[ip] += uint64(count)
+	}
+	e.setWindow(report)
+	e.activeSessions = 0
+	e.observeQoS(report.Clients)
+	for _, client := range report.Clients {
+		e.activeSessions += client.Active
+		for _, end := range client.Ended {
+			if end.Abnormal {
+				e.sessionEnds["abnormal"]++
+			} else {
+				e.sessionEnds["normal"]++
+			}
+		}
+	}
+	e.groups = report.Groups
+	e.topics, e.patterns = report.Topics, report.Patterns
+	e.windowLoss = make(map[string]float64, len(report.Capture))
+	for name, stats := range report.Capture {
+		e.windowLoss[name] = stats.lossRatio()
+	}
+	if report.Roster != nil {
+		e.roster = report.Roster
+		e.rosterAlerts += uint64(len(report.Roster.Alerts))
+	}
+	if report.Cadence != nil {
+		e.cadence = report.Cadence
+		e.duplicates += uint64(report.Cadence.Duplicates)
+		e.gaps += uint64(report.Cadence.Gaps)
+	}
+	if report.Fanout != nil {
+		e.observeFanout(report.Fanout)
+	}
+	e.windowEnd = report.End
+	e.windows++
+}
+
+// 累計broker轉發的計數
+func (e *metricsExporter) observeFanout(report *fanoutReport) {
+	e.fanout = report
+	e.fanoutMessages += uint64(report.Messages)
+	e.fanoutNoSub += uint64(report.NoSubscriber)
+	e.fanoutUnmatched += uint64(report.Unmatched)
+	for _, sub := range report.Subscribers {
+		total := e.fanoutSubscribers[sub.Subscriber]
+		if total == nil {
+			total = &fanoutSubscriberReport{Subscriber: sub.Subscriber}
+			e.fanoutSubscribers[sub.Subscriber] = total
+		}
+		total.Expected += sub.Expected
+		total.Delivered += sub.Delivered
+		total.Lost += sub.Lost
+	}
+}
+
+// 累計各客戶端的QoS計數，並計算本區間所有客戶端的確認延遲
+func (e *metricsExporter) observeQoS(clients map[string]*ClientStats) {
+	var latencies [2][2][]float64
+	for key, client := range clients {
+		for dir := range client.QoS {
+			s := client.QoS[dir]
+			if s.empty() {
+				continue
+			}
+			total := e.qosTotals[[2]string{key, qosDirectionLabels[dir]}]
+			if total == nil {
+				total = &qosStats{}
+				e.qosTotals[[2]string{key, qosDirectionLabels[dir]}] = total
+			}
+			for i := range s.latencies {
+				latencies[dir][i] = append(latencies[dir][i], s.latencies[i]...)
+			}
+			s.latencies = [2][]float64{}
+			total.merge(&s)
+		}
+	}
+	e.qosLatency = make(map[[2]string]*durationSummary)
+	for dir := range latencies {
+		for i := range latencies[dir] {
+			if summary := newDurationSummary(latencies[dir][i]); summary != nil {
+				e.qosLatency[[2]string{qosDirectionLabels[dir], fmt.Sprint(i + 1)}] = summary
+			}
+		}
+	}
+}
+
+// 更新按目標IP的視窗量規
+func (e *metricsExporter) setWindow(report *WindowReport) {
+	e.windowPackets = make(map[string]int, len(report.Stats))
+	e.windowImsi = make(map[string]int, len(report.Stats))
+	e.windowRate = make(map[string]float64, len(report.Stats))
+	for ip, stat := range report.Stats {
+		e.windowPackets[ip] = stat.Count
+		e.windowImsi[ip] = stat.ImsiSet.Len()
+		e.windowRate[ip] = report.rate(stat)
+	}
+}
+
+// 每個TLS handshake結束時更新指標
+func (e *metricsExporter) observeTLS(server string, info *tlsInfo) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.tlsHandshakes[[2]string{info.versionName(), info.cipherName()}]++
+	if info.CertSubject != "" {
+		e.certExpiry[[2]string{server, info.CertSubject}] = info.CertNotAfter
+	}
+}
+
+func (e *metricsExporter) serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	fmt.Fprintf(infoOut, "Prometheus指標: http://%s/metrics\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		if ui != nil {
+			ui.close()
+		}
+		log.Fatalf("無法啟動指標服務 %s: %v", addr, err)
+	}
+}
+
+func (e *metricsExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.write(w)
+}
+
+// sliding視窗在統計區間之間的格子結束時，更新按目標IP的視窗量規
+func (e *metricsExporter) observeSliding(report *WindowReport) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.setWindow(report)
+}
+
+// 只輸出報告協程發布的數值，抓取時不存取統計
+func (e *metricsExporter) write(w io.Writer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	writeMetricHeader(w, "mqtt_sniffer_publish_packets_total", "counter", "帶IMSI的PUBLISH數量（按目標IP累計）")
+	for _, ip := range sortedKeys(e.publishTotal) {
+		fmt.Fprintf(w, "mqtt_sniffer_publish_packets_total{destination_ip=%s} %d\n", quoteLabel(ip), e.publishTotal[ip])
+	}
+
+	writeMetricHeader(w, "mqtt_sniffer_window_publish_packets", "gauge", "最近一個統計區間帶IMSI的PUBLISH數量")
+	for _, ip := range sortedKeys(e.windowPackets) {
+		fmt.Fprintf(w, "mqtt_sniffer_window_publish_packets{destination_ip=%s} %d\n", quoteLabel(ip), e.windowPackets[ip])
+	}
+
+	writeMetricHeader(w, "mqtt_sniffer_window_distinct_imsi", "gauge", "最近一個統計區間的獨立IMSI數量")
+	for _, ip := range sortedKeys(e.windowImsi) {
+		fmt.Fprintf(w, "mqtt_sniffer_window_distinct_imsi{destination_ip=%s} %d\n", quoteLabel(ip), e.windowImsi[ip])
+	}
+
+	writeMetricHeader(w, "mqtt_sniffer_window_publish_rate", "gauge", "最近一個統計視窗每秒帶IMSI的PUBLISH數量")
+	for _, ip := range sortedKeys(e.windowRate) {
+		fmt.Fprintf(w, "mqtt_sniffer_window_publish_rate{destination_ip=%s} %g\n", quoteLabel(ip), e.windowRate[ip])
+	}
+
+	if len(e.windowLoss) > 0 {
+		writeMetricHeader(w, "mqtt_sniffer_window_capture_loss_ratio", "gauge", "最近一個統計區間各介面被核心或網卡丟棄的封包比例")
+		for _, name := range sortedKeys(e.windowLoss) {
+			fmt.Fprintf(w, "mqtt_sniffer_window_capture_loss_ratio{interface=%s} %g\n", quoteLabel(name), e.windowLoss[name])
+		}
+	}
+
+	if e.roster != nil {
+		writeMetricHeader(w, "mqtt_sniffer_roster_expected_imsi", "gauge", "預期IMSI名單中的IMSI數")
+		fmt.Fprintf(w, "mqtt_sniffer_roster_expected_imsi %d\n", e.roster.Expected)
+		writeMetricHeader(w, "mqtt_sniffer_roster_missing_imsi", "gauge", "最近一個統計視窗中名單內沒有出現的IMSI數")
+		fmt.Fprintf(w, "mqtt_sniffer_roster_missing_imsi %d\n", len(e.roster.Missing))
+		writeMetricHeader(w, "mqtt_sniffer_roster_unexpected_imsi", "gauge", "最近一個統計視窗中出現但不在名單內的IMSI數")
+		fmt.Fprintf(w, "mqtt_sniffer_roster_unexpected_imsi %d\n", len(e.roster.Unexpected))
+		writeMetricHeader(w, "mqtt_sniffer_roster_alerts_total", "counter", "名單中的IMSI連續缺席達到門檻的次數")
+		fmt.Fprintf(w, "mqtt_sniffer_roster_alerts_total %d\n", e.rosterAlerts)
+	}
+
+	if e.cadence != nil {
+		e.writeCadence(w)
+	}
+
+	writeMetricHeader(w, "mqtt_sniffer_windows_total", "counter", "已完成的統計區間數")
+	fmt.Fprintf(w, "mqtt_sniffer_windows_total %d\n", e.windows)
+	if !e.windowEnd.IsZero() {
+		writeMetricHeader(w, "mqtt_sniffer_window_end_timestamp_seconds", "gauge", "最近一個統計區間的結束時間")
+		fmt.Fprintf(w, "mqtt_sniffer_window_end_timestamp_seconds %d\n", e.windowEnd.Unix())
+	}
+
+	writeMetricHeader(w, "mqtt_sniffer_sessions_active", "gauge", "最近一個統計區間結束時連線中的MQTT session數")
+	fmt.Fprintf(w, "mqtt_sniffer_sessions_active %d\n", e.activeSessions)
+	writeMetricHeader(w, "mqtt_sniffer_sessions_ended_total", "counter", "已結束的MQTT session數（abnormal 為未送DISCONNECT、被拒絕或broker斷線）")
+	for _, result := range []string{"normal", "abnormal"} {
+		fmt.Fprintf(w, "mqtt_sniffer_sessions_ended_total{result=%s} %d\n", quoteLabel(result), e.sessionEnds[result])
+	}
+
+	if len(e.groups) > 0 {
+		e.writeGroups(w)
+	}
+	if len(e.qosTotals) > 0 {
+		e.writeQoS(w)
+	}
+	if e.fanout != nil {
+		e.writeFanout(w)
+	}
+	writeTopicMetrics(w, "mqtt_sniffer_window_topic", "topic", "主題", e.topics)
+	writeTopicMetrics(w, "mqtt_sniffer_window_topic_pattern", "pattern", "主題樣式", e.patterns)
+
+	if len(e.tlsHandshakes) > 0 {
+		writeMetricHeader(w, "mqtt_sniffer_tls_handshakes_total", "counter", "MQTT over TLS的handshake數（按版本和加密套件）")
+		for _, key := range sortedPairs(e.tlsHandshakes) {
+			fmt.Fprintf(w, "mqtt_sniffer_tls_handshakes_total{version=%s,cipher=%s} %d\n", quoteLabel(key[0]), quoteLabel(key[1]), e.tlsHandshakes[key])
+		}
+	}
+	if len(e.certExpiry) > 0 {
+		writeMetricHeader(w, "mqtt_sniffer_tls_cert_expiry_timestamp_seconds", "gauge", "broker憑證的到期時間")
+		for _, key := range sortedPairs(e.certExpiry) {
+			fmt.Fprintf(w, "mqtt_sniffer_tls_cert_expiry_timestamp_seconds{server=%s,subject=%s} %d\n", quoteLabel(key[0]), quoteLabel(key[1]), e.certExpiry[key].Unix())
+		}
+	}
+
+	if pcapOut != nil {
+		writeMetricHeader(w, "mqtt_sniffer_pcap_written_packets_total", "counter", "寫入 -pcap-out 檔案的封包數")
+		fmt.Fprintf(w, "mqtt_sniffer_pcap_written_packets_total %d\n", pcapOut.written())
+	}
+	if recorder != nil {
+		dumps, buffered := recorder.stats()
+		writeMetricHeader(w, "mqtt_sniffer_recorder_buffered_packets", "gauge", "flight recorder目前在記憶體保留的封包數")
+		fmt.Fprintf(w, "mqtt_sniffer_recorder_buffered_packets %d\n", buffered)
+		writeMetricHeader(w, "mqtt_sniffer_recorder_dumps_total", "counter", "flight recorder觸發後寫出的檔案數（按觸發條件）")
+		for _, trigger := range []string{triggerImsi, triggerMinImsi} {
+			fmt.Fprintf(w, "mqtt_sniffer_recorder_dumps_total{trigger=%s} %d\n", quoteLabel(trigger), dumps[trigger])
+		}
+	}
+
+	// 失敗原因即時輸出，不等區間結束
+	totals := failures.totals()
+	writeMetricHeader(w, "mqtt_sniffer_packet_failures_total", "counter", "未被統計的封包數（按原因，not_ip 為非IPv4/IPv6封包）")
+	for _, reason := range sortedKeys(totals) {
+		fmt.Fprintf(w, "mqtt_sniffer_packet_failures_total{reason=%s} %d\n", quoteLabel(reason), totals[reason])
+	}
+
+	if captures == nil {
+		return
+	}
+	stats := captures.interfaceStats()
+	writeMetricHeader(w, "mqtt_sniffer_captured_packets_total", "counter", "各介面捕獲的封包數")
+	for _, stat := range stats {
+		fmt.Fprintf(w, "mqtt_sniffer_captured_packets_total{interface=%s} %d\n", quoteLabel(stat.Name), stat.Captured)
+	}
+	writeMetricHeader(w, "mqtt_sniffer_pcap_received_packets_total", "counter", "抓包後端（libpcap或AF_PACKET socket）統計的接收封包數")
+	for _, stat := range stats {
+		fmt.Fprintf(w, "mqtt_sniffer_pcap_received_packets_total{interface=%s} %d\n", quoteLabel(stat.Name), stat.Received)
+	}
+	writeMetricHeader(w, "mqtt_sniffer_pcap_dropped_packets_total", "counter", "因緩衝區或ring滿被核心丟棄的封包數")
+	for _, stat := range stats {
+		fmt.Fprintf(w, "mqtt_sniffer_pcap_dropped_packets_total{interface=%s} %d\n", quoteLabel(stat.Name), stat.Dropped)
+	}
+	writeMetricHeader(w, "mqtt_sniffer_pcap_if_dropped_packets_total", "counter", "網卡或驅動丟棄的封包數，afpacket沒有此統計")
+	for _, stat := range stats {
+		fmt.Fprintf(w, "mqtt_sniffer_pcap_if_dropped_packets_total{interface=%s} %d\n", quoteLabel(stat.Name), stat.IfDropped)
+	}
+}
+
+// IMSI回報週期的摘要
+func (e *metricsExporter) writeCadence(w io.Writer) {
+	writeMetricHeader(w, "mqtt_sniffer_cadence_tracked_imsi", "gauge", "回報週期分析中追蹤的IMSI數")
+	fmt.Fprintf(w, "mqtt_sniffer_cadence_tracked_imsi %d\n", e.cadence.Tracked)
+	writeMetricHeader(w, "mqtt_sniffer_cadence_noncompliant_imsi", "gauge", "最近一個統計區間有重複回報、中斷或靜默的IMSI數")
+	fmt.Fprintf(w, "mqtt_sniffer_cadence_noncompliant_imsi %d\n", len(e.cadence.NonCompliant))
+	writeMetricHeader(w, "mqtt_sniffer_cadence_silent_imsi", "gauge", "最近一個統計區間結束時已超過中斷門檻沒有回報的IMSI數")
+	fmt.Fprintf(w, "mqtt_sniffer_cadence_silent_imsi %d\n", e.cadence.Silent)
+	writeMetricHeader(w, "mqtt_sniffer_cadence_duplicates_total", "counter", "同一個IMSI的回報間隔小於重複門檻的次數")
+	fmt.Fprintf(w, "mqtt_sniffer_cadence_duplicates_total %d\n", e.duplicates)
+	writeMetricHeader(w, "mqtt_sniffer_cadence_gaps_total", "counter", "同一個IMSI的回報間隔超過中斷門檻的次數")
+	fmt.Fprintf(w, "mqtt_sniffer_cadence_gaps_total %d\n", e.gaps)
+	if i := e.cadence.Intervals; i != nil {
+		writeMetricHeader(w, "mqtt_sniffer_window_interarrival_seconds", "gauge", "最近一個統計區間所有IMSI的回報間隔分布")
+		for _, pair := range []struct {
+			stat  string
+			value float64
+		}{{"min", i.MinSeconds}, {"avg", i.AvgSeconds}, {"p95", i.P95Seconds}, {"max", i.MaxSeconds}} {
+			fmt.Fprintf(w, "mqtt_sniffer_window_interarrival_seconds{stat=%s} %g\n", quoteLabel(pair.stat), pair.value)
+		}
+	}
+}
+
+// QoS 1/2確認流程的累計計數和最近一個區間的確認延遲
+func (e *metricsExporter) writeQoS(w io.Writer) {
+	keys := sortedPairs(e.qosTotals)
+	for _, counter := range []struct {
+		name, help string
+		value      func(*qosStats) int
+	}{
+		{"publish", "QoS 1/2的PUBLISH數，包含重送", func(s *qosStats) int { return s.Publishes }},
+		{"acked", "完成確認流程（PUBACK或PUBCOMP）的PUBLISH數", func(s *qosStats) int { return s.Acked }},
+		{"rejected", "MQTT 5.0 PUBACK/PUBREC原因碼表示失敗的PUBLISH數", func(s *qosStats) int { return s.Rejected }},
+		{"unacked", "逾時或連線中斷時仍未確認的PUBLISH數", func(s *qosStats) int { return s.Unacked }},
+		{"retransmissions", "確認前以同一個封包ID再次送出的PUBLISH數", func(s *qosStats) int { return s.Retransmissions }},
+		{"dup", "帶DUP旗標的PUBLISH數", func(s *qosStats) int { return s.Dup }},
+		{"unmatched_acks", "找不到對應PUBLISH的確認數", func(s *qosStats) int { return s.Unmatched }},
+		{"unmatched_releases", "找不到對應PUBREC的PUBREL數", func(s *qosStats) int { return s.UnmatchedRel }},
+	} {
+		name := "mqtt_sniffer_qos_" + counter.name + "_total"
+		writeMetricHeader(w, name, "counter", counter.help+"（按客戶端和方向）")
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s{client_id=%s,direction=%s} %d\n", name, quoteLabel(key[0]), quoteLabel(key[1]), counter.value(e.qosTotals[key]))
+		}
+	}
+	if len(e.qosLatency) == 0 {
+		return
+	}
+	writeMetricHeader(w, "mqtt_sniffer_window_qos_ack_latency_seconds", "gauge", "最近一個統計區間從PUBLISH到PUBACK（QoS 1）或PUBCOMP（QoS 2）的時間")
+	for _, key := range sortedPairs(e.qosLatency) {
+		summary := e.qosLatency[key]
+		for _, stat := range []struct {
+			name  string
+			value float64
+		}{{"min", summary.MinSeconds}, {"avg", summary.AvgSeconds}, {"p95", summary.P95Seconds}, {"max", summary.MaxSeconds}} {
+			fmt.Fprintf(w, "mqtt_sniffer_window_qos_ack_latency_seconds{direction=%s,qos=%s,stat=%s} %g\n",
+				quoteLabel(key[0]), quoteLabel(key[1]), quoteLabel(stat.name), stat.value)
+		}
+	}
+}
+
+// broker轉發驗證的累計計數和最近一個區間的轉發延遲
+func (e *metricsExporter) writeFanout(w io.Writer) {
+	writeMetricHeader(w, "mqtt_sniffer_fanout_messages_total", "counter", "已判斷轉發結果的送進broker的PUBLISH數")
+	fmt.Fprintf(w, "mqtt_sniffer_fanout_messages_total %d\n", e.fanoutMessages)
+	writeMetricHeader(w, "mqtt_sniffer_fanout_no_subscriber_total", "counter", "沒有任何訂閱者應該收到的PUBLISH數")
+	fmt.Fprintf(w, "mqtt_sniffer_fanout_no_subscriber_total %d\n", e.fanoutNoSub)
+	writeMetricHeader(w, "mqtt_sniffer_fanout_unmatched_deliveries_total", "counter", "找不到來源PUBLISH的轉發數")
+	fmt.Fprintf(w, "mqtt_sniffer_fanout_unmatched_deliveries_total %d\n", e.fanoutUnmatched)
+	writeMetricHeader(w, "mqtt_sniffer_fanout_pending_messages", "gauge", "最近一個統計區間結束時還在等待轉發的PUBLISH數")
+	fmt.Fprintf(w, "mqtt_sniffer_fanout_pending_messages %d\n", e.fanout.Pending)
+
+	keys := sortedKeys(e.fanoutSubscribers)
+	for _, counter := range []struct {
+		name, help string
+		value      func(*fanoutSubscriberReport) int
+	}{
+		{"expected", "應該轉發給訂閱者的PUBLISH數", func(s *fanoutSubscriberReport) int { return s.Expected }},
+		{"delivered", "在等待時間內轉發給訂閱者的PUBLISH數", func(s *fanoutSubscriberReport) int { return s.Delivered }},
+		{"lost", "超過等待時間沒有轉發給訂閱者的PUBLISH數", func(s *fanoutSubscriberReport) int { return s.Lost }},
+	} {
+		name := "mqtt_sniffer_fanout_" + counter.name + "_total"
+		writeMetricHeader(w, name, "counter", counter.help+"（按訂閱者）")
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s{subscriber=%s} %d\n", name, quoteLabel(key), counter.value(e.fanoutSubscribers[key]))
+		}
+	}
+
+	latency := e.fanout.Latency
+	if latency == nil {
+		return
+	}
+	writeMetricHeader(w, "mqtt_sniffer_window_fanout_latency_seconds", "gauge", "最近一個統計區間從PUBLISH送進broker到轉發給訂閱者的時間")
+	for _, stat := range []struct {
+		name  string
+		value float64
+	}{{"min", latency.MinSeconds}, {"avg", latency.AvgSeconds}, {"p95", latency.P95Seconds}, {"max", latency.MaxSeconds}} {
+		fmt.Fprintf(w, "mqtt_sniffer_window_fanout_latency_seconds{stat=%s} %g\n", quoteLabel(stat.name), stat.value)
+	}
+}
+
+// 按主題或主題樣式的區間統計，prefix 為指標名稱的前綴
+func writeTopicMetrics(w io.Writer, prefix, label, name string, topics map[string]*TopicStats) {
+	if len(topics) == 0 {
+		return
+	}
+	keys := sortedKeys(topics)
+	writeMetricHeader(w, prefix+"_publish_packets", "gauge", "最近一個統計區間各"+name+"的PUBLISH數量")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s_publish_packets{%s=%s} %d\n", prefix, label, quoteLabel(key), topics[key].Count)
+	}
+	writeMetricHeader(w, prefix+"_payload_bytes", "gauge", "最近一個統計區間各"+name+"的payload位元組數")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s_payload_bytes{%s=%s} %d\n", prefix, label, quoteLabel(key), topics[key].Bytes)
+	}
+	writeMetricHeader(w, prefix+"_distinct_imsi", "gauge", "最近一個統計區間各"+name+"的獨立IMSI數量")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s_distinct_imsi{%s=%s} %d\n", prefix, label, quoteLabel(key), topics[key].ImsiSet.Len())
+	}
+}
+
+// 擷取規格的分組，分組鍵當作標籤，每個數值欄位一個指標
+func (e *metricsExporter) writeGroups(w io.Writer) {
+	labels := make([]string, len(e.groups))
+	for i, group := range e.groups {
+		pairs := make([]string, 0, len(group.Keys))
+		for j, f := range payloadSchema.Keys() {
+			pairs = append(pairs, f.Name+"="+quoteLabel(group.Keys[j]))
+		}
+		labels[i] = "{" + strings.Join(pairs, ",") + "}"
+	}
+
+	writeMetricHeader(w, "mqtt_sniffer_window_group_messages", "gauge", "最近一個統計區間各分組的訊息數")
+	for i, group := range e.groups {
+		fmt.Fprintf(w, "mqtt_sniffer_window_group_messages%s %d\n", labels[i], group.Count)
+	}
+	writeMetricHeader(w, "mqtt_sniffer_window_group_distinct_imsi", "gauge", "最近一個統計區間各分組的獨立IMSI數量")
+	for i, group := range e.groups {
+		fmt.Fprintf(w, "mqtt_sniffer_window_group_distinct_imsi%s %d\n", labels[i], group.ImsiSet.Len())
+	}
+	for j, f := range payloadSchema.Values() {
+		name := "mqtt_sniffer_window_group_" + f.Name + "_" + f.Role
+		aggregate := "加總"
+		if f.Role == schema.RoleAvg {
+			aggregate = "平均"
+		}
+		writeMetricHeader(w, name, "gauge", fmt.Sprintf("最近一個統計區間各分組 %s 的%s", f.Path, aggregate))
+		for i, group := range e.groups {
+			value := group.Sums[j]
+			if f.Role == schema.RoleAvg {
+				var ok bool
+				if value, ok = group.Average(j); !ok {
+					continue
+				}
+			}
+			fmt.Fprintf(w, "%s%s %g\n", name, labels[i], value)
+		}
+	}
+}
+
+func sortedPairs[V any](m map[[2]string]V) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+func writeMetricHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
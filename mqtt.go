@@ -0,0 +1,566 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MQTT控制封包類型 (MQTT 3.1.1 / 5.0)
+const (
+	MQTT_CONNECT     = 1
+	MQTT_CONNACK     = 2
+	MQTT_PUBLISH     = 3
+	MQTT_PUBACK      = 4
+	MQTT_PUBREC      = 5
+	MQTT_PUBREL      = 6
+	MQTT_PUBCOMP     = 7
+	MQTT_SUBSCRIBE   = 8
+	MQTT_SUBACK      = 9
+	MQTT_UNSUBSCRIBE = 10
+	MQTT_UNSUBACK    = 11
+	MQTT_PINGREQ     = 12
+	MQTT_PINGRESP    = 13
+	MQTT_DISCONNECT  = 14
+	MQTT_AUTH        = 15
+)
+
+// MQTT協議等級
+const (
+	MQTT_V31  = 3
+	MQTT_V311 = 4
+	MQTT_V5   = 5
+)
+
+var (
+	// 資料不足一個完整的MQTT封包，需要等待更多位元組
+	errMqttIncomplete = errors.New("MQTT封包不完整")
+	// 資料不符合MQTT格式
+	errMqttMalformed = errors.New("MQTT封包格式錯誤")
+)
+
+// MQTT 5.0 屬性（只保留分析時用得到的欄位）
+type MqttProperties struct {
+	TopicAlias         uint16
+	ContentType        string
+	PayloadFormat      byte
+	SessionExpiry      uint32
+	ReasonString       string
+	ResponseTopic      string
+	SubscriptionIDs    []int
+	AssignedClientID   string
+	ServerKeepAlive    uint16
+	MessageExpiry      uint32
+	HasSessionExpiry   bool
+	HasServerKeepAlive bool
+}
+
+// 解析後的MQTT控制封包
+type MqttPacket struct {
+	Type   byte
+	Flags  byte
+	Length int // 整個封包長度（固定頭部 + 剩餘長度）
+
+	// PUBLISH
+	Dup      bool
+	QoS      byte
+	Retain   bool
+	Topic    string
+	Payload  []byte
+	PacketID uint16
+
+	// CONNECT
+	ProtocolName  string
+	ProtocolLevel byte
+	CleanSession  bool
+	KeepAlive     uint16
+	ClientID      string
+	Username      string
+	WillTopic     string
+
+	// CONNACK / PUBACK 等 / DISCONNECT / AUTH
+	SessionPresent bool
+	ReasonCode     byte
+
+	// SUBSCRIBE / UNSUBSCRIBE 的主題過濾器和訂閱選項，SUBACK / UNSUBACK 的回應碼
+	TopicFilters []string
+	SubOptions   []byte
+	ReturnCodes  []byte
+
+	Properties MqttProperties
+}
+
+var mqttPacketTypeNames = map[byte]string{
+	MQTT_CONNECT:     "CONNECT",
+	MQTT_CONNACK:     "CONNACK",
+	MQTT_PUBLISH:     "PUBLISH",
+	MQTT_PUBACK:      "PUBACK",
+	MQTT_PUBREC:      "PUBREC",
+	MQTT_PUBREL:      "PUBREL",
+	MQTT_PUBCOMP:     "PUBCOMP",
+	MQTT_SUBSCRIBE:   "SUBSCRIBE",
+	MQTT_SUBACK:      "SUBACK",
+	MQTT_UNSUBSCRIBE: "UNSUBSCRIBE",
+	MQTT_UNSUBACK:    "UNSUBACK",
+	MQTT_PINGREQ:     "PINGREQ",
+	MQTT_PINGRESP:    "PINGRESP",
+	MQTT_DISCONNECT:  "DISCONNECT",
+	MQTT_AUTH:        "AUTH",
+}
+
+func mqttPacketTypeName(t byte) string {
+	if name, ok := mqttPacketTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", t)
+}
+
+// 解析剩餘長度（最多4個位元組的變長整數），回傳數值和佔用的位元組數
+func decodeVarInt(b []byte) (int, int, error) {
+	value := 0
+	multiplier := 1
+	for i := 0; i < 4; i++ {
+		if i >= len(b) {
+			return 0, 0, errMqttIncomplete
+		}
+		value += int(b[i]&0x7f) * multiplier
+		if b[i]&0x80 == 0 {
+			return value, i + 1, nil
+		}
+		multiplier *= 128
+	}
+	return 0, 0, errMqttMalformed
+}
+
+// 檢查固定頭部的保留標誌位
+func validMqttFlags(packetType, flags byte) bool {
+	switch packetType {
+	case MQTT_PUBLISH:
+		// QoS 不可為 3
+		return (flags>>1)&0x03 != 3
+	case MQTT_PUBREL, MQTT_SUBSCRIBE, MQTT_UNSUBSCRIBE:
+		return flags == 0x02
+	case 0:
+		return false
+	default:
+		return flags == 0
+	}
+}
+
+// 從位元組切片依序讀取MQTT欄位
+type mqttReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *mqttReader) remaining() int {
+	return len(r.buf) - r.pos
+}
+
+func (r *mqttReader) readByte() (byte, error) {
+	if r.remaining() < 1 {
+		return 0, errMqttMalformed
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *mqttReader) readUint16() (uint16, error) {
+	if r.remaining() < 2 {
+		return 0, errMqttMalformed
+	}
+	v := binary.BigEndian.Uint16(r.buf[r.pos:])
+	r.pos += 2
+	return v, nil
+}
+
+func (r *mqttReader) readUint32() (uint32, error) {
+	if r.remaining() < 4 {
+		return 0, errMqttMalformed
+	}
+	v := binary.BigEndian.Uint32(r.buf[r.pos:])
+	r.pos += 4
+	return v, nil
+}
+
+func (r *mqttReader) readVarInt() (int, error) {
+	v, n, err := decodeVarInt(r.buf[r.pos:])
+	if err != nil {
+		return 0, errMqttMalformed
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *mqttReader) readBinary() ([]byte, error) {
+	n, err := r.readUint16()
+	if err != nil {
+		return nil, err
+	}
+	if r.remaining() < int(n) {
+		return nil, errMqttMalformed
+	}
+	b := r.buf[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+func (r *mqttReader) readString() (string, error) {
+	b, err := r.readBinary()
+	return string(b), err
+}
+
+func (r *mqttReader) rest() []byte {
+	b := r.buf[r.pos:]
+	r.pos = len(r.buf)
+	return b
+}
+
+// 解析MQTT 5.0屬性區塊
+func (r *mqttReader) readProperties(props *MqttProperties) error {
+	length, err := r.readVarInt()
+	if err != nil {
+		return err
+	}
+	if r.remaining() < length {
+		return errMqttMalformed
+	}
+	pr := &mqttReader{buf: r.buf[r.pos : r.pos+length]}
+	r.pos += length
+
+	for pr.remaining() > 0 {
+		id, err := pr.readVarInt()
+		if err != nil {
+			return err
+		}
+		switch id {
+		// 單位元組屬性
+		case 0x01:
+			props.PayloadFormat, err = pr.readByte()
+		case 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2A:
+			_, err = pr.readByte()
+		// 雙位元組整數
+		case 0x13:
+			props.ServerKeepAlive, err = pr.readUint16()
+			props.HasServerKeepAlive = true
+		case 0x23:
+			props.TopicAlias, err = pr.readUint16()
+		case 0x21, 0x22:
+			_, err = pr.readUint16()
+		// 四位元組整數
+		case 0x02:
+			props.MessageExpiry, err = pr.readUint32()
+		case 0x11:
+			props.SessionExpiry, err = pr.readUint32()
+			props.HasSessionExpiry = true
+		case 0x18, 0x27:
+			_, err = pr.readUint32()
+		// 變長整數
+		case 0x0B:
+			var subID int
+			subID, err = pr.readVarInt()
+			props.SubscriptionIDs = append(props.SubscriptionIDs, subID)
+		// UTF-8字串
+		case 0x03:
+			props.ContentType, err = pr.readString()
+		case 0x08:
+			props.ResponseTopic, err = pr.readString()
+		case 0x12:
+			props.AssignedClientID, err = pr.readString()
+		case 0x1F:
+			props.ReasonString, err = pr.readString()
+		case 0x15, 0x1A, 0x1C:
+			_, err = pr.readString()
+		// 二進位資料
+		case 0x09, 0x16:
+			_, err = pr.readBinary()
+		// 使用者屬性（字串對）
+		case 0x26:
+			if _, err = pr.readString(); err == nil {
+				_, err = pr.readString()
+			}
+		default:
+			return errMqttMalformed
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMqttPacket 從位元組流開頭解析一個MQTT控制封包。
+// version 為該連線CONNECT中的協議等級，未知時傳0（視為3.1.1）。
+// 回傳解析結果和消耗的位元組數；資料不足時回傳 errMqttIncomplete。
+func parseMqttPacket(data []byte, version byte) (*MqttPacket, int, error) {
+	if len(data) < 2 {
+		return nil, 0, errMqttIncomplete
+	}
+
+	packetType := data[0] >> 4
+	flags := data[0] & 0x0f
+	if !validMqttFlags(packetType, flags) {
+		return nil, 0, errMqttMalformed
+	}
+
+	remainingLength, n, err := decodeVarInt(data[1:])
+	if err != nil {
+		return nil, 0, err
+	}
+	total := 1 + n + remainingLength
+	if len(data) < total {
+		return nil, 0, errMqttIncomplete
+	}
+
+	pkt := &MqttPacket{
+		Type:   packetType,
+		Flags:  flags,
+		Length: total,
+	}
+	r := &mqttReader{buf: data[1+n : total]}
+
+	// CONNECT自帶協議等級，其他封包依連線狀態判斷
+	if packetType != MQTT_CONNECT && version == 0 {
+		version = MQTT_V311
+	}
+
+	switch packetType {
+	case MQTT_CONNECT:
+		err = parseMqttConnect(r, pkt)
+	case MQTT_CONNACK:
+		err = parseMqttConnack(r, pkt, version)
+	case MQTT_PUBLISH:
+		err = parseMqttPublish(r, pkt, version)
+	case MQTT_PUBACK, MQTT_PUBREC, MQTT_PUBREL, MQTT_PUBCOMP:
+		err = parseMqttAck(r, pkt, version)
+	case MQTT_SUBSCRIBE, MQTT_UNSUBSCRIBE:
+		err = parseMqttSubscribe(r, pkt, version)
+	case MQTT_SUBACK, MQTT_UNSUBACK:
+		err = parseMqttSuback(r, pkt, version)
+	case MQTT_PINGREQ, MQTT_PINGRESP:
+		if r.remaining() != 0 {
+			err = errMqttMalformed
+		}
+	case MQTT_DISCONNECT, MQTT_AUTH:
+		err = parseMqttReason(r, pkt, version)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return pkt, total, nil
+}
+
+func parseMqttConnect(r *mqttReader, pkt *MqttPacket) error {
+	var err error
+	if pkt.ProtocolName, err = r.readString(); err != nil {
+		return err
+	}
+	if pkt.ProtocolName != "MQTT" && pkt.ProtocolName != "MQIsdp" {
+		return errMqttMalformed
+	}
+	if pkt.ProtocolLevel, err = r.readByte(); err != nil {
+		return err
+	}
+	connectFlags, err := r.readByte()
+	if err != nil {
+		return err
+	}
+	if connectFlags&0x01 != 0 {
+		return errMqttMalformed
+	}
+	pkt.CleanSession = connectFlags&0x02 != 0
+	if pkt.KeepAlive, err = r.readUint16(); err != nil {
+		return err
+	}
+	if pkt.ProtocolLevel == MQTT_V5 {
+		if err = r.readProperties(&pkt.Properties); err != nil {
+			return err
+		}
+	}
+	if pkt.ClientID, err = r.readString(); err != nil {
+		return err
+	}
+	// Will 標誌
+	if connectFlags&0x04 != 0 {
+		if pkt.ProtocolLevel == MQTT_V5 {
+			var willProps MqttProperties
+			if err = r.readProperties(&willProps); err != nil {
+				return err
+			}
+		}
+		if pkt.WillTopic, err = r.readString(); err != nil {
+			return err
+		}
+		if _, err = r.readBinary(); err != nil {
+			return err
+		}
+	}
+	if connectFlags&0x80 != 0 {
+		if pkt.Username, err = r.readString(); err != nil {
+			return err
+		}
+	}
+	if connectFlags&0x40 != 0 {
+		if _, err = r.readBinary(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseMqttConnack(r *mqttReader, pkt *MqttPacket, version byte) error {
+	ackFlags, err := r.readByte()
+	if err != nil {
+		return err
+	}
+	pkt.SessionPresent = ackFlags&0x01 != 0
+	if pkt.ReasonCode, err = r.readByte(); err != nil {
+		return err
+	}
+	if version == MQTT_V5 && r.remaining() > 0 {
+		return r.readProperties(&pkt.Properties)
+	}
+	return nil
+}
+
+func parseMqttPublish(r *mqttReader, pkt *MqttPacket, version byte) error {
+	var err error
+	pkt.Dup = pkt.Flags&0x08 != 0
+	pkt.QoS = (pkt.Flags >> 1) & 0x03
+	pkt.Retain = pkt.Flags&0x01 != 0
+
+	if pkt.Topic, err = r.readString(); err != nil {
+		return err
+	}
+	if pkt.QoS > 0 {
+		if pkt.PacketID, err = r.readUint16(); err != nil {
+			return err
+		}
+	}
+	if version == MQTT_V5 {
+		if err = r.readProperties(&pkt.Properties); err != nil {
+			return err
+		}
+	}
+	pkt.Payload = r.rest()
+	return nil
+}
+
+func parseMqttAck(r *mqttReader, pkt *MqttPacket, version byte) error {
+	var err error
+	if pkt.PacketID, err = r.readUint16(); err != nil {
+		return err
+	}
+	// MQTT 5.0 的原因碼和屬性在剩餘長度為2時可省略
+	if version == MQTT_V5 && r.remaining() > 0 {
+		if pkt.ReasonCode, err = r.readByte(); err != nil {
+			return err
+		}
+		if r.remaining() > 0 {
+			return r.readProperties(&pkt.Properties)
+		}
+	}
+	return nil
+}
+
+func parseMqttSubscribe(r *mqttReader, pkt *MqttPacket, version byte) error {
+	var err error
+	if pkt.PacketID, err = r.readUint16(); err != nil {
+		return err
+	}
+	if version == MQTT_V5 {
+		if err = r.readProperties(&pkt.Properties); err != nil {
+			return err
+		}
+	}
+	for r.remaining() > 0 {
+		filter, err := r.readString()
+		if err != nil {
+			return err
+		}
+		pkt.TopicFilters = append(pkt.TopicFilters, filter)
+		if pkt.Type == MQTT_SUBSCRIBE {
+			options, err := r.readByte()
+			if err != nil {
+				return err
+			}
+			pkt.SubOptions = append(pkt.SubOptions, options)
+		}
+	}
+	if len(pkt.TopicFilters) == 0 {
+		return errMqttMalformed
+	}
+	return nil
+}
+
+func parseMqttSuback(r *mqttReader, pkt *MqttPacket, version byte) error {
+	var err error
+	if pkt.PacketID, err = r.readUint16(); err != nil {
+		return err
+	}
+	if version == MQTT_V5 {
+		if err = r.readProperties(&pkt.Properties); err != nil {
+			return err
+		}
+	}
+	pkt.ReturnCodes = r.rest()
+	return nil
+}
+
+func parseMqttReason(r *mqttReader, pkt *MqttPacket, version byte) error {
+	if version != MQTT_V5 {
+		if pkt.Type == MQTT_AUTH || r.remaining() != 0 {
+			return errMqttMalformed
+		}
+		return nil
+	}
+	if r.remaining() == 0 {
+		return nil
+	}
+	var err error
+	if pkt.ReasonCode, err = r.readByte(); err != nil {
+		return err
+	}
+	if r.remaining() > 0 {
+		return r.readProperties(&pkt.Properties)
+	}
+	return nil
+}
+
+// 單一TCP連線上的MQTT狀態
+type mqttConn struct {
+	version byte
+	// 主題別名由發送方各自定義，[0] 為客戶端 -> broker，[1] 為 broker -> 客戶端
+	topicAliases [2]map[uint16]string
+	// 目前的session，只由處理此連線的工作協程修改，建立和結束時另外持有 lock
+	session *mqttSession
+	// 處理此連線的工作協程，PUBLISH統計寫入它的分片
+	worker *packetWorker
+	// 此連線在 qosSessions 中的鍵，沒有QoS 1/2流程時為零值
+	qosKey qosKey
+}
+
+func newMqttConn(worker *packetWorker) *mqttConn {
+	return &mqttConn{
+		topicAliases: [2]map[uint16]string{make(map[uint16]string), make(map[uint16]string)},
+		worker:       worker,
+	}
+}
+
+// 取得PUBLISH的實際主題，處理MQTT 5.0的主題別名
+func (c *mqttConn) resolveTopic(pkt *MqttPacket, toBroker bool) string {
+	alias := pkt.Properties.TopicAlias
+	if alias == 0 {
+		return pkt.Topic
+	}
+	aliases := c.topicAliases[0]
+	if !toBroker {
+		aliases = c.topicAliases[1]
+	}
+	if pkt.Topic != "" {
+		aliases[alias] = pkt.Topic
+		return pkt.Topic
+	}
+	return aliases[alias]
+}
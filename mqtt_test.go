@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// 剩餘長度和屬性長度使用的變長整數
+func mqttVarInt(n int) []byte {
+	var out []byte
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			return out
+		}
+	}
+}
+
+func mqttStr(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+func mqttU16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+// 以固定頭部的第一個位元組和各欄位組成完整的封包
+func mqttFrame(header byte, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	return append(append([]byte{header}, mqttVarInt(len(body))...), body...)
+}
+
+// MQTT 5.0的屬性區塊：長度加上屬性
+func mqttProps(parts ...[]byte) []byte {
+	props := bytes.Join(parts, nil)
+	return append(mqttVarInt(len(props)), props...)
+}
+
+func TestParseMqttPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		version byte
+		want    MqttPacket // 只比對有設定的欄位，Type和Length一定比對
+	}{
+		{
+			name: "CONNECT 3.1.1",
+			data: mqttFrame(0x10, mqttStr("MQTT"), []byte{MQTT_V311, 0xc2}, mqttU16(60),
+				mqttStr("amf-1"), mqttStr("user"), mqttStr("secret")),
+			want: MqttPacket{Type: MQTT_CONNECT, ProtocolName: "MQTT", ProtocolLevel: MQTT_V311,
+				CleanSession: true, KeepAlive: 60, ClientID: "amf-1", Username: "user"},
+		},
+		{
+			name: "CONNECT 5.0 有屬性和will",
+			data: mqttFrame(0x10, mqttStr("MQTT"), []byte{MQTT_V5, 0x06}, mqttU16(30),
+				mqttProps([]byte{0x11, 0, 0, 0x0e, 0x10}, []byte{0x21}, mqttU16(10)),
+				mqttStr("smf-1"),
+				mqttProps([]byte{0x01, 1}), mqttStr("will/topic"), mqttStr("bye")),
+			want: MqttPacket{Type: MQTT_CONNECT, ProtocolName: "MQTT", ProtocolLevel: MQTT_V5,
+				CleanSession: true, KeepAlive: 30, ClientID: "smf-1", WillTopic: "will/topic",
+				Properties: MqttProperties{SessionExpiry: 3600, HasSessionExpiry: true}},
+		},
+		{
+			name: "CONNECT 3.1 MQIsdp",
+			data: mqttFrame(0x10, mqttStr("MQIsdp"), []byte{MQTT_V31, 0x02}, mqttU16(10), mqttStr("old")),
+			want: MqttPacket{Type: MQTT_CONNECT, ProtocolName: "MQIsdp", ProtocolLevel: MQTT_V31,
+				CleanSession: true, KeepAlive: 10, ClientID: "old"},
+		},
+		{
+			name: "PUBLISH QoS 0",
+			data: mqttFrame(0x30, mqttStr("FiveGC/metric"), []byte(`{"imsi":"1"}`)),
+			want: MqttPacket{Type: MQTT_PUBLISH, Topic: "FiveGC/metric", Payload: []byte(`{"imsi":"1"}`)},
+		},
+		{
+			name: "PUBLISH QoS 1",
+			data: mqttFrame(0x32, mqttStr("a/b"), mqttU16(7), []byte("x")),
+			want: MqttPacket{Type: MQTT_PUBLISH, Flags: 0x02, QoS: 1, Topic: "a/b", PacketID: 7, Payload: []byte("x")},
+		},
+		{
+			name: "PUBLISH QoS 2 DUP retain",
+			data: mqttFrame(0x3d, mqttStr("a/b"), mqttU16(9), []byte("y")),
+			want: MqttPacket{Type: MQTT_PUBLISH, Flags: 0x0d, Dup: true, QoS: 2, Retain: true,
+				Topic: "a/b", PacketID: 9, Payload: []byte("y")},
+		},
+		{
+			name:    "PUBLISH 5.0 QoS 1 有屬性",
+			version: MQTT_V5,
+			data: mqttFrame(0x32, mqttStr("t"), mqttU16(3),
+				mqttProps([]byte{0x23}, mqttU16(4), []byte{0x03}, mqttStr("application/json"),
+					[]byte{0x26}, mqttStr("k"), mqttStr("v"), []byte{0x0b, 0x81, 0x01}, []byte{0x02, 0, 0, 0, 60}),
+				[]byte("{}")),
+			want: MqttPacket{Type: MQTT_PUBLISH, Flags: 0x02, QoS: 1, Topic: "t", PacketID: 3, Payload: []byte("{}"),
+				Properties: MqttProperties{TopicAlias: 4, ContentType: "application/json",
+					SubscriptionIDs: []int{129}, MessageExpiry: 60}},
+		},
+		{
+			name:    "PUBLISH 5.0 空主題使用別名",
+			version: MQTT_V5,
+			data:    mqttFrame(0x30, mqttStr(""), mqttProps([]byte{0x23}, mqttU16(1)), []byte("p")),
+			want: MqttPacket{Type: MQTT_PUBLISH, Payload: []byte("p"),
+				Properties: MqttProperties{TopicAlias: 1}},
+		},
+		{
+			name: "PUBLISH 3.1.1 空主題和空payload",
+			data: mqttFrame(0x30, mqttStr("")),
+			want: MqttPacket{Type: MQTT_PUBLISH, Payload: []byte{}},
+		},
+		{
+			name: "PUBREL",
+			data: mqttFrame(0x62, mqttU16(9)),
+			want: MqttPacket{Type: MQTT_PUBREL, Flags: 0x02, PacketID: 9},
+		},
+		{
+			name:    "PUBACK 5.0 有原因碼",
+			version: MQTT_V5,
+			data:    mqttFrame(0x40, mqttU16(5), []byte{0x10}),
+			want:    MqttPacket{Type: MQTT_PUBACK, PacketID: 5, ReasonCode: 0x10},
+		},
+		{
+			name: "SUBSCRIBE",
+			data: mqttFrame(0x82, mqttU16(2), mqttStr("t/#"), []byte{1}, mqttStr("x/+"), []byte{0}),
+			want: MqttPacket{Type: MQTT_SUBSCRIBE, Flags: 0x02, PacketID: 2,
+				TopicFilters: []string{"t/#", "x/+"}, SubOptions: []byte{1, 0}},
+		},
+		{
+			name:    "DISCONNECT 5.0",
+			version: MQTT_V5,
+			data:    mqttFrame(0xe0, []byte{0x8e}),
+			want:    MqttPacket{Type: MQTT_DISCONNECT, ReasonCode: 0x8e},
+		},
+		{
+			name: "PINGREQ",
+			data: []byte{0xc0, 0x00},
+			want: MqttPacket{Type: MQTT_PINGREQ},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 後面接著下一個封包，只能消耗第一個封包的長度
+			data := append(append([]byte{}, tt.data...), 0xc0, 0x00)
+			pkt, n, err := parseMqttPacket(data, tt.version)
+			if err != nil {
+				t.Fatalf("parseMqttPacket: %v", err)
+			}
+			if n != len(tt.data) || pkt.Length != n {
+				t.Fatalf("消耗 %d 位元組（Length %d），應為 %d", n, pkt.Length, len(tt.data))
+			}
+			want := tt.want
+			want.Length = n
+			if want.Flags == 0 {
+				want.Flags = pkt.Flags
+			}
+			if pkt.Type == MQTT_PUBLISH && want.Payload == nil {
+				want.Payload = pkt.Payload
+			}
+			if !reflect.DeepEqual(*pkt, want) {
+				t.Errorf("解析結果\n got %+v\nwant %+v", *pkt, want)
+			}
+		})
+	}
+}
+
+func TestParseMqttPacketErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		version byte
+		want    error
+	}{
+		{"空資料", nil, 0, errMqttIncomplete},
+		{"只有固定頭部第一個位元組", []byte{0x30}, 0, errMqttIncomplete},
+		{"剩餘長度未結束", []byte{0x30, 0x80}, 0, errMqttIncomplete},
+		{"剩餘長度三個位元組未結束", []byte{0x30, 0xff, 0xff, 0xff}, 0, errMqttIncomplete},
+		{"剩餘長度超過四個位元組", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, 0, errMqttMalformed},
+		{"內容不足剩餘長度", []byte{0x30, 0x05, 0x00, 0x01}, 0, errMqttIncomplete},
+		{"大剩餘長度不完整", append([]byte{0x30}, mqttVarInt(1<<20)...), 0, errMqttIncomplete},
+		{"QoS 3", mqttFrame(0x36, mqttStr("t"), mqttU16(1)), 0, errMqttMalformed},
+		{"類型0", []byte{0x00, 0x00}, 0, errMqttMalformed},
+		{"PUBREL保留位錯誤", mqttFrame(0x60, mqttU16(1)), 0, errMqttMalformed},
+		{"主題長度超出封包", mqttFrame(0x30, []byte{0x00, 0x10, 'a'}), 0, errMqttMalformed},
+		{"QoS 1缺少封包ID", mqttFrame(0x32, mqttStr("t"), []byte{0x00}), 0, errMqttMalformed},
+		{"協議名稱錯誤", mqttFrame(0x10, mqttStr("HTTP"), []byte{4, 0}, mqttU16(0), mqttStr("c")), 0, errMqttMalformed},
+		{"CONNECT保留旗標", mqttFrame(0x10, mqttStr("MQTT"), []byte{4, 1}, mqttU16(0), mqttStr("c")), 0, errMqttMalformed},
+		{"屬性長度超出封包", mqttFrame(0x30, mqttStr("t"), []byte{0x20}), MQTT_V5, errMqttMalformed},
+		{"未知屬性", mqttFrame(0x30, mqttStr("t"), mqttProps([]byte{0x7f, 0})), MQTT_V5, errMqttMalformed},
+		{"屬性值截斷", mqttFrame(0x30, mqttStr("t"), mqttProps([]byte{0x23, 0})), MQTT_V5, errMqttMalformed},
+		{"屬性中的變長整數過長", mqttFrame(0x30, mqttStr("t"), mqttProps([]byte{0x0b, 0xff, 0xff, 0xff, 0xff})), MQTT_V5, errMqttMalformed},
+		{"SUBSCRIBE沒有主題", mqttFrame(0x82, mqttU16(1)), 0, errMqttMalformed},
+		{"PINGREQ有內容", []byte{0xc0, 0x01, 0x00}, 0, errMqttMalformed},
+		{"3.1.1的AUTH", []byte{0xf0, 0x00}, 0, errMqttMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt, n, err := parseMqttPacket(tt.data, tt.version)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("錯誤為 %v，應為 %v", err, tt.want)
+			}
+			if pkt != nil || n != 0 {
+				t.Errorf("錯誤時回傳了封包 %+v 和長度 %d", pkt, n)
+			}
+		})
+	}
+}
+
+func TestResolveTopicAlias(t *testing.T) {
+	conn := newMqttConn(nil)
+	publish := func(topic string, alias uint16) *MqttPacket {
+		return &MqttPacket{Type: MQTT_PUBLISH, Topic: topic, Properties: MqttProperties{TopicAlias: alias}}
+	}
+	steps := []struct {
+		pkt      *MqttPacket
+		toBroker bool
+		want     string
+	}{
+		{publish("plain", 0), true, "plain"},
+		{publish("FiveGC/amf/metric", 1), true, "FiveGC/amf/metric"}, // 設定別名
+		{publish("", 1), true, "FiveGC/amf/metric"},                  // 使用別名
+		{publish("", 1), false, ""},                                  // 兩個方向的別名互相獨立
+		{publish("down/topic", 1), false, "down/topic"},
+		{publish("", 1), true, "FiveGC/amf/metric"},
+		{publish("FiveGC/smf/metric", 1), true, "FiveGC/smf/metric"}, // 重新指定
+		{publish("", 1), true, "FiveGC/smf/metric"},
+		{publish("", 2), true, ""}, // 未設定的別名
+	}
+	for i, step := range steps {
+		if got := conn.resolveTopic(step.pkt, step.toBroker); got != step.want {
+			t.Errorf("第 %d 步: 主題為 %q，應為 %q", i, got, step.want)
+		}
+	}
+}
+
+func TestDecodeVarInt(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152, 268435455} {
+		encoded := mqttVarInt(n)
+		value, used, err := decodeVarInt(encoded)
+		if err != nil || value != n || used != len(encoded) {
+			t.Errorf("decodeVarInt(%x) = %d, %d, %v，應為 %d, %d", encoded, value, used, err, n, len(encoded))
+		}
+	}
+}
+
+func FuzzParseMqttPacket(f *testing.F) {
+	f.Add(mqttFrame(0x10, mqttStr("MQTT"), []byte{MQTT_V5, 0xc6}, mqttU16(30), mqttProps(),
+		mqttStr("c"), mqttProps(), mqttStr("w"), mqttStr("m"), mqttStr("u"), mqttStr("p")), byte(0))
+	f.Add(mqttFrame(0x32, mqttStr("t"), mqttU16(3), mqttProps([]byte{0x23}, mqttU16(4)), []byte("{}")), byte(MQTT_V5))
+	f.Add(mqttFrame(0x82, mqttU16(2), mqttProps(), mqttStr("t/#"), []byte{1}), byte(MQTT_V5))
+	f.Add(mqttFrame(0x90, mqttU16(2), []byte{0, 1, 0x80}), byte(MQTT_V311))
+	f.Add([]byte{0x30, 0xff, 0xff, 0xff, 0x7f}, byte(0))
+	f.Fuzz(func(t *testing.T, data []byte, version byte) {
+		pkt, n, err := parseMqttPacket(data, version)
+		if err != nil {
+			if !errors.Is(err, errMqttIncomplete) && !errors.Is(err, errMqttMalformed) {
+				t.Fatalf("未預期的錯誤: %v", err)
+			}
+			return
+		}
+		if n < 2 || n > len(data) || pkt.Length != n {
+			t.Fatalf("消耗 %d 位元組（Length %d），資料只有 %d", n, pkt.Length, len(data))
+		}
+		if pkt.Type == MQTT_PUBLISH && pkt.QoS > 2 {
+			t.Fatalf("QoS %d", pkt.QoS)
+		}
+	})
+}
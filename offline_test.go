@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testdata/two_intervals.pcap：三個客戶端連到兩個broker（1883端口），PUBLISH的JSON payload帶IMSI。
+//
+//	08:00:01    10.0.0.1:40001 -> 10.1.153.153  CONNECT upf-a
+//	08:00:01.5  10.0.0.2:40002 -> 10.1.153.154  CONNECT upf-b
+//	08:00:02    upf-a  208930000000001
+//	08:00:03    upf-a  208930000000002
+//	08:00:04    upf-a  208930000000001（重複）
+//	08:00:05    upf-b  208930000000003
+//	08:00:06    upf-b  沒有IMSI
+//	08:00:14.999 upf-a 208930000000004（第一個區間的最後一刻）
+//	08:00:15    10.0.0.3:40003 -> 10.1.153.153  CONNECT upf-c
+//	08:00:16    upf-a  208930000000001
+//	08:00:17    upf-c  208930000000005
+//	08:00:21    upf-b  208930000000003
+//	08:00:25    upf-b  208930000000006
+const twoIntervalsPcap = "testdata/two_intervals.pcap"
+
+// 以 workers 個工作協程離線分析檔案，回傳輸出的統計區間事件
+func replayWindows(t *testing.T, workers int, files ...string) []windowEvent {
+	t.Helper()
+	config = defaultConfig()
+	config.Workers = workers
+	// 沒有可用的libpcap時無法測試（replayPcapFiles打不開檔案會結束程序）
+	handle, err := openOffline(files[0], config.bpfFilter())
+	if err != nil {
+		t.Skipf("無法讀取pcap檔案: %v", err)
+	}
+	handle.Close()
+
+	var out bytes.Buffer
+	savedInfo := infoOut
+	infoOut = io.Discard
+	events = newEventWriter(nopCloser{&out})
+	lock.Lock()
+	clientStats = make(map[string]*ClientStats)
+	activeSessions = make(map[*mqttSession]bool)
+	lock.Unlock()
+	pipeline = newPacketPipeline(workers)
+	defer func() {
+		pipeline.close()
+		events = nil
+		infoOut = savedInfo
+	}()
+
+	replayPcapFiles(files)
+
+	var reports []windowEvent
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var event windowEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("無效的JSON事件 %s: %v", scanner.Text(), err)
+		}
+		if event.Type == "window" {
+			reports = append(reports, event)
+		}
+	}
+	return reports
+}
+
+func TestReplayPcapFiles(t *testing.T) {
+	at := func(sec float64) time.Time {
+		return time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC).Add(time.Duration(sec * float64(time.Second)))
+	}
+	type destination struct {
+		ip      string
+		packets int
+		imsis   []string
+	}
+	tests := []struct {
+		start, end   time.Time
+		destinations []destination
+		clients      map[string]int // client ID -> PUBLISH數
+	}{
+		{
+			// 第一個區間從第一個封包開始
+			start: at(1), end: at(15),
+			destinations: []destination{
+				{"10.1.153.153", 4, []string{"208930000000001", "208930000000002", "208930000000004"}},
+				{"10.1.153.154", 1, []string{"208930000000003"}},
+			},
+			clients: map[string]int{"upf-a": 4, "upf-b": 2},
+		},
+		{
+			// 最後一個區間在最後一個封包結束
+			start: at(15), end: at(25),
+			destinations: []destination{
+				{"10.1.153.153", 2, []string{"208930000000001", "208930000000005"}},
+				{"10.1.153.154", 2, []string{"208930000000003", "208930000000006"}},
+			},
+			clients: map[string]int{"upf-a": 1, "upf-b": 2, "upf-c": 1},
+		},
+	}
+
+	// 單一和多個工作協程的結果應相同
+	for _, workers := range []int{1, 4} {
+		reports := replayWindows(t, workers, twoIntervalsPcap)
+		if len(reports) != len(tests) {
+			t.Fatalf("workers=%d: %d 個統計區間，應為 %d", workers, len(reports), len(tests))
+		}
+		for i, tt := range tests {
+			report := reports[i]
+			if !report.Start.Equal(tt.start) || !report.End.Equal(tt.end) {
+				t.Errorf("workers=%d 區間%d: %v - %v，應為 %v - %v", workers, i, report.Start, report.End, tt.start, tt.end)
+			}
+			var got []destination
+			for _, d := range report.Destinations {
+				got = append(got, destination{d.DestinationIP, d.Packets, d.Imsis})
+				if d.DistinctImsi != len(d.Imsis) {
+					t.Errorf("workers=%d 區間%d %s: 獨立IMSI數 %d，列表 %v", workers, i, d.DestinationIP, d.DistinctImsi, d.Imsis)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.destinations) {
+				t.Errorf("workers=%d 區間%d: 目標IP統計 %v，應為 %v", workers, i, got, tt.destinations)
+			}
+			clients := make(map[string]int)
+			for _, c := range report.Clients {
+				clients[c.ClientID] = c.Packets
+			}
+			if !reflect.DeepEqual(clients, tt.clients) {
+				t.Errorf("workers=%d 區間%d: 客戶端統計 %v，應為 %v", workers, i, clients, tt.clients)
+			}
+		}
+	}
+}
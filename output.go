@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"getMqtt/roster"
+	"getMqtt/schema"
+)
+
+// 輸出格式
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+var (
+	// 啟動訊息、介面變化等狀態訊息的輸出位置。
+	// JSON輸出到stdout時改為stderr，讓stdout只有NDJSON方便接jq。
+	infoOut io.Writer = os.Stdout
+
+	// JSON事件輸出，text模式為nil
+	events *eventWriter
+)
+
+// 每個PUBLISH一筆的事件
+type publishEvent struct {
+	Type        string    `json:"type"`
+	Timestamp   time.Time `json:"timestamp"`
+	Src         string    `json:"src"`
+	Dst         string    `json:"dst"`
+	Topic       string    `json:"topic"`
+	Imsi        string    `json:"imsi,omitempty"`
+	PayloadSize int       `json:"payloadSize"`
+	QoS         byte      `json:"qos"`
+	Retain      bool      `json:"retain"`
+	PacketID    uint16    `json:"packetId,omitempty"`
+
+	// 擷取規格取出的欄位
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// 每個MQTT over TLS連線一筆的事件
+type tlsEvent struct {
+	Type         string     `json:"type"`
+	Timestamp    time.Time  `json:"timestamp"`
+	Client       string     `json:"client"`
+	Server       string     `json:"server"`
+	ServerName   string     `json:"serverName,omitempty"`
+	ALPN         []string   `json:"alpn,omitempty"`
+	Version      string     `json:"version"`
+	CipherSuite  string     `json:"cipherSuite"`
+	CertSubject  string     `json:"certSubject,omitempty"`
+	CertIssuer   string     `json:"certIssuer,omitempty"`
+	CertNotAfter *time.Time `json:"certNotAfter,omitempty"`
+	Decrypted    bool       `json:"decrypted"`
+}
+
+// 每個統計區間一筆的事件
+type windowEvent struct {
+	Type            string                  `json:"type"`
+	WindowType      string                  `json:"windowType"`
+	DistinctMode    string                  `json:"distinctMode"`               // exact 或 hll
+	DistinctError   float64                 `json:"distinctStdError,omitempty"` // hll模式獨立IMSI數的相對標準誤差
+	Start           time.Time               `json:"start"`
+	End             time.Time               `json:"end"`
+	IntervalSeconds float64                 `json:"intervalSeconds"`
+	Destinations    []destinationEvent      `json:"destinations"`
+	Clients         []clientEvent           `json:"clients"`
+	Topics          []topicEvent            `json:"topics"`
+	TopicPatterns   []topicEvent            `json:"topicPatterns,omitempty"` // 按 -topic-patterns 樣式的統計
+	Groups          []groupEvent            `json:"groups,omitempty"`
+	Interfaces      map[string]uint64       `json:"interfaces,omitempty"`
+	Capture         map[string]captureStats `json:"capture,omitempty"`     // 各介面本區間抓包後端的收到和丟棄數
+	CaptureLoss     *float64                `json:"captureLoss,omitempty"` // 所有介面的遺失比例，離線模式省略
+	Failures        map[string]uint64       `json:"failures"`              // 未被統計的封包數（按原因）
+	Roster          *roster.Result          `json:"roster,omitempty"`      // 和預期IMSI名單的比對
+	Cadence         *cadenceReport          `json:"cadence,omitempty"`     // 各IMSI的回報週期
+	Fanout          *fanoutReport           `json:"fanout,omitempty"`      // broker轉發給各訂閱者的結果
+}
+
+type destinationEvent struct {
+	DestinationIP string   `json:"destinationIp"`
+	SourceIP      string   `json:"sourceIp"`
+	Packets       int      `json:"packets"`
+	Rate          float64  `json:"rate"` // 每秒PUBLISH數
+	DistinctImsi  int      `json:"distinctImsi"`
+	Imsis         []string `json:"imsis"` // hll模式沒有保存IMSI，為null
+}
+
+// 一個主題或主題樣式
+type topicEvent struct {
+	Topic        string `json:"topic"`
+	Packets      int    `json:"packets"`
+	Bytes        int64  `json:"bytes"` // payload位元組數
+	DistinctImsi int    `json:"distinctImsi"`
+}
+
+func newTopicEvents(topics map[string]*TopicStats) []topicEvent {
+	events := make([]topicEvent, 0, len(topics))
+	for _, key := range sortedKeys(topics) {
+		stat := topics[key]
+		events = append(events, topicEvent{Topic: key, Packets: stat.Count, Bytes: stat.Bytes, DistinctImsi: stat.ImsiSet.Len()})
+	}
+	return events
+}
+
+// 擷取規格的一個分組
+type groupEvent struct {
+	Keys         map[string]string  `json:"keys"`
+	Packets      int                `json:"packets"`
+	DistinctImsi int                `json:"distinctImsi"`
+	Values       map[string]float64 `json:"values,omitempty"` // 依欄位用途為加總或平均
+}
+
+type clientEvent struct {
+	ClientID       string             `json:"clientId"`
+	Username       string             `json:"username,omitempty"`
+	ProtocolLevel  byte               `json:"protocolLevel,omitempty"`
+	KeepAlive      uint16             `json:"keepAlive"`
+	Addresses      []string           `json:"addresses"`
+	Packets        int                `json:"packets"`
+	DistinctImsi   int                `json:"distinctImsi"`
+	Imsis          []string           `json:"imsis"`
+	Connects       int                `json:"connects"`
+	ActiveSessions int                `json:"activeSessions"`
+	EndedSessions  []sessionEndRecord `json:"endedSessions,omitempty"`
+	QoS            []qosEvent         `json:"qos,omitempty"` // QoS 1/2的確認流程，沒有QoS 1/2的PUBLISH時省略
+}
+
+// 一個客戶端在一個方向上的QoS 1/2確認流程
+type qosEvent struct {
+	Direction          string           `json:"direction"` // to_broker（客戶端送出）或 to_client（收到的PUBLISH）
+	Publishes          int              `json:"publishes"`
+	Acked              int              `json:"acked"`
+	Rejected           int              `json:"rejected"`
+	Unacked            int              `json:"unacked"`
+	Retransmissions    int              `json:"retransmissions"`
+	RetransmissionRate float64          `json:"retransmissionRate"`
+	Dup                int              `json:"dup"`
+	UnmatchedAcks      int              `json:"unmatchedAcks"`
+	UnmatchedReleases  int              `json:"unmatchedReleases"`
+	Qos1Latency        *durationSummary `json:"qos1Latency,omitempty"` // PUBLISH到PUBACK
+	Qos2Latency        *durationSummary `json:"qos2Latency,omitempty"` // PUBLISH到PUBCOMP
+}
+
+type sessionEndRecord struct {
+	Client          string    `json:"client"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Publishes       int       `json:"publishes"`
+	Partial         bool      `json:"partial,omitempty"`
+	Abnormal        bool      `json:"abnormal"`
+	Reason          string    `json:"reason"`
+}
+
+// session開始或結束時一筆的事件
+type sessionEvent struct {
+	Type          string            `json:"type"`
+	Event         string            `json:"event"` // start 或 end
+	Timestamp     time.Time         `json:"timestamp"`
+	ClientID      string            `json:"clientId"`
+	Username      string            `json:"username,omitempty"`
+	ProtocolLevel byte              `json:"protocolLevel,omitempty"`
+	KeepAlive     uint16            `json:"keepAlive"`
+	Client        string            `json:"client"`
+	Broker        string            `json:"broker"`
+	End           *sessionEndRecord `json:"session,omitempty"`
+}
+
+func newSessionEndRecord(end *SessionEnd) sessionEndRecord {
+	return sessionEndRecord{
+		Client:          end.Client,
+		Start:           end.Start,
+		End:             end.End,
+		DurationSeconds: end.End.Sub(end.Start).Seconds(),
+		Publishes:       end.Publishes,
+		Partial:         end.Partial,
+		Abnormal:        end.Abnormal,
+		Reason:          end.Reason,
+	}
+}
+
+// 以NDJSON格式（每行一個JSON物件）寫出事件
+type eventWriter struct {
+	mu      sync.Mutex
+	out     io.WriteCloser
+	encoder *json.Encoder
+}
+
+func newEventWriter(out io.WriteCloser) *eventWriter {
+	return &eventWriter{out: out, encoder: json.NewEncoder(out)}
+}
+
+func (w *eventWriter) write(v interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.encoder.Encode(v); err != nil {
+		log.Printf("寫出JSON事件失敗: %v", err)
+	}
+}
+
+func (w *eventWriter) publish(msg *mqttMessage, topic string, record *schema.Record) {
+	pkt := msg.packet
+	event := &publishEvent{
+		Type:        "publish",
+		Timestamp:   msg.timestamp,
+		Src:         joinHostPort(msg.srcIP, msg.srcPort),
+		Dst:         joinHostPort(msg.dstIP, msg.dstPort),
+		Topic:       topic,
+		PayloadSize: len(pkt.Payload),
+		QoS:         pkt.QoS,
+		Retain:      pkt.Retain,
+		PacketID:    pkt.PacketID,
+	}
+	if record != nil {
+		event.Imsi = record.Imsi
+		event.Fields = payloadSchema.RecordMap(record)
+	}
+	w.write(event)
+}
+
+func (w *eventWriter) tls(timestamp time.Time, client, server string, info *tlsInfo) {
+	event := &tlsEvent{
+		Type:        "tls",
+		Timestamp:   timestamp,
+		Client:      client,
+		Server:      server,
+		ServerName:  info.ServerName,
+		ALPN:        info.ALPN,
+		Version:     info.versionName(),
+		CipherSuite: info.cipherName(),
+		CertSubject: info.CertSubject,
+		CertIssuer:  info.CertIssuer,
+		Decrypted:   info.KeyFound,
+	}
+	if !info.CertNotAfter.IsZero() {
+		event.CertNotAfter = &info.CertNotAfter
+	}
+	w.write(event)
+}
+
+func (w *eventWriter) session(session *mqttSession, end *SessionEnd) {
+	event := &sessionEvent{
+		Type:          "session",
+		Event:         "start",
+		Timestamp:     session.Start,
+		ClientID:      session.key(),
+		Username:      session.Username,
+		ProtocolLevel: session.ProtocolLevel,
+		KeepAlive:     session.KeepAlive,
+		Client:        session.Client,
+		Broker:        session.Broker,
+	}
+	if end != nil {
+		record := newSessionEndRecord(end)
+		event.Event = "end"
+		event.Timestamp = end.End
+		event.End = &record
+	}
+	w.write(event)
+}
+
+func (w *eventWriter) window(report *WindowReport) {
+	event := &windowEvent{
+		Type:            "window",
+		WindowType:      windows.kind,
+		DistinctMode:    config.DistinctMode,
+		DistinctError:   config.imsiStdError(),
+		Start:           report.Start,
+		End:             report.End,
+		IntervalSeconds: report.End.Sub(report.Start).Seconds(),
+		Destinations:    make([]destinationEvent, 0, len(report.Stats)),
+		Interfaces:      report.Interfaces,
+		Capture:         report.Capture,
+		Failures:        report.Failures,
+		Topics:          newTopicEvents(report.Topics),
+		Roster:          report.Roster,
+		Cadence:         report.Cadence,
+		Fanout:          report.Fanout,
+	}
+	if len(report.Patterns) > 0 {
+		event.TopicPatterns = newTopicEvents(report.Patterns)
+	}
+	if report.Capture != nil {
+		loss := report.captureTotal().lossRatio()
+		event.CaptureLoss = &loss
+	}
+	for _, ip := range sortedKeys(report.Stats) {
+		stat := report.Stats[ip]
+		event.Destinations = append(event.Destinations, destinationEvent{
+			DestinationIP: ip,
+			SourceIP:      stat.SourceIP,
+			Packets:       stat.Count,
+			Rate:          report.rate(stat),
+			DistinctImsi:  stat.ImsiSet.Len(),
+			Imsis:         stat.ImsiSet.Members(),
+		})
+	}
+	event.Clients = make([]clientEvent, 0, len(report.Clients))
+	for _, key := range sortedKeys(report.Clients) {
+		stat := report.Clients[key]
+		client := clientEvent{
+			ClientID:       key,
+			Username:       stat.Username,
+			ProtocolLevel:  stat.ProtocolLevel,
+			KeepAlive:      stat.KeepAlive,
+			Addresses:      sortedKeys(stat.Addresses),
+			Packets:        stat.Count,
+			DistinctImsi:   stat.ImsiSet.Len(),
+			Imsis:          stat.ImsiSet.Members(),
+			Connects:       stat.Connects,
+			ActiveSessions: stat.Active,
+		}
+		for i := range stat.Ended {
+			client.EndedSessions = append(client.EndedSessions, newSessionEndRecord(&stat.Ended[i]))
+		}
+		for dir := range stat.QoS {
+			s := &stat.QoS[dir]
+			if s.empty() {
+				continue
+			}
+			client.QoS = append(client.QoS, qosEvent{
+				Direction:          qosDirectionLabels[dir],
+				Publishes:          s.Publishes,
+				Acked:              s.Acked,
+				Rejected:           s.Rejected,
+				Unacked:            s.Unacked,
+				Retransmissions:    s.Retransmissions,
+				RetransmissionRate: s.retransmissionRate(),
+				Dup:                s.Dup,
+				UnmatchedAcks:      s.Unmatched,
+				UnmatchedReleases:  s.UnmatchedRel,
+				Qos1Latency:        s.latency(1),
+				Qos2Latency:        s.latency(2),
+			})
+		}
+		event.Clients = append(event.Clients, client)
+	}
+	for _, group := range report.Groups {
+		event.Groups = append(event.Groups, groupEvent{
+			Keys:         payloadSchema.KeyMap(group),
+			Packets:      group.Count,
+			DistinctImsi: group.ImsiSet.Len(),
+			Values:       payloadSchema.ValueMap(group),
+		})
+	}
+	w.write(event)
+}
+
+func (w *eventWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.out.Close()
+}
+
+func joinHostPort(ip string, port uint16) string {
+	return net.JoinHostPort(ip, strconv.Itoa(int(port)))
+}
+
+// 依配置建立輸出，回傳錯誤時程序應結束
+func setupOutput(cfg *Config) error {
+	if cfg.Output != outputJSON {
+		return nil
+	}
+	if cfg.OutputFile == "" {
+		infoOut = os.Stderr
+		events = newEventWriter(nopCloser{os.Stdout})
+		return nil
+	}
+	file, err := openRotatingFile(cfg.OutputFile, int64(cfg.OutputMaxMB)*1024*1024, cfg.OutputMaxFiles)
+	if err != nil {
+		return err
+	}
+	events = newEventWriter(file)
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// 超過大小上限時輪替的檔案：path -> path.1 -> path.2 ...，最多保留 maxFiles 個舊檔
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxBytes int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("無法打開輸出檔案 %s: %v", r.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxBytes > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	if r.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxFiles))
+		for i := r.maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
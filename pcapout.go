@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"getMqtt/roster"
+)
+
+// 把通過目標IP和端口檢查的封包存成pcapng：
+// -pcap-out 持續寫入檔案，依大小或時間輪替；
+// -recorder 在記憶體保留最近一段時間的封包（flight recorder），觸發條件成立時寫到 -recorder-dir。
+
+const (
+	// flight recorder最多保留的封包位元組數，超過時丟棄最舊的封包
+	recorderMaxBytes = 256 * 1024 * 1024
+	// pcapng每個封包區塊除了資料以外的長度
+	pcapngBlockOverhead = 32
+)
+
+// 寫入pcapng的一個封包
+type savedPacket struct {
+	linkType layers.LinkType
+	ci       gopacket.CaptureInfo
+	data     []byte
+}
+
+// 封包的連結層類型，由解碼出的第一層判斷
+func packetLinkType(packet gopacket.Packet) (layers.LinkType, bool) {
+	packetLayers := packet.Layers()
+	if len(packetLayers) == 0 {
+		return 0, false
+	}
+	switch packetLayers[0].LayerType() {
+	case layers.LayerTypeEthernet:
+		return layers.LinkTypeEthernet, true
+	case layers.LayerTypeLinuxSLL:
+		return layers.LinkTypeLinuxSLL, true
+	case layers.LayerTypeLoopback:
+		return layers.LinkTypeNull, true
+	case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+		return layers.LinkTypeRaw, true
+	}
+	return 0, false
+}
+
+// 把封包交給pcapng輸出和flight recorder，在分派封包的協程中呼叫
+func savePacket(packet gopacket.Packet) {
+	linkType, ok := packetLinkType(packet)
+	if !ok {
+		if debugOn() {
+			log.Printf("[any] 不支援的連結層，封包不寫入pcapng")
+		}
+		return
+	}
+	saved := savedPacket{linkType: linkType, ci: packet.Metadata().CaptureInfo, data: packet.Data()}
+	// 重組後的IPv6分片長度和原本的捕獲資訊不同
+	saved.ci.CaptureLength = len(saved.data)
+	if saved.ci.Length < saved.ci.CaptureLength {
+		saved.ci.Length = saved.ci.CaptureLength
+	}
+	saved.ci.InterfaceIndex = 0
+	if pcapOut != nil {
+		pcapOut.write(saved)
+	}
+	if recorder != nil {
+		recorder.add(saved)
+	}
+}
+
+// 一個pcapng區段，每種連結層類型一個介面描述區塊，在第一個封包時寫入區段標頭
+type pcapngFile struct {
+	out        io.Writer
+	writer     *pcapgo.NgWriter
+	interfaces map[layers.LinkType]int
+}
+
+func newPcapngFile(out io.Writer) *pcapngFile {
+	return &pcapngFile{out: out, interfaces: make(map[layers.LinkType]int)}
+}
+
+func pcapngInterface(linkType layers.LinkType) pcapgo.NgInterface {
+	return pcapgo.NgInterface{
+		Name:                linkType.String(),
+		OS:                  runtime.GOOS,
+		LinkType:            linkType,
+		TimestampResolution: 9,
+	}
+}
+
+func (f *pcapngFile) write(packet savedPacket) error {
+	id, ok := f.interfaces[packet.linkType]
+	switch {
+	case ok:
+	case f.writer == nil:
+		options := pcapgo.NgWriterOptions{SectionInfo: pcapgo.NgSectionInfo{
+			Hardware:    runtime.GOARCH,
+			OS:          runtime.GOOS,
+			Application: "getMqtt",
+		}}
+		writer, err := pcapgo.NewNgWriterInterface(f.out, pcapngInterface(packet.linkType), options)
+		if err != nil {
+			return err
+		}
+		f.writer = writer
+		f.interfaces[packet.linkType] = 0
+	default:
+		var err error
+		if id, err = f.writer.AddInterface(pcapngInterface(packet.linkType)); err != nil {
+			return err
+		}
+		f.interfaces[packet.linkType] = id
+	}
+	packet.ci.InterfaceIndex = id
+	return f.writer.WritePacket(packet.ci, packet.data)
+}
+
+func (f *pcapngFile) flush() error {
+	if f.writer == nil {
+		return nil
+	}
+	return f.writer.Flush()
+}
+
+// 持續寫入的pcapng檔案，超過大小或時間（封包時間）時輪替：path -> path.1 -> path.2 ...
+type pcapWriter struct {
+	mu       sync.Mutex
+	out      *rotatingFile
+	file     *pcapngFile
+	maxBytes int64
+	rotate   time.Duration
+	started  time.Time // 目前檔案第一個封包的時間
+	size     int64     // 目前檔案已寫入的封包區塊大小
+	packets  uint64    // 累計寫入的封包數
+	failed   bool      // 寫入失敗後不再寫入
+}
+
+func openPcapWriter(path string, maxBytes int64, rotate time.Duration, maxFiles int) (*pcapWriter, error) {
+	// 輪替由pcapWriter決定，每個檔案都從新的區段標頭開始
+	out, err := openRotatingFile(path, 0, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	if out.size > 0 {
+		if err := out.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return &pcapWriter{out: out, file: newPcapngFile(out), maxBytes: maxBytes, rotate: rotate}, nil
+}
+
+func (w *pcapWriter) write(packet savedPacket) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failed {
+		return
+	}
+	size := int64(len(packet.data) + pcapngBlockOverhead)
+	if w.packets > 0 && ((w.maxBytes > 0 && w.size+size > w.maxBytes) ||
+		(w.rotate > 0 && packet.ci.Timestamp.Sub(w.started) >= w.rotate)) {
+		w.file.flush()
+		if err := w.out.rotate(); err != nil {
+			w.fail(err)
+			return
+		}
+		w.file = newPcapngFile(w.out)
+		w.size = 0
+	}
+	if w.size == 0 {
+		w.started = packet.ci.Timestamp
+	}
+	if err := w.file.write(packet); err != nil {
+		w.fail(err)
+		return
+	}
+	w.size += size
+	w.packets++
+}
+
+// 呼叫者需持有 w.mu
+func (w *pcapWriter) fail(err error) {
+	w.failed = true
+	log.Printf("無法寫入pcapng檔案 %s，停止寫入: %v", w.out.path, err)
+}
+
+// 寫出緩衝的封包，在每個統計區間結束時呼叫
+func (w *pcapWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.file.flush(); err != nil && !w.failed {
+		w.fail(err)
+	}
+}
+
+func (w *pcapWriter) close() {
+	w.flush()
+	w.out.Close()
+}
+
+func (w *pcapWriter) written() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.packets
+}
+
+// 觸發條件的名稱，也用在檔名和指標標籤
+const (
+	triggerImsi    = "imsi"     // 指定的IMSI出現
+	triggerMinImsi = "min_imsi" // 區間的獨立IMSI數降到門檻以下
+)
+
+// 在記憶體保留最近 length 的封包（封包時間），觸發時寫成pcapng檔案。
+// 同一種觸發條件寫出後的 length 內不再寫出，避免指定的IMSI每次出現都寫一個檔案。
+type flightRecorder struct {
+	mu       sync.Mutex
+	length   time.Duration
+	dir      string
+	packets  []savedPacket // 依時間排序，最舊的在前
+	bytes    int
+	latest   time.Time
+	lastDump map[string]time.Time // 按觸發條件上次寫出的觸發時間
+	dumps    map[string]uint64    // 按觸發條件累計的寫出次數
+	writing  sync.WaitGroup
+
+	imsis   *roster.Roster // 出現時觸發的IMSI，未指定時為nil
+	minImsi int            // 區間的獨立IMSI數低於此值時觸發，0表示不觸發
+	above   bool           // 上一個區間的獨立IMSI數不低於 minImsi，只在降下來時觸發一次
+}
+
+func newFlightRecorder(length time.Duration, dir string, imsis *roster.Roster, minImsi int) *flightRecorder {
+	return &flightRecorder{
+		length:   length,
+		dir:      dir,
+		imsis:    imsis,
+		minImsi:  minImsi,
+		lastDump: make(map[string]time.Time),
+		dumps:    make(map[string]uint64),
+	}
+}
+
+func (r *flightRecorder) add(packet savedPacket) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if packet.ci.Timestamp.After(r.latest) {
+		r.latest = packet.ci.Timestamp
+	}
+	r.packets = append(r.packets, packet)
+	r.bytes += len(packet.data)
+
+	oldest := r.latest.Add(-r.length)
+	drop := 0
+	for drop < len(r.packets) && (r.packets[drop].ci.Timestamp.Before(oldest) || r.bytes > recorderMaxBytes) {
+		r.bytes -= len(r.packets[drop].data)
+		drop++
+	}
+	// 底層陣列在append需要擴充時換成只有保留部分的新陣列
+	r.packets = r.packets[drop:]
+}
+
+// 工作協程解出IMSI時呼叫，at 為PUBLISH的封包時間
+func (r *flightRecorder) observeImsi(imsi string, at time.Time) {
+	if r.imsis != nil && r.imsis.Contains(imsi) {
+		r.trigger(triggerImsi, imsi, at)
+	}
+}
+
+// 每個統計區間結束時檢查獨立IMSI數
+func (r *flightRecorder) observeWindow(report *WindowReport) {
+	if r.minImsi <= 0 {
+		return
+	}
+	count := report.distinctImsi()
+	r.mu.Lock()
+	dropped := r.above && count < r.minImsi
+	r.above = count >= r.minImsi
+	r.mu.Unlock()
+	if dropped {
+		r.trigger(triggerMinImsi, fmt.Sprint(count), report.End)
+	}
+}
+
+// 把目前保留的封包寫成檔案，檔名帶觸發時間、條件和 detail。
+// 工作協程處理PUBLISH時分派協程可能已經送出更新的封包，檔案會包含觸發之後的一些封包
+func (r *flightRecorder) trigger(reason, detail string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if last, ok := r.lastDump[reason]; len(r.packets) == 0 || (ok && at.Sub(last) < r.length) {
+		return
+	}
+	r.lastDump[reason] = at
+	r.dumps[reason]++
+	packets := append([]savedPacket(nil), r.packets...)
+	path := filepath.Join(r.dir, fmt.Sprintf("recorder-%s-%s-%s.pcapng", at.Format("20060102-150405.000"), reason, detail))
+
+	// 寫檔不佔用分派封包和產生報告的協程
+	r.writing.Add(1)
+	go func() {
+		defer r.writing.Done()
+		if err := writePcapngFile(path, packets); err != nil {
+			log.Printf("flight recorder無法寫出 %s: %v", path, err)
+			return
+		}
+		log.Printf("flight recorder觸發（%s %s）: 已寫出 %d 個封包（%s - %s）到 %s", reason, detail, len(packets),
+			packets[0].ci.Timestamp.Format("15:04:05.000"), packets[len(packets)-1].ci.Timestamp.Format("15:04:05.000"), path)
+	}()
+}
+
+// 等待寫出中的檔案完成，程式結束前呼叫
+func (r *flightRecorder) wait() {
+	r.writing.Wait()
+}
+
+// 按觸發條件累計的寫出次數和目前保留的封包數
+func (r *flightRecorder) stats() (map[string]uint64, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dumps := make(map[string]uint64, len(r.dumps))
+	for reason, count := range r.dumps {
+		dumps[reason] = count
+	}
+	return dumps, len(r.packets)
+}
+
+func writePcapngFile(path string, packets []savedPacket) error {
+	// 封包由多個介面交錯送入，寫出前依時間排序
+	sort.SliceStable(packets, func(i, j int) bool { return packets[i].ci.Timestamp.Before(packets[j].ci.Timestamp) })
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	out := newPcapngFile(file)
+	for _, packet := range packets {
+		if err := out.write(packet); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := out.flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// 依配置打開pcapng檔案和建立flight recorder
+func setupPcapOutputs() error {
+	if config.PcapOut != "" {
+		writer, err := openPcapWriter(config.PcapOut, int64(config.PcapMaxMB)*1024*1024, config.PcapRotate, config.PcapMaxFiles)
+		if err != nil {
+			return err
+		}
+		pcapOut = writer
+		fmt.Fprintf(infoOut, "封包寫入 %s（%d MB或 %v 輪替，保留 %d 個舊檔）\n", config.PcapOut, config.PcapMaxMB, config.PcapRotate, config.PcapMaxFiles)
+	}
+	if config.Recorder <= 0 {
+		return nil
+	}
+	var imsis *roster.Roster
+	if config.TriggerImsi != "" {
+		var err error
+		if imsis, err = roster.Load(config.TriggerImsi); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(config.RecorderDir, 0755); err != nil {
+		return fmt.Errorf("無法建立flight recorder目錄: %v", err)
+	}
+	recorder = newFlightRecorder(config.Recorder, config.RecorderDir, imsis, config.TriggerMinImsi)
+	fmt.Fprintf(infoOut, "flight recorder: 保留最近 %v 的封包，觸發時寫到 %s\n", config.Recorder, config.RecorderDir)
+	return nil
+}
+
+// 程式結束前寫出所有緩衝的封包
+func closePcapOutputs() {
+	if pcapOut != nil {
+		pcapOut.close()
+	}
+	if recorder != nil {
+		recorder.wait()
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+
+	"getMqtt/schema"
+)
+
+// 每個工作協程的佇列長度
+const workerQueueSize = 1024
+
+// 送往工作協程的項目：一個TCP段或一個控制指令。
+// 控制指令和封包走同一個佇列，所以工作協程處理到指令時，之前送出的封包都已處理完。
+type workItem struct {
+	netFlow gopacket.Flow
+	tcp     *layers.TCP
+	ctx     *captureContext
+
+	flush    time.Time            // 非零時清理重組器，為目前的封包時間
+	flushAll bool                 // 送出所有暫存資料並關閉所有連線
+	swap     chan *aggregateShard // 換成新的分片，舊分片送回
+	done     chan struct{}        // flushAll完成後關閉
+}
+
+// 一個工作協程的統計分片，只由該協程寫入。
+// 報告時整個換成新的分片，舊分片交給報告協程合併，不需要在熱路徑上加鎖或複製。
+type aggregateShard struct {
+	windows  *windowEngine           // 按目標IP的視窗統計
+	clients  map[string]*ClientStats // 按client ID的PUBLISH數和IMSI
+	topics   map[string]*TopicStats  // 按主題的PUBLISH數、位元組數和IMSI
+	patterns map[string]*TopicStats  // 按 -topic-patterns 樣式的統計
+	groups   *schema.Aggregator      // 按擷取規格的分組彙總
+
+	// 按IMSI的PUBLISH時間，沒有啟用回報週期分析時為nil
+	arrivals map[string][]time.Time
+	// broker轉發驗證的事件，沒有啟用時為nil
+	fanout *fanoutEvents
+}
+
+func newAggregateShard() *aggregateShard {
+	shard := &aggregateShard{
+		windows:  newWindowEngine(&config, time.Time{}),
+		clients:  make(map[string]*ClientStats),
+		topics:   make(map[string]*TopicStats),
+		patterns: make(map[string]*TopicStats),
+		groups:   schema.NewAggregator(payloadSchema, config.imsiPrecision()),
+	}
+	if config.ImsiPeriod > 0 {
+		shard.arrivals = make(map[string][]time.Time)
+	}
+	if config.FanoutTimeout > 0 {
+		shard.fanout = &fanoutEvents{}
+	}
+	return shard
+}
+
+// 一個工作協程：擁有自己的TCP重組器和統計分片。
+// 同一條TCP連線的兩個方向永遠送到同一個工作協程，連線狀態不需要加鎖。
+type packetWorker struct {
+	items     chan workItem
+	assembler *reassembly.Assembler
+	shard     *aggregateShard
+	draining  bool // flushAll中，關閉的連線不記未確認
+}
+
+func newPacketWorker() *packetWorker {
+	w := &packetWorker{shard: newAggregateShard()}
+	w.assembler = newMqttAssembler(w)
+	return w
+}
+
+func (w *packetWorker) run() {
+	for item := range w.items {
+		w.handle(item)
+	}
+}
+
+func (w *packetWorker) handle(item workItem) {
+	switch {
+	case item.tcp != nil:
+		w.assembler.AssembleWithContext(item.netFlow, item.tcp, item.ctx)
+	case !item.flush.IsZero():
+		flushAssembler(w.assembler, item.flush)
+		w.expireQoS(item.flush)
+	case item.flushAll:
+		w.draining = true
+		w.assembler.FlushAll()
+		w.draining = false
+		close(item.done)
+	case item.swap != nil:
+		shard := w.shard
+		w.shard = newAggregateShard()
+		item.swap <- shard
+	}
+}
+
+// 把封包分給工作協程處理的管線
+type packetPipeline struct {
+	workers []*packetWorker
+}
+
+// 建立管線並啟動 workers 個工作協程
+func newPacketPipeline(workers int) *packetPipeline {
+	p := &packetPipeline{}
+	for i := 0; i < workers; i++ {
+		w := newPacketWorker()
+		w.items = make(chan workItem, workerQueueSize)
+		p.workers = append(p.workers, w)
+		go w.run()
+	}
+	return p
+}
+
+// 依連線分派一個TCP段。Flow的FastHash兩個方向相同，所以同一條連線落在同一個工作協程
+func (p *packetPipeline) dispatch(netFlow gopacket.Flow, tcp *layers.TCP, ctx *captureContext) {
+	hash := netFlow.FastHash()*31 + tcp.TransportFlow().FastHash()
+	p.workers[hash%uint64(len(p.workers))].items <- workItem{netFlow: netFlow, tcp: tcp, ctx: ctx}
+}
+
+// 清理所有重組器，now 為目前的封包時間
+func (p *packetPipeline) flush(now time.Time) {
+	for _, w := range p.workers {
+		w.items <- workItem{flush: now}
+	}
+}
+
+// 送出所有暫存資料並關閉所有連線，等全部完成後才回傳
+func (p *packetPipeline) flushAll() {
+	pending := make([]chan struct{}, 0, len(p.workers))
+	for _, w := range p.workers {
+		done := make(chan struct{})
+		pending = append(pending, done)
+		w.items <- workItem{flushAll: true, done: done}
+	}
+	for _, done := range pending {
+		<-done
+	}
+}
+
+// 換出所有工作協程的分片。回傳時之前分派的封包都已處理完
+func (p *packetPipeline) swap() []*aggregateShard {
+	replies := make([]chan *aggregateShard, 0, len(p.workers))
+	for _, w := range p.workers {
+		reply := make(chan *aggregateShard, 1)
+		replies = append(replies, reply)
+		w.items <- workItem{swap: reply}
+	}
+	shards := make([]*aggregateShard, 0, len(replies))
+	for _, reply := range replies {
+		shards = append(shards, <-reply)
+	}
+	return shards
+}
+
+// 結束工作協程，之後不能再使用管線
+func (p *packetPipeline) close() {
+	for _, w := range p.workers {
+		close(w.items)
+	}
+}
+
+// 把所有分片併入全域統計，之後的報告和指標都從全域統計取得
+func collectShards() {
+	shards := pipeline.swap()
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, shard := range shards {
+		windows.merge(shard.windows)
+		mergeClients(clientStats, shard.clients)
+		mergeTopics(topicStats, shard.topics)
+		mergeTopics(patternStats, shard.patterns)
+		payloadGroups.Merge(shard.groups)
+		if cadence != nil {
+			cadence.merge(shard.arrivals)
+		}
+	}
+	if fanout != nil {
+		events := make([]*fanoutEvents, 0, len(shards))
+		for _, shard := range shards {
+			events = append(events, shard.fanout)
+		}
+		fanout.merge(events)
+	}
+}
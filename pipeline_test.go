@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// 效能測試的連線數，封包依序輪流分配到各連線
+const benchConnections = 64
+
+// 以合成的MQTT流量測試封包處理速度。
+// baseline模擬改用工作協程前的流程（在同一個協程中直接處理，每個封包加鎖一次），其他依序加倍到CPU數。
+// 封包在計時前已建立並解碼好，只測量封包檢查、TCP重組、MQTT和payload解析和統計。
+func BenchmarkPipeline(b *testing.B) {
+	config = defaultConfig()
+	// 不輸出每個封包的訊息
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	os.Stdout = devNull
+	defer func() {
+		os.Stdout = stdout
+		devNull.Close()
+	}()
+
+	counts := []int{0}
+	for n := 1; n < runtime.NumCPU(); n *= 2 {
+		counts = append(counts, n)
+	}
+	counts = append(counts, runtime.NumCPU())
+	for _, workers := range counts {
+		name := fmt.Sprintf("workers=%d", workers)
+		if workers == 0 {
+			name = "baseline"
+		}
+		b.Run(name, func(b *testing.B) {
+			benchRun(b, workers)
+		})
+	}
+}
+
+// 以指定的工作協程數處理 b.N 個封包，回報每秒封包數和統計到的獨立IMSI數
+func benchRun(b *testing.B, workers int) {
+	packets := benchPackets(b.N)
+	start := packets[0].Metadata().Timestamp.Truncate(config.Interval)
+	lock.Lock()
+	windows = newWindowEngine(&config, start)
+	clientStats = make(map[string]*ClientStats)
+	activeSessions = make(map[*mqttSession]bool)
+	lock.Unlock()
+
+	b.ResetTimer()
+	if workers == 0 {
+		serialRun(packets)
+	} else {
+		pipeline = newPacketPipeline(workers)
+		for _, packet := range packets {
+			processPacket(packet)
+		}
+	}
+	collectShards()
+	b.StopTimer()
+	pipeline.close()
+
+	end := packets[len(packets)-1].Metadata().Timestamp.Truncate(windows.pane).Add(windows.pane)
+	lock.Lock()
+	_, stats := windows.window(end)
+	lock.Unlock()
+	distinctImsi := 0
+	for _, stat := range stats {
+		distinctImsi += stat.ImsiSet.Len()
+	}
+	b.ReportMetric(float64(len(packets))/b.Elapsed().Seconds(), "packets/s")
+	b.ReportMetric(float64(distinctImsi), "imsi")
+}
+
+// 效能測試的比較基準：和改用工作協程前一樣，所有封包在同一個協程中重組和解析，每個封包加鎖一次。
+// session追蹤自己會取得全域 lock，所以改用另一個鎖，沒有報告協程競爭時成本相同。
+// 合成流量都是監控目標的TCP封包，省略 processPacket 的檢查。處理完後把唯一的工作協程接上管線，交給 collectShards 合併
+func serialRun(packets []gopacket.Packet) {
+	var mu sync.Mutex
+	w := newPacketWorker()
+	for _, packet := range packets {
+		ctx := &captureContext{ci: packet.Metadata().CaptureInfo}
+		item := workItem{netFlow: packet.NetworkLayer().NetworkFlow(), tcp: packet.TransportLayer().(*layers.TCP), ctx: ctx}
+		mu.Lock()
+		w.handle(item)
+		mu.Unlock()
+	}
+	w.items = make(chan workItem, workerQueueSize)
+	pipeline = &packetPipeline{workers: []*packetWorker{w}}
+	go w.run()
+}
+
+// 建立合成流量：每條連線一個CONNECT，之後輪流送出帶JSON payload的PUBLISH
+func benchPackets(count int) []gopacket.Packet {
+	broker := net.IP{10, 1, 153, 153}
+	port := uint16(config.BrokerPorts[0])
+	if len(config.TargetIPs) > 0 {
+		broker = net.ParseIP(config.TargetIPs[0])
+	}
+
+	ts := time.Now()
+	seqs := make([]uint32, benchConnections)
+	packets := make([]gopacket.Packet, 0, count)
+	segment := func(conn int, payload []byte) {
+		client := net.IP{10, 0, byte(conn >> 8), byte(conn + 1)}
+		packets = append(packets, testSegment(client, broker, uint16(40000+conn), port, seqs[conn], payload, ts))
+		seqs[conn] += uint32(len(payload))
+		ts = ts.Add(10 * time.Microsecond)
+	}
+	for conn := 0; conn < benchConnections && len(packets) < count; conn++ {
+		segment(conn, testConnect(fmt.Sprintf("bench-%d", conn)))
+	}
+	for i := 0; len(packets) < count; i++ {
+		body := fmt.Sprintf(`{"imsi":"20893%010d","dnn":"internet","sst":1,"ulBytes":%d}`, i%100000, i%1500)
+		segment(i%benchConnections, testPublish("bench/usage", body))
+	}
+	return packets
+}
+
+// 一個帶資料的TCP段，包在乙太網路和IPv4或IPv6中
+func testSegment(src, dst net.IP, srcPort, dstPort uint16, seq uint32, payload []byte, ts time.Time) gopacket.Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	var network gopacket.SerializableLayer
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort), Seq: seq, ACK: true, PSH: true, Window: 65535}
+	if dst.To4() != nil {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: dst.To4()}
+		tcp.SetNetworkLayerForChecksum(ip)
+		network = ip
+	} else {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: net.ParseIP("fd00::" + src.String()), DstIP: dst}
+		tcp.SetNetworkLayerForChecksum(ip)
+		network = ip
+	}
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		eth, network, tcp, gopacket.Payload(payload))
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	packet.Metadata().CaptureInfo = gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(buf.Bytes()), Length: len(buf.Bytes())}
+	return packet
+}
+
+// MQTT 3.1.1 CONNECT（clean session，keepalive 60秒）
+func testConnect(clientID string) []byte {
+	return mqttFrame(MQTT_CONNECT<<4, mqttStr("MQTT"), []byte{MQTT_V311, 0x02}, mqttU16(60), mqttStr(clientID))
+}
+
+// QoS 0 的PUBLISH
+func testPublish(topic, payload string) []byte {
+	return mqttFrame(MQTT_PUBLISH<<4, mqttStr(topic), []byte(payload))
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// QoS 1/2 的確認流程：依封包ID配對每個session的PUBLISH和PUBACK/PUBREC/PUBREL/PUBCOMP，
+// 計算確認延遲、重送和逾時未確認的數量，按客戶端和方向統計。
+// 持久session斷線後，等待確認的PUBLISH保留到重新連線，雙方以DUP重送時算作重送而不是新的PUBLISH。
+// 統計寫入處理目前封包的工作協程的分片。
+
+// PUBLISH的方向
+const (
+	qosToBroker = 0 // 客戶端送給broker
+	qosToClient = 1 // broker送給客戶端（訂閱者）
+)
+
+var (
+	qosDirectionNames  = [2]string{"上行", "下行"}
+	qosDirectionLabels = [2]string{"to_broker", "to_client"}
+)
+
+// 等待確認的PUBLISH所在的階段
+const (
+	qosAwaitAck  = iota // 等待PUBACK（QoS 1）或PUBREC（QoS 2）
+	qosAwaitRel         // QoS 2 已收到PUBREC，等待送出方的PUBREL
+	qosAwaitComp        // QoS 2 已送出PUBREL，等待PUBCOMP
+)
+
+// 一個等待確認的PUBLISH
+type qosFlight struct {
+	qos     byte
+	start   time.Time
+	stage   int
+	session *mqttSession // 送出或收到PUBLISH的客戶端，逾時時記在它的統計
+}
+
+// 等待確認的PUBLISH按client ID保存。沒有client ID的連線（抓包開始前已連線）無法和重新連線對應，按連線保存
+type qosKey struct {
+	clientID string
+	conn     *mqttConn
+}
+
+// 一個客戶端等待確認的PUBLISH，依方向（qosToBroker/qosToClient）和封包ID
+type qosSession struct {
+	flights    [2]map[uint16]*qosFlight
+	persistent bool      // 最後一次CONNECT要求斷線後保留session
+	conn       *mqttConn // 目前的連線
+}
+
+func (s *qosSession) pending() int {
+	return len(s.flights[0]) + len(s.flights[1])
+}
+
+// 所有session等待確認的PUBLISH。同一個client ID重新連線後可能由另一個工作協程處理，所以另外加鎖
+type qosTracker struct {
+	mu       sync.Mutex
+	sessions map[qosKey]*qosSession
+}
+
+var qosSessions = newQoSTracker()
+
+func newQoSTracker() *qosTracker {
+	return &qosTracker{sessions: make(map[qosKey]*qosSession)}
+}
+
+// 斷線後broker是否保留session：MQTT 5.0為Session Expiry Interval大於0，3.1.1為沒有設Clean Session
+func persistentSession(pkt *MqttPacket) bool {
+	if pkt.ProtocolLevel == MQTT_V5 {
+		return pkt.Properties.SessionExpiry > 0
+	}
+	return !pkt.CleanSession
+}
+
+// 一個客戶端在一個方向上的QoS 1/2統計
+type qosStats struct {
+	Publishes       int          // QoS 1/2 的PUBLISH數，包含重送
+	Retransmissions int          // 同一個封包ID在確認前再次送出
+	Dup             int          // 帶DUP旗標的PUBLISH
+	Acked           int          // 完成確認流程（QoS 1的PUBACK、QoS 2的PUBCOMP）
+	Rejected        int          // MQTT 5.0 PUBACK/PUBREC的原因碼表示失敗
+	Unacked         int          // 逾時或連線中斷時仍未確認
+	Unmatched       int          // 找不到對應PUBLISH的確認（抓包開始前送出或已逾時）
+	UnmatchedRel    int          // 找不到對應PUBREC的PUBREL
+	latencies       [2][]float64 // QoS 1和QoS 2從PUBLISH到完成確認的時間（秒）
+}
+
+func (s *qosStats) merge(other *qosStats) {
+	s.Publishes += other.Publishes
+	s.Retransmissions += other.Retransmissions
+	s.Dup += other.Dup
+	s.Acked += other.Acked
+	s.Rejected += other.Rejected
+	s.Unacked += other.Unacked
+	s.Unmatched += other.Unmatched
+	s.UnmatchedRel += other.UnmatchedRel
+	for i := range s.latencies {
+		s.latencies[i] = append(s.latencies[i], other.latencies[i]...)
+	}
+}
+
+func (s *qosStats) empty() bool {
+	return s.Publishes == 0 && s.Unacked == 0 && s.Unmatched == 0 && s.UnmatchedRel == 0 && s.Acked == 0
+}
+
+// 重送佔PUBLISH的比例
+func (s *qosStats) retransmissionRate() float64 {
+	if s.Publishes == 0 {
+		return 0
+	}
+	return float64(s.Retransmissions) / float64(s.Publishes)
+}
+
+// QoS 1或2的確認延遲分布，沒有完成確認的PUBLISH時為nil
+func (s *qosStats) latency(qos byte) *durationSummary {
+	return newDurationSummary(s.latencies[qos-1])
+}
+
+// 取得客戶端在一個方向上的統計
+func qosStatsIn(clients map[string]*ClientStats, session *mqttSession, dir int) *qosStats {
+	return &clientIn(clients, session).QoS[dir]
+}
+
+// 依CONNECT、PUBLISH和確認封包更新session等待確認的PUBLISH
+func trackQoS(msg *mqttMessage) {
+	pkt := msg.packet
+	conn := msg.conn
+	if conn.session == nil {
+		return
+	}
+	clients := conn.worker.shard.clients
+	conn.qosKey = qosKey{clientID: conn.session.ClientID}
+	if conn.qosKey.clientID == "" {
+		conn.qosKey.conn = conn
+	}
+
+	qosSessions.mu.Lock()
+	defer qosSessions.mu.Unlock()
+	session := qosSessions.sessions[conn.qosKey]
+
+	switch pkt.Type {
+	case MQTT_CONNECT:
+		if !msg.toBroker {
+			return
+		}
+		if session != nil && pkt.CleanSession {
+			// 重新開始的session不會再重送之前未確認的PUBLISH
+			session.unacked(clients)
+			session = nil
+		}
+		if session == nil {
+			session = &qosSession{}
+			qosSessions.sessions[conn.qosKey] = session
+		}
+		session.persistent = persistentSession(pkt)
+		session.conn = conn
+
+	case MQTT_PUBLISH:
+		if pkt.QoS == 0 {
+			return
+		}
+		dir := qosToClient
+		if msg.toBroker {
+			dir = qosToBroker
+		}
+		stats := qosStatsIn(clients, conn.session, dir)
+		stats.Publishes++
+		if pkt.Dup {
+			stats.Dup++
+		}
+		if session == nil {
+			session = &qosSession{conn: conn}
+			qosSessions.sessions[conn.qosKey] = session
+		}
+		if session.flights[dir] == nil {
+			session.flights[dir] = make(map[uint16]*qosFlight)
+		}
+		// 確認前再次送出同一個封包ID（包括重新連線後的DUP重送），延遲從第一次送出開始計算
+		if flight := session.flights[dir][pkt.PacketID]; flight != nil && flight.stage == qosAwaitAck {
+			stats.Retransmissions++
+			return
+		}
+		session.flights[dir][pkt.PacketID] = &qosFlight{qos: pkt.QoS, start: msg.timestamp, session: conn.session}
+
+	case MQTT_PUBREL:
+		// PUBREL由PUBLISH的送出方在收到PUBREC後送出，和PUBLISH同方向
+		dir := qosToClient
+		if msg.toBroker {
+			dir = qosToBroker
+		}
+		var flight *qosFlight
+		if session != nil {
+			flight = session.flights[dir][pkt.PacketID]
+		}
+		switch {
+		case flight == nil || flight.qos != 2 || flight.stage == qosAwaitAck:
+			qosStatsIn(clients, conn.session, dir).UnmatchedRel++
+		case flight.stage == qosAwaitRel:
+			flight.stage = qosAwaitComp
+		default:
+			// 重送的PUBREL，不影響流程
+			if debugOn() {
+				log.Printf("[any] PUBREL 封包ID %d 重送", pkt.PacketID)
+			}
+		}
+
+	case MQTT_PUBACK, MQTT_PUBREC, MQTT_PUBCOMP:
+		// 確認由接收方送出，對應反方向的PUBLISH
+		dir := qosToBroker
+		if msg.toBroker {
+			dir = qosToClient
+		}
+		stats := qosStatsIn(clients, conn.session, dir)
+		var flight *qosFlight
+		if session != nil {
+			flight = session.flights[dir][pkt.PacketID]
+		}
+		if flight == nil {
+			stats.Unmatched++
+			return
+		}
+		switch {
+		case pkt.Type == MQTT_PUBACK && flight.qos == 1:
+		case pkt.Type == MQTT_PUBREC && flight.qos == 2 && flight.stage == qosAwaitAck:
+			if pkt.ReasonCode < 0x80 {
+				flight.stage = qosAwaitRel
+				return
+			}
+		case pkt.Type == MQTT_PUBCOMP && flight.stage == qosAwaitComp:
+		default:
+			// 重送的PUBREC、沒有看到PUBREL的PUBCOMP等，不影響流程
+			if debugOn() {
+				log.Printf("[any] %s 封包ID %d 在QoS %d 流程中不預期", mqttPacketTypeName(pkt.Type), pkt.PacketID, flight.qos)
+			}
+			return
+		}
+		delete(session.flights[dir], pkt.PacketID)
+		if pkt.ReasonCode >= 0x80 {
+			stats.Rejected++
+			return
+		}
+		stats.Acked++
+		stats.latencies[flight.qos-1] = append(stats.latencies[flight.qos-1], msg.timestamp.Sub(flight.start).Seconds())
+	}
+}
+
+// 所有等待確認的PUBLISH記為未確認並清除。呼叫者需持有 qosSessions.mu
+func (s *qosSession) unacked(clients map[string]*ClientStats) {
+	for dir, flights := range s.flights {
+		for _, flight := range flights {
+			qosStatsIn(clients, flight.session, dir).Unacked++
+		}
+	}
+	s.flights = [2]map[uint16]*qosFlight{}
+}
+
+// 超過 -qos-timeout 沒有確認的PUBLISH記為未確認，now 為目前的封包時間。
+// 每個工作協程都會呼叫，未確認記在最先清理到的工作協程的分片
+func (w *packetWorker) expireQoS(now time.Time) {
+	qosSessions.mu.Lock()
+	defer qosSessions.mu.Unlock()
+	for key, session := range qosSessions.sessions {
+		for dir, flights := range session.flights {
+			for id, flight := range flights {
+				if now.Sub(flight.start) > config.QoSTimeout {
+					qosStatsIn(w.shard.clients, flight.session, dir).Unacked++
+					delete(flights, id)
+				}
+			}
+		}
+		// 持久session的連線已結束，等待確認的都已逾時，不再等重新連線
+		if session.pending() == 0 && session.conn == nil {
+			delete(qosSessions.sessions, key)
+		}
+	}
+}
+
+// 連線結束。不保留session時等待確認的PUBLISH不會再重送，記為未確認；
+// 持久session保留到重新連線或逾時。
+// 離線分析結束時關閉的連線不算，確認可能在抓包結束後才送出
+func (w *packetWorker) closeQoS(conn *mqttConn) {
+	if conn.qosKey == (qosKey{}) {
+		return
+	}
+	qosSessions.mu.Lock()
+	defer qosSessions.mu.Unlock()
+	session := qosSessions.sessions[conn.qosKey]
+	// 同一個client ID已經從新的連線重新連線
+	if session == nil || session.conn != conn {
+		return
+	}
+	session.conn = nil
+	switch {
+	case w.draining:
+		delete(qosSessions.sessions, conn.qosKey)
+	case session.persistent && session.pending() > 0:
+	default:
+		session.unacked(w.shard.clients)
+		delete(qosSessions.sessions, conn.qosKey)
+	}
+}
+
+// 打印一個客戶端兩個方向的QoS統計
+func printQoS(stats *ClientStats) {
+	for dir := range stats.QoS {
+		s := &stats.QoS[dir]
+		if s.empty() {
+			continue
+		}
+		fmt.Printf("    QoS%s: PUBLISH %d  確認 %d  拒絕 %d  未確認 %d  重送 %d（%.2f%%）  DUP %d  無對應確認 %d  無對應PUBREL %d\n",
+			qosDirectionNames[dir], s.Publishes, s.Acked, s.Rejected, s.Unacked,
+			s.Retransmissions, s.retransmissionRate()*100, s.Dup, s.Unmatched, s.UnmatchedRel)
+		for qos := byte(1); qos <= 2; qos++ {
+			if latency := s.latency(qos); latency != nil {
+				fmt.Printf("      QoS %d 確認延遲: %s\n", qos, latency)
+			}
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 一個送出的封包，up 為客戶端送給broker
+type qosStep struct {
+	up  bool
+	pkt MqttPacket
+}
+
+func TestTrackQoS(t *testing.T) {
+	config = defaultConfig()
+	t0 := time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		steps []qosStep
+		want  [2]qosStats
+	}{
+		{
+			name: "QoS 1",
+			steps: []qosStep{
+				{true, MqttPacket{Type: MQTT_PUBLISH, QoS: 1, PacketID: 1}},
+				{false, MqttPacket{Type: MQTT_PUBACK, PacketID: 1}},
+			},
+			want: [2]qosStats{qosToBroker: {Publishes: 1, Acked: 1}},
+		},
+		{
+			name: "QoS 2 完整流程",
+			steps: []qosStep{
+				{true, MqttPacket{Type: MQTT_PUBLISH, QoS: 2, PacketID: 1}},
+				{false, MqttPacket{Type: MQTT_PUBREC, PacketID: 1}},
+				{true, MqttPacket{Type: MQTT_PUBREL, PacketID: 1}},
+				{true, MqttPacket{Type: MQTT_PUBREL, PacketID: 1}}, // 重送
+				{false, MqttPacket{Type: MQTT_PUBCOMP, PacketID: 1}},
+			},
+			want: [2]qosStats{qosToBroker: {Publishes: 1, Acked: 1}},
+		},
+		{
+			name: "QoS 2 下行",
+			steps: []qosStep{
+				{false, MqttPacket{Type: MQTT_PUBLISH, QoS: 2, PacketID: 7}},
+				{true, MqttPacket{Type: MQTT_PUBREC, PacketID: 7}},
+				{false, MqttPacket{Type: MQTT_PUBREL, PacketID: 7}},
+				{true, MqttPacket{Type: MQTT_PUBCOMP, PacketID: 7}},
+			},
+			want: [2]qosStats{qosToClient: {Publishes: 1, Acked: 1}},
+		},
+		{
+			name: "沒有看到PUBREL的PUBCOMP",
+			steps: []qosStep{
+				{true, MqttPacket{Type: MQTT_PUBLISH, QoS: 2, PacketID: 1}},
+				{false, MqttPacket{Type: MQTT_PUBREC, PacketID: 1}},
+				{false, MqttPacket{Type: MQTT_PUBCOMP, PacketID: 1}},
+			},
+			want: [2]qosStats{qosToBroker: {Publishes: 1}},
+		},
+		{
+			name: "無對應PUBREL",
+			steps: []qosStep{
+				{true, MqttPacket{Type: MQTT_PUBREL, PacketID: 3}}, // PUBLISH在抓包開始前
+				{true, MqttPacket{Type: MQTT_PUBLISH, QoS: 2, PacketID: 4}},
+				{true, MqttPacket{Type: MQTT_PUBREL, PacketID: 4}}, // 還沒有PUBREC
+				{true, MqttPacket{Type: MQTT_PUBLISH, QoS: 1, PacketID: 5}},
+				{true, MqttPacket{Type: MQTT_PUBREL, PacketID: 5}}, // QoS 1沒有PUBREL
+			},
+			want: [2]qosStats{qosToBroker: {Publishes: 2, UnmatchedRel: 3}},
+		},
+		{
+			name: "重送和拒絕",
+			steps: []qosStep{
+				{true, MqttPacket{Type: MQTT_PUBLISH, QoS: 1, PacketID: 1}},
+				{true, MqttPacket{Type: MQTT_PUBLISH, QoS: 1, PacketID: 1, Dup: true}},
+				{false, MqttPacket{Type: MQTT_PUBACK, PacketID: 1}},
+				{false, MqttPacket{Type: MQTT_PUBACK, PacketID: 1}}, // 已確認
+				{true, MqttPacket{Type: MQTT_PUBLISH, QoS: 2, PacketID: 2}},
+				{false, MqttPacket{Type: MQTT_PUBREC, PacketID: 2, ReasonCode: 0x80}},
+			},
+			want: [2]qosStats{qosToBroker: {Publishes: 3, Retransmissions: 1, Dup: 1, Acked: 1, Rejected: 1, Unmatched: 1}},
+		},
+	}
+	for _, tt := range tests {
+		qosSessions = newQoSTracker()
+		w := newPacketWorker()
+		conn := newMqttConn(w)
+		conn.session = &mqttSession{ClientID: "upf-a"}
+		for i, step := range tt.steps {
+			pkt := step.pkt
+			trackQoS(&mqttMessage{packet: &pkt, conn: conn, toBroker: step.up, timestamp: t0.Add(time.Duration(i) * time.Millisecond)})
+		}
+		got := w.shard.clients["upf-a"].QoS
+		for dir := range got {
+			got[dir].latencies = [2][]float64{}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %+v，應為 %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// 完成PUBREC的QoS 2 PUBLISH沒有等到PUBCOMP時逾時記為未確認，延遲從PUBLISH開始計算
+func TestQoSTimeout(t *testing.T) {
+	config = defaultConfig()
+	qosSessions = newQoSTracker()
+	t0 := time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)
+	w := newPacketWorker()
+	conn := newMqttConn(w)
+	conn.session = &mqttSession{ClientID: "upf-a"}
+	send := func(toBroker bool, pkt MqttPacket, at time.Duration) {
+		trackQoS(&mqttMessage{packet: &pkt, conn: conn, toBroker: toBroker, timestamp: t0.Add(at)})
+	}
+	send(true, MqttPacket{Type: MQTT_PUBLISH, QoS: 2, PacketID: 1}, 0)
+	send(false, MqttPacket{Type: MQTT_PUBREC, PacketID: 1}, time.Millisecond)
+	send(true, MqttPacket{Type: MQTT_PUBREL, PacketID: 1}, 2*time.Millisecond)
+	send(true, MqttPacket{Type: MQTT_PUBLISH, QoS: 2, PacketID: 2}, time.Second)
+	send(false, MqttPacket{Type: MQTT_PUBREC, PacketID: 2}, time.Second+time.Millisecond)
+	send(true, MqttPacket{Type: MQTT_PUBREL, PacketID: 2}, time.Second+2*time.Millisecond)
+	send(false, MqttPacket{Type: MQTT_PUBCOMP, PacketID: 2}, time.Second+5*time.Millisecond)
+
+	w.expireQoS(t0.Add(config.QoSTimeout + time.Millisecond))
+	stats := w.shard.clients["upf-a"].QoS[qosToBroker]
+	if stats.Acked != 1 || stats.Unacked != 1 || stats.UnmatchedRel != 0 {
+		t.Errorf("%+v", stats)
+	}
+	if latency := stats.latencies[1]; len(latency) != 1 || latency[0] != 0.005 {
+		t.Errorf("QoS 2 延遲 %v，應為 [0.005]", latency)
+	}
+	if pending := qosSessions.sessions[conn.qosKey].pending(); pending != 0 {
+		t.Errorf("逾時後仍有 %d 個PUBLISH等待確認", pending)
+	}
+
+	// 連線結束後不再保留
+	w.closeQoS(conn)
+	if len(qosSessions.sessions) != 0 {
+		t.Errorf("連線結束後仍有 %d 個session", len(qosSessions.sessions))
+	}
+}
+
+// 持久session斷線後重新連線，DUP重送的PUBLISH對應斷線前的PUBLISH，不重複計算。
+// 重新連線的連線可能由另一個工作協程處理
+func TestQoSReconnect(t *testing.T) {
+	config = defaultConfig()
+	t0 := time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)
+	connect := func(w *packetWorker, pkt MqttPacket, at time.Duration) *mqttConn {
+		conn := newMqttConn(w)
+		conn.session = &mqttSession{ClientID: "upf-a"}
+		pkt.Type = MQTT_CONNECT
+		trackQoS(&mqttMessage{packet: &pkt, conn: conn, toBroker: true, timestamp: t0.Add(at)})
+		return conn
+	}
+	send := func(conn *mqttConn, toBroker bool, pkt MqttPacket, at time.Duration) {
+		trackQoS(&mqttMessage{packet: &pkt, conn: conn, toBroker: toBroker, timestamp: t0.Add(at)})
+	}
+	merged := func(workers ...*packetWorker) [2]qosStats {
+		var got [2]qosStats
+		for _, w := range workers {
+			if client := w.shard.clients["upf-a"]; client != nil {
+				for dir := range got {
+					got[dir].merge(&client.QoS[dir])
+				}
+			}
+		}
+		return got
+	}
+
+	tests := []struct {
+		name    string
+		connect MqttPacket // 兩次CONNECT
+		want    qosStats
+		latency float64
+	}{
+		{"3.1.1 持久session", MqttPacket{ProtocolLevel: MQTT_V311},
+			qosStats{Publishes: 2, Retransmissions: 1, Dup: 1, Acked: 1}, 1.002},
+		{"5.0 Session Expiry", MqttPacket{ProtocolLevel: MQTT_V5, Properties: MqttProperties{SessionExpiry: 300}},
+			qosStats{Publishes: 2, Retransmissions: 1, Dup: 1, Acked: 1}, 1.002},
+		// 不保留session：斷線時記為未確認，重新連線後的PUBLISH是新的流程
+		{"3.1.1 Clean Session", MqttPacket{ProtocolLevel: MQTT_V311, CleanSession: true},
+			qosStats{Publishes: 2, Dup: 1, Acked: 1, Unacked: 1}, 0.002},
+		{"5.0 沒有Session Expiry", MqttPacket{ProtocolLevel: MQTT_V5},
+			qosStats{Publishes: 2, Dup: 1, Acked: 1, Unacked: 1}, 0.002},
+		// Clean Start丟棄之前的session
+		{"5.0 Clean Start", MqttPacket{ProtocolLevel: MQTT_V5, CleanSession: true, Properties: MqttProperties{SessionExpiry: 300}},
+			qosStats{Publishes: 2, Dup: 1, Acked: 1, Unacked: 1}, 0.002},
+	}
+	for _, tt := range tests {
+		qosSessions = newQoSTracker()
+		w1, w2 := newPacketWorker(), newPacketWorker()
+		conn := connect(w1, tt.connect, 0)
+		send(conn, true, MqttPacket{Type: MQTT_PUBLISH, QoS: 1, PacketID: 1}, time.Millisecond)
+		w1.closeQoS(conn)
+
+		conn = connect(w2, tt.connect, time.Second)
+		send(conn, true, MqttPacket{Type: MQTT_PUBLISH, QoS: 1, PacketID: 1, Dup: true}, time.Second+time.Millisecond)
+		send(conn, false, MqttPacket{Type: MQTT_PUBACK, PacketID: 1}, time.Second+3*time.Millisecond)
+
+		got := merged(w1, w2)[qosToBroker]
+		latency := got.latencies[0]
+		got.latencies = [2][]float64{}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %+v，應為 %+v", tt.name, got, tt.want)
+		}
+		if len(latency) != 1 || latency[0] != tt.latency {
+			t.Errorf("%s: 延遲 %v，應為 [%v]", tt.name, latency, tt.latency)
+		}
+		if len(qosSessions.sessions) != 1 {
+			t.Errorf("%s: %d 個session，應為 1", tt.name, len(qosSessions.sessions))
+		}
+	}
+
+	// 持久session斷線後沒有重新連線，逾時記為未確認並移除
+	qosSessions = newQoSTracker()
+	w := newPacketWorker()
+	conn := connect(w, MqttPacket{ProtocolLevel: MQTT_V311}, 0)
+	send(conn, false, MqttPacket{Type: MQTT_PUBLISH, QoS: 2, PacketID: 9}, time.Millisecond)
+	w.closeQoS(conn)
+	if got := w.shard.clients["upf-a"].QoS[qosToClient].Unacked; got != 0 {
+		t.Errorf("斷線時未確認 %d，應保留到逾時", got)
+	}
+	w.expireQoS(t0.Add(config.QoSTimeout + time.Second))
+	if got := w.shard.clients["upf-a"].QoS[qosToClient].Unacked; got != 1 || len(qosSessions.sessions) != 0 {
+		t.Errorf("逾時後未確認 %d，%d 個session", got, len(qosSessions.sessions))
+	}
+}
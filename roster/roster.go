@@ -0,0 +1,154 @@
+// Package roster 比對每個統計區間出現的IMSI和預期的名單（例如測試用的UE），
+// 列出缺少和非預期的IMSI，以及每個IMSI連續幾個區間沒有出現，超過門檻時發出告警。
+// 抓包程式和 SubscribeMqtt 共用。
+//
+// 名單可以是逗號分隔的範圍或檔案，例如：
+//
+//	208930000000001-208930000001000
+//	ues.txt,208930000002001-208930000002010
+//
+// 檔案每行一個IMSI或範圍，# 之後為註解，SUPI的 "imsi-" 前綴會去掉。
+package roster
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 名單的IMSI數上限，避免範圍寫錯時佔用大量記憶體
+const MaxSize = 10000000
+
+// Roster 是預期會出現的IMSI名單，建立後不再修改，可以在多個協程中讀取
+type Roster struct {
+	members map[string]struct{}
+	sorted  []string
+}
+
+// Load 解析逗號分隔的IMSI、範圍或檔案
+func Load(spec string) (*Roster, error) {
+	r := &Roster{members: make(map[string]struct{})}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if isDigits(item) {
+			r.members[item] = struct{}{}
+			continue
+		}
+		if isRange(item) {
+			if err := r.addRange(item); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := r.addFile(item); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.members) == 0 {
+		return nil, fmt.Errorf("IMSI名單是空的: %q", spec)
+	}
+	r.sorted = make([]string, 0, len(r.members))
+	for imsi := range r.members {
+		r.sorted = append(r.sorted, imsi)
+	}
+	sort.Strings(r.sorted)
+	return r, nil
+}
+
+// 兩個以 - 連接的數字，檔名不會是這個樣子
+func isRange(item string) bool {
+	from, to, ok := strings.Cut(item, "-")
+	return ok && isDigits(from) && isDigits(to)
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// 範圍的兩端需為相同長度，產生的IMSI保留前導的0
+func (r *Roster) addRange(item string) error {
+	from, to, _ := strings.Cut(item, "-")
+	if len(from) != len(to) {
+		return fmt.Errorf("IMSI範圍的兩端長度不同: %s", item)
+	}
+	start, err := strconv.ParseUint(from, 10, 64)
+	if err != nil {
+		return fmt.Errorf("無效的IMSI範圍 %s: %v", item, err)
+	}
+	end, err := strconv.ParseUint(to, 10, 64)
+	if err != nil {
+		return fmt.Errorf("無效的IMSI範圍 %s: %v", item, err)
+	}
+	if start > end {
+		return fmt.Errorf("IMSI範圍的開頭大於結尾: %s", item)
+	}
+	if end-start >= MaxSize || len(r.members)+int(end-start+1) > MaxSize {
+		return fmt.Errorf("IMSI名單超過 %d 個: %s", MaxSize, item)
+	}
+	for n := start; ; n++ {
+		r.members[fmt.Sprintf("%0*d", len(from), n)] = struct{}{}
+		if n == end {
+			return nil
+		}
+	}
+}
+
+func (r *Roster) addFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("無法讀取IMSI名單: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimPrefix(strings.TrimSpace(text), "imsi-")
+		switch {
+		case text == "":
+		case isRange(text):
+			if err := r.addRange(text); err != nil {
+				return fmt.Errorf("%s 第%d行: %v", path, line, err)
+			}
+		case isDigits(text):
+			r.members[text] = struct{}{}
+			if len(r.members) > MaxSize {
+				return fmt.Errorf("%s: IMSI名單超過 %d 個", path, MaxSize)
+			}
+		default:
+			return fmt.Errorf("%s 第%d行: 無效的IMSI %q", path, line, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("無法讀取IMSI名單 %s: %v", path, err)
+	}
+	return nil
+}
+
+// Len 回傳名單中的IMSI數
+func (r *Roster) Len() int {
+	return len(r.sorted)
+}
+
+// Contains 回傳IMSI是否在名單中
+func (r *Roster) Contains(imsi string) bool {
+	_, ok := r.members[imsi]
+	return ok
+}
@@ -0,0 +1,105 @@
+package roster
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 名單中所有的IMSI，排序過
+func members(r *Roster) []string {
+	return r.sorted
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ues.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{"208930000000001", []string{"208930000000001"}},
+		// 範圍保留前導的0
+		{"001010000000008-001010000000011", []string{"001010000000008", "001010000000009", "001010000000010", "001010000000011"}},
+		{"09-11", []string{"09", "10", "11"}},
+		{"5-5", []string{"5"}},
+		// 重複的IMSI只算一次，空白和空的項目略過
+		{" 208930000000002 , 208930000000001-208930000000002,,", []string{"208930000000001", "208930000000002"}},
+	}
+	for _, tt := range tests {
+		r, err := Load(tt.spec)
+		if err != nil {
+			t.Errorf("Load(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := members(r); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Load(%q) = %v，應為 %v", tt.spec, got, tt.want)
+		}
+		if r.Len() != len(tt.want) || !r.Contains(tt.want[0]) || r.Contains("1"+tt.want[0]) {
+			t.Errorf("Load(%q): Len=%d", tt.spec, r.Len())
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeFile(t, `# 測試用的UE
+imsi-208930000000001
+208930000000002   # SMF測試
+  imsi-208930000000010-208930000000012
+
+208930000000002
+`)
+	r, err := Load(path + ",208930000000020")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"208930000000001", "208930000000002", "208930000000010", "208930000000011", "208930000000012", "208930000000020"}
+	if got := members(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("%v，應為 %v", got, want)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{"", "是空的"},
+		{" , ", "是空的"},
+		{"0010-100", "兩端長度不同"},
+		{"208930000000002-208930000000001", "開頭大於結尾"},
+		{"99999999999999999999-99999999999999999999", "無效的IMSI範圍"},
+		{"not-a-file.txt", "無法讀取IMSI名單"},
+		{writeFile(t, "# 只有註解\n"), "是空的"},
+		{writeFile(t, "208930000000001\nimsi-abc\n"), "第2行: 無效的IMSI"},
+		{writeFile(t, "\n\n1-22\n"), "第3行: IMSI範圍的兩端長度不同"},
+	}
+	for _, tt := range tests {
+		if r, err := Load(tt.spec); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Load(%q) = %v, %v，錯誤應包含 %q", tt.spec, r, err, tt.err)
+		}
+	}
+}
+
+// 超過 MaxSize 的範圍在產生IMSI前就拒絕，多個範圍加起來超過也拒絕
+func TestLoadMaxSize(t *testing.T) {
+	rangeOf := func(from, n int) string {
+		return fmt.Sprintf("%015d-%015d", from, from+n-1)
+	}
+	if _, err := Load(rangeOf(0, MaxSize+1)); err == nil || !strings.Contains(err.Error(), "超過") {
+		t.Errorf("單一範圍超過上限: %v", err)
+	}
+	if _, err := Load(rangeOf(0, 2) + "," + rangeOf(MaxSize, MaxSize-1)); err == nil || !strings.Contains(err.Error(), "超過") {
+		t.Errorf("多個範圍超過上限: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package roster
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Tracker 記錄名單中每個IMSI連續沒有出現的區間數，不是並行安全的
+type Tracker struct {
+	roster    *Roster
+	threshold int            // 連續沒有出現的區間數達到此值時告警，0表示不告警
+	absent    map[string]int // IMSI -> 連續沒有出現的區間數，出現後刪除
+}
+
+// NewTracker 建立追蹤器，threshold為0時不產生告警
+func NewTracker(r *Roster, threshold int) *Tracker {
+	return &Tracker{roster: r, threshold: threshold, absent: make(map[string]int)}
+}
+
+// Roster 回傳追蹤的名單
+func (t *Tracker) Roster() *Roster {
+	return t.roster
+}
+
+// Result 是一個統計區間的比對結果
+type Result struct {
+	Expected   int            `json:"expected"`   // 名單中的IMSI數
+	Seen       int            `json:"seen"`       // 名單中有出現的IMSI數
+	Missing    []string       `json:"missing"`    // 名單中沒有出現的IMSI，排序過
+	Unexpected []string       `json:"unexpected"` // 出現但不在名單中的IMSI，排序過
+	Absent     map[string]int `json:"absent"`     // 沒有出現的IMSI已連續幾個區間沒有出現
+	Threshold  int            `json:"threshold,omitempty"`
+	Alerts     []string       `json:"alerts,omitempty"` // 本區間連續沒有出現的區間數剛好達到門檻的IMSI
+}
+
+// Observe 以一個統計區間出現的IMSI更新追蹤狀態並回傳比對結果，每個區間呼叫一次
+func (t *Tracker) Observe(seen []string) *Result {
+	present := make(map[string]bool, len(seen))
+	result := &Result{
+		Expected:   t.roster.Len(),
+		Missing:    []string{},
+		Unexpected: []string{},
+		Absent:     make(map[string]int),
+		Threshold:  t.threshold,
+	}
+	for _, imsi := range seen {
+		if present[imsi] {
+			continue
+		}
+		present[imsi] = true
+		if t.roster.Contains(imsi) {
+			result.Seen++
+		} else {
+			result.Unexpected = append(result.Unexpected, imsi)
+		}
+	}
+	sort.Strings(result.Unexpected)
+
+	for _, imsi := range t.roster.sorted {
+		if present[imsi] {
+			delete(t.absent, imsi)
+			continue
+		}
+		t.absent[imsi]++
+		n := t.absent[imsi]
+		result.Missing = append(result.Missing, imsi)
+		result.Absent[imsi] = n
+		// 只在剛達到門檻的區間告警，同一次缺席不重複告警
+		if t.threshold > 0 && n == t.threshold {
+			result.Alerts = append(result.Alerts, imsi)
+		}
+	}
+	return result
+}
+
+// Print 輸出文字報告，缺少的IMSI按連續沒有出現的區間數分組
+func Print(w io.Writer, r *Result) {
+	fmt.Fprintf(w, "IMSI名單: 預期 %d  出現 %d  缺少 %d  非預期 %d\n", r.Expected, r.Seen, len(r.Missing), len(r.Unexpected))
+
+	byCount := make(map[int][]string)
+	for _, imsi := range r.Missing {
+		byCount[r.Absent[imsi]] = append(byCount[r.Absent[imsi]], imsi)
+	}
+	counts := make([]int, 0, len(byCount))
+	for n := range byCount {
+		counts = append(counts, n)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(counts)))
+	for _, n := range counts {
+		fmt.Fprintf(w, "  缺少（連續 %d 個區間）: %s\n", n, strings.Join(byCount[n], ", "))
+	}
+	if len(r.Unexpected) > 0 {
+		fmt.Fprintf(w, "  非預期: %s\n", strings.Join(r.Unexpected, ", "))
+	}
+	if len(r.Alerts) > 0 {
+		fmt.Fprintf(w, "  !!! 連續 %d 個區間沒有出現: %s\n", r.Threshold, strings.Join(r.Alerts, ", "))
+	}
+}
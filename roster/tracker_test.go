@@ -0,0 +1,88 @@
+package roster
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// 連續沒有出現的區間數、門檻告警和非預期的IMSI
+func TestTrackerObserve(t *testing.T) {
+	r, err := Load("208930000000001-208930000000003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const a, b, c, x = "208930000000001", "208930000000002", "208930000000003", "208930000000099"
+	tracker := NewTracker(r, 2)
+	steps := []struct {
+		seen []string
+		want Result
+	}{
+		{
+			[]string{a, b, c},
+			Result{Expected: 3, Seen: 3, Missing: []string{}, Unexpected: []string{}, Absent: map[string]int{}},
+		},
+		{
+			// 重複出現只算一次，非預期的IMSI排序
+			[]string{x, a, a, "208930000000050"},
+			Result{Expected: 3, Seen: 1, Missing: []string{b, c}, Unexpected: []string{"208930000000050", x},
+				Absent: map[string]int{b: 1, c: 1}},
+		},
+		{
+			// 連續兩個區間沒有出現，剛達到門檻
+			[]string{c},
+			Result{Expected: 3, Seen: 1, Missing: []string{a, b}, Unexpected: []string{},
+				Absent: map[string]int{a: 1, b: 2}, Alerts: []string{b}},
+		},
+		{
+			// 超過門檻後不重複告警
+			nil,
+			Result{Expected: 3, Missing: []string{a, b, c}, Unexpected: []string{},
+				Absent: map[string]int{a: 2, b: 3, c: 1}, Alerts: []string{a}},
+		},
+		{
+			// 出現後重新計算
+			[]string{b},
+			Result{Expected: 3, Seen: 1, Missing: []string{a, c}, Unexpected: []string{},
+				Absent: map[string]int{a: 3, c: 2}, Alerts: []string{c}},
+		},
+		{
+			[]string{a, c},
+			Result{Expected: 3, Seen: 2, Missing: []string{b}, Unexpected: []string{}, Absent: map[string]int{b: 1}},
+		},
+	}
+	for i, step := range steps {
+		got := tracker.Observe(step.seen)
+		step.want.Threshold = 2
+		if !reflect.DeepEqual(*got, step.want) {
+			t.Errorf("第%d個區間: %+v，應為 %+v", i+1, *got, step.want)
+		}
+	}
+
+	// 門檻為0時不告警
+	tracker = NewTracker(r, 0)
+	for i := 0; i < 3; i++ {
+		if got := tracker.Observe(nil); got.Alerts != nil || got.Absent[a] != i+1 {
+			t.Errorf("門檻為0的第%d個區間: %+v", i+1, got)
+		}
+	}
+}
+
+func TestTrackerPrint(t *testing.T) {
+	r, err := Load("208930000000001-208930000000003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := NewTracker(r, 2)
+	tracker.Observe([]string{"208930000000003"})
+	var out bytes.Buffer
+	Print(&out, tracker.Observe([]string{"208930000000001", "208930000000009"}))
+	want := "IMSI名單: 預期 3  出現 1  缺少 2  非預期 1\n" +
+		"  缺少（連續 2 個區間）: 208930000000002\n" +
+		"  缺少（連續 1 個區間）: 208930000000003\n" +
+		"  非預期: 208930000000009\n" +
+		"  !!! 連續 2 個區間沒有出現: 208930000000002\n"
+	if out.String() != want {
+		t.Errorf("Print =\n%s應為\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,43 @@
+package roster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// 送出webhook的逾時
+const webhookTimeout = 5 * time.Second
+
+// Alert 是送往webhook的告警內容
+type Alert struct {
+	Type      string    `json:"type"`   // 固定為 rosterAlert
+	Source    string    `json:"source"` // 送出告警的程式
+	WindowEnd time.Time `json:"windowEnd"`
+	*Result
+}
+
+// NewAlert 以比對結果建立告警
+func NewAlert(source string, windowEnd time.Time, r *Result) *Alert {
+	return &Alert{Type: "rosterAlert", Source: source, WindowEnd: windowEnd, Result: r}
+}
+
+// Notify 以JSON POST告警到webhook，回應不是2xx時回傳錯誤
+func Notify(url string, alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook回應 %s", resp.Status)
+	}
+	return nil
+}
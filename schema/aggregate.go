@@ -0,0 +1,162 @@
+package schema
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"getMqtt/distinct"
+)
+
+// Group 是一組分組鍵在統計區間內的彙總
+type Group struct {
+	Keys    []string // 分組鍵的值，順序同 Spec.Keys
+	Count   int      // 訊息數
+	ImsiSet *distinct.Set
+	Sums    []float64 // 數值欄位的加總，順序同 Spec.Values
+	Samples []int     // 數值欄位出現的次數，平均 = Sums / Samples
+}
+
+// Average 是第i個數值欄位的平均，沒有樣本時回傳false
+func (g *Group) Average(i int) (float64, bool) {
+	if g.Samples[i] == 0 {
+		return 0, false
+	}
+	return g.Sums[i] / float64(g.Samples[i]), true
+}
+
+// Aggregator 按分組鍵彙總記錄，不是並行安全的，呼叫者需自行加鎖
+type Aggregator struct {
+	spec      *Spec
+	precision int // 獨立IMSI的HyperLogLog精度，0為精確計算
+	groups    map[string]*Group
+}
+
+// NewAggregator 建立一個空的彙總，precision 同 distinct.New
+func NewAggregator(spec *Spec, precision int) *Aggregator {
+	return &Aggregator{spec: spec, precision: precision, groups: make(map[string]*Group)}
+}
+
+// 分組鍵的值以 \x00 連接當作map的鍵
+func groupKey(keys []string) string {
+	return strings.Join(keys, "\x00")
+}
+
+// Add 把一筆記錄加入對應的分組
+func (a *Aggregator) Add(r *Record) {
+	key := groupKey(r.Keys)
+	group := a.groups[key]
+	if group == nil {
+		group = &Group{
+			Keys:    r.Keys,
+			ImsiSet: distinct.New(a.precision),
+			Sums:    make([]float64, len(a.spec.values)),
+			Samples: make([]int, len(a.spec.values)),
+		}
+		a.groups[key] = group
+	}
+	group.Count++
+	if r.Imsi != "" {
+		group.ImsiSet.Add(r.Imsi)
+	}
+	for i := range r.Values {
+		if r.Has[i] {
+			group.Sums[i] += r.Values[i]
+			group.Samples[i]++
+		}
+	}
+}
+
+// Merge 把另一個彙總的分組併入，other 之後不再使用。
+// 多個協程各自彙總時，報告前用它合併。
+func (a *Aggregator) Merge(other *Aggregator) {
+	for key, group := range other.groups {
+		merged := a.groups[key]
+		if merged == nil {
+			a.groups[key] = group
+			continue
+		}
+		merged.Count += group.Count
+		merged.ImsiSet.Merge(group.ImsiSet)
+		for i := range group.Sums {
+			merged.Sums[i] += group.Sums[i]
+			merged.Samples[i] += group.Samples[i]
+		}
+	}
+	other.groups = make(map[string]*Group)
+}
+
+// Snapshot 取出本區間的分組（按分組鍵排序）並清空
+func (a *Aggregator) Snapshot() []*Group {
+	groups := make([]*Group, 0, len(a.groups))
+	for _, group := range a.groups {
+		groups = append(groups, group)
+	}
+	a.groups = make(map[string]*Group)
+	sort.Slice(groups, func(i, j int) bool {
+		return groupKey(groups[i].Keys) < groupKey(groups[j].Keys)
+	})
+	return groups
+}
+
+// KeyMap 把分組鍵轉成欄位名稱對應值，給JSON輸出用
+func (s *Spec) KeyMap(g *Group) map[string]string {
+	keys := make(map[string]string, len(s.keys))
+	for i, f := range s.keys {
+		keys[f.Name] = g.Keys[i]
+	}
+	return keys
+}
+
+// ValueMap 把數值欄位依用途轉成加總或平均，沒有樣本的平均不列出
+func (s *Spec) ValueMap(g *Group) map[string]float64 {
+	values := make(map[string]float64, len(s.values))
+	for i, f := range s.values {
+		if f.Role == RoleSum {
+			values[f.Name] = g.Sums[i]
+		} else if avg, ok := g.Average(i); ok {
+			values[f.Name] = avg
+		}
+	}
+	return values
+}
+
+// Print 以文字格式輸出分組統計
+func Print(w io.Writer, spec *Spec, groups []*Group) {
+	if len(groups) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "按欄位分組統計:\n")
+	for _, group := range groups {
+		fmt.Fprintf(w, " ")
+		if len(spec.keys) == 0 {
+			fmt.Fprintf(w, " (全部)")
+		}
+		for i, f := range spec.keys {
+			value := group.Keys[i]
+			if value == "" {
+				value = "-"
+			}
+			fmt.Fprintf(w, " %s=%s", f.Name, value)
+		}
+		fmt.Fprintf(w, "\n    訊息數: %d  獨立IMSI數量: %d", group.Count, group.ImsiSet.Len())
+		for i, f := range spec.values {
+			if f.Role == RoleSum {
+				fmt.Fprintf(w, "  %s總和: %s", f.Name, formatNumber(group.Sums[i]))
+			} else if avg, ok := group.Average(i); ok {
+				fmt.Fprintf(w, "  %s平均: %s", f.Name, formatNumber(avg))
+			} else {
+				fmt.Fprintf(w, "  %s平均: -", f.Name)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func formatNumber(f float64) string {
+	if f == float64(int64(f)) {
+		return fmt.Sprintf("%d", int64(f))
+	}
+	return fmt.Sprintf("%.3f", f)
+}
@@ -0,0 +1,111 @@
+package schema
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// 巢狀陣列/map的深度上限，避免惡意或損壞的payload耗盡堆疊
+const maxDecodeDepth = 64
+
+var (
+	errTruncated = errors.New("資料不完整")
+	errTooDeep   = errors.New("巢狀層數過多")
+	errTrailing  = errors.New("資料後有多餘的位元組")
+)
+
+// CBOR和MessagePack共用的讀取器，所有讀取都檢查邊界
+type byteReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *byteReader) remaining() int { return len(r.data) - r.pos }
+
+func (r *byteReader) byte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, errTruncated
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *byteReader) bytes(n uint64) ([]byte, error) {
+	if n > uint64(r.remaining()) {
+		return nil, errTruncated
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+// 讀取n位元組的big endian無號整數（n為1、2、4、8）
+func (r *byteReader) uint(n int) (uint64, error) {
+	b, err := r.bytes(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// 元素個數不可能超過剩下的位元組數，先檢查以免配置過大的slice
+func (r *byteReader) checkCount(n uint64) error {
+	if n > uint64(r.remaining()) {
+		return errTruncated
+	}
+	return nil
+}
+
+func intNumber(n int64) json.Number   { return json.Number(strconv.FormatInt(n, 10)) }
+func uintNumber(n uint64) json.Number { return json.Number(strconv.FormatUint(n, 10)) }
+
+func floatNumber(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		// JSON沒有NaN和無限大，當作不存在
+		return nil
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+// CBOR的負整數為 -1-n，n可以到2^64-1，超出int64時用大整數表示
+func negativeNumber(n uint64) json.Number {
+	if n <= math.MaxInt64 {
+		return intNumber(-1 - int64(n))
+	}
+	v := new(big.Int).SetUint64(n)
+	v.Add(v, big.NewInt(1))
+	return json.Number(v.Neg(v).String())
+}
+
+func bytesValue(b []byte) string {
+	return hex.EncodeToString(b)
+}
+
+// 非字串的map鍵轉成字串
+func mapKey(key interface{}) string {
+	switch k := key.(type) {
+	case string:
+		return k
+	case json.Number:
+		return k.String()
+	case bool:
+		return strconv.FormatBool(k)
+	case nil:
+		return "null"
+	}
+	return "?"
+}
@@ -0,0 +1,213 @@
+package schema
+
+import (
+	"errors"
+	"math"
+	"unicode/utf8"
+)
+
+// CBOR（RFC 8949）的major type
+const (
+	CBOR_UINT   = 0
+	CBOR_NEGINT = 1
+	CBOR_BYTES  = 2
+	CBOR_TEXT   = 3
+	CBOR_ARRAY  = 4
+	CBOR_MAP    = 5
+	CBOR_TAG    = 6
+	CBOR_SIMPLE = 7
+)
+
+// 不定長度項目的結束標記
+const cborBreak = 0xFF
+
+var errCBORMalformed = errors.New("CBOR格式錯誤")
+
+func decodeCBOR(topic string, payload []byte) (interface{}, error) {
+	r := &byteReader{data: payload}
+	v, err := r.cbor(0)
+	if err != nil {
+		return nil, err
+	}
+	if r.remaining() > 0 {
+		return nil, errTrailing
+	}
+	return v, nil
+}
+
+// 讀取項目標頭，回傳major type、附加資訊和長度（或值）。
+// 不定長度時 indefinite 為true。
+func (r *byteReader) cborHead() (major byte, info byte, arg uint64, indefinite bool, err error) {
+	b, err := r.byte()
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	major, info = b>>5, b&0x1F
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		arg, err = r.uint(1 << (info - 24))
+	case info == 31 && major >= CBOR_BYTES && major <= CBOR_MAP:
+		indefinite = true
+	case info == 31 && major == CBOR_SIMPLE:
+		// break 由呼叫者處理
+	default:
+		err = errCBORMalformed
+	}
+	return major, info, arg, indefinite, err
+}
+
+func (r *byteReader) cbor(depth int) (interface{}, error) {
+	if depth > maxDecodeDepth {
+		return nil, errTooDeep
+	}
+	major, info, arg, indefinite, err := r.cborHead()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case CBOR_UINT:
+		return uintNumber(arg), nil
+	case CBOR_NEGINT:
+		return negativeNumber(arg), nil
+	case CBOR_BYTES, CBOR_TEXT:
+		data, err := r.cborString(major, arg, indefinite)
+		if err != nil {
+			return nil, err
+		}
+		if major == CBOR_BYTES {
+			return bytesValue(data), nil
+		}
+		if !utf8.Valid(data) {
+			return nil, errCBORMalformed
+		}
+		return string(data), nil
+	case CBOR_ARRAY:
+		list := []interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && r.cborAtBreak() {
+				break
+			}
+			if !indefinite && i == 0 {
+				if err := r.checkCount(arg); err != nil {
+					return nil, err
+				}
+			}
+			v, err := r.cbor(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case CBOR_MAP:
+		m := make(map[string]interface{})
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && r.cborAtBreak() {
+				break
+			}
+			if !indefinite && i == 0 {
+				if err := r.checkCount(arg * 2); err != nil {
+					return nil, err
+				}
+			}
+			key, err := r.cbor(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			v, err := r.cbor(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[mapKey(key)] = v
+		}
+		return m, nil
+	case CBOR_TAG:
+		// 標籤（日期、大整數等）只取內容
+		return r.cbor(depth + 1)
+	}
+
+	// major type 7：簡單值和浮點數
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		return floatNumber(halfFloat(uint16(arg))), nil
+	case 26:
+		return floatNumber(float64(math.Float32frombits(uint32(arg)))), nil
+	case 27:
+		return floatNumber(math.Float64frombits(arg)), nil
+	case 24:
+		if arg < 32 {
+			return nil, errCBORMalformed
+		}
+		return nil, nil
+	}
+	if info < 20 {
+		// 未指定的簡單值
+		return nil, nil
+	}
+	return nil, errCBORMalformed
+}
+
+// 不定長度的項目是否到了結尾，是的話讀掉break
+func (r *byteReader) cborAtBreak() bool {
+	if r.pos < len(r.data) && r.data[r.pos] == cborBreak {
+		r.pos++
+		return true
+	}
+	return false
+}
+
+// 讀取位元組或文字字串，不定長度時把各段接起來
+func (r *byteReader) cborString(major byte, length uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		return r.bytes(length)
+	}
+	var data []byte
+	for {
+		if r.cborAtBreak() {
+			return data, nil
+		}
+		chunkMajor, _, chunkLength, chunkIndefinite, err := r.cborHead()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor != major || chunkIndefinite {
+			return nil, errCBORMalformed
+		}
+		chunk, err := r.bytes(chunkLength)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+}
+
+// IEEE 754 半精度浮點數
+func halfFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1F
+	mant := float64(h & 0x3FF)
+	var f float64
+	switch exp {
+	case 0:
+		f = mant * math.Pow(2, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = (mant + 1024) * math.Pow(2, float64(exp-25))
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
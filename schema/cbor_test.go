@@ -0,0 +1,171 @@
+package schema
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 測試資料以十六進位表示，可以有空白
+func unhex(t testing.TB, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("無效的十六進位 %q: %v", s, err)
+	}
+	return b
+}
+
+type num = json.Number
+type obj = map[string]interface{}
+type arr = []interface{}
+
+// 解碼結果必須能轉成JSON，和 encoding/json 解出的文件形狀相同
+func checkJSONShape(t testing.TB, doc interface{}) {
+	t.Helper()
+	if _, err := json.Marshal(doc); err != nil {
+		t.Fatalf("解碼結果無法轉成JSON: %v（%#v）", err, doc)
+	}
+}
+
+// RFC 8949 附錄A的範例，加上巢狀和不定長度的組合
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{"00", num("0")},
+		{"17", num("23")},
+		{"1818", num("24")},
+		{"1903e8", num("1000")},
+		{"1a000f4240", num("1000000")},
+		{"1bffffffffffffffff", num("18446744073709551615")},
+		{"20", num("-1")},
+		{"3863", num("-100")},
+		{"3903e7", num("-1000")},
+		{"3b7fffffffffffffff", num("-9223372036854775808")},
+		{"3bffffffffffffffff", num("-18446744073709551616")},
+		// 半精度
+		{"f90000", num("0")},
+		{"f93c00", num("1")},
+		{"f93e00", num("1.5")},
+		{"f97bff", num("65504")},
+		{"f90001", num("5.960464477539063e-08")},
+		{"f90400", num("6.103515625e-05")},
+		{"f9c400", num("-4")},
+		{"f97c00", nil}, // 無限大
+		{"f97e00", nil}, // NaN
+		// 單精度和倍精度
+		{"fa47c35000", num("100000")},
+		{"fa7f7fffff", num("3.4028234663852886e+38")},
+		{"fabf800000", num("-1")},
+		{"fb3ff199999999999a", num("1.1")},
+		{"fbc010666666666666", num("-4.1")},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"f7", nil},
+		{"f0", nil},
+		{"f8ff", nil},
+		{"40", ""},
+		{"4401020304", "01020304"},
+		{"60", ""},
+		{"6449455446", "IETF"},
+		{"62c3bc", "ü"},
+		{"80", arr{}},
+		{"83010203", arr{num("1"), num("2"), num("3")}},
+		{"a0", obj{}},
+		{"a201020304", obj{"1": num("2"), "3": num("4")}},
+		{"a26161016162820203", obj{"a": num("1"), "b": arr{num("2"), num("3")}}},
+		{"826161a161626163", arr{"a", obj{"b": "c"}}},
+		// 巢狀map和負整數
+		{"a2 6473757069 6f323038393330303030303030303031 657573616765 a2 62756c 1903e8 6564656c7461 3863",
+			obj{"supi": "208930000000001", "usage": obj{"ul": num("1000"), "delta": num("-100")}}},
+		// 標籤只取內容
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+		{"c11a514b67b0", num("1363896240")},
+		// 不定長度
+		{"5f42010243030405ff", "0102030405"},
+		{"7f657374726561646d696e67ff", "streaming"},
+		{"9fff", arr{}},
+		{"9f018202039f0405ffff", arr{num("1"), arr{num("2"), num("3")}, arr{num("4"), num("5")}}},
+		{"bf61610161629f0203ffff", obj{"a": num("1"), "b": arr{num("2"), num("3")}}},
+		// 非字串的鍵
+		{"a3f501f602f93c0003", obj{"true": num("1"), "null": num("2"), "1": num("3")}},
+	}
+	for _, tt := range tests {
+		got, err := decodeCBOR("t", unhex(t, tt.in))
+		if err != nil {
+			t.Errorf("decodeCBOR(%s): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decodeCBOR(%s) = %#v，應為 %#v", tt.in, got, tt.want)
+		}
+		checkJSONShape(t, got)
+	}
+}
+
+func TestDecodeCBORErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		want error
+	}{
+		{"", errTruncated},
+		{"19 03", errTruncated},
+		{"1b 0000", errTruncated},
+		{"62 61", errTruncated},
+		{"83 01 02", errTruncated},
+		{"a2 01 02 03", errTruncated},
+		{"f9 3c", errTruncated},
+		{"fa 47c350", errTruncated},
+		{"5f 42 0102", errTruncated},          // 不定長度沒有break
+		{"9b ffffffffffffffff", errTruncated}, // 元素個數超過資料
+		{"bb 7fffffffffffffff", errTruncated},
+		{"00 00", errTrailing},
+		{"1c", errCBORMalformed},          // 保留的附加資訊
+		{"3f", errCBORMalformed},          // 整數不能是不定長度
+		{"62 fffe", errCBORMalformed},     // 無效的UTF-8
+		{"5f 61 61 ff", errCBORMalformed}, // 位元組字串的段落是文字
+		{"7f 7f ff ff", errCBORMalformed}, // 段落不能是不定長度
+		{"f8 10", errCBORMalformed},       // 兩位元組簡單值小於32
+		{"ff", errCBORMalformed},          // 單獨的break
+		{strings.Repeat("81", 100) + "00", errTooDeep},
+		{strings.Repeat("c0", 100) + "00", errTooDeep},
+	}
+	for _, tt := range tests {
+		if _, err := decodeCBOR("t", unhex(t, tt.in)); !errors.Is(err, tt.want) {
+			t.Errorf("decodeCBOR(%s) 錯誤為 %v，應為 %v", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestHalfFloat(t *testing.T) {
+	tests := map[uint16]float64{
+		0x0000: 0, 0x3c00: 1, 0x3c01: 1.0009765625, 0x7bff: 65504,
+		0x0001: 5.960464477539063e-08, 0x03ff: 6.097555160522461e-05, 0xc000: -2, 0x3555: 0.333251953125,
+	}
+	for h, want := range tests {
+		if got := halfFloat(h); got != want {
+			t.Errorf("halfFloat(%#04x) = %v，應為 %v", h, got, want)
+		}
+	}
+}
+
+func FuzzDecodeCBOR(f *testing.F) {
+	for _, seed := range []string{
+		"a26161016162820203", "bf61610161629f0203ffff", "5f42010243030405ff", "f97bff",
+		"fa47c35000", "3bffffffffffffffff", "c074323031332d30332d32315432303a30343a30305a",
+	} {
+		f.Add(unhex(f, seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		doc, err := decodeCBOR("t", data)
+		if err == nil {
+			checkJSONShape(t, doc)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// 支援的payload格式
+const (
+	FormatJSON      = "json"
+	FormatCBOR      = "cbor"
+	FormatMsgPack   = "msgpack"
+	FormatProtobuf  = "protobuf"
+	FormatSparkplug = "sparkplugb"
+)
+
+// 解碼器把payload轉成和 encoding/json 相同形狀的文件：
+// map[string]interface{}、[]interface{}、string、bool、json.Number，二進位資料轉成十六進位字串。
+type decodeFunc func(topic string, payload []byte) (interface{}, error)
+
+// Decoder 指定某些主題的payload格式，依規格中的順序第一個符合的生效，都不符合時當作JSON
+type Decoder struct {
+	Topic         string `yaml:"topic"`         // MQTT主題過濾器，可用 + 和 #
+	Format        string `yaml:"format"`        // json、cbor、msgpack、protobuf、sparkplugb
+	DescriptorSet string `yaml:"descriptorSet"` // protobuf：protoc --include_imports --descriptor_set_out 產生的檔案
+	Message       string `yaml:"message"`       // protobuf：完整的訊息名稱，例如 free5gc.metric.Report
+
+	decode decodeFunc
+}
+
+// DecodeError 表示payload無法依指定的格式解碼
+type DecodeError struct {
+	Format string
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("無法解析payload為%s: %v", e.Format, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// dir 為規格檔所在目錄，descriptorSet 的相對路徑以它為準
+func (d *Decoder) compile(dir string) error {
+	if err := ValidateTopicFilter(d.Topic); err != nil {
+		return err
+	}
+	if d.Format != FormatProtobuf && (d.DescriptorSet != "" || d.Message != "") {
+		return fmt.Errorf("descriptorSet 和 message 只用於 protobuf")
+	}
+	switch d.Format {
+	case FormatJSON:
+		d.decode = decodeJSON
+	case FormatCBOR:
+		d.decode = decodeCBOR
+	case FormatMsgPack:
+		d.decode = decodeMsgPack
+	case FormatSparkplug:
+		d.decode = newSparkplugDecoder().decode
+	case FormatProtobuf:
+		if d.DescriptorSet == "" || d.Message == "" {
+			return fmt.Errorf("protobuf 需要 descriptorSet 和 message")
+		}
+		path := d.DescriptorSet
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		decode, err := newProtobufDecoder(path, d.Message)
+		if err != nil {
+			return err
+		}
+		d.decode = decode
+	default:
+		return fmt.Errorf("不支援的格式 %q（json、cbor、msgpack、protobuf、sparkplugb）", d.Format)
+	}
+	return nil
+}
+
+// 依主題選擇解碼器
+func (s *Spec) decoderFor(topic string) (string, decodeFunc) {
+	for _, d := range s.Decoders {
+		if MatchTopic(d.Topic, topic) {
+			return d.Format, d.decode
+		}
+	}
+	return FormatJSON, decodeJSON
+}
+
+func decodeJSON(topic string, payload []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// ValidateTopicFilter 檢查MQTT主題過濾器：# 只能是最後一層，+ 和 # 必須獨佔一層
+func ValidateTopicFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("主題過濾器不能是空的")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) > 1 {
+			return fmt.Errorf("主題過濾器 %q: 萬用字元必須獨佔一層", filter)
+		}
+		if level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("主題過濾器 %q: # 只能在最後一層", filter)
+		}
+	}
+	return nil
+}
+
+// MatchTopic 判斷主題是否符合MQTT主題過濾器。
+// 依MQTT規範，$ 開頭的主題（例如 $SYS）不會被第一層的萬用字元匹配。
+func MatchTopic(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			// a/# 也匹配 a 本身
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
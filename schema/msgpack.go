@@ -0,0 +1,203 @@
+package schema
+
+import (
+	"errors"
+	"math"
+	"time"
+	"unicode/utf8"
+)
+
+// MessagePack時間戳記的擴充型別
+const MSGPACK_EXT_TIMESTAMP = -1
+
+var errMsgPackMalformed = errors.New("MessagePack格式錯誤")
+
+func decodeMsgPack(topic string, payload []byte) (interface{}, error) {
+	r := &byteReader{data: payload}
+	v, err := r.msgpack(0)
+	if err != nil {
+		return nil, err
+	}
+	if r.remaining() > 0 {
+		return nil, errTrailing
+	}
+	return v, nil
+}
+
+func (r *byteReader) msgpack(depth int) (interface{}, error) {
+	if depth > maxDecodeDepth {
+		return nil, errTooDeep
+	}
+	b, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b <= 0x7F: // positive fixint
+		return uintNumber(uint64(b)), nil
+	case b >= 0xE0: // negative fixint
+		return intNumber(int64(int8(b))), nil
+	case b&0xF0 == 0x80: // fixmap
+		return r.msgpackMap(uint64(b&0x0F), depth)
+	case b&0xF0 == 0x90: // fixarray
+		return r.msgpackArray(uint64(b&0x0F), depth)
+	case b&0xE0 == 0xA0: // fixstr
+		return r.msgpackString(uint64(b & 0x1F))
+	}
+
+	switch b {
+	case 0xC0:
+		return nil, nil
+	case 0xC2:
+		return false, nil
+	case 0xC3:
+		return true, nil
+	case 0xC4, 0xC5, 0xC6: // bin 8/16/32
+		n, err := r.uint(1 << (b - 0xC4))
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		return bytesValue(data), nil
+	case 0xC7, 0xC8, 0xC9: // ext 8/16/32
+		n, err := r.uint(1 << (b - 0xC7))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackExt(n)
+	case 0xCA:
+		bits, err := r.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return floatNumber(float64(math.Float32frombits(uint32(bits)))), nil
+	case 0xCB:
+		bits, err := r.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return floatNumber(math.Float64frombits(bits)), nil
+	case 0xCC, 0xCD, 0xCE, 0xCF: // uint 8/16/32/64
+		n, err := r.uint(1 << (b - 0xCC))
+		if err != nil {
+			return nil, err
+		}
+		return uintNumber(n), nil
+	case 0xD0, 0xD1, 0xD2, 0xD3: // int 8/16/32/64
+		size := 1 << (b - 0xD0)
+		n, err := r.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// 符號延伸
+		shift := 64 - 8*uint(size)
+		return intNumber(int64(n<<shift) >> shift), nil
+	case 0xD4, 0xD5, 0xD6, 0xD7, 0xD8: // fixext 1/2/4/8/16
+		return r.msgpackExt(1 << (b - 0xD4))
+	case 0xD9, 0xDA, 0xDB: // str 8/16/32
+		n, err := r.uint(1 << (b - 0xD9))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackString(n)
+	case 0xDC, 0xDD: // array 16/32
+		n, err := r.uint(2 << (b - 0xDC))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackArray(n, depth)
+	case 0xDE, 0xDF: // map 16/32
+		n, err := r.uint(2 << (b - 0xDE))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackMap(n, depth)
+	}
+	// 0xC1 保留不用
+	return nil, errMsgPackMalformed
+}
+
+func (r *byteReader) msgpackString(n uint64) (interface{}, error) {
+	data, err := r.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.Valid(data) {
+		return nil, errMsgPackMalformed
+	}
+	return string(data), nil
+}
+
+func (r *byteReader) msgpackArray(n uint64, depth int) (interface{}, error) {
+	if err := r.checkCount(n); err != nil {
+		return nil, err
+	}
+	list := make([]interface{}, 0, n)
+	for i := uint64(0); i < n; i++ {
+		v, err := r.msgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func (r *byteReader) msgpackMap(n uint64, depth int) (interface{}, error) {
+	if err := r.checkCount(n * 2); err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		key, err := r.msgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := r.msgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[mapKey(key)] = v
+	}
+	return m, nil
+}
+
+// 擴充型別：時間戳記轉成RFC 3339字串，其他型別只保留資料的十六進位
+func (r *byteReader) msgpackExt(n uint64) (interface{}, error) {
+	typ, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := r.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(typ) != MSGPACK_EXT_TIMESTAMP {
+		return bytesValue(data), nil
+	}
+	var sec int64
+	var nsec uint64
+	switch n {
+	case 4:
+		sec = int64((&byteReader{data: data}).mustUint(4))
+	case 8:
+		v := (&byteReader{data: data}).mustUint(8)
+		nsec, sec = v>>34, int64(v&(1<<34-1))
+	case 12:
+		inner := &byteReader{data: data}
+		nsec = inner.mustUint(4)
+		sec = int64(inner.mustUint(8))
+	default:
+		return nil, errMsgPackMalformed
+	}
+	return time.Unix(sec, int64(nsec)).UTC().Format(time.RFC3339Nano), nil
+}
+
+// 長度已經檢查過的讀取
+func (r *byteReader) mustUint(n int) uint64 {
+	v, _ := r.uint(n)
+	return v
+}
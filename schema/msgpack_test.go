@@ -0,0 +1,126 @@
+package schema
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// MessagePack規格中各型別的編碼
+func TestDecodeMsgPack(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{"00", num("0")},
+		{"7f", num("127")},
+		{"cc ff", num("255")},
+		{"cd 0100", num("256")},
+		{"ce ffffffff", num("4294967295")},
+		{"cf ffffffffffffffff", num("18446744073709551615")},
+		// 負整數
+		{"ff", num("-1")},
+		{"e0", num("-32")},
+		{"d0 80", num("-128")},
+		{"d0 7f", num("127")},
+		{"d1 8000", num("-32768")},
+		{"d2 80000000", num("-2147483648")},
+		{"d2 fffffc18", num("-1000")},
+		{"d3 8000000000000000", num("-9223372036854775808")},
+		// 浮點數
+		{"ca 3fc00000", num("1.5")},
+		{"ca c0800000", num("-4")},
+		{"ca 7f800000", nil}, // 無限大
+		{"cb 3ff199999999999a", num("1.1")},
+		{"cb 7ff8000000000000", nil}, // NaN
+		{"c0", nil},
+		{"c2", false},
+		{"c3", true},
+		{"a0", ""},
+		{"a3 616263", "abc"},
+		{"d9 03 616263", "abc"},
+		{"da 0003 616263", "abc"},
+		{"db 00000003 616263", "abc"},
+		{"c4 02 0102", "0102"},
+		{"c5 0001 ff", "ff"},
+		{"90", arr{}},
+		{"93 01 02 03", arr{num("1"), num("2"), num("3")}},
+		{"dc 0002 01 ff", arr{num("1"), num("-1")}},
+		{"dd 00000001 c3", arr{true}},
+		{"80", obj{}},
+		{"82 a161 01 a162 92 02 03", obj{"a": num("1"), "b": arr{num("2"), num("3")}}},
+		{"de 0001 a161 01", obj{"a": num("1")}},
+		{"df 00000001 a161 01", obj{"a": num("1")}},
+		// 巢狀map和負整數
+		{"82 a4 73757069 af 323038393330303030303030303031 a5 7573616765 82 a2 756c cd 03e8 a5 64656c7461 d0 9c",
+			obj{"supi": "208930000000001", "usage": obj{"ul": num("1000"), "delta": num("-100")}}},
+		// 非字串的鍵
+		{"83 01 02 c3 03 c0 04", obj{"1": num("2"), "true": num("3"), "null": num("4")}},
+		// 時間戳記擴充型別的三種長度
+		{"d6 ff 00000000", "1970-01-01T00:00:00Z"},
+		{"d6 ff 65a54d52", "2024-01-15T15:20:50Z"},
+		{"d7 ff 7735940000000001", "1970-01-01T00:00:01.5Z"},
+		{"c7 0c ff 00000001 0000000000000002", "1970-01-01T00:00:02.000000001Z"},
+		// 其他擴充型別只保留資料
+		{"d4 01 ab", "ab"},
+		{"c7 03 05 010203", "010203"},
+	}
+	for _, tt := range tests {
+		got, err := decodeMsgPack("t", unhex(t, tt.in))
+		if err != nil {
+			t.Errorf("decodeMsgPack(%s): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decodeMsgPack(%s) = %#v，應為 %#v", tt.in, got, tt.want)
+		}
+		checkJSONShape(t, got)
+	}
+}
+
+func TestDecodeMsgPackErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		want error
+	}{
+		{"", errTruncated},
+		{"cd 01", errTruncated},
+		{"cf 00000000", errTruncated},
+		{"d3 ff", errTruncated},
+		{"ca 3fc0", errTruncated},
+		{"a3 6162", errTruncated},
+		{"d9", errTruncated},
+		{"c4 05 01", errTruncated},
+		{"92 01", errTruncated},
+		{"82 a161 01", errTruncated},
+		{"dd ffffffff", errTruncated}, // 元素個數超過資料
+		{"df 7fffffff 00", errTruncated},
+		{"d6 ff 0000", errTruncated},
+		{"00 00", errTrailing},
+		{"c1", errMsgPackMalformed},
+		{"a2 fffe", errMsgPackMalformed},
+		{"d5 ff 0000", errMsgPackMalformed}, // 時間戳記長度錯誤
+		{strings.Repeat("91", 100) + "00", errTooDeep},
+	}
+	for _, tt := range tests {
+		if _, err := decodeMsgPack("t", unhex(t, tt.in)); !errors.Is(err, tt.want) {
+			t.Errorf("decodeMsgPack(%s) 錯誤為 %v，應為 %v", tt.in, err, tt.want)
+		}
+	}
+}
+
+func FuzzDecodeMsgPack(f *testing.F) {
+	for _, seed := range []string{
+		"82 a161 01 a162 92 02 03", "d7 ff 7735940000000001", "c7 0c ff 00000001 0000000000000002",
+		"ca 3fc00000", "d3 8000000000000000", "dc 0002 01 ff",
+	} {
+		f.Add(unhex(f, seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		doc, err := decodeMsgPack("t", data)
+		if err == nil {
+			checkJSONShape(t, doc)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 路徑中的一步：物件的鍵、陣列索引或陣列長度（#）
+type step struct {
+	key    string
+	index  int // -1 表示不是索引
+	length bool
+}
+
+// 解析路徑，支援兩種寫法：
+//
+//	gjson樣式：  counters.ulBytes、items.0.cause、items.#、a\.b（鍵中有點）
+//	JSONPath樣式：$.counters.ulBytes、$.items[0].cause、$['a.b']
+func parsePath(path string) ([]step, error) {
+	if path == "$" {
+		return nil, fmt.Errorf("路徑不能只有 $")
+	}
+	jsonPath := strings.HasPrefix(path, "$")
+	if jsonPath {
+		path = strings.TrimPrefix(path[1:], ".")
+	}
+
+	var steps []step
+	var key strings.Builder
+	pending := false // key 中有尚未加入的鍵
+	flush := func() {
+		if pending {
+			steps = append(steps, gjsonStep(key.String(), jsonPath))
+		}
+		key.Reset()
+		pending = false
+	}
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '\\' && !jsonPath && i+1 < len(path):
+			i++
+			key.WriteByte(path[i])
+			pending = true
+		case c == '.':
+			if (!pending && (i == 0 || path[i-1] != ']')) || i+1 == len(path) {
+				return nil, fmt.Errorf("路徑 %q 有空的鍵", path)
+			}
+			flush()
+		case c == '[' && jsonPath:
+			flush()
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("路徑 %q 缺少 ]", path)
+			}
+			inner := path[i+1 : i+end]
+			i += end
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, step{key: inner[1 : len(inner)-1], index: -1})
+				continue
+			}
+			n, err := strconv.Atoi(inner)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("路徑 %q 的索引 [%s] 不是非負整數", path, inner)
+			}
+			steps = append(steps, step{key: inner, index: n})
+		default:
+			key.WriteByte(c)
+			pending = true
+		}
+	}
+	flush()
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("路徑 %q 是空的", path)
+	}
+	return steps, nil
+}
+
+// gjson樣式中，數字的鍵在陣列上當作索引，# 是陣列長度
+func gjsonStep(key string, jsonPath bool) step {
+	s := step{key: key, index: -1}
+	if jsonPath {
+		return s
+	}
+	if key == "#" {
+		s.length = true
+	} else if n, err := strconv.Atoi(key); err == nil && n >= 0 {
+		s.index = n
+	}
+	return s
+}
+
+// 依路徑取值，路徑不存在時回傳false
+func lookup(v interface{}, steps []step) (interface{}, bool) {
+	for _, s := range steps {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			// 數字的鍵在物件上仍然是鍵
+			child, ok := node[s.key]
+			if !ok {
+				// 和 encoding/json 解到struct時一樣，找不到時不分大小寫
+				for key, value := range node {
+					if strings.EqualFold(key, s.key) {
+						child, ok = value, true
+						break
+					}
+				}
+			}
+			if !ok {
+				return nil, false
+			}
+			v = child
+		case []interface{}:
+			switch {
+			case s.length:
+				v = json.Number(strconv.Itoa(len(node)))
+			case s.index >= 0 && s.index < len(node):
+				v = node[s.index]
+			default:
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+	if v == nil {
+		// JSON null 當作不存在
+		return nil, false
+	}
+	return v, true
+}
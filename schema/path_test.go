@@ -0,0 +1,275 @@
+package schema
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	key := func(k string) step { return step{key: k, index: -1} }
+	index := func(k string, n int) step { return step{key: k, index: n} }
+	tests := []struct {
+		path string
+		want []step
+	}{
+		{"imsi", []step{key("imsi")}},
+		{"counters.ulBytes", []step{key("counters"), key("ulBytes")}},
+		{"items.0.cause", []step{key("items"), index("0", 0), key("cause")}},
+		{"items.#", []step{key("items"), {key: "#", index: -1, length: true}}},
+		{`a\.b.c`, []step{key("a.b"), key("c")}},
+		{"items.-1", []step{key("items"), key("-1")}}, // 負數不是索引
+		{"$.counters.ulBytes", []step{key("counters"), key("ulBytes")}},
+		{"$.items[0].cause", []step{key("items"), index("0", 0), key("cause")}},
+		{"$.items[2][10]", []step{key("items"), index("2", 2), index("10", 10)}},
+		{"$['a.b']", []step{key("a.b")}},
+		{`$.x["y z"].w`, []step{key("x"), key("y z"), key("w")}},
+		// JSONPath中數字的鍵和 # 都只是鍵
+		{"$.items.0", []step{key("items"), key("0")}},
+		{"$.items.#", []step{key("items"), key("#")}},
+	}
+	for _, tt := range tests {
+		got, err := parsePath(tt.path)
+		if err != nil {
+			t.Errorf("parsePath(%q): %v", tt.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePath(%q) = %+v，應為 %+v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParsePathErrors(t *testing.T) {
+	for _, path := range []string{"", "$", "$.", "a..b", ".a", "a.", "$.items[0", "$.items[-1]", "$.items[x]", "$[]"} {
+		if steps, err := parsePath(path); err == nil {
+			t.Errorf("parsePath(%q) = %+v，應回傳錯誤", path, steps)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	doc := obj{
+		"imsi":     "208930000000001",
+		"counters": obj{"ulBytes": num("250"), "dlBytes": "300"},
+		"items":    arr{obj{"cause": "ok"}, obj{"cause": nil}},
+		"a.b":      obj{"c": true},
+		"map":      obj{"0": "zero"},
+		"SNSSAI":   obj{"sst": num("1")},
+	}
+	tests := []struct {
+		path string
+		want interface{} // nil 表示不存在
+	}{
+		{"imsi", "208930000000001"},
+		{"counters.ulBytes", num("250")},
+		{"$.counters.dlBytes", "300"},
+		{"items.0.cause", "ok"},
+		{"$.items[0].cause", "ok"},
+		{"items.#", num("2")},
+		{`a\.b.c`, true},
+		{"$['a.b'].c", true},
+		{"map.0", "zero"}, // 物件上的數字仍然是鍵
+		{"snssai.sst", num("1")},
+		{"counters", obj{"ulBytes": num("250"), "dlBytes": "300"}},
+		// 不存在
+		{"missing", nil},
+		{"counters.missing", nil},
+		{"items.2.cause", nil},
+		{"$.items[5]", nil},
+		{"items.1.cause", nil}, // JSON null
+		{"imsi.x", nil},        // 字串不能再往下
+		{"counters.#", nil},    // # 只用於陣列
+		{"items.cause", nil},
+	}
+	for _, tt := range tests {
+		steps, err := parsePath(tt.path)
+		if err != nil {
+			t.Fatalf("parsePath(%q): %v", tt.path, err)
+		}
+		got, ok := lookup(doc, steps)
+		if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookup(%q) = %#v, %v，應為 %#v", tt.path, got, ok, tt.want)
+		}
+	}
+}
+
+// 測試用的規格，依YAML中的欄位定義編譯
+func testSpec(t testing.TB, spec *Spec) *Spec {
+	t.Helper()
+	if err := spec.compile(""); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func TestExtract(t *testing.T) {
+	spec := testSpec(t, &Spec{
+		Imsi:           "$.supi",
+		ImsiTrimPrefix: "imsi-",
+		Fields: []Field{
+			{Name: "dnn", Role: RoleKey},
+			{Name: "sst", Path: "snssai.sst", Type: TypeInt},
+			{Name: "roaming", Type: TypeBool},
+			{Name: "ulBytes", Path: "$.counters.ulBytes", Type: TypeInt, Role: RoleSum},
+			{Name: "latency", Path: "metrics.0.latencyMs", Type: TypeFloat, Role: RoleAvg},
+			{Name: "failed", Type: TypeBool, Role: RoleSum},
+		},
+	})
+	tests := []struct {
+		name    string
+		payload string
+		want    Record
+	}{
+		{
+			"所有欄位",
+			`{"supi":"imsi-208930000000001","dnn":"internet","snssai":{"sst":1},"roaming":false,
+			  "counters":{"ulBytes":250},"metrics":[{"latencyMs":2.5}],"failed":true}`,
+			Record{Imsi: "208930000000001", Keys: []string{"internet", "1", "false"}, Values: []float64{250, 2.5, 1}, Has: []bool{true, true, true}},
+		},
+		{
+			"缺少的欄位留空",
+			`{"supi":"imsi-208930000000002","metrics":[]}`,
+			Record{Imsi: "208930000000002", Keys: []string{"", "", ""}, Values: []float64{0, 0, 0}, Has: []bool{false, false, false}},
+		},
+		{
+			// 數字字串和字串的布林值可以轉換，數字的IMSI直接使用
+			"字串的數值",
+			`{"supi":208930000000003,"dnn":"ims","snssai":{"sst":"2"},"roaming":"true","counters":{"ulBytes":"1500"},"metrics":[{"latencyMs":"0.25"}]}`,
+			Record{Imsi: "208930000000003", Keys: []string{"ims", "2", "true"}, Values: []float64{1500, 0.25, 0}, Has: []bool{true, true, false}},
+		},
+		{
+			"型別不符",
+			`{"supi":["imsi-1"],"dnn":5,"snssai":{"sst":1.5},"roaming":1,"counters":{"ulBytes":"many"},"metrics":[{"latencyMs":{}}],"failed":"maybe"}`,
+			Record{Keys: []string{"", "", ""}, Values: []float64{0, 0, 0}, Has: []bool{false, false, false},
+				Mismatches: []string{"imsi", "dnn", "sst", "roaming", "ulBytes", "latency", "failed"}},
+		},
+		{
+			"null當作不存在",
+			`{"supi":null,"dnn":null,"counters":{"ulBytes":null}}`,
+			Record{Keys: []string{"", "", ""}, Values: []float64{0, 0, 0}, Has: []bool{false, false, false}},
+		},
+	}
+	for _, tt := range tests {
+		got, err := spec.Extract("t/usage", []byte(tt.payload))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%s: %+v，應為 %+v", tt.name, *got, tt.want)
+		}
+	}
+
+	// 只有無法解碼時回傳錯誤
+	var decodeErr *DecodeError
+	if _, err := spec.Extract("t/usage", []byte(`{"supi":`)); !errors.As(err, &decodeErr) || decodeErr.Format != FormatJSON {
+		t.Errorf("無效的JSON: %v", err)
+	}
+
+	// 沒有規格檔時只取 imsi
+	record, err := Default().Extract("t", []byte(`{"imsi":"208930000000001","dnn":"internet"}`))
+	if err != nil || record.Imsi != "208930000000001" || len(record.Keys) != 0 || Default().RecordMap(record) != nil {
+		t.Errorf("預設規格: %+v, %v", record, err)
+	}
+}
+
+func TestSpecCompileErrors(t *testing.T) {
+	tests := []struct {
+		spec Spec
+		err  string
+	}{
+		{Spec{Imsi: "a..b"}, "imsi"},
+		{Spec{Fields: []Field{{Name: "ul-bytes"}}}, "只能包含英數字和底線"},
+		{Spec{Fields: []Field{{Name: "dnn"}, {Name: "dnn"}}}, "重複"},
+		{Spec{Fields: []Field{{Name: "dnn", Path: "$.x["}}}, "缺少 ]"},
+		{Spec{Fields: []Field{{Name: "dnn", Type: "date"}}}, "不支援的型別"},
+		{Spec{Fields: []Field{{Name: "dnn", Role: RoleSum}}}, "需要數值型別"},
+		{Spec{Fields: []Field{{Name: "n", Type: TypeInt, Role: "max"}}}, "不支援的用途"},
+	}
+	for _, tt := range tests {
+		spec := tt.spec
+		if err := spec.compile(""); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%+v: 錯誤 %v，應包含 %q", tt.spec.Fields, err, tt.err)
+		}
+	}
+}
+
+// 依分組鍵彙總，多個彙總合併後和全部加入同一個相同；Snapshot 依分組鍵排序後清空
+func TestAggregator(t *testing.T) {
+	spec := testSpec(t, &Spec{Fields: []Field{
+		{Name: "dnn"},
+		{Name: "sst", Type: TypeInt},
+		{Name: "ulBytes", Type: TypeInt, Role: RoleSum},
+		{Name: "latency", Type: TypeFloat, Role: RoleAvg},
+	}})
+	payloads := []string{
+		`{"imsi":"208930000000001","dnn":"internet","sst":1,"ulBytes":100,"latency":2}`,
+		`{"imsi":"208930000000002","dnn":"internet","sst":1,"ulBytes":50}`,
+		`{"imsi":"208930000000001","dnn":"internet","sst":1,"ulBytes":25,"latency":4}`,
+		`{"imsi":"208930000000003","dnn":"ims","sst":1,"latency":1}`,
+		`{"dnn":"internet","sst":2,"ulBytes":10}`,
+		`{"imsi":"208930000000004"}`, // 沒有分組鍵的記錄自成一組
+	}
+	records := make([]*Record, len(payloads))
+	for i, payload := range payloads {
+		record, err := spec.Extract("t", []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records[i] = record
+	}
+
+	whole := NewAggregator(spec, 0)
+	for _, record := range records {
+		whole.Add(record)
+	}
+	parts := []*Aggregator{NewAggregator(spec, 0), NewAggregator(spec, 0), NewAggregator(spec, 0)}
+	for i, record := range records {
+		parts[i%len(parts)].Add(record)
+	}
+	merged := NewAggregator(spec, 0)
+	for _, part := range parts {
+		merged.Merge(part)
+		if len(part.Snapshot()) != 0 {
+			t.Error("併入後的彙總應為空")
+		}
+	}
+
+	type summary struct {
+		keys    string
+		count   int
+		imsi    int
+		values  map[string]float64
+		members []string
+	}
+	want := []summary{
+		{"\x00", 1, 1, map[string]float64{"ulBytes": 0}, []string{"208930000000004"}},
+		{"ims\x001", 1, 1, map[string]float64{"ulBytes": 0, "latency": 1}, []string{"208930000000003"}},
+		{"internet\x001", 3, 2, map[string]float64{"ulBytes": 175, "latency": 3}, []string{"208930000000001", "208930000000002"}},
+		{"internet\x002", 1, 0, map[string]float64{"ulBytes": 10}, []string{}},
+	}
+	for name, aggregator := range map[string]*Aggregator{"單一彙總": whole, "合併": merged} {
+		groups := aggregator.Snapshot()
+		got := make([]summary, len(groups))
+		for i, g := range groups {
+			got[i] = summary{groupKey(g.Keys), g.Count, g.ImsiSet.Len(), spec.ValueMap(g), g.ImsiSet.Members()}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %+v，應為 %+v", name, got, want)
+		}
+		if again := aggregator.Snapshot(); len(again) != 0 {
+			t.Errorf("%s: Snapshot後仍有 %d 組", name, len(again))
+		}
+	}
+
+	// 文字輸出：空的鍵顯示 -，沒有樣本的平均顯示 -
+	whole.Add(records[4])
+	var out bytes.Buffer
+	Print(&out, spec, whole.Snapshot())
+	if want := "按欄位分組統計:\n  dnn=internet sst=2\n    訊息數: 1  獨立IMSI數量: 0  ulBytes總和: 10  latency平均: -\n"; out.String() != want {
+		t.Errorf("Print = %q，應為 %q", out.String(), want)
+	}
+}
@@ -0,0 +1,106 @@
+package schema
+
+import (
+	"fmt"
+	"os"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// 依descriptor set解碼Protobuf訊息，欄位名稱用.proto中的名稱（不是lowerCamelCase的JSON名稱）
+func newProtobufDecoder(descriptorSet, message string) (decodeFunc, error) {
+	data, err := os.ReadFile(descriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf("無法讀取descriptor set: %v", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("descriptor set %s 格式錯誤: %v", descriptorSet, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set %s 無法載入（產生時需要 --include_imports）: %v", descriptorSet, err)
+	}
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(message))
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set %s 中找不到訊息 %s", descriptorSet, message)
+	}
+	md, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s 不是訊息", message)
+	}
+
+	return func(topic string, payload []byte) (interface{}, error) {
+		msg := dynamicpb.NewMessage(md)
+		if err := proto.Unmarshal(payload, msg); err != nil {
+			return nil, err
+		}
+		return protoMessage(msg, 0), nil
+	}, nil
+}
+
+func protoMessage(msg protoreflect.Message, depth int) interface{} {
+	doc := make(map[string]interface{})
+	if depth > maxDecodeDepth {
+		return doc
+	}
+	// proto3沒有presence的純量欄位為預設值時不會出現在線路上，仍然列出，平均才不會漏掉0
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if !msg.Has(fd) && (fd.HasPresence() || fd.IsList() || fd.IsMap()) {
+			continue
+		}
+		v := msg.Get(fd)
+		switch {
+		case fd.IsList():
+			list := v.List()
+			items := make([]interface{}, 0, list.Len())
+			for j := 0; j < list.Len(); j++ {
+				items = append(items, protoValue(fd, list.Get(j), depth))
+			}
+			doc[string(fd.Name())] = items
+		case fd.IsMap():
+			m := make(map[string]interface{})
+			v.Map().Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+				m[key.String()] = protoValue(fd.MapValue(), value, depth)
+				return true
+			})
+			doc[string(fd.Name())] = m
+		default:
+			doc[string(fd.Name())] = protoValue(fd, v, depth)
+		}
+	}
+	return doc
+}
+
+func protoValue(fd protoreflect.FieldDescriptor, v protoreflect.Value, depth int) interface{} {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return v.Bool()
+	case protoreflect.EnumKind:
+		// 列舉用名稱，未定義的值用數字
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return intNumber(int64(v.Enum()))
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return intNumber(v.Int())
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return uintNumber(v.Uint())
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return floatNumber(v.Float())
+	case protoreflect.StringKind:
+		return v.String()
+	case protoreflect.BytesKind:
+		return bytesValue(v.Bytes())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return protoMessage(v.Message(), depth+1)
+	}
+	return nil
+}
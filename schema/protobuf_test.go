@@ -0,0 +1,226 @@
+package schema
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// 測試用的descriptor set：
+//
+//	syntax = "proto3";
+//	package test;
+//	enum Rat { RAT_UNKNOWN = 0; NR = 1; LTE = 2; }
+//	message Usage { uint64 ul = 1; sint32 delta = 2; }
+//	message Report {
+//	  string supi = 1; int64 count = 2; double ratio = 3; float temp = 4; bool ok = 5;
+//	  bytes raw = 6; Rat rat = 7; Usage usage = 8; repeated int32 codes = 9;
+//	  map<string, Usage> by_slice = 10; optional uint32 opt = 11;
+//	}
+func writeTestDescriptorSet(t testing.TB) string {
+	t.Helper()
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		fd := &descriptorpb.FieldDescriptorProto{
+			Name: proto.String(name), Number: proto.Int32(number), Type: typ.Enum(), Label: label.Enum(),
+			JsonName: proto.String(name),
+		}
+		if typeName != "" {
+			fd.TypeName = proto.String(typeName)
+		}
+		return fd
+	}
+	const optional = descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	const repeated = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	opt := field("opt", 11, descriptorpb.FieldDescriptorProto_TYPE_UINT32, optional, "")
+	opt.Proto3Optional = proto.Bool(true)
+	opt.OneofIndex = proto.Int32(0)
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name: proto.String("test.proto"), Package: proto.String("test"), Syntax: proto.String("proto3"),
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Rat"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("RAT_UNKNOWN"), Number: proto.Int32(0)},
+				{Name: proto.String("NR"), Number: proto.Int32(1)},
+				{Name: proto.String("LTE"), Number: proto.Int32(2)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Usage"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("ul", 1, descriptorpb.FieldDescriptorProto_TYPE_UINT64, optional, ""),
+					field("delta", 2, descriptorpb.FieldDescriptorProto_TYPE_SINT32, optional, ""),
+				},
+			},
+			{
+				Name: proto.String("Report"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("supi", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+					field("count", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, optional, ""),
+					field("ratio", 3, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, optional, ""),
+					field("temp", 4, descriptorpb.FieldDescriptorProto_TYPE_FLOAT, optional, ""),
+					field("ok", 5, descriptorpb.FieldDescriptorProto_TYPE_BOOL, optional, ""),
+					field("raw", 6, descriptorpb.FieldDescriptorProto_TYPE_BYTES, optional, ""),
+					field("rat", 7, descriptorpb.FieldDescriptorProto_TYPE_ENUM, optional, ".test.Rat"),
+					field("usage", 8, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, optional, ".test.Usage"),
+					field("codes", 9, descriptorpb.FieldDescriptorProto_TYPE_INT32, repeated, ""),
+					field("by_slice", 10, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, ".test.Report.BySliceEntry"),
+					opt,
+				},
+				NestedType: []*descriptorpb.DescriptorProto{{
+					Name: proto.String("BySliceEntry"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						field("key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+						field("value", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, optional, ".test.Usage"),
+					},
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				}},
+				OneofDecl: []*descriptorpb.OneofDescriptorProto{{Name: proto.String("_opt")}},
+			},
+		},
+	}
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test.pb")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testProtobufDecoder(t testing.TB) decodeFunc {
+	t.Helper()
+	decode, err := newProtobufDecoder(writeTestDescriptorSet(t), "test.Report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decode
+}
+
+func protoUsage(ul uint64, delta int64) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, ul)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeZigZag(delta))
+}
+
+func TestProtobufDecode(t *testing.T) {
+	decode := testProtobufDecoder(t)
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, "208930000000001")
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(math.MaxUint64-41)) // int64的-42
+	b = protowire.AppendTag(b, 3, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(1.1))
+	b = protowire.AppendTag(b, 4, protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, math.Float32bits(-1.5))
+	b = protowire.AppendTag(b, 5, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+	b = protowire.AppendTag(b, 6, protowire.BytesType)
+	b = protowire.AppendBytes(b, []byte{0x01, 0xff})
+	b = protowire.AppendTag(b, 7, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+	b = protowire.AppendTag(b, 8, protowire.BytesType)
+	b = protowire.AppendBytes(b, protoUsage(1000, -100))
+	// packed和未packed的repeated欄位都要接受
+	b = protowire.AppendTag(b, 9, protowire.BytesType)
+	b = protowire.AppendBytes(b, []byte{0x01, 0x02})
+	b = protowire.AppendTag(b, 9, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(math.MaxUint64)) // int32的-1
+	var entry []byte
+	entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+	entry = protowire.AppendString(entry, "embb")
+	entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+	entry = protowire.AppendBytes(entry, protoUsage(7, 3))
+	b = protowire.AppendTag(b, 10, protowire.BytesType)
+	b = protowire.AppendBytes(b, entry)
+	b = protowire.AppendTag(b, 11, protowire.VarintType)
+	b = protowire.AppendVarint(b, 0)
+
+	got, err := decode("t", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := obj{
+		"supi": "208930000000001", "count": num("-42"), "ratio": num("1.1"), "temp": num("-1.5"),
+		"ok": true, "raw": "01ff", "rat": "NR",
+		"usage":    obj{"ul": num("1000"), "delta": num("-100")},
+		"codes":    arr{num("1"), num("2"), num("-1")},
+		"by_slice": obj{"embb": obj{"ul": num("7"), "delta": num("3")}},
+		"opt":      num("0"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decode = %#v，應為 %#v", got, want)
+	}
+	checkJSONShape(t, got)
+
+	// 空訊息：proto3沒有presence的純量欄位列出預設值，訊息、repeated和optional欄位不列出
+	got, err = decode("t", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = obj{
+		"supi": "", "count": num("0"), "ratio": num("0"), "temp": num("0"),
+		"ok": false, "raw": "", "rat": "RAT_UNKNOWN",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decode(空訊息) = %#v，應為 %#v", got, want)
+	}
+
+	// 未定義的列舉值用數字
+	got, err = decode("t", []byte{0x38, 0x09})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rat := got.(obj)["rat"]; rat != num("9") {
+		t.Errorf("未定義的列舉值 = %#v，應為 9", rat)
+	}
+}
+
+func TestProtobufDecodeErrors(t *testing.T) {
+	decode := testProtobufDecoder(t)
+	for name, payload := range map[string][]byte{
+		"截斷的varint": {0x10, 0x80},
+		"截斷的字串":     {0x0a, 0x05, 'a'},
+		"截斷的double": {0x19, 0x00, 0x00},
+		"巢狀訊息截斷":    {0x42, 0x02, 0x08},
+		"無效的UTF-8":  {0x0a, 0x02, 0xff, 0xfe},
+		"欄位編號0":     {0x00, 0x00},
+	} {
+		if _, err := decode("t", payload); err == nil {
+			t.Errorf("%s: 應該傳回錯誤", name)
+		}
+	}
+
+	if _, err := newProtobufDecoder(writeTestDescriptorSet(t), "test.Missing"); err == nil {
+		t.Error("不存在的訊息應該傳回錯誤")
+	}
+	if _, err := newProtobufDecoder(writeTestDescriptorSet(t), "test.Rat"); err == nil {
+		t.Error("列舉不是訊息，應該傳回錯誤")
+	}
+}
+
+func FuzzProtobufDecode(f *testing.F) {
+	decode := testProtobufDecoder(f)
+	f.Add([]byte{0x0a, 0x03, 'a', 'b', 'c', 0x10, 0x2a})
+	f.Add(append([]byte{0x42, 0x04}, protoUsage(1, -1)...))
+	f.Add([]byte{0x4a, 0x02, 0x01, 0x02, 0x52, 0x02, 0x0a, 0x00})
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		doc, err := decode("t", payload)
+		if err == nil {
+			checkJSONShape(t, doc)
+		}
+	})
+}
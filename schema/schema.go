@@ -0,0 +1,310 @@
+// Package schema 依使用者定義的規格從MQTT payload取出欄位。
+// payload預設為JSON，也可以依主題指定CBOR、MessagePack、Protobuf或Sparkplug B。
+// 欄位分成分組鍵（key）和數值（sum/avg），統計區間內按分組鍵彙總。
+// 抓包程式和 SubscribeMqtt 共用同一份規格檔。
+//
+// 規格檔範例（YAML）：
+//
+//	imsi: supi
+//	imsiTrimPrefix: "imsi-"
+//	fields:
+//	  - {name: dnn, path: dnn, type: string, role: key}
+//	  - {name: sst, path: snssai.sst, type: int, role: key}
+//	  - {name: ulBytes, path: counters.ulBytes, type: int, role: sum}
+//	  - {name: latency, path: "$.metrics[0].latencyMs", type: float, role: avg}
+//	decoders:
+//	  - {topic: "spBv1.0/#", format: sparkplugb}
+//	  - {topic: "FiveGC/metric/pb", format: protobuf, descriptorSet: metric.pb, message: free5gc.Metric}
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 欄位型別
+const (
+	TypeString = "string"
+	TypeInt    = "int"
+	TypeFloat  = "float"
+	TypeBool   = "bool"
+)
+
+// 欄位用途
+const (
+	RoleKey = "key" // 分組鍵
+	RoleSum = "sum" // 區間內加總
+	RoleAvg = "avg" // 區間內平均
+)
+
+// Spec 是一份payload擷取規格
+type Spec struct {
+	Imsi           string     `yaml:"imsi"`           // IMSI的路徑，預設 imsi
+	ImsiTrimPrefix string     `yaml:"imsiTrimPrefix"` // 從IMSI去掉的前綴，例如SUPI的 "imsi-"
+	Fields         []Field    `yaml:"fields"`
+	Decoders       []*Decoder `yaml:"decoders"` // 依主題選擇payload格式，預設JSON
+
+	imsi   []step
+	keys   []*Field
+	values []*Field
+}
+
+// Field 是一個要擷取的欄位
+type Field struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"` // gjson樣式（a.b.0.c、a.#）或JSONPath樣式（$.a.b[0]['c']）
+	Type string `yaml:"type"`
+	Role string `yaml:"role"`
+
+	steps []step
+}
+
+var fieldName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Default 是沒有規格檔時的行為：只取 imsi 欄位
+func Default() *Spec {
+	spec := &Spec{}
+	if err := spec.compile(""); err != nil {
+		panic(err)
+	}
+	return spec
+}
+
+// Load 讀取YAML規格檔
+func Load(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("無法讀取擷取規格 %s: %v", path, err)
+	}
+	spec := &Spec{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(spec); err != nil {
+		return nil, fmt.Errorf("擷取規格格式錯誤 %s: %v", path, err)
+	}
+	if err := spec.compile(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("擷取規格錯誤 %s: %v", path, err)
+	}
+	return spec, nil
+}
+
+func (s *Spec) compile(dir string) error {
+	if s.Imsi == "" {
+		s.Imsi = "imsi"
+	}
+	var err error
+	if s.imsi, err = parsePath(s.Imsi); err != nil {
+		return fmt.Errorf("imsi: %v", err)
+	}
+	names := make(map[string]bool)
+	for i := range s.Fields {
+		f := &s.Fields[i]
+		if !fieldName.MatchString(f.Name) {
+			return fmt.Errorf("欄位名稱 %q 只能包含英數字和底線", f.Name)
+		}
+		if names[f.Name] {
+			return fmt.Errorf("欄位名稱 %q 重複", f.Name)
+		}
+		names[f.Name] = true
+		if f.Path == "" {
+			f.Path = f.Name
+		}
+		if f.steps, err = parsePath(f.Path); err != nil {
+			return fmt.Errorf("欄位 %s: %v", f.Name, err)
+		}
+		if f.Type == "" {
+			f.Type = TypeString
+		}
+		switch f.Type {
+		case TypeString, TypeInt, TypeFloat, TypeBool:
+		default:
+			return fmt.Errorf("欄位 %s: 不支援的型別 %q（string、int、float、bool）", f.Name, f.Type)
+		}
+		switch f.Role {
+		case RoleKey, "":
+			f.Role = RoleKey
+			s.keys = append(s.keys, f)
+		case RoleSum, RoleAvg:
+			if f.Type == TypeString {
+				return fmt.Errorf("欄位 %s: %s 需要數值型別", f.Name, f.Role)
+			}
+			s.values = append(s.values, f)
+		default:
+			return fmt.Errorf("欄位 %s: 不支援的用途 %q（key、sum、avg）", f.Name, f.Role)
+		}
+	}
+	for i, d := range s.Decoders {
+		if err := d.compile(dir); err != nil {
+			return fmt.Errorf("decoders[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Keys 是分組鍵欄位，順序和 Record.Keys 相同
+func (s *Spec) Keys() []*Field { return s.keys }
+
+// Values 是數值欄位，順序和 Record.Values 相同
+func (s *Spec) Values() []*Field { return s.values }
+
+// Grouped 表示規格有定義欄位，報告需要分組統計
+func (s *Spec) Grouped() bool { return len(s.Fields) > 0 }
+
+// Record 是從一個payload取出的欄位
+type Record struct {
+	Imsi       string
+	Keys       []string  // 分組鍵的值，沒有該欄位時為空字串
+	Values     []float64 // 數值欄位的值
+	Has        []bool    // 數值欄位是否存在
+	Mismatches []string  // 存在但型別不符的欄位名稱
+}
+
+// Extract 依主題選擇的格式解析payload並取出規格中的欄位。只有payload無法解碼時回傳 *DecodeError，
+// 缺少的欄位留空，型別不符的欄位記在 Mismatches。
+func (s *Spec) Extract(topic string, payload []byte) (*Record, error) {
+	format, decode := s.decoderFor(topic)
+	doc, err := decode(topic, payload)
+	if err != nil {
+		return nil, &DecodeError{Format: format, Err: err}
+	}
+
+	record := &Record{
+		Keys:   make([]string, len(s.keys)),
+		Values: make([]float64, len(s.values)),
+		Has:    make([]bool, len(s.values)),
+	}
+	if v, ok := lookup(doc, s.imsi); ok {
+		switch imsi := v.(type) {
+		case string:
+			record.Imsi = strings.TrimPrefix(imsi, s.ImsiTrimPrefix)
+		case json.Number:
+			record.Imsi = imsi.String()
+		default:
+			record.Mismatches = append(record.Mismatches, "imsi")
+		}
+	}
+	for i, f := range s.keys {
+		v, ok := lookup(doc, f.steps)
+		if !ok {
+			continue
+		}
+		if key, ok := formatKey(f.Type, v); ok {
+			record.Keys[i] = key
+		} else {
+			record.Mismatches = append(record.Mismatches, f.Name)
+		}
+	}
+	for i, f := range s.values {
+		v, ok := lookup(doc, f.steps)
+		if !ok {
+			continue
+		}
+		if n, ok := number(f.Type, v); ok {
+			record.Values[i] = n
+			record.Has[i] = true
+		} else {
+			record.Mismatches = append(record.Mismatches, f.Name)
+		}
+	}
+	return record, nil
+}
+
+// RecordMap 把記錄轉成欄位名稱對應值，給JSON輸出用，缺少的欄位不列出
+func (s *Spec) RecordMap(r *Record) map[string]interface{} {
+	if len(s.Fields) == 0 {
+		return nil
+	}
+	fields := make(map[string]interface{}, len(s.Fields))
+	for i, f := range s.keys {
+		if r.Keys[i] != "" {
+			fields[f.Name] = r.Keys[i]
+		}
+	}
+	for i, f := range s.values {
+		if r.Has[i] {
+			fields[f.Name] = r.Values[i]
+		}
+	}
+	return fields
+}
+
+// 分組鍵統一轉成字串
+func formatKey(fieldType string, v interface{}) (string, bool) {
+	switch fieldType {
+	case TypeString:
+		s, ok := v.(string)
+		return s, ok
+	case TypeBool:
+		b, ok := boolean(v)
+		return strconv.FormatBool(b), ok
+	case TypeInt:
+		n, ok := integer(v)
+		return strconv.FormatInt(n, 10), ok
+	case TypeFloat:
+		f, ok := float(v)
+		return strconv.FormatFloat(f, 'g', -1, 64), ok
+	}
+	return "", false
+}
+
+func number(fieldType string, v interface{}) (float64, bool) {
+	switch fieldType {
+	case TypeInt:
+		n, ok := integer(v)
+		return float64(n), ok
+	case TypeFloat:
+		return float(v)
+	case TypeBool:
+		// 布林值加總即為true的次數，平均即為比例
+		b, ok := boolean(v)
+		if b {
+			return 1, ok
+		}
+		return 0, ok
+	}
+	return 0, false
+}
+
+// 數字或數字字串（有些NF把計數器序列化成字串）
+func integer(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		n, err := v.Int64()
+		return n, err == nil
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func float(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func boolean(v interface{}) (bool, bool) {
+	switch v := v.(type) {
+	case bool:
+		return v, true
+	case string:
+		b, err := strconv.ParseBool(v)
+		return b, err == nil
+	}
+	return false, false
+}
@@ -0,0 +1,264 @@
+package schema
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sparkplug B（org.eclipse.tahu.protobuf.Payload）的欄位編號
+const (
+	SPB_PAYLOAD_TIMESTAMP = 1
+	SPB_PAYLOAD_METRICS   = 2
+	SPB_PAYLOAD_SEQ       = 3
+	SPB_PAYLOAD_UUID      = 4
+
+	SPB_METRIC_NAME      = 1
+	SPB_METRIC_ALIAS     = 2
+	SPB_METRIC_TIMESTAMP = 3
+	SPB_METRIC_DATATYPE  = 4
+	SPB_METRIC_IS_NULL   = 7
+	SPB_METRIC_INT       = 10
+	SPB_METRIC_LONG      = 11
+	SPB_METRIC_FLOAT     = 12
+	SPB_METRIC_DOUBLE    = 13
+	SPB_METRIC_BOOLEAN   = 14
+	SPB_METRIC_STRING    = 15
+	SPB_METRIC_BYTES     = 16
+)
+
+// Sparkplug B的資料型別
+var sparkplugDataTypes = map[uint64]string{
+	1: "Int8", 2: "Int16", 3: "Int32", 4: "Int64",
+	5: "UInt8", 6: "UInt16", 7: "UInt32", 8: "UInt64",
+	9: "Float", 10: "Double", 11: "Boolean", 12: "String",
+	13: "DateTime", 14: "Text", 15: "UUID", 16: "DataSet",
+	17: "Bytes", 18: "File", 19: "Template",
+}
+
+var errSparkplugMalformed = errors.New("Sparkplug B格式錯誤")
+
+// Sparkplug B解碼器。BIRTH訊息帶有metric名稱和alias的對應，之後的DATA訊息通常只帶alias，
+// 所以按edge node/device記住最近一次BIRTH的對應。
+//
+// 解碼結果：
+//
+//	{"group": "...", "messageType": "DDATA", "edgeNode": "...", "device": "...",
+//	 "timestamp": ..., "seq": ..., "uuid": "...",
+//	 "metrics": [{"name": "...", "alias": ..., "timestamp": ..., "datatype": "Int32", "value": ...}],
+//	 "values": {"<metric名稱>": <值>}}
+type sparkplugDecoder struct {
+	mu      sync.Mutex
+	aliases map[string]map[uint64]string // group/edgeNode[/device] -> alias -> 名稱
+}
+
+func newSparkplugDecoder() *sparkplugDecoder {
+	return &sparkplugDecoder{aliases: make(map[string]map[uint64]string)}
+}
+
+type sparkplugMetric struct {
+	name     string
+	alias    uint64
+	hasAlias bool
+	fields   map[string]interface{}
+}
+
+func (d *sparkplugDecoder) decode(topic string, payload []byte) (interface{}, error) {
+	doc := make(map[string]interface{})
+
+	// spBv1.0/<group>/<message type>/<edge node>[/<device>]
+	levels := strings.Split(topic, "/")
+	messageType, node := "", ""
+	if len(levels) >= 4 && strings.HasPrefix(levels[0], "spBv1") {
+		messageType = levels[2]
+		doc["group"] = levels[1]
+		doc["messageType"] = messageType
+		doc["edgeNode"] = levels[3]
+		node = levels[1] + "/" + levels[3]
+		if len(levels) >= 5 {
+			doc["device"] = levels[4]
+			node += "/" + levels[4]
+		}
+	}
+
+	var metrics []*sparkplugMetric
+	for len(payload) > 0 {
+		num, typ, n := protowire.ConsumeTag(payload)
+		if n < 0 {
+			return nil, errSparkplugMalformed
+		}
+		payload = payload[n:]
+		switch {
+		case num == SPB_PAYLOAD_TIMESTAMP && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(payload)
+			if n < 0 {
+				return nil, errSparkplugMalformed
+			}
+			doc["timestamp"] = uintNumber(v)
+			payload = payload[n:]
+		case num == SPB_PAYLOAD_SEQ && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(payload)
+			if n < 0 {
+				return nil, errSparkplugMalformed
+			}
+			doc["seq"] = uintNumber(v)
+			payload = payload[n:]
+		case num == SPB_PAYLOAD_UUID && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(payload)
+			if n < 0 {
+				return nil, errSparkplugMalformed
+			}
+			doc["uuid"] = string(v)
+			payload = payload[n:]
+		case num == SPB_PAYLOAD_METRICS && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(payload)
+			if n < 0 {
+				return nil, errSparkplugMalformed
+			}
+			metric, err := decodeSparkplugMetric(v)
+			if err != nil {
+				return nil, err
+			}
+			metrics = append(metrics, metric)
+			payload = payload[n:]
+		default:
+			// body 和其他未使用的欄位
+			n := protowire.ConsumeFieldValue(num, typ, payload)
+			if n < 0 {
+				return nil, errSparkplugMalformed
+			}
+			payload = payload[n:]
+		}
+	}
+
+	d.resolveAliases(node, messageType, metrics)
+	list := make([]interface{}, 0, len(metrics))
+	values := make(map[string]interface{}, len(metrics))
+	for _, metric := range metrics {
+		list = append(list, metric.fields)
+		if metric.name != "" {
+			if value, ok := metric.fields["value"]; ok {
+				values[metric.name] = value
+			}
+		}
+	}
+	doc["metrics"] = list
+	doc["values"] = values
+	return doc, nil
+}
+
+// BIRTH記錄alias對應，其他訊息用它補上名稱
+func (d *sparkplugDecoder) resolveAliases(node, messageType string, metrics []*sparkplugMetric) {
+	if node == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if strings.HasSuffix(messageType, "BIRTH") {
+		aliases := make(map[uint64]string)
+		for _, metric := range metrics {
+			if metric.hasAlias && metric.name != "" {
+				aliases[metric.alias] = metric.name
+			}
+		}
+		d.aliases[node] = aliases
+		return
+	}
+	aliases := d.aliases[node]
+	for _, metric := range metrics {
+		if metric.name == "" && metric.hasAlias {
+			if name, ok := aliases[metric.alias]; ok {
+				metric.name = name
+				metric.fields["name"] = name
+			}
+		}
+	}
+}
+
+func decodeSparkplugMetric(data []byte) (*sparkplugMetric, error) {
+	metric := &sparkplugMetric{fields: make(map[string]interface{})}
+	var datatype uint64
+	var raw interface{} // 尚未依型別轉換的值
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, errSparkplugMalformed
+		}
+		data = data[n:]
+		var v uint64
+		var b []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(data)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(data)
+		case protowire.BytesType:
+			b, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return nil, errSparkplugMalformed
+		}
+		data = data[n:]
+
+		switch num {
+		case SPB_METRIC_NAME:
+			metric.name = string(b)
+			metric.fields["name"] = metric.name
+		case SPB_METRIC_ALIAS:
+			metric.alias, metric.hasAlias = v, true
+			metric.fields["alias"] = uintNumber(v)
+		case SPB_METRIC_TIMESTAMP:
+			metric.fields["timestamp"] = uintNumber(v)
+		case SPB_METRIC_DATATYPE:
+			datatype = v
+			if name, ok := sparkplugDataTypes[v]; ok {
+				metric.fields["datatype"] = name
+			} else {
+				metric.fields["datatype"] = strconv.FormatUint(v, 10)
+			}
+		case SPB_METRIC_IS_NULL:
+			if v != 0 {
+				raw = nil
+				metric.fields["isNull"] = true
+			}
+		case SPB_METRIC_INT, SPB_METRIC_LONG:
+			raw = v
+		case SPB_METRIC_FLOAT:
+			raw = floatNumber(float64(math.Float32frombits(uint32(v))))
+		case SPB_METRIC_DOUBLE:
+			raw = floatNumber(math.Float64frombits(v))
+		case SPB_METRIC_BOOLEAN:
+			raw = v != 0
+		case SPB_METRIC_STRING:
+			raw = string(b)
+		case SPB_METRIC_BYTES:
+			raw = bytesValue(b)
+		}
+	}
+
+	if integer, ok := raw.(uint64); ok {
+		// 有號整數以二補數存放在 int_value（32位元）或 long_value（64位元）
+		switch datatype {
+		case 1, 2, 3:
+			raw = intNumber(int64(int32(uint32(integer))))
+		case 4:
+			raw = intNumber(int64(integer))
+		default:
+			raw = uintNumber(integer)
+		}
+	}
+	if raw != nil && metric.fields["isNull"] == nil {
+		metric.fields["value"] = raw
+	}
+	return metric, nil
+}
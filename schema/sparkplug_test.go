@@ -0,0 +1,169 @@
+package schema
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// 用protowire組出Sparkplug B的Payload和Metric
+type spbField func(b []byte) []byte
+
+func spbVarint(num protowire.Number, v uint64) spbField {
+	return func(b []byte) []byte {
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, v)
+	}
+}
+
+func spbBytes(num protowire.Number, v []byte) spbField {
+	return func(b []byte) []byte {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendBytes(b, v)
+	}
+}
+
+func spbFloat(v float32) spbField {
+	return func(b []byte) []byte {
+		b = protowire.AppendTag(b, SPB_METRIC_FLOAT, protowire.Fixed32Type)
+		return protowire.AppendFixed32(b, math.Float32bits(v))
+	}
+}
+
+func spbDouble(v float64) spbField {
+	return func(b []byte) []byte {
+		b = protowire.AppendTag(b, SPB_METRIC_DOUBLE, protowire.Fixed64Type)
+		return protowire.AppendFixed64(b, math.Float64bits(v))
+	}
+}
+
+func spbMessage(fields ...spbField) []byte {
+	var b []byte
+	for _, field := range fields {
+		b = field(b)
+	}
+	return b
+}
+
+func spbMetric(fields ...spbField) spbField {
+	return spbBytes(SPB_PAYLOAD_METRICS, spbMessage(fields...))
+}
+
+func TestSparkplugDecode(t *testing.T) {
+	d := newSparkplugDecoder()
+	birth := spbMessage(
+		spbVarint(SPB_PAYLOAD_TIMESTAMP, 1700000000000),
+		spbMetric(
+			spbBytes(SPB_METRIC_NAME, []byte("temperature")),
+			spbVarint(SPB_METRIC_ALIAS, 1),
+			spbVarint(SPB_METRIC_DATATYPE, 9),
+			spbFloat(21.5),
+		),
+		spbMetric(
+			spbBytes(SPB_METRIC_NAME, []byte("offset")),
+			spbVarint(SPB_METRIC_ALIAS, 2),
+			spbVarint(SPB_METRIC_DATATYPE, 3),
+			spbVarint(SPB_METRIC_INT, uint64(uint32(0xfffffff6))), // int32的-10
+		),
+		spbVarint(SPB_PAYLOAD_SEQ, 0),
+		spbBytes(SPB_PAYLOAD_UUID, []byte("u-1")),
+	)
+	got, err := d.decode("spBv1.0/plant/DBIRTH/edge1/dev1", birth)
+	if err != nil {
+		t.Fatalf("decode(DBIRTH): %v", err)
+	}
+	want := obj{
+		"group": "plant", "messageType": "DBIRTH", "edgeNode": "edge1", "device": "dev1",
+		"timestamp": num("1700000000000"), "seq": num("0"), "uuid": "u-1",
+		"metrics": arr{
+			obj{"name": "temperature", "alias": num("1"), "datatype": "Float", "value": num("21.5")},
+			obj{"name": "offset", "alias": num("2"), "datatype": "Int32", "value": num("-10")},
+		},
+		"values": obj{"temperature": num("21.5"), "offset": num("-10")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decode(DBIRTH) = %#v，應為 %#v", got, want)
+	}
+	checkJSONShape(t, got)
+
+	// DATA只帶alias，名稱由BIRTH補上
+	data := spbMessage(
+		spbMetric(spbVarint(SPB_METRIC_ALIAS, 1), spbVarint(SPB_METRIC_TIMESTAMP, 5), spbFloat(-0.25)),
+		spbMetric(spbVarint(SPB_METRIC_ALIAS, 3), spbVarint(SPB_METRIC_DATATYPE, 4), spbVarint(SPB_METRIC_LONG, math.MaxUint64)),
+		spbMetric(spbBytes(SPB_METRIC_NAME, []byte("flag")), spbVarint(SPB_METRIC_BOOLEAN, 1)),
+		spbMetric(spbBytes(SPB_METRIC_NAME, []byte("ratio")), spbDouble(1.1)),
+		spbMetric(spbBytes(SPB_METRIC_NAME, []byte("raw")), spbBytes(SPB_METRIC_BYTES, []byte{0xde, 0xad})),
+		spbMetric(spbBytes(SPB_METRIC_NAME, []byte("label")), spbBytes(SPB_METRIC_STRING, []byte("ok"))),
+		spbMetric(spbBytes(SPB_METRIC_NAME, []byte("missing")), spbVarint(SPB_METRIC_IS_NULL, 1)),
+		spbMetric(spbBytes(SPB_METRIC_NAME, []byte("counter")), spbVarint(SPB_METRIC_DATATYPE, 8), spbVarint(SPB_METRIC_LONG, math.MaxUint64)),
+		spbVarint(SPB_PAYLOAD_SEQ, 1),
+		spbBytes(99, []byte("未使用的欄位")),
+	)
+	got, err = d.decode("spBv1.0/plant/DDATA/edge1/dev1", data)
+	if err != nil {
+		t.Fatalf("decode(DDATA): %v", err)
+	}
+	want = obj{
+		"group": "plant", "messageType": "DDATA", "edgeNode": "edge1", "device": "dev1", "seq": num("1"),
+		"metrics": arr{
+			obj{"name": "temperature", "alias": num("1"), "timestamp": num("5"), "value": num("-0.25")},
+			obj{"alias": num("3"), "datatype": "Int64", "value": num("-1")}, // BIRTH中沒有的alias
+			obj{"name": "flag", "value": true},
+			obj{"name": "ratio", "value": num("1.1")},
+			obj{"name": "raw", "value": "dead"},
+			obj{"name": "label", "value": "ok"},
+			obj{"name": "missing", "isNull": true},
+			obj{"name": "counter", "datatype": "UInt64", "value": num("18446744073709551615")},
+		},
+		"values": obj{
+			"temperature": num("-0.25"), "flag": true, "ratio": num("1.1"),
+			"raw": "dead", "label": "ok", "counter": num("18446744073709551615"),
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decode(DDATA) = %#v，應為 %#v", got, want)
+	}
+
+	// 其他edge node的alias不共用
+	got, err = d.decode("spBv1.0/plant/DDATA/edge2/dev1", spbMessage(spbMetric(spbVarint(SPB_METRIC_ALIAS, 1))))
+	if err != nil {
+		t.Fatalf("decode(edge2): %v", err)
+	}
+	if name, ok := got.(obj)["metrics"].(arr)[0].(obj)["name"]; ok {
+		t.Errorf("edge2 的alias 1 不應解析為 %v", name)
+	}
+}
+
+func TestSparkplugDecodeErrors(t *testing.T) {
+	d := newSparkplugDecoder()
+	metric := spbMessage(spbMetric(spbBytes(SPB_METRIC_NAME, []byte("temperature")), spbFloat(1)))
+	tests := map[string][]byte{
+		"截斷的tag":       {0x80},
+		"截斷的varint":    {0x08, 0x80},
+		"截斷的metric":    metric[:len(metric)-1],
+		"metric內截斷":    spbMessage(spbBytes(SPB_PAYLOAD_METRICS, []byte{0x65, 0x00})),
+		"無效的wire type": {0x0f},
+	}
+	for name, payload := range tests {
+		if _, err := d.decode("spBv1.0/g/NDATA/n", payload); !errors.Is(err, errSparkplugMalformed) {
+			t.Errorf("%s: 錯誤為 %v，應為 %v", name, err, errSparkplugMalformed)
+		}
+	}
+}
+
+func FuzzSparkplugDecode(f *testing.F) {
+	f.Add("spBv1.0/g/NBIRTH/n", spbMessage(
+		spbVarint(SPB_PAYLOAD_TIMESTAMP, 1),
+		spbMetric(spbBytes(SPB_METRIC_NAME, []byte("a")), spbVarint(SPB_METRIC_ALIAS, 1), spbDouble(2)),
+	))
+	f.Add("spBv1.0/g/NDATA/n", spbMessage(spbMetric(spbVarint(SPB_METRIC_ALIAS, 1), spbFloat(3))))
+	f.Fuzz(func(t *testing.T, topic string, payload []byte) {
+		doc, err := newSparkplugDecoder().decode(topic, payload)
+		if err == nil {
+			checkJSONShape(t, doc)
+		}
+	})
+}
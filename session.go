@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"getMqtt/distinct"
+)
+
+// 一個MQTT session：一條TCP連線從CONNECT到DISCONNECT或斷線
+type mqttSession struct {
+	ClientID      string
+	Username      string
+	ProtocolLevel byte
+	KeepAlive     uint16
+	Client        string // 客戶端 ip:port
+	Broker        string // broker ip:port
+	Start         time.Time
+	Partial       bool // 抓包開始前已連線，沒有看到CONNECT
+
+	// 由處理此連線的工作協程不加鎖地更新，結束session時可能在其他協程讀取（離線分析結束時），所以用atomic
+	lastSeen  atomic.Int64 // 最後一個客戶端封包的時間（Unix奈秒）
+	publishes atomic.Int64
+}
+
+// 客戶端的顯示名稱和統計鍵，沒有client ID時用客戶端IP。
+// 不含端口：每次重新連線的端口不同，統計和metrics的client_id標籤會無限增加
+func (s *mqttSession) key() string {
+	if s.ClientID != "" {
+		return s.ClientID
+	}
+	host, _, err := net.SplitHostPort(s.Client)
+	if err != nil {
+		return "(未知)"
+	}
+	return "(未知) " + host
+}
+
+// 一個已結束的session
+type SessionEnd struct {
+	ClientID  string
+	Client    string
+	Start     time.Time
+	End       time.Time
+	Publishes int
+	Partial   bool
+	Abnormal  bool
+	Reason    string
+}
+
+// 一個客戶端在統計區間內的統計
+type ClientStats struct {
+	ClientID      string
+	Username      string
+	ProtocolLevel byte
+	KeepAlive     uint16
+	Addresses     map[string]bool // 客戶端 ip:port
+	ImsiSet       *distinct.Set
+	Count         int          // PUBLISH數
+	Connects      int          // 本區間的CONNECT數
+	Active        int          // 區間結束時仍在連線的session數
+	Ended         []SessionEnd // 本區間結束的session
+	QoS           [2]qosStats  // QoS 1/2的確認流程，[qosToBroker] 為客戶端送出，[qosToClient] 為收到的PUBLISH
+}
+
+// 沒看到CONNECT的session只知道持續時間的下限
+func (e *SessionEnd) duration() string {
+	duration := e.End.Sub(e.Start).Round(time.Millisecond).String()
+	if e.Partial {
+		return "至少" + duration
+	}
+	return duration
+}
+
+func (c *ClientStats) abnormal() int {
+	n := 0
+	for _, end := range c.Ended {
+		if end.Abnormal {
+			n++
+		}
+	}
+	return n
+}
+
+var (
+	// 按client ID分組的統計，由 lock 保護。PUBLISH數和IMSI記在工作協程的分片，報告時併入
+	clientStats = make(map[string]*ClientStats)
+	// 進行中的session
+	activeSessions = make(map[*mqttSession]bool)
+)
+
+func mqttVersionName(level byte) string {
+	switch level {
+	case MQTT_V31:
+		return "3.1"
+	case MQTT_V311:
+		return "3.1.1"
+	case MQTT_V5:
+		return "5.0"
+	}
+	return fmt.Sprintf("協議等級%d", level)
+}
+
+// 取得客戶端的統計，呼叫者需持有 lock
+func clientFor(session *mqttSession) *ClientStats {
+	return clientIn(clientStats, session)
+}
+
+func clientIn(clients map[string]*ClientStats, session *mqttSession) *ClientStats {
+	key := session.key()
+	stats := clients[key]
+	if stats == nil {
+		stats = &ClientStats{
+			ClientID:  key,
+			Addresses: make(map[string]bool),
+			ImsiSet:   distinct.New(config.imsiPrecision()),
+		}
+		clients[key] = stats
+	}
+	if !session.Partial {
+		stats.Username = session.Username
+		stats.ProtocolLevel = session.ProtocolLevel
+		stats.KeepAlive = session.KeepAlive
+	}
+	stats.Addresses[session.Client] = true
+	return stats
+}
+
+func clientAddresses(msg *mqttMessage) (client, broker string) {
+	client, broker = joinHostPort(msg.srcIP, msg.srcPort), joinHostPort(msg.dstIP, msg.dstPort)
+	if !msg.toBroker {
+		client, broker = broker, client
+	}
+	return client, broker
+}
+
+// 依MQTT控制封包更新連線的session
+func trackSession(msg *mqttMessage) {
+	pkt := msg.packet
+	conn := msg.conn
+
+	// 大部分封包只更新連線自己的session，不需要加鎖
+	if conn.session != nil && pkt.Type != MQTT_CONNECT && pkt.Type != MQTT_CONNACK && pkt.Type != MQTT_DISCONNECT {
+		if msg.toBroker {
+			conn.session.lastSeen.Store(msg.timestamp.UnixNano())
+		}
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	switch {
+	case pkt.Type == MQTT_CONNECT && msg.toBroker:
+		if conn.session != nil {
+			endSession(conn, msg.timestamp, true, "同一連線重複CONNECT")
+		}
+		client, broker := clientAddresses(msg)
+		session := &mqttSession{
+			ClientID:      pkt.ClientID,
+			Username:      pkt.Username,
+			ProtocolLevel: pkt.ProtocolLevel,
+			KeepAlive:     pkt.KeepAlive,
+			Client:        client,
+			Broker:        broker,
+			Start:         msg.timestamp,
+		}
+		session.lastSeen.Store(msg.timestamp.UnixNano())
+		conn.session = session
+		activeSessions[session] = true
+		clientFor(session).Connects++
+		reportSession(session, nil)
+		return
+	case conn.session == nil:
+		// 抓包開始前已建立的連線，用第一個封包的時間當作開始
+		client, broker := clientAddresses(msg)
+		conn.session = &mqttSession{Client: client, Broker: broker, Start: msg.timestamp, Partial: true}
+		activeSessions[conn.session] = true
+	}
+
+	session := conn.session
+	if msg.toBroker {
+		session.lastSeen.Store(msg.timestamp.UnixNano())
+	}
+	switch pkt.Type {
+	case MQTT_CONNACK:
+		// MQTT 5.0 client ID為空時由broker指定
+		if session.ClientID == "" && pkt.Properties.AssignedClientID != "" {
+			session.ClientID = pkt.Properties.AssignedClientID
+		}
+		if pkt.ReasonCode != 0 {
+			endSession(conn, msg.timestamp, true, fmt.Sprintf("CONNACK拒絕 (0x%02x)", pkt.ReasonCode))
+		}
+	case MQTT_DISCONNECT:
+		switch {
+		case !msg.toBroker:
+			endSession(conn, msg.timestamp, true, fmt.Sprintf("broker送出DISCONNECT (0x%02x)", pkt.ReasonCode))
+		case pkt.ReasonCode >= 0x80:
+			endSession(conn, msg.timestamp, true, fmt.Sprintf("DISCONNECT (0x%02x)", pkt.ReasonCode))
+		default:
+			endSession(conn, msg.timestamp, false, "DISCONNECT")
+		}
+	}
+}
+
+// 記錄一個發往broker的PUBLISH，寫入工作協程的分片
+func countSessionPublish(shard *aggregateShard, msg *mqttMessage, imsi string) {
+	session := msg.conn.session
+	if session == nil {
+		return
+	}
+	session.publishes.Add(1)
+	stats := clientIn(shard.clients, session)
+	stats.Count++
+	if imsi != "" {
+		stats.ImsiSet.Add(imsi)
+	}
+}
+
+// TCP連線結束（FIN/RST或閒置逾時）
+func closeSession(conn *mqttConn, at time.Time) {
+	lock.Lock()
+	defer lock.Unlock()
+	if conn.session != nil {
+		endSession(conn, at, true, "未送DISCONNECT就斷線")
+	}
+}
+
+// 離線分析結束時仍在連線的session，不算異常
+func closeAllSessions(at time.Time) {
+	lock.Lock()
+	defer lock.Unlock()
+	for session := range activeSessions {
+		finishSession(session, at, false, "抓包結束")
+	}
+}
+
+// 呼叫者需持有 lock
+func endSession(conn *mqttConn, at time.Time, abnormal bool, reason string) {
+	finishSession(conn.session, at, abnormal, reason)
+	conn.session = nil
+}
+
+func finishSession(session *mqttSession, at time.Time, abnormal bool, reason string) {
+	if !activeSessions[session] {
+		return
+	}
+	delete(activeSessions, session)
+	end := SessionEnd{
+		ClientID:  session.key(),
+		Client:    session.Client,
+		Start:     session.Start,
+		End:       at,
+		Publishes: int(session.publishes.Load()),
+		Partial:   session.Partial,
+		Abnormal:  abnormal,
+		Reason:    reason,
+	}
+	stats := clientFor(session)
+	stats.Ended = append(stats.Ended, end)
+	if fanout != nil {
+		fanout.ended(session.key(), at)
+	}
+	reportSession(session, &end)
+}
+
+// 輸出session開始（end為nil）或結束
+func reportSession(session *mqttSession, end *SessionEnd) {
+	if events != nil {
+		events.session(session, end)
+		return
+	}
+	if !textOutput() {
+		return
+	}
+	if end == nil {
+		fmt.Printf("[SESSION] %s 連線 client=%s user=%s MQTT %s keepalive=%ds -> %s\n", session.Client, session.ClientID,
+			session.Username, mqttVersionName(session.ProtocolLevel), session.KeepAlive, session.Broker)
+		return
+	}
+	result := "正常"
+	if end.Abnormal {
+		result = "異常"
+	}
+	fmt.Printf("[SESSION] %s 結束 client=%s 持續%s PUBLISH=%d %s: %s\n", end.Client, end.ClientID,
+		end.duration(), end.Publishes, result, end.Reason)
+	if end.Abnormal && debugOn() {
+		log.Printf("[any] session %s 最後客戶端封包 %s", end.ClientID, time.Unix(0, session.lastSeen.Load()).Format(time.RFC3339Nano))
+	}
+}
+
+// 把工作協程分片中的客戶端統計併入 dst，src 之後不再使用。呼叫者需持有 lock
+func mergeClients(dst, src map[string]*ClientStats) {
+	for key, stats := range src {
+		merged := dst[key]
+		if merged == nil {
+			dst[key] = stats
+			continue
+		}
+		if stats.ProtocolLevel != 0 {
+			merged.Username = stats.Username
+			merged.ProtocolLevel = stats.ProtocolLevel
+			merged.KeepAlive = stats.KeepAlive
+		}
+		for address := range stats.Addresses {
+			merged.Addresses[address] = true
+		}
+		merged.ImsiSet.Merge(stats.ImsiSet)
+		merged.Count += stats.Count
+		merged.Connects += stats.Connects
+		merged.Ended = append(merged.Ended, stats.Ended...)
+		for dir := range merged.QoS {
+			merged.QoS[dir].merge(&stats.QoS[dir])
+		}
+	}
+}
+
+// 取出本區間的客戶端統計並清空，呼叫者需持有 lock
+func snapshotClients() map[string]*ClientStats {
+	for session := range activeSessions {
+		clientFor(session).Active++
+	}
+	snapshot := clientStats
+	clientStats = make(map[string]*ClientStats)
+	return snapshot
+}
+
+func printClientReport(clients map[string]*ClientStats) {
+	if len(clients) == 0 {
+		return
+	}
+	fmt.Printf("各客戶端統計:\n")
+	for _, key := range sortedKeys(clients) {
+		stat := clients[key]
+		fmt.Printf("  %s", key)
+		if stat.Username != "" {
+			fmt.Printf(" user=%s", stat.Username)
+		}
+		if stat.ProtocolLevel != 0 {
+			fmt.Printf(" MQTT %s keepalive=%ds", mqttVersionName(stat.ProtocolLevel), stat.KeepAlive)
+		}
+		fmt.Printf(" %v\n", sortedKeys(stat.Addresses))
+		fmt.Printf("    PUBLISH: %d  獨立IMSI數量: %d  連線中: %d  新連線: %d  結束: %d  異常斷線: %d\n",
+			stat.Count, stat.ImsiSet.Len(), stat.Active, stat.Connects, len(stat.Ended), stat.abnormal())
+		printQoS(stat)
+		sort.Slice(stat.Ended, func(i, j int) bool { return stat.Ended[i].End.Before(stat.Ended[j].End) })
+		for _, end := range stat.Ended {
+			fmt.Printf("    session %s 持續%s PUBLISH=%d %s\n", end.Client, end.duration(), end.Publishes, end.Reason)
+		}
+	}
+}
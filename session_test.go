@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSessionKey(t *testing.T) {
+	tests := []struct {
+		session *mqttSession
+		want    string
+	}{
+		{&mqttSession{ClientID: "upf-a", Client: "10.0.0.1:40001"}, "upf-a"},
+		// 沒有看到CONNECT的連線依IP合併，不因端口不同而增加
+		{&mqttSession{Client: "10.0.0.1:40001", Partial: true}, "(未知) 10.0.0.1"},
+		{&mqttSession{Client: "10.0.0.1:40002", Partial: true}, "(未知) 10.0.0.1"},
+		{&mqttSession{Client: "[fd00::1]:40001", Partial: true}, "(未知) fd00::1"},
+		{&mqttSession{}, "(未知)"},
+	}
+	for _, tt := range tests {
+		if got := tt.session.key(); got != tt.want {
+			t.Errorf("key(%q, %q) = %q，應為 %q", tt.session.ClientID, tt.session.Client, got, tt.want)
+		}
+	}
+}
+
+// 工作協程不加鎖更新session時，離線分析結束由其他協程結束session不應有資料競爭（以 -race 執行）
+func TestSessionEndWhileWorkerUpdates(t *testing.T) {
+	config = defaultConfig()
+	events = newEventWriter(nopCloser{io.Discard})
+	lock.Lock()
+	clientStats = make(map[string]*ClientStats)
+	activeSessions = make(map[*mqttSession]bool)
+	lock.Unlock()
+	defer func() { events = nil }()
+
+	t0 := time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)
+	w := newPacketWorker()
+	conn := newMqttConn(w)
+	message := func(typ byte, at time.Duration) *mqttMessage {
+		return &mqttMessage{packet: &MqttPacket{Type: typ, ClientID: "upf-a"}, conn: conn, toBroker: true,
+			srcIP: "10.0.0.1", dstIP: "10.1.153.153", srcPort: 40001, dstPort: 1883, timestamp: t0.Add(at)}
+	}
+	trackSession(message(MQTT_CONNECT, 0))
+	session := conn.session
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 1000; i++ {
+			msg := message(MQTT_PUBLISH, time.Duration(i)*time.Millisecond)
+			trackSession(msg)
+			countSessionPublish(w.shard, msg, "")
+		}
+	}()
+	closeAllSessions(t0.Add(2 * time.Second))
+	<-done
+
+	if got := session.publishes.Load(); got != 1000 {
+		t.Errorf("publishes = %d，應為 1000", got)
+	}
+	if got := time.Unix(0, session.lastSeen.Load()); !got.Equal(t0.Add(time.Second)) {
+		t.Errorf("lastSeen = %v", got)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if ended := clientStats["upf-a"].Ended; len(ended) != 1 || ended[0].Publishes > 1000 {
+		t.Errorf("結束的session %+v", ended)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+const (
+	// 亂序封包等待補齊的最長時間，超過後跳過缺失的位元組
+	assemblyFlushTimeout = 10 * time.Second
+	// 連線閒置超過此時間視為已結束
+	assemblyCloseTimeout = 5 * time.Minute
+	// 單一方向最多暫存的未完成MQTT位元組數，避免錯位時無限增長
+	maxStreamBuffer = 4 * 1024 * 1024
+)
+
+// 從TCP流中解出的一個MQTT封包及其上下文
+type mqttMessage struct {
+	packet    *MqttPacket
+	conn      *mqttConn
+	srcIP     string
+	dstIP     string
+	srcPort   uint16
+	dstPort   uint16
+	toBroker  bool // true: 客戶端 -> broker，false: broker -> 客戶端
+	timestamp time.Time
+}
+
+// 實作 reassembly.AssemblerContext，讓重組器使用封包本身的時間戳
+type captureContext struct {
+	ci gopacket.CaptureInfo
+}
+
+func (c *captureContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return c.ci
+}
+
+// TCP和MQTT之間的一層（TLS或WebSocket），把TCP位元組流轉成MQTT位元組流
+type streamTransport interface {
+	// 處理一個方向新收到的位元組，MQTT位元組交給 plaintext
+	feed(msg *mqttMessage, data []byte, plaintext func([]byte))
+	// 此方向有遺失的位元組
+	lost(toBroker bool)
+	// 連線結束
+	close(msg *mqttMessage)
+}
+
+func directionIndex(toBroker bool) int {
+	if toBroker {
+		return 0
+	}
+	return 1
+}
+
+// 建立每條TCP連線的MQTT流
+type mqttStreamFactory struct {
+	worker *packetWorker // 使用此重組器的工作協程
+}
+
+func (f *mqttStreamFactory) New(netFlow, tcpFlow gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	s := &mqttStream{
+		netFlow:    netFlow,
+		tcpFlow:    tcpFlow,
+		fsm:        reassembly.NewTCPSimpleFSM(reassembly.TCPSimpleFSMOptions{SupportMissingEstablishment: true}),
+		optChecker: reassembly.NewTCPOptionCheck(),
+		conn:       newMqttConn(f.worker),
+	}
+	// 抓包可能從連線中途開始，第一個封包不一定由客戶端發出，用端口判斷方向
+	s.firstToBroker = isMqttPort(uint16(tcp.DstPort))
+	switch {
+	case config.isTLSPort(uint16(tcp.DstPort)) || config.isTLSPort(uint16(tcp.SrcPort)):
+		s.transport = newTLSConn()
+	case config.isWebSocketPort(uint16(tcp.DstPort)) || config.isWebSocketPort(uint16(tcp.SrcPort)):
+		s.transport = newWebSocketConn()
+	}
+	return s
+}
+
+// 一條TCP連線（雙向）上的MQTT位元組流
+type mqttStream struct {
+	netFlow       gopacket.Flow
+	tcpFlow       gopacket.Flow
+	fsm           *reassembly.TCPSimpleFSM
+	optChecker    reassembly.TCPOptionCheck
+	firstToBroker bool
+	conn          *mqttConn
+	transport     streamTransport // TLS或WebSocket，明文MQTT為nil
+	lastSeen      time.Time
+
+	// 每個方向尚未組成完整MQTT封包的位元組
+	buffers [2][]byte
+}
+
+func (s *mqttStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if !s.fsm.CheckState(tcp, dir) {
+		if debugOn() {
+			log.Printf("[any] %s 不符合TCP狀態 (%s)，忽略", s.connString(), s.fsm.String())
+		}
+		return false
+	}
+	if err := s.optChecker.Accept(tcp, ci, dir, nextSeq, start); err != nil {
+		if debugOn() {
+			log.Printf("[any] %s TCP選項檢查失敗: %v", s.connString(), err)
+		}
+		return false
+	}
+	// 允許沒有看到SYN的連線（抓包開始前已建立的長連線）
+	*start = true
+	return true
+}
+
+func (s *mqttStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	dir, _, _, skip := sg.Info()
+	length, _ := sg.Lengths()
+	idx := 0
+	if dir == reassembly.TCPDirServerToClient {
+		idx = 1
+	}
+	msg := s.message(dir, ac.GetCaptureInfo().Timestamp)
+	s.lastSeen = msg.timestamp
+
+	// 中間有遺失的位元組，暫存的半個封包已無法還原
+	if skip != 0 && len(s.buffers[idx]) > 0 {
+		if debugOn() {
+			log.Printf("[any] %s 遺失 %d 位元組，丟棄暫存的 %d 位元組", s.connString(), skip, len(s.buffers[idx]))
+		}
+		s.buffers[idx] = nil
+	}
+	if skip != 0 && s.transport != nil {
+		s.transport.lost(msg.toBroker)
+	}
+	if length == 0 {
+		return
+	}
+	data := sg.Fetch(length)
+
+	if s.transport != nil {
+		s.transport.feed(&msg, data, func(plaintext []byte) {
+			s.parseMqtt(idx, &msg, plaintext)
+		})
+		return
+	}
+	s.parseMqtt(idx, &msg, data)
+}
+
+// 組出此方向的訊息上下文
+func (s *mqttStream) message(dir reassembly.TCPFlowDirection, timestamp time.Time) mqttMessage {
+	msg := mqttMessage{
+		conn:      s.conn,
+		toBroker:  (dir == reassembly.TCPDirClientToServer) == s.firstToBroker,
+		timestamp: timestamp,
+	}
+	src, dst := s.netFlow.Endpoints()
+	srcPort, dstPort := s.tcpFlow.Endpoints()
+	if dir == reassembly.TCPDirServerToClient {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+	msg.srcIP, msg.dstIP = src.String(), dst.String()
+	msg.srcPort = portOf(srcPort)
+	msg.dstPort = portOf(dstPort)
+	return msg
+}
+
+// 把一個方向的MQTT位元組（明文或TLS解密後）接到暫存後解析
+func (s *mqttStream) parseMqtt(idx int, msg *mqttMessage, data []byte) {
+	s.buffers[idx] = append(s.buffers[idx], data...)
+
+	// 一次重組的資料可能包含多個MQTT封包，也可能只有半個
+	buf := s.buffers[idx]
+	for len(buf) > 0 {
+		mqttPacket, n, err := parseMqttPacket(buf, s.conn.version)
+		if err == errMqttIncomplete {
+			break
+		}
+		if err != nil {
+			failures.add(failMqttMalformed)
+			if debugOn() {
+				log.Printf("[any] %s 無法解析MQTT封包: %v，丟棄 %d 位元組", s.connString(), err, len(buf))
+			}
+			buf = nil
+			break
+		}
+		buf = buf[n:]
+		msg.packet = mqttPacket
+		handleMqttPacket(msg)
+	}
+
+	if len(buf) > maxStreamBuffer {
+		if debugOn() {
+			log.Printf("[any] %s 暫存超過 %d 位元組，丟棄", s.connString(), maxStreamBuffer)
+		}
+		buf = nil
+	}
+	// 保留未完成的部分，複製一份避免持有已處理的大緩衝區
+	if len(buf) == 0 {
+		s.buffers[idx] = nil
+	} else {
+		s.buffers[idx] = append([]byte(nil), buf...)
+	}
+}
+
+func (s *mqttStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	closeSession(s.conn, s.lastSeen)
+	s.conn.worker.closeQoS(s.conn)
+	if s.transport != nil {
+		// 重組器關閉連線時ac可能為nil
+		msg := s.message(reassembly.TCPDirClientToServer, s.lastSeen)
+		s.transport.close(&msg)
+	}
+	if debugOn() {
+		log.Printf("[any] %s 連線結束", s.connString())
+	}
+	return true
+}
+
+func (s *mqttStream) connString() string {
+	src, dst := s.netFlow.Endpoints()
+	srcPort, dstPort := s.tcpFlow.Endpoints()
+	return joinHostPort(src.String(), portOf(srcPort)) + "-" + joinHostPort(dst.String(), portOf(dstPort))
+}
+
+func portOf(e gopacket.Endpoint) uint16 {
+	raw := e.Raw()
+	if len(raw) != 2 {
+		return 0
+	}
+	return uint16(raw[0])<<8 | uint16(raw[1])
+}
+
+// 建立工作協程的TCP重組器，重組器不是並行安全的，只在該工作協程中使用
+func newMqttAssembler(worker *packetWorker) *reassembly.Assembler {
+	pool := reassembly.NewStreamPool(&mqttStreamFactory{worker: worker})
+	return reassembly.NewAssembler(pool)
+}
+
+// 送出等待過久的亂序資料並關閉閒置連線，now 為目前的封包時間
+func flushAssembler(a *reassembly.Assembler, now time.Time) {
+	flushed, closed := a.FlushWithOptions(reassembly.FlushOptions{
+		T:  now.Add(-assemblyFlushTimeout),
+		TC: now.Add(-assemblyCloseTimeout),
+	})
+	if debugOn() && (flushed > 0 || closed > 0) {
+		log.Printf("[any] 重組器清理: flushed=%d closed=%d", flushed, closed)
+	}
+}
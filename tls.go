@@ -0,0 +1,492 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// TLS record的內容類型
+const (
+	TLS_CHANGE_CIPHER_SPEC = 20
+	TLS_ALERT              = 21
+	TLS_HANDSHAKE          = 22
+	TLS_APPLICATION_DATA   = 23
+)
+
+// TLS handshake訊息類型
+const (
+	TLS_CLIENT_HELLO         = 1
+	TLS_SERVER_HELLO         = 2
+	TLS_NEW_SESSION_TICKET   = 4
+	TLS_ENCRYPTED_EXTENSIONS = 8
+	TLS_CERTIFICATE          = 11
+	TLS_FINISHED             = 20
+	TLS_KEY_UPDATE           = 24
+)
+
+const (
+	// record長度上限（2^14加上加密的額外長度）
+	maxTLSRecordLength = 16384 + 2048
+	// handshake訊息上限，避免錯位時無限暫存
+	maxTLSHandshakeLength = 256 * 1024
+)
+
+var errTLSMalformed = errors.New("TLS record格式錯誤")
+
+// HelloRetryRequest使用固定的server random（RFC 8446 4.1.3）
+var helloRetryRequestRandom = []byte{
+	0xCF, 0x21, 0xAD, 0x74, 0xE5, 0x9A, 0x61, 0x11, 0xBE, 0x1D, 0x8C, 0x02, 0x1E, 0x65, 0xB8, 0x91,
+	0xC2, 0xA2, 0x11, 0x16, 0x7A, 0xBB, 0x8C, 0x5E, 0x07, 0x9E, 0x09, 0xE2, 0xC8, 0xA8, 0x33, 0x9C,
+}
+
+// 一條TLS連線的handshake資訊
+type tlsInfo struct {
+	ServerName   string
+	ALPN         []string
+	Version      uint16
+	CipherSuite  uint16
+	CertSubject  string
+	CertIssuer   string
+	CertNotAfter time.Time
+	KeyFound     bool // key log中有此連線的金鑰
+}
+
+func (i *tlsInfo) versionName() string {
+	if i.Version == 0 {
+		return "未知"
+	}
+	return tls.VersionName(i.Version)
+}
+
+func (i *tlsInfo) cipherName() string {
+	if i.CipherSuite == 0 {
+		return "未知"
+	}
+	return tls.CipherSuiteName(i.CipherSuite)
+}
+
+// 單一方向的TLS狀態
+type tlsDirection struct {
+	records   []byte // 尚未組成完整record的位元組
+	handshake []byte // 尚未組成完整handshake訊息的位元組
+	encrypted bool   // 已切換到加密
+	decrypter *tlsDecrypter
+	broken    bool // 遺失資料或解密失敗後不再嘗試
+}
+
+// 一條TLS連線（雙向）。收到的位元組先組成record，handshake訊息用來取得連線資訊，
+// 有key log時解密application data，明文交給MQTT解析。
+type tlsConn struct {
+	dirs     [2]tlsDirection // 0: 客戶端 -> broker，1: broker -> 客戶端
+	info     tlsInfo
+	reported bool
+
+	clientRandom []byte
+	serverRandom []byte
+	suite        *tlsCipherSuite
+	tls13        bool
+}
+
+func newTLSConn() *tlsConn {
+	return &tlsConn{}
+}
+
+// 處理一個方向新收到的位元組，plaintext 收到解密後的application data
+func (c *tlsConn) feed(msg *mqttMessage, data []byte, plaintext func([]byte)) {
+	d := &c.dirs[directionIndex(msg.toBroker)]
+	if d.broken {
+		return
+	}
+	d.records = append(d.records, data...)
+	buf := d.records
+	for len(buf) >= 5 {
+		length := int(binary.BigEndian.Uint16(buf[3:5]))
+		if buf[1] != 3 || length > maxTLSRecordLength {
+			c.fail(msg, d, errTLSMalformed)
+			return
+		}
+		if len(buf) < 5+length {
+			break
+		}
+		if err := c.record(msg, d, buf[:5], buf[5:5+length], plaintext); err != nil {
+			c.fail(msg, d, err)
+			return
+		}
+		buf = buf[5+length:]
+	}
+	d.records = append([]byte(nil), buf...)
+}
+
+// 中間有遺失的位元組，此方向之後的record無法再解析和解密
+func (c *tlsConn) lost(toBroker bool) {
+	d := &c.dirs[directionIndex(toBroker)]
+	d.broken = true
+	d.records = nil
+	d.handshake = nil
+}
+
+func (c *tlsConn) fail(msg *mqttMessage, d *tlsDirection, err error) {
+	if err == errTLSMalformed {
+		failures.add(failTLSMalformed)
+	} else {
+		failures.add(failTLSDecrypt)
+	}
+	if debugOn() {
+		log.Printf("[any] %s -> %s TLS處理失敗: %v", joinHostPort(msg.srcIP, msg.srcPort), joinHostPort(msg.dstIP, msg.dstPort), err)
+	}
+	d.broken = true
+	d.records = nil
+	d.handshake = nil
+}
+
+func (c *tlsConn) record(msg *mqttMessage, d *tlsDirection, header, payload []byte, plaintext func([]byte)) error {
+	contentType := header[0]
+	// TLS 1.3相容模式的ChangeCipherSpec不加密，也不影響狀態
+	if contentType == TLS_CHANGE_CIPHER_SPEC {
+		if !c.tls13 {
+			return c.changeCipherSpec(msg, d)
+		}
+		return nil
+	}
+	if !d.encrypted {
+		if contentType == TLS_HANDSHAKE {
+			return c.handshakeData(msg, d, payload)
+		}
+		return nil
+	}
+	if d.decrypter == nil {
+		// 沒有金鑰，只能看到加密後的資料
+		return nil
+	}
+
+	data, err := d.decrypter.decrypt(header, payload)
+	if err != nil {
+		return fmt.Errorf("解密失敗: %v", err)
+	}
+	if c.tls13 {
+		// 去掉補零，最後一個位元組是真正的內容類型
+		end := len(data) - 1
+		for end >= 0 && data[end] == 0 {
+			end--
+		}
+		if end < 0 {
+			return errTLSMalformed
+		}
+		contentType, data = data[end], data[:end]
+	}
+
+	switch contentType {
+	case TLS_HANDSHAKE:
+		return c.handshakeData(msg, d, data)
+	case TLS_APPLICATION_DATA:
+		plaintext(data)
+	}
+	return nil
+}
+
+// TLS 1.2的ChangeCipherSpec，之後此方向的record都加密
+func (c *tlsConn) changeCipherSpec(msg *mqttMessage, d *tlsDirection) error {
+	d.encrypted = true
+	if msg.toBroker {
+		// 客戶端送出ChangeCipherSpec時憑證等明文handshake都已經看過
+		defer c.report(msg)
+	}
+	if c.suite == nil || keyLog == nil || c.clientRandom == nil || c.serverRandom == nil {
+		return nil
+	}
+	if c.dirs[0].decrypter != nil || c.dirs[1].decrypter != nil {
+		return nil
+	}
+	master := keyLog.lookup(c.clientRandom, keyLogClientRandom)
+	if master == nil {
+		return nil
+	}
+	client, server, err := newTLS12Decrypters(c.suite, master, c.clientRandom, c.serverRandom)
+	if err != nil {
+		return err
+	}
+	c.info.KeyFound = true
+	// 另一個方向可能已經先切換，兩邊的金鑰一起設定
+	c.dirs[0].decrypter, c.dirs[1].decrypter = client, server
+	return nil
+}
+
+// 組合handshake訊息（可能跨多個record，一個record也可能有多個訊息）
+func (c *tlsConn) handshakeData(msg *mqttMessage, d *tlsDirection, data []byte) error {
+	d.handshake = append(d.handshake, data...)
+	buf := d.handshake
+	for len(buf) >= 4 {
+		length := int(buf[1])<<16 | int(buf[2])<<8 | int(buf[3])
+		if length > maxTLSHandshakeLength {
+			return errTLSMalformed
+		}
+		if len(buf) < 4+length {
+			break
+		}
+		if err := c.handshakeMessage(msg, d, buf[0], buf[4:4+length]); err != nil {
+			return err
+		}
+		buf = buf[4+length:]
+	}
+	d.handshake = append([]byte(nil), buf...)
+	return nil
+}
+
+func (c *tlsConn) handshakeMessage(msg *mqttMessage, d *tlsDirection, msgType byte, body []byte) error {
+	switch msgType {
+	case TLS_CLIENT_HELLO:
+		if msg.toBroker {
+			return c.clientHello(body)
+		}
+	case TLS_SERVER_HELLO:
+		if !msg.toBroker {
+			return c.serverHello(msg, body)
+		}
+	case TLS_CERTIFICATE:
+		// 只記錄broker的憑證
+		if !msg.toBroker {
+			return c.certificate(body)
+		}
+	case TLS_FINISHED:
+		if c.tls13 && d.decrypter != nil {
+			// Finished之後改用application traffic secret
+			label := keyLogServerApplication
+			if msg.toBroker {
+				label = keyLogClientApplication
+			}
+			if err := c.setTLS13Decrypter(d, label); err != nil {
+				return err
+			}
+			if msg.toBroker {
+				c.report(msg)
+			}
+		}
+	case TLS_KEY_UPDATE:
+		if c.tls13 && d.decrypter != nil {
+			next, err := d.decrypter.update()
+			if err != nil {
+				return err
+			}
+			d.decrypter = next
+		}
+	}
+	return nil
+}
+
+func (c *tlsConn) clientHello(body []byte) error {
+	r := &tlsReader{data: body}
+	r.skip(2) // legacy_version
+	c.clientRandom = append([]byte(nil), r.bytes(32)...)
+	r.vector8()  // session_id
+	r.vector16() // cipher_suites
+	r.vector8()  // compression_methods
+	if r.err != nil {
+		return errTLSMalformed
+	}
+	if len(r.data) == 0 {
+		return nil
+	}
+	return forEachTLSExtension(r.vector16(), func(extType uint16, ext *tlsReader) {
+		switch extType {
+		case 0: // server_name
+			list := &tlsReader{data: ext.vector16()}
+			for len(list.data) > 0 && list.err == nil {
+				nameType := list.uint8()
+				name := list.vector16()
+				if nameType == 0 {
+					c.info.ServerName = string(name)
+				}
+			}
+		case 16: // application_layer_protocol_negotiation
+			list := &tlsReader{data: ext.vector16()}
+			for len(list.data) > 0 && list.err == nil {
+				c.info.ALPN = append(c.info.ALPN, string(list.vector8()))
+			}
+		}
+	})
+}
+
+func (c *tlsConn) serverHello(msg *mqttMessage, body []byte) error {
+	r := &tlsReader{data: body}
+	version := r.uint16()
+	random := r.bytes(32)
+	r.vector8() // session_id
+	suite := r.uint16()
+	r.skip(1) // compression_method
+	if r.err != nil {
+		return errTLSMalformed
+	}
+	if string(random) == string(helloRetryRequestRandom) {
+		// HelloRetryRequest之後客戶端會再送一次ClientHello
+		return nil
+	}
+	c.serverRandom = append([]byte(nil), random...)
+	c.info.Version = version
+	c.info.CipherSuite = suite
+	c.suite = tlsCipherSuites[suite]
+
+	if len(r.data) > 0 {
+		err := forEachTLSExtension(r.vector16(), func(extType uint16, ext *tlsReader) {
+			switch extType {
+			case 16: // 伺服器選定的ALPN
+				list := &tlsReader{data: ext.vector16()}
+				c.info.ALPN = []string{string(list.vector8())}
+			case 43: // supported_versions
+				c.info.Version = ext.uint16()
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if c.info.Version != tls.VersionTLS13 {
+		return nil
+	}
+
+	// TLS 1.3在ServerHello之後的handshake都加密
+	c.tls13 = true
+	c.dirs[0].encrypted = true
+	c.dirs[1].encrypted = true
+	if c.suite == nil || keyLog == nil || c.clientRandom == nil {
+		c.report(msg)
+		return nil
+	}
+	if err := c.setTLS13Decrypter(&c.dirs[0], keyLogClientHandshake); err != nil {
+		return err
+	}
+	if err := c.setTLS13Decrypter(&c.dirs[1], keyLogServerHandshake); err != nil {
+		return err
+	}
+	if c.dirs[0].decrypter == nil || c.dirs[1].decrypter == nil {
+		// 沒有金鑰，之後只能看到加密的資料
+		c.report(msg)
+	} else {
+		c.info.KeyFound = true
+	}
+	return nil
+}
+
+func (c *tlsConn) setTLS13Decrypter(d *tlsDirection, label string) error {
+	secret := keyLog.lookup(c.clientRandom, label)
+	if secret == nil {
+		d.decrypter = nil
+		return nil
+	}
+	decrypter, err := newTLS13Decrypter(c.suite, secret)
+	if err != nil {
+		return err
+	}
+	d.decrypter = decrypter
+	return nil
+}
+
+// 取出第一張（伺服器自己的）憑證
+func (c *tlsConn) certificate(body []byte) error {
+	r := &tlsReader{data: body}
+	if c.tls13 {
+		r.vector8() // certificate_request_context
+	}
+	list := &tlsReader{data: r.vector24()}
+	cert := list.vector24()
+	if r.err != nil || list.err != nil {
+		return errTLSMalformed
+	}
+	if len(cert) == 0 {
+		return nil
+	}
+	parsed, err := x509.ParseCertificate(cert)
+	if err != nil {
+		if debugOn() {
+			log.Printf("[any] 無法解析TLS憑證: %v", err)
+		}
+		return nil
+	}
+	c.info.CertSubject = parsed.Subject.String()
+	c.info.CertIssuer = parsed.Issuer.String()
+	c.info.CertNotAfter = parsed.NotAfter
+	return nil
+}
+
+// handshake結束時輸出一次連線資訊
+func (c *tlsConn) report(msg *mqttMessage) {
+	if c.reported || c.info.Version == 0 {
+		return
+	}
+	c.reported = true
+	handleTLSHandshake(msg, &c.info)
+}
+
+// 連線結束時還沒輸出（例如handshake未完成）的補上
+func (c *tlsConn) close(msg *mqttMessage) {
+	c.report(msg)
+}
+
+func forEachTLSExtension(data []byte, fn func(extType uint16, ext *tlsReader)) error {
+	r := &tlsReader{data: data}
+	for len(r.data) > 0 {
+		extType := r.uint16()
+		ext := r.vector16()
+		if r.err != nil {
+			return errTLSMalformed
+		}
+		fn(extType, &tlsReader{data: ext})
+	}
+	return nil
+}
+
+// 依序讀取handshake欄位，長度不足時設定err並回傳零值
+type tlsReader struct {
+	data []byte
+	err  error
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = errTLSMalformed
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tlsReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *tlsReader) uint8() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *tlsReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *tlsReader) vector8() []byte {
+	return r.bytes(int(r.uint8()))
+}
+
+func (r *tlsReader) vector16() []byte {
+	return r.bytes(int(r.uint16()))
+}
+
+func (r *tlsReader) vector24() []byte {
+	b := r.bytes(3)
+	if b == nil {
+		return nil
+	}
+	return r.bytes(int(b[0])<<16 | int(b[1])<<8 | int(b[2]))
+}
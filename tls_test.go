@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 一次TCP寫入，依寫入順序記錄
+type tlsChunk struct {
+	toBroker bool
+	data     []byte
+}
+
+type tlsRecorder struct {
+	mu     sync.Mutex
+	chunks []tlsChunk
+}
+
+// 記錄寫入的位元組後再送出，所以對方收到前一定已經記錄
+type recordingConn struct {
+	net.Conn
+	toBroker bool
+	rec      *tlsRecorder
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.rec.mu.Lock()
+	c.rec.chunks = append(c.rec.chunks, tlsChunk{c.toBroker, append([]byte(nil), b...)})
+	c.rec.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "broker.test"},
+		DNSNames:     []string{"broker.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// 以crypto/tls在本機建立一條連線：客戶端送出 clientData，broker回覆 serverData。
+// 回傳兩個方向的TCP位元組和key log檔案
+func tlsTranscript(t *testing.T, version, suite uint16, clientData, serverData []byte) ([]tlsChunk, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("無法監聽本機端口: %v", err)
+	}
+	defer listener.Close()
+
+	keyLogPath := filepath.Join(t.TempDir(), "keys.log")
+	keyLogFile, err := os.Create(keyLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyLogFile.Close()
+
+	rec := &tlsRecorder{}
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+		NextProtos:   []string{"mqtt"},
+		MinVersion:   version,
+		MaxVersion:   version,
+	}
+	if suite != 0 {
+		serverConfig.CipherSuites = []uint16{suite}
+	}
+	done := make(chan error, 1)
+	go func() {
+		raw, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		conn := tls.Server(&recordingConn{Conn: raw, toBroker: false, rec: rec}, serverConfig)
+		defer conn.Close()
+		buf := make([]byte, len(clientData))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			done <- err
+			return
+		}
+		_, err = conn.Write(serverData)
+		done <- err
+	}()
+
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := tls.Client(&recordingConn{Conn: raw, toBroker: true, rec: rec}, &tls.Config{
+		ServerName:         "broker.test",
+		NextProtos:         []string{"mqtt"},
+		InsecureSkipVerify: true,
+		KeyLogWriter:       keyLogFile,
+		MinVersion:         version,
+		MaxVersion:         version,
+	})
+	if _, err := conn.Write(clientData); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(serverData))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.chunks, keyLogPath
+}
+
+// 依序把記錄的位元組交給tlsConn，每次最多 step 個位元組，回傳兩個方向解密出的明文
+func feedTLS(c *tlsConn, chunks []tlsChunk, step int) [2][]byte {
+	var plaintext [2][]byte
+	for _, chunk := range chunks {
+		msg := &mqttMessage{toBroker: chunk.toBroker, srcIP: "10.0.0.1", dstIP: "10.1.153.153", srcPort: 40000, dstPort: 8883}
+		if !chunk.toBroker {
+			msg.srcIP, msg.dstIP, msg.srcPort, msg.dstPort = msg.dstIP, msg.srcIP, msg.dstPort, msg.srcPort
+		}
+		dir := directionIndex(chunk.toBroker)
+		for data := chunk.data; len(data) > 0; {
+			n := min(step, len(data))
+			c.feed(msg, data[:n], func(b []byte) {
+				plaintext[dir] = append(plaintext[dir], b...)
+			})
+			data = data[n:]
+		}
+	}
+	return plaintext
+}
+
+// 不輸出handshake資訊
+func quietTLSOutput(t *testing.T) {
+	events = newEventWriter(nopCloser{io.Discard})
+	t.Cleanup(func() {
+		events = nil
+		keyLog = nil
+	})
+}
+
+func TestTLSConnDecrypt(t *testing.T) {
+	quietTLSOutput(t)
+	clientData := append(testConnect("tls-client"), testPublish("t/usage", `{"imsi":"208930000000001"}`)...)
+	serverData := []byte{MQTT_CONNACK << 4, 2, 0, 0}
+
+	tests := []struct {
+		name    string
+		version uint16
+		suite   uint16
+	}{
+		{"TLS 1.2 AES-128-GCM", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		{"TLS 1.2 AES-256-GCM", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		{"TLS 1.2 ChaCha20-Poly1305", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+		{"TLS 1.3", tls.VersionTLS13, 0},
+	}
+	for _, tt := range tests {
+		chunks, keyLogPath := tlsTranscript(t, tt.version, tt.suite, clientData, serverData)
+		var err error
+		if keyLog, err = loadKeyLog(keyLogPath); err != nil {
+			t.Fatal(err)
+		}
+		// 整段送入，以及拆成小段模擬跨TCP段的record
+		for _, step := range []int{1 << 20, 7} {
+			c := newTLSConn()
+			plaintext := feedTLS(c, chunks, step)
+			if !bytes.Equal(plaintext[0], clientData) {
+				t.Errorf("%s step=%d: 客戶端明文 %x，應為 %x", tt.name, step, plaintext[0], clientData)
+			}
+			if !bytes.Equal(plaintext[1], serverData) {
+				t.Errorf("%s step=%d: broker明文 %x，應為 %x", tt.name, step, plaintext[1], serverData)
+			}
+			info := c.info
+			if info.Version != tt.version || (tt.suite != 0 && info.CipherSuite != tt.suite) {
+				t.Errorf("%s: 版本 %x 加密套件 %x", tt.name, info.Version, info.CipherSuite)
+			}
+			if info.ServerName != "broker.test" || len(info.ALPN) != 1 || info.ALPN[0] != "mqtt" {
+				t.Errorf("%s: sni=%q alpn=%v", tt.name, info.ServerName, info.ALPN)
+			}
+			if !info.KeyFound || !c.reported {
+				t.Errorf("%s: KeyFound=%v reported=%v", tt.name, info.KeyFound, c.reported)
+			}
+			// TLS 1.3的憑證在加密的handshake中，也要解密後才看得到
+			if info.CertSubject != "CN=broker.test" {
+				t.Errorf("%s: 憑證 %q", tt.name, info.CertSubject)
+			}
+		}
+
+		// 沒有金鑰時只取得明文的handshake資訊
+		keyLog = nil
+		c := newTLSConn()
+		plaintext := feedTLS(c, chunks, 1<<20)
+		if len(plaintext[0]) != 0 || len(plaintext[1]) != 0 {
+			t.Errorf("%s: 沒有金鑰時不應有明文", tt.name)
+		}
+		if c.info.KeyFound || !c.reported || c.info.Version != tt.version || c.info.ServerName != "broker.test" {
+			t.Errorf("%s 沒有金鑰: %+v reported=%v", tt.name, c.info, c.reported)
+		}
+	}
+}
+
+// 組成handshake訊息和record
+func tlsHandshake(msgType byte, body []byte) []byte {
+	return append([]byte{msgType, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func tlsRecord(contentType byte, body []byte) []byte {
+	return append([]byte{contentType, 0x03, 0x03, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func TestTLSConnMalformed(t *testing.T) {
+	quietTLSOutput(t)
+	msg := &mqttMessage{toBroker: true}
+	// server_name擴充欄位的長度為9，實際沒有資料
+	truncatedExt := append([]byte{0x03, 0x03}, make([]byte, 32)...)
+	truncatedExt = append(truncatedExt, 0x00, 0x00, 0x02, 0x13, 0x01, 0x01, 0x00)
+	truncatedExt = append(truncatedExt, 0x00, 0x04, 0x00, 0x00, 0x00, 0x09)
+	tests := map[string][]byte{
+		"版本錯誤":          {TLS_HANDSHAKE, 0x02, 0x00, 0x00, 0x01, 0x00},
+		"record過長":      {TLS_HANDSHAKE, 0x03, 0x03, 0xff, 0xff},
+		"ClientHello截斷": {TLS_HANDSHAKE, 0x03, 0x01, 0x00, 0x06, TLS_CLIENT_HELLO, 0x00, 0x00, 0x02, 0x03, 0x03},
+		"handshake過長":   {TLS_HANDSHAKE, 0x03, 0x01, 0x00, 0x04, TLS_CLIENT_HELLO, 0xff, 0xff, 0xff},
+		"擴充欄位截斷":        tlsRecord(TLS_HANDSHAKE, tlsHandshake(TLS_CLIENT_HELLO, truncatedExt)),
+	}
+	for name, data := range tests {
+		c := newTLSConn()
+		before := failures.totals()[failTLSMalformed]
+		c.feed(msg, data, func([]byte) { t.Errorf("%s: 不應有明文", name) })
+		if !c.dirs[0].broken {
+			t.Errorf("%s: 應標記為無法解析", name)
+		}
+		if got := failures.totals()[failTLSMalformed]; got != before+1 {
+			t.Errorf("%s: tls_malformed 計數 %d，應為 %d", name, got, before+1)
+		}
+		// 之後的資料不再處理
+		c.feed(msg, []byte{TLS_HANDSHAKE, 0x03, 0x03, 0x00, 0x00}, nil)
+	}
+
+	// 遺失資料後此方向不再解析，另一個方向不受影響
+	c := newTLSConn()
+	c.lost(true)
+	if !c.dirs[0].broken || c.dirs[1].broken {
+		t.Errorf("lost: %v %v", c.dirs[0].broken, c.dirs[1].broken)
+	}
+}
+
+func FuzzTLSConn(f *testing.F) {
+	f.Add([]byte{TLS_HANDSHAKE, 0x03, 0x01, 0x00, 0x04, TLS_CLIENT_HELLO, 0x00, 0x00, 0x00}, []byte{TLS_ALERT, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28})
+	f.Add([]byte{TLS_CHANGE_CIPHER_SPEC, 0x03, 0x03, 0x00, 0x01, 0x01}, []byte{TLS_HANDSHAKE, 0x03, 0x03, 0x00, 0x04, TLS_SERVER_HELLO, 0x00, 0x00, 0x00})
+	f.Fuzz(func(t *testing.T, toBroker, toClient []byte) {
+		events = newEventWriter(nopCloser{io.Discard})
+		defer func() { events = nil }()
+		c := newTLSConn()
+		feedTLS(c, []tlsChunk{{true, toBroker}, {false, toClient}}, 3)
+	})
+}
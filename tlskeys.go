@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// NSS key log 檔案中用到的標籤
+const (
+	keyLogClientRandom      = "CLIENT_RANDOM" // TLS 1.2 master secret
+	keyLogClientHandshake   = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogServerHandshake   = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogClientApplication = "CLIENT_TRAFFIC_SECRET_0"
+	keyLogServerApplication = "SERVER_TRAFFIC_SECRET_0"
+)
+
+const (
+	// 找不到金鑰時最多每秒重新讀取一次key log
+	keyLogReloadInterval = time.Second
+	tls12MasterSecretLen = 48
+)
+
+// SSLKEYLOGFILE 格式的金鑰檔，以client random為索引。
+// 找不到金鑰時若檔案有更新會重新讀取，讓即時模式也能用正在寫入的檔案。
+type tlsKeyLog struct {
+	path string
+
+	mu       sync.Mutex
+	secrets  map[string]map[string][]byte // client random(hex) -> 標籤 -> secret
+	modTime  time.Time
+	lastLoad time.Time
+}
+
+func loadKeyLog(path string) (*tlsKeyLog, error) {
+	k := &tlsKeyLog{path: path, secrets: make(map[string]map[string][]byte)}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *tlsKeyLog) load() error {
+	file, err := os.Open(k.path)
+	if err != nil {
+		return fmt.Errorf("無法打開key log檔案: %v", err)
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil {
+		k.modTime = info.ModTime()
+	}
+	k.lastLoad = time.Now()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		random, err1 := hex.DecodeString(fields[1])
+		secret, err2 := hex.DecodeString(fields[2])
+		if err1 != nil || err2 != nil || len(random) != 32 {
+			continue
+		}
+		key := hex.EncodeToString(random)
+		if k.secrets[key] == nil {
+			k.secrets[key] = make(map[string][]byte)
+		}
+		k.secrets[key][fields[0]] = secret
+	}
+	return scanner.Err()
+}
+
+// 取得某個連線的secret，沒有時回傳nil
+func (k *tlsKeyLog) lookup(clientRandom []byte, label string) []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key := hex.EncodeToString(clientRandom)
+	if secret := k.secrets[key][label]; secret != nil {
+		return secret
+	}
+	if time.Since(k.lastLoad) < keyLogReloadInterval {
+		return nil
+	}
+	info, err := os.Stat(k.path)
+	if err != nil || !info.ModTime().After(k.modTime) {
+		return nil
+	}
+	if err := k.load(); err != nil {
+		log.Printf("重新讀取key log失敗: %v", err)
+		return nil
+	}
+	return k.secrets[key][label]
+}
+
+func (k *tlsKeyLog) count() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.secrets)
+}
+
+// 可解密的AEAD加密套件
+type tlsCipherSuite struct {
+	id     uint16
+	keyLen int
+	ivLen  int // TLS 1.2 GCM為4位元組的隱含部分，其餘為12
+	hash   func() hash.Hash
+	aead   func(key []byte) (cipher.AEAD, error)
+	// TLS 1.2 GCM每個record前帶8位元組的explicit nonce
+	explicitNonce bool
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var tlsCipherSuites = map[uint16]*tlsCipherSuite{
+	// TLS 1.3
+	0x1301: {id: 0x1301, keyLen: 16, ivLen: 12, hash: sha256.New, aead: newAESGCM},
+	0x1302: {id: 0x1302, keyLen: 32, ivLen: 12, hash: sha512.New384, aead: newAESGCM},
+	0x1303: {id: 0x1303, keyLen: 32, ivLen: 12, hash: sha256.New, aead: chacha20poly1305.New},
+	// TLS 1.2 AES-GCM
+	0x009C: {id: 0x009C, keyLen: 16, ivLen: 4, hash: sha256.New, aead: newAESGCM, explicitNonce: true},
+	0x009D: {id: 0x009D, keyLen: 32, ivLen: 4, hash: sha512.New384, aead: newAESGCM, explicitNonce: true},
+	0x009E: {id: 0x009E, keyLen: 16, ivLen: 4, hash: sha256.New, aead: newAESGCM, explicitNonce: true},
+	0x009F: {id: 0x009F, keyLen: 32, ivLen: 4, hash: sha512.New384, aead: newAESGCM, explicitNonce: true},
+	0xC02B: {id: 0xC02B, keyLen: 16, ivLen: 4, hash: sha256.New, aead: newAESGCM, explicitNonce: true},
+	0xC02C: {id: 0xC02C, keyLen: 32, ivLen: 4, hash: sha512.New384, aead: newAESGCM, explicitNonce: true},
+	0xC02F: {id: 0xC02F, keyLen: 16, ivLen: 4, hash: sha256.New, aead: newAESGCM, explicitNonce: true},
+	0xC030: {id: 0xC030, keyLen: 32, ivLen: 4, hash: sha512.New384, aead: newAESGCM, explicitNonce: true},
+	// TLS 1.2 ChaCha20-Poly1305
+	0xCCA8: {id: 0xCCA8, keyLen: 32, ivLen: 12, hash: sha256.New, aead: chacha20poly1305.New},
+	0xCCA9: {id: 0xCCA9, keyLen: 32, ivLen: 12, hash: sha256.New, aead: chacha20poly1305.New},
+	0xCCAA: {id: 0xCCAA, keyLen: 32, ivLen: 12, hash: sha256.New, aead: chacha20poly1305.New},
+}
+
+// 單一方向的record解密狀態
+type tlsDecrypter struct {
+	suite *tlsCipherSuite
+	aead  cipher.AEAD
+	iv    []byte
+	seq   uint64
+	tls13 bool
+
+	secret []byte // TLS 1.3目前的traffic secret，KeyUpdate時使用
+}
+
+// TLS 1.2：由master secret導出兩個方向的金鑰
+func newTLS12Decrypters(suite *tlsCipherSuite, masterSecret, clientRandom, serverRandom []byte) (client, server *tlsDecrypter, err error) {
+	if len(masterSecret) != tls12MasterSecretLen {
+		return nil, nil, fmt.Errorf("master secret長度錯誤: %d", len(masterSecret))
+	}
+	seed := append(append([]byte(nil), serverRandom...), clientRandom...)
+	keyBlock := tls12PRF(suite.hash, masterSecret, "key expansion", seed, 2*suite.keyLen+2*suite.ivLen)
+
+	clientKey, keyBlock := keyBlock[:suite.keyLen], keyBlock[suite.keyLen:]
+	serverKey, keyBlock := keyBlock[:suite.keyLen], keyBlock[suite.keyLen:]
+	clientIV, serverIV := keyBlock[:suite.ivLen], keyBlock[suite.ivLen:]
+
+	if client, err = newTLSDecrypter(suite, clientKey, clientIV, false); err != nil {
+		return nil, nil, err
+	}
+	if server, err = newTLSDecrypter(suite, serverKey, serverIV, false); err != nil {
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+// TLS 1.3：由traffic secret導出單一方向的金鑰
+func newTLS13Decrypter(suite *tlsCipherSuite, secret []byte) (*tlsDecrypter, error) {
+	key := hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen)
+	iv := hkdfExpandLabel(suite.hash, secret, "iv", suite.ivLen)
+	d, err := newTLSDecrypter(suite, key, iv, true)
+	if err != nil {
+		return nil, err
+	}
+	d.secret = secret
+	return d, nil
+}
+
+func newTLSDecrypter(suite *tlsCipherSuite, key, iv []byte, tls13 bool) (*tlsDecrypter, error) {
+	aead, err := suite.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsDecrypter{suite: suite, aead: aead, iv: append([]byte(nil), iv...), tls13: tls13}, nil
+}
+
+// TLS 1.3 KeyUpdate後改用下一代的traffic secret
+func (d *tlsDecrypter) update() (*tlsDecrypter, error) {
+	next := hkdfExpandLabel(d.suite.hash, d.secret, "traffic upd", d.suite.hash().Size())
+	return newTLS13Decrypter(d.suite, next)
+}
+
+// 解密一個record。header為5位元組的record標頭，回傳明文（TLS 1.3包含內部的content type）
+func (d *tlsDecrypter) decrypt(header, payload []byte) ([]byte, error) {
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], d.seq)
+	d.seq++
+
+	nonce := make([]byte, 0, 12)
+	var additional []byte
+	switch {
+	case d.tls13:
+		nonce = xorNonce(d.iv, seq[:])
+		additional = header
+	case d.suite.explicitNonce:
+		if len(payload) < 8 {
+			return nil, errors.New("record太短")
+		}
+		nonce = append(append(nonce, d.iv...), payload[:8]...)
+		payload = payload[8:]
+	default:
+		nonce = xorNonce(d.iv, seq[:])
+	}
+	if len(payload) < d.aead.Overhead() {
+		return nil, errors.New("record太短")
+	}
+	if !d.tls13 {
+		// seq_num + type + version + 明文長度
+		additional = append(append(seq[:], header[:3]...), 0, 0)
+		binary.BigEndian.PutUint16(additional[11:], uint16(len(payload)-d.aead.Overhead()))
+	}
+	return d.aead.Open(nil, nonce, payload, additional)
+}
+
+func xorNonce(iv, seq []byte) []byte {
+	nonce := append([]byte(nil), iv...)
+	offset := len(nonce) - len(seq)
+	for i, b := range seq {
+		nonce[offset+i] ^= b
+	}
+	return nonce
+}
+
+// RFC 5246 第5節的PRF（P_hash）
+func tls12PRF(h func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	labelSeed := append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	mac.Write(labelSeed)
+	a := mac.Sum(nil)
+
+	result := make([]byte, 0, length)
+	for len(result) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelSeed)
+		result = mac.Sum(result)
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return result[:length]
+}
+
+// RFC 8446 第7.1節的HKDF-Expand-Label，context固定為空
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	fullLabel := "tls13 " + label
+	info := make([]byte, 0, 4+len(fullLabel))
+	info = append(info, byte(length>>8), byte(length), byte(len(fullLabel)))
+	info = append(info, fullLabel...)
+	info = append(info, 0)
+
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(h, secret, info), out); err != nil {
+		panic(err)
+	}
+	return out
+}
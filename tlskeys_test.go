@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 測試向量以十六進位表示，可以有空白
+func tlsHex(t testing.TB, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatalf("無效的十六進位 %q: %v", s, err)
+	}
+	return b
+}
+
+// TLS 1.2 PRF（P_SHA256）的公開測試向量
+func TestTLS12PRF(t *testing.T) {
+	secret := tlsHex(t, "9b be 43 6b a9 40 f0 17 b1 76 52 84 9a 71 db 35")
+	seed := tlsHex(t, "a0 ba 9f 93 6c da 31 18 27 a6 f7 96 ff d5 19 8c")
+	want := tlsHex(t, `
+		e3 f2 29 ba 72 7b e1 7b 8d 12 26 20 55 7c d4 53 c2 aa b2 1d 07 c3 d4 95 32 9b 52 d4 e6 1e db 5a
+		6b 30 17 91 e9 0d 35 c9 c9 a4 6b 4e 14 ba f9 af 0f a0 22 f7 07 7d ef 17 ab fd 37 97 c0 56 4b ab
+		4f bc 91 66 6e 9d ef 9b 97 fc e3 4f 79 67 89 ba a4 80 82 d1 22 ee 42 c5 a7 2e 5a 51 10 ff f7 01
+		87 34 7b 66`)
+	if got := tls12PRF(sha256.New, secret, "test label", seed, len(want)); !bytes.Equal(got, want) {
+		t.Errorf("tls12PRF = %x，應為 %x", got, want)
+	}
+	// 較短的輸出是較長輸出的前綴
+	if got := tls12PRF(sha256.New, secret, "test label", seed, 20); !bytes.Equal(got, want[:20]) {
+		t.Errorf("tls12PRF(20) = %x，應為 %x", got, want[:20])
+	}
+}
+
+// RFC 8448 第3節（Simple 1-RTT Handshake）由traffic secret導出的金鑰和IV
+func TestHKDFExpandLabel(t *testing.T) {
+	tests := []struct {
+		name, secret, key, iv string
+	}{
+		{
+			"client handshake",
+			"b3 ed db 12 6e 06 7f 35 a7 80 b3 ab f4 5e 2d 8f 3b 1a 95 07 38 f5 2e 96 00 74 6a 0e 27 a5 5a 21",
+			"db fa a6 93 d1 76 2c 5b 66 6a f5 d9 50 25 8d 01",
+			"5b d3 c7 1b 83 6e 0b 76 bb 73 26 5f",
+		},
+		{
+			"server handshake",
+			"b6 7b 7d 69 0c c1 6c 4e 75 e5 42 13 cb 2d 37 b4 e9 c9 12 bc de d9 10 5d 42 be fd 59 d3 91 ad 38",
+			"3f ce 51 60 09 c2 17 27 d0 f2 e4 e8 6e e4 03 bc",
+			"5d 31 3e b2 67 12 76 ee 13 00 0b 30",
+		},
+		{
+			"server application",
+			"a1 1a f9 f0 55 31 f8 56 ad 47 11 6b 45 a9 50 32 82 04 b4 f4 4b fb 6b 3a 4b 4f 1f 3f cb 63 16 43",
+			"9f 02 28 3b 6c 9c 07 ef c2 6b b9 f2 ac 92 e3 56",
+			"cf 78 2b 88 dd 83 54 9a ad f1 e9 84",
+		},
+	}
+	suite := tlsCipherSuites[0x1301]
+	for _, tt := range tests {
+		secret := tlsHex(t, tt.secret)
+		if got, want := hkdfExpandLabel(sha256.New, secret, "key", 16), tlsHex(t, tt.key); !bytes.Equal(got, want) {
+			t.Errorf("%s key = %x，應為 %x", tt.name, got, want)
+		}
+		if got, want := hkdfExpandLabel(sha256.New, secret, "iv", 12), tlsHex(t, tt.iv); !bytes.Equal(got, want) {
+			t.Errorf("%s iv = %x，應為 %x", tt.name, got, want)
+		}
+		d, err := newTLS13Decrypter(suite, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tlsHex(t, tt.iv); !bytes.Equal(d.iv, want) {
+			t.Errorf("%s 解密器的iv = %x，應為 %x", tt.name, d.iv, want)
+		}
+	}
+}
+
+// RFC 8448 第3節客戶端送出的第一個application data record（50位元組的 00..31）
+func TestTLS13DecryptRecord(t *testing.T) {
+	key := tlsHex(t, "17 42 2d da 59 6e d5 d9 ac d8 90 e3 c6 3f 50 51")
+	iv := tlsHex(t, "5b 78 92 3d ee 08 57 90 33 e5 23 d9")
+	record := tlsHex(t, `
+		17 03 03 00 43 a2 3f 70 54 b6 2c 94 d0 af fa fe 82 28 ba 55 cb ef ac ea 42 f9 14 aa 66 bc ab 3f
+		2b 98 19 a8 a5 b4 6b 39 5b d5 4a 9a 20 44 1e 2b 62 97 4e 1f 5a 62 92 a2 97 70 14 bd 1e 3d ea e6
+		3a ee bb 21 69 49 15 e4`)
+	want := make([]byte, 0, 51)
+	for i := 0; i < 50; i++ {
+		want = append(want, byte(i))
+	}
+	want = append(want, TLS_APPLICATION_DATA) // 內部的content type
+
+	d, err := newTLSDecrypter(tlsCipherSuites[0x1301], key, iv, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.decrypt(record[:5], record[5:])
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("decrypt = %x，應為 %x", got, want)
+	}
+
+	// 序號已經遞增，同一個record不能再解密
+	if _, err := d.decrypt(record[:5], record[5:]); err == nil {
+		t.Error("序號錯誤時應該解密失敗")
+	}
+	// 竄改的record
+	d, _ = newTLSDecrypter(tlsCipherSuites[0x1301], key, iv, true)
+	tampered := append([]byte(nil), record...)
+	tampered[10] ^= 1
+	if _, err := d.decrypt(tampered[:5], tampered[5:]); err == nil {
+		t.Error("竄改的record應該解密失敗")
+	}
+	// 比認證標籤還短
+	if _, err := d.decrypt(record[:5], record[5:15]); err == nil {
+		t.Error("過短的record應該解密失敗")
+	}
+}
+
+func TestXorNonce(t *testing.T) {
+	iv := tlsHex(t, "5b 78 92 3d ee 08 57 90 33 e5 23 d9")
+	seq := tlsHex(t, "00 00 00 00 00 00 01 02")
+	if got, want := xorNonce(iv, seq), tlsHex(t, "5b 78 92 3d ee 08 57 90 33 e5 22 db"); !bytes.Equal(got, want) {
+		t.Errorf("xorNonce = %x，應為 %x", got, want)
+	}
+	if iv[11] != 0xd9 {
+		t.Error("xorNonce不應修改iv")
+	}
+}
+
+func TestLoadKeyLog(t *testing.T) {
+	random := strings.Repeat("ab", 32)
+	content := "# 註解\n" +
+		"CLIENT_RANDOM " + random + " " + strings.Repeat("01", 48) + "\n" +
+		"CLIENT_HANDSHAKE_TRAFFIC_SECRET " + strings.ToUpper(random) + " " + strings.Repeat("02", 32) + "\n" +
+		"CLIENT_RANDOM abcd " + strings.Repeat("03", 48) + "\n" + // client random長度錯誤
+		"CLIENT_RANDOM " + random + " zz\n" + // 不是十六進位
+		"不完整的行\n"
+	path := filepath.Join(t.TempDir(), "keys.log")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadKeyLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.count() != 1 {
+		t.Errorf("count = %d，應為 1", keys.count())
+	}
+	clientRandom := tlsHex(t, random)
+	if got := keys.lookup(clientRandom, keyLogClientRandom); !bytes.Equal(got, bytes.Repeat([]byte{1}, 48)) {
+		t.Errorf("CLIENT_RANDOM = %x", got)
+	}
+	if got := keys.lookup(clientRandom, keyLogClientHandshake); !bytes.Equal(got, bytes.Repeat([]byte{2}, 32)) {
+		t.Errorf("CLIENT_HANDSHAKE_TRAFFIC_SECRET = %x", got)
+	}
+	if got := keys.lookup(clientRandom, keyLogServerHandshake); got != nil {
+		t.Errorf("沒有的標籤應為nil: %x", got)
+	}
+	if _, err := loadKeyLog(filepath.Join(t.TempDir(), "missing.log")); err == nil {
+		t.Error("不存在的檔案應該傳回錯誤")
+	}
+}
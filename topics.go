@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"getMqtt/distinct"
+	"getMqtt/schema"
+)
+
+const (
+	// 每個統計區間最多分開統計的主題數，超過的併入 otherTopics，避免每個UE一個主題時無限增長
+	maxTopics   = 1000
+	otherTopics = "(其他主題)"
+)
+
+// 一個主題或主題樣式在統計區間內的PUBLISH統計
+type TopicStats struct {
+	Topic   string // 主題，或 -topic-patterns 的樣式
+	Count   int    // PUBLISH數，包含沒有IMSI的
+	Bytes   int64  // payload位元組數
+	ImsiSet *distinct.Set
+}
+
+func (s *TopicStats) merge(other *TopicStats) {
+	s.Count += other.Count
+	s.Bytes += other.Bytes
+	s.ImsiSet.Merge(other.ImsiSet)
+}
+
+var (
+	// 按主題和按主題樣式的統計，由 lock 保護。工作協程的分片在報告時併入
+	topicStats   = make(map[string]*TopicStats)
+	patternStats = make(map[string]*TopicStats)
+)
+
+// 取得主題的統計，主題數達到上限後新的主題併入 otherTopics
+func topicIn(topics map[string]*TopicStats, topic string) *TopicStats {
+	if stats := topics[topic]; stats != nil {
+		return stats
+	}
+	if len(topics) >= maxTopics {
+		topic = otherTopics
+		if stats := topics[topic]; stats != nil {
+			return stats
+		}
+	}
+	stats := &TopicStats{Topic: topic, ImsiSet: distinct.New(config.imsiPrecision())}
+	topics[topic] = stats
+	return stats
+}
+
+// 主題是否通過 -topics 和 -exclude-topics 的過濾
+func (c *Config) topicAllowed(topic string) bool {
+	if len(c.Topics) > 0 && !matchAnyTopic(c.Topics, topic) {
+		return false
+	}
+	return !matchAnyTopic(c.ExcludeTopics, topic)
+}
+
+func matchAnyTopic(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if schema.MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// 主題過濾器列表的顯示，沒有過濾器時顯示 none
+func topicListString(filters []string, none string) string {
+	if len(filters) == 0 {
+		return none
+	}
+	return strings.Join(filters, ", ")
+}
+
+// 記錄一個發往broker的PUBLISH，寫入工作協程的分片
+func countTopicPublish(shard *aggregateShard, topic string, payloadSize int, imsi string) {
+	count := func(stats *TopicStats) {
+		stats.Count++
+		stats.Bytes += int64(payloadSize)
+		if imsi != "" {
+			stats.ImsiSet.Add(imsi)
+		}
+	}
+	count(topicIn(shard.topics, topic))
+	for _, pattern := range config.TopicPatterns {
+		if schema.MatchTopic(pattern, topic) {
+			count(topicIn(shard.patterns, pattern))
+		}
+	}
+}
+
+// 把工作協程分片中的主題統計併入 dst，src 之後不再使用。呼叫者需持有 lock
+func mergeTopics(dst, src map[string]*TopicStats) {
+	for topic, stats := range src {
+		if dst[topic] == nil && len(dst) < maxTopics {
+			dst[topic] = stats
+			continue
+		}
+		topicIn(dst, topic).merge(stats)
+	}
+}
+
+// 取出本區間的主題和主題樣式統計並清空，呼叫者需持有 lock
+func snapshotTopics() (topics, patterns map[string]*TopicStats) {
+	topics, patterns = topicStats, patternStats
+	topicStats = make(map[string]*TopicStats)
+	patternStats = make(map[string]*TopicStats)
+	return topics, patterns
+}
+
+func printTopicReport(topics, patterns map[string]*TopicStats) {
+	printStats := func(title string, stats map[string]*TopicStats) {
+		if len(stats) == 0 {
+			return
+		}
+		fmt.Printf("%s:\n", title)
+		for _, key := range sortedKeys(stats) {
+			stat := stats[key]
+			fmt.Printf("  %s: PUBLISH %d  位元組 %d  獨立IMSI數量 %d\n", key, stat.Count, stat.Bytes, stat.ImsiSet.Len())
+		}
+	}
+	printStats("各主題統計", topics)
+	printStats("各主題樣式統計", patterns)
+}
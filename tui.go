@@ -0,0 +1,736 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"getMqtt/distinct"
+)
+
+// 終端介面的分頁
+const (
+	tuiDestinations = iota
+	tuiClients
+	tuiTopics
+	tuiImsi
+	tuiLog
+	tuiViews
+)
+
+var tuiViewNames = [tuiViews]string{"目標IP", "客戶端", "主題", "IMSI", "訊息"}
+
+// 表格的欄位名稱，前 tuiTextColumns 欄靠左，其餘為數值靠右
+var (
+	tuiHeaders = [tuiViews][]string{
+		tuiDestinations: {"目標IP", "來源IP", "PUBLISH", "速率/秒", "獨立IMSI"},
+		tuiClients:      {"客戶端", "位址", "PUBLISH", "速率/秒", "獨立IMSI", "連線中", "異常斷線"},
+		tuiTopics:       {"主題", "PUBLISH", "速率/秒", "位元組", "獨立IMSI"},
+	}
+	tuiTextColumns = [tuiViews]int{tuiDestinations: 2, tuiClients: 2, tuiTopics: 1}
+)
+
+// 底部輸入列正在編輯的欄位
+const (
+	tuiInputNone = iota
+	tuiInputFilter
+	tuiInputSearch
+)
+
+const (
+	tuiHistory  = 120         // 趨勢圖保留的區間數
+	tuiLogLines = 1000        // 訊息分頁保留的行數
+	tuiLogTail  = 3           // 其他分頁下方顯示的最新訊息行數
+	tuiRefresh  = time.Second // 沒有按鍵和報告時的重繪間隔
+)
+
+// 趨勢圖由低到高的字元
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// 按鍵的轉義序列
+var tuiEscapeKeys = map[string]string{
+	"\x1b[A": "up", "\x1b[B": "down", "\x1bOA": "up", "\x1bOB": "down",
+	"\x1b[5~": "pgup", "\x1b[6~": "pgdn",
+	"\x1b[H": "home", "\x1b[F": "end", "\x1bOH": "home", "\x1bOF": "end", "\x1b[1~": "home", "\x1b[4~": "end",
+}
+
+// 一個統計區間在終端介面顯示的內容。報告時從 WindowReport 取出，之後不再存取統計結構
+type tuiWindow struct {
+	start, end  time.Time
+	publishes   int // 本區間的PUBLISH數，包含沒有IMSI的
+	distinct    int // 視窗內所有目標IP合計的獨立IMSI數
+	approximate bool
+	rows        [tuiViews][][]string // 各分頁的表格，依PUBLISH數由多到少排列
+	imsis       []string             // 視窗內出現的IMSI，近似模式沒有保存
+}
+
+func newTuiWindow(report *WindowReport) *tuiWindow {
+	w := &tuiWindow{
+		start:       report.Start,
+		end:         report.End,
+		distinct:    report.distinctImsi(),
+		approximate: config.imsiPrecision() != 0,
+	}
+	// 目標IP的統計涵蓋整個視窗，客戶端和主題只有最近一個統計間隔
+	interval := config.Interval.Seconds()
+
+	imsis := make(map[string]bool)
+	ips := sortedKeys(report.Stats)
+	sort.SliceStable(ips, func(i, j int) bool { return report.Stats[ips[i]].Count > report.Stats[ips[j]].Count })
+	for _, ip := range ips {
+		stat := report.Stats[ip]
+		if stat.Count == 0 {
+			continue
+		}
+		w.rows[tuiDestinations] = append(w.rows[tuiDestinations], []string{ip, stat.SourceIP,
+			strconv.Itoa(stat.Count), fmt.Sprintf("%.2f", report.rate(stat)), tuiDistinct(stat.ImsiSet)})
+		if !stat.ImsiSet.Approximate() {
+			for _, imsi := range stat.ImsiSet.Members() {
+				imsis[imsi] = true
+			}
+		}
+	}
+	w.imsis = sortedKeys(imsis)
+
+	clients := sortedKeys(report.Clients)
+	sort.SliceStable(clients, func(i, j int) bool { return report.Clients[clients[i]].Count > report.Clients[clients[j]].Count })
+	for _, key := range clients {
+		stat := report.Clients[key]
+		address := ""
+		if addresses := sortedKeys(stat.Addresses); len(addresses) > 0 {
+			address = addresses[0]
+			if len(addresses) > 1 {
+				address += fmt.Sprintf(" +%d", len(addresses)-1)
+			}
+		}
+		w.rows[tuiClients] = append(w.rows[tuiClients], []string{key, address, strconv.Itoa(stat.Count),
+			fmt.Sprintf("%.2f", float64(stat.Count)/interval), tuiDistinct(stat.ImsiSet),
+			strconv.Itoa(stat.Active), strconv.Itoa(stat.abnormal())})
+	}
+
+	addTopics := func(stats map[string]*TopicStats, prefix string) {
+		keys := sortedKeys(stats)
+		sort.SliceStable(keys, func(i, j int) bool { return stats[keys[i]].Count > stats[keys[j]].Count })
+		for _, key := range keys {
+			stat := stats[key]
+			w.rows[tuiTopics] = append(w.rows[tuiTopics], []string{prefix + key, strconv.Itoa(stat.Count),
+				fmt.Sprintf("%.2f", float64(stat.Count)/interval), strconv.FormatInt(stat.Bytes, 10), tuiDistinct(stat.ImsiSet)})
+		}
+	}
+	addTopics(report.Topics, "")
+	addTopics(report.Patterns, "樣式 ")
+	for _, stat := range report.Topics {
+		w.publishes += stat.Count
+	}
+	return w
+}
+
+// 近似模式的獨立IMSI數前面加上 ~
+func tuiDistinct(set *distinct.Set) string {
+	if set.Approximate() {
+		return fmt.Sprintf("~%d", set.Len())
+	}
+	return strconv.Itoa(set.Len())
+}
+
+// 終端介面：在替代畫面顯示最近的統計區間、趨勢圖和訊息，並處理按鍵。
+// 實作 io.Writer 接收log和狀態訊息，顯示在訊息分頁
+type tui struct {
+	out        *os.File
+	state      *terminalState
+	windowDesc string
+
+	mu      sync.Mutex
+	history []*tuiWindow // 最近的統計區間，最新的在最後
+	frozen  []*tuiWindow // 暫停時顯示的統計區間
+	paused  bool
+	view    int
+	filter  string // 表格和訊息的過濾字串
+	search  string // IMSI的搜尋字串
+	input   int    // 正在編輯的欄位
+	editing []rune
+	scroll  int // 表格從第幾列開始顯示，訊息分頁為離最新一行的距離
+	page    int // 上次繪製時表格可以顯示的列數
+	logs    []string
+	partial string // 還沒有換行的訊息
+	closed  bool
+
+	redraw    chan struct{}
+	closeOnce sync.Once
+}
+
+// 把終端切到原始模式和替代畫面，之後的log和狀態訊息改為顯示在TUI中
+func startTUI() (*tui, error) {
+	if _, _, err := terminalSize(int(os.Stdout.Fd())); err != nil {
+		return nil, fmt.Errorf("TUI模式需要在終端中執行: %v", err)
+	}
+	state, err := makeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("無法切換終端到原始模式: %v", err)
+	}
+	t := &tui{
+		out:        os.Stdout,
+		state:      state,
+		windowDesc: windows.String(),
+		redraw:     make(chan struct{}, 1),
+	}
+	// 使用替代畫面並隱藏游標，結束時回到原本的終端內容
+	fmt.Fprint(t.out, "\x1b[?1049h\x1b[?25l")
+	log.SetOutput(t)
+	infoOut = t
+	return t, nil
+}
+
+// 處理按鍵和訊號，定時重繪畫面，不會返回
+func (t *tui) run() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go t.readKeys()
+
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+	for {
+		t.draw()
+		select {
+		case <-ticker.C:
+		case <-t.redraw:
+		case <-signals:
+			t.quit()
+		}
+	}
+}
+
+func (t *tui) requestRedraw() {
+	select {
+	case t.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// 還原終端，之後的訊息寫到stderr。可重複呼叫
+func (t *tui) close() {
+	t.closeOnce.Do(func() {
+		t.mu.Lock()
+		t.closed = true
+		t.mu.Unlock()
+		fmt.Fprint(t.out, "\x1b[?25h\x1b[?1049l")
+		if err := t.state.restore(); err != nil {
+			fmt.Fprintf(os.Stderr, "無法還原終端設定: %v\n", err)
+		}
+	})
+}
+
+// 還原終端，關閉輸出檔案後結束程式
+func (t *tui) quit() {
+	t.close()
+	if events != nil {
+		events.close()
+	}
+	closePcapOutputs()
+	os.Exit(0)
+}
+
+// 加入一個統計區間，由產生報告的協程呼叫
+func (t *tui) window(report *WindowReport) {
+	w := newTuiWindow(report)
+	t.mu.Lock()
+	t.history = append(t.history, w)
+	if len(t.history) > tuiHistory {
+		t.history = t.history[len(t.history)-tuiHistory:]
+	}
+	t.mu.Unlock()
+	t.requestRedraw()
+}
+
+// log和狀態訊息按行保存，結束後直接寫到stderr
+func (t *tui) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return os.Stderr.Write(p)
+	}
+	lines := strings.Split(t.partial+string(p), "\n")
+	t.partial = lines[len(lines)-1]
+	t.logs = append(t.logs, lines[:len(lines)-1]...)
+	if len(t.logs) > tuiLogLines {
+		t.logs = t.logs[len(t.logs)-tuiLogLines:]
+	}
+	return len(p), nil
+}
+
+func (t *tui) readKeys() {
+	buf := make([]byte, 256)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			t.quit()
+		}
+		for _, key := range parseKeys(buf[:n]) {
+			if !t.handleKey(key) {
+				t.quit()
+			}
+		}
+		t.requestRedraw()
+	}
+}
+
+// 把讀到的位元組拆成按鍵，特殊鍵以名稱表示，其他為字元本身
+func parseKeys(data []byte) []string {
+	var keys []string
+	for len(data) > 0 {
+		switch b := data[0]; {
+		case b == 0x1b:
+			key, n := "esc", 1
+			for seq, name := range tuiEscapeKeys {
+				if strings.HasPrefix(string(data), seq) {
+					key, n = name, len(seq)
+					break
+				}
+			}
+			if key == "esc" && len(data) > 2 && data[1] == '[' {
+				// 不認識的CSI序列整個略過
+				key, n = "", 2
+				for n < len(data) && (data[n] < 0x40 || data[n] > 0x7e) {
+					n++
+				}
+				n = min(n+1, len(data))
+			}
+			if key != "" {
+				keys = append(keys, key)
+			}
+			data = data[n:]
+		case b == '\r' || b == '\n':
+			keys = append(keys, "enter")
+			data = data[1:]
+		case b == 0x7f || b == 0x08:
+			keys = append(keys, "backspace")
+			data = data[1:]
+		case b == '\t':
+			keys = append(keys, "tab")
+			data = data[1:]
+		case b == 0x03:
+			keys = append(keys, "ctrl-c")
+			data = data[1:]
+		case b < 0x20:
+			data = data[1:]
+		default:
+			r, n := utf8.DecodeRune(data)
+			keys = append(keys, string(r))
+			data = data[n:]
+		}
+	}
+	return keys
+}
+
+// 處理一個按鍵，回傳false表示要結束程式
+func (t *tui) handleKey(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.input != tuiInputNone {
+		switch key {
+		case "ctrl-c":
+			return false
+		case "enter":
+			if t.input == tuiInputFilter {
+				t.filter = string(t.editing)
+			} else {
+				t.search = string(t.editing)
+			}
+			t.input = tuiInputNone
+			t.scroll = 0
+		case "esc":
+			t.input = tuiInputNone
+		case "backspace":
+			if len(t.editing) > 0 {
+				t.editing = t.editing[:len(t.editing)-1]
+			}
+		default:
+			if r, _ := utf8.DecodeRuneInString(key); utf8.RuneCountInString(key) == 1 && r >= ' ' {
+				t.editing = append(t.editing, r)
+			}
+		}
+		return true
+	}
+
+	switch key {
+	case "q", "ctrl-c":
+		return false
+	case "p", " ":
+		// 暫停時畫面固定在目前的區間，報告照常收集
+		t.paused = !t.paused
+		t.frozen = nil
+		if t.paused {
+			t.frozen = append(t.frozen, t.history...)
+		}
+	case "f":
+		t.input = tuiInputFilter
+		t.editing = []rune(t.filter)
+	case "/":
+		t.input = tuiInputSearch
+		t.editing = []rune(t.search)
+		t.view = tuiImsi
+		t.scroll = 0
+	case "d":
+		debugMode.Store(!debugOn())
+	case "esc":
+		t.filter, t.search = "", ""
+		t.scroll = 0
+	case "tab":
+		t.view = (t.view + 1) % tuiViews
+		t.scroll = 0
+	case "1", "2", "3", "4", "5":
+		t.view = int(key[0] - '1')
+		t.scroll = 0
+	case "up", "k":
+		t.scrollBy(-1)
+	case "down", "j":
+		t.scrollBy(1)
+	case "pgup":
+		t.scrollBy(-t.page)
+	case "pgdn":
+		t.scrollBy(t.page)
+	case "home":
+		t.scroll = 0
+		t.scrollBy(-math.MaxInt32)
+	case "end":
+		t.scroll = 0
+		t.scrollBy(math.MaxInt32)
+	}
+	return true
+}
+
+// 往下捲動 n 列，訊息分頁的 scroll 是離最新一行的距離，方向相反。超出範圍的值在繪製時修正
+func (t *tui) scrollBy(n int) {
+	if t.view == tuiLog {
+		n = -n
+	}
+	t.scroll = max(t.scroll+n, 0)
+}
+
+// 重繪整個畫面
+func (t *tui) draw() {
+	width, height, err := terminalSize(int(t.out.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	// 抓包計數在鎖外取得，取得失敗時的調試訊息會寫回TUI
+	var captured, failed uint64
+	if captures != nil {
+		for _, stat := range captures.interfaceStats() {
+			captured += stat.Captured
+		}
+	}
+	for _, n := range failures.totals() {
+		failed += n
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	// 最後一欄不寫字，避免終端自動換行
+	lines := t.render(max(width-1, 20), max(height, 12), captured, failed)
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+		b.WriteString("\x1b[K")
+	}
+	b.WriteString("\x1b[J")
+	t.out.WriteString(b.String())
+}
+
+// 產生畫面的每一行，呼叫者需持有 t.mu
+func (t *tui) render(width, height int, captured, failed uint64) []string {
+	history := t.history
+	if t.paused {
+		history = t.frozen
+	}
+	var latest *tuiWindow
+	if len(history) > 0 {
+		latest = history[len(history)-1]
+	}
+
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fitWidth(fmt.Sprintf(format, args...), width))
+	}
+
+	status := ""
+	if t.paused {
+		status += "  [已暫停]"
+	}
+	if debugOn() {
+		status += "  [調試]"
+	}
+	lines = append(lines, reverseVideo(fitWidth(fmt.Sprintf(" MQTT封包監控  %s  %s%s",
+		t.windowDesc, time.Now().Format("15:04:05"), status), width)))
+
+	if latest == nil {
+		add(" 捕獲封包 %d  未統計 %d  等待第一個統計區間（每 %v 報告）", captured, failed, config.Interval)
+	} else {
+		// 暫停時仍依最新收到的區間計算下次報告
+		next := time.Until(t.history[len(t.history)-1].end.Add(config.Interval)).Round(time.Second)
+		add(" 捕獲封包 %d  未統計 %d  區間 %s - %s  下次報告 %v", captured, failed,
+			latest.start.Format("15:04:05"), latest.end.Format("15:04:05"), max(next, 0))
+	}
+
+	publishes := make([]int, len(history))
+	distincts := make([]int, len(history))
+	for i, w := range history {
+		publishes[i], distincts[i] = w.publishes, w.distinct
+	}
+	publishNow, distinctNow := "", ""
+	if latest != nil {
+		publishNow = fmt.Sprintf("%d（%.1f/秒）", latest.publishes, float64(latest.publishes)/config.Interval.Seconds())
+		distinctNow = strconv.Itoa(latest.distinct)
+		if latest.approximate {
+			distinctNow = "~" + distinctNow
+		}
+	}
+	add(" PUBLISH  %s %s", sparkline(publishes, width-displayWidth(publishNow)-12), publishNow)
+	add(" 獨立IMSI %s %s", sparkline(distincts, width-displayWidth(distinctNow)-12), distinctNow)
+
+	var tabs strings.Builder
+	for i, name := range tuiViewNames {
+		if i == t.view {
+			fmt.Fprintf(&tabs, "[%d %s]", i+1, name)
+		} else {
+			fmt.Fprintf(&tabs, " %d %s ", i+1, name)
+		}
+	}
+	if t.filter != "" {
+		fmt.Fprintf(&tabs, "   過濾「%s」", t.filter)
+	}
+	if t.search != "" {
+		fmt.Fprintf(&tabs, "   搜尋IMSI「%s」", t.search)
+	}
+	add("%s", tabs.String())
+
+	// 下方保留分隔線、最新訊息和說明列
+	footer := 2
+	if t.view != tuiLog {
+		footer += tuiLogTail
+	}
+	body := height - len(lines) - footer
+	switch {
+	case t.view == tuiLog:
+		lines = append(lines, t.renderLog(width, body)...)
+	case latest == nil:
+		add(" 等待第一個統計區間...")
+	case t.view == tuiImsi:
+		lines = append(lines, t.renderImsi(latest, width, body)...)
+	default:
+		lines = append(lines, t.renderTable(latest, width, body)...)
+	}
+	for len(lines) < height-footer {
+		lines = append(lines, "")
+	}
+
+	lines = append(lines, fitWidth(strings.Repeat("─", width), width))
+	if t.view != tuiLog {
+		tail := t.logs[max(len(t.logs)-tuiLogTail, 0):]
+		for i := 0; i < tuiLogTail; i++ {
+			if i < len(tail) {
+				lines = append(lines, fitWidth(tail[i], width))
+			} else {
+				lines = append(lines, "")
+			}
+		}
+	}
+	switch t.input {
+	case tuiInputFilter:
+		add(" 過濾: %s█   Enter確定  Esc取消", string(t.editing))
+	case tuiInputSearch:
+		add(" 搜尋IMSI: %s█   Enter確定  Esc取消", string(t.editing))
+	default:
+		lines = append(lines, reverseVideo(fitWidth(" q離開  p暫停  f過濾  /搜尋IMSI  d調試  Tab/1-5切換  j/k/PgUp/PgDn捲動  Esc清除過濾", width)))
+	}
+	return lines
+}
+
+// 表格分頁：標題列和符合過濾條件的列
+func (t *tui) renderTable(w *tuiWindow, width, height int) []string {
+	headers := tuiHeaders[t.view]
+	var rows [][]string
+	for _, row := range w.rows[t.view] {
+		if matchFilter(strings.Join(row, " "), t.filter) {
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) == 0 {
+		if t.filter != "" {
+			return []string{fitWidth(fmt.Sprintf(" 沒有符合「%s」的資料", t.filter), width)}
+		}
+		return []string{fitWidth(" 本區間沒有資料", width)}
+	}
+
+	widths := make([]int, len(headers))
+	for i, header := range headers {
+		widths[i] = displayWidth(header)
+		for _, row := range rows {
+			widths[i] = max(widths[i], displayWidth(row[i]))
+		}
+	}
+	format := func(cells []string) string {
+		var b strings.Builder
+		for i, cell := range cells {
+			pad := strings.Repeat(" ", widths[i]-displayWidth(cell))
+			b.WriteString(" ")
+			if i < tuiTextColumns[t.view] {
+				b.WriteString(cell + pad)
+			} else {
+				b.WriteString(pad + cell)
+			}
+			b.WriteString(" ")
+		}
+		return b.String()
+	}
+
+	t.page = max(height-1, 1)
+	t.scroll = min(t.scroll, max(len(rows)-t.page, 0))
+	lines := []string{reverseVideo(fitWidth(format(headers), width))}
+	for _, row := range rows[t.scroll:min(t.scroll+t.page, len(rows))] {
+		lines = append(lines, fitWidth(format(row), width))
+	}
+	return lines
+}
+
+// IMSI分頁：視窗內出現的IMSI依搜尋字串篩選後分欄列出
+func (t *tui) renderImsi(w *tuiWindow, width, height int) []string {
+	if w.approximate {
+		return []string{fitWidth(fmt.Sprintf(" 近似模式（-distinct hll）沒有保存IMSI，視窗內約 %d 個獨立IMSI", w.distinct), width)}
+	}
+	var imsis []string
+	for _, imsi := range w.imsis {
+		if strings.Contains(imsi, t.search) {
+			imsis = append(imsis, imsi)
+		}
+	}
+	title := fmt.Sprintf(" 視窗內 %d 個IMSI", len(w.imsis))
+	if t.search != "" {
+		title += fmt.Sprintf("，符合「%s」的 %d 個", t.search, len(imsis))
+	}
+	lines := []string{reverseVideo(fitWidth(title, width))}
+
+	cell := 1
+	for _, imsi := range imsis {
+		cell = max(cell, len(imsi)+2)
+	}
+	columns := max((width-1)/cell, 1)
+	rows := (len(imsis) + columns - 1) / columns
+	t.page = max(height-1, 1)
+	t.scroll = min(t.scroll, max(rows-t.page, 0))
+	for row := t.scroll; row < min(t.scroll+t.page, rows); row++ {
+		var b strings.Builder
+		b.WriteString(" ")
+		for _, imsi := range imsis[row*columns : min((row+1)*columns, len(imsis))] {
+			b.WriteString(imsi + strings.Repeat(" ", cell-len(imsi)))
+		}
+		lines = append(lines, fitWidth(b.String(), width))
+	}
+	return lines
+}
+
+// 訊息分頁：符合過濾條件的最新訊息，可往回捲動
+func (t *tui) renderLog(width, height int) []string {
+	var logs []string
+	for _, line := range t.logs {
+		if matchFilter(line, t.filter) {
+			logs = append(logs, line)
+		}
+	}
+	t.page = max(height, 1)
+	t.scroll = min(t.scroll, max(len(logs)-t.page, 0))
+	end := len(logs) - t.scroll
+	var lines []string
+	for _, line := range logs[max(end-t.page, 0):end] {
+		lines = append(lines, fitWidth(line, width))
+	}
+	return lines
+}
+
+// 不分大小寫的子字串比對，過濾字串為空時都符合
+func matchFilter(text, filter string) bool {
+	return filter == "" || strings.Contains(strings.ToLower(text), strings.ToLower(filter))
+}
+
+// 最近 width 個數值的趨勢圖，依其中的最大值縮放，0顯示為空白
+func sparkline(values []int, width int) string {
+	width = max(width, 1)
+	values = values[max(len(values)-width, 0):]
+	peak := 0
+	for _, v := range values {
+		peak = max(peak, v)
+	}
+	var b strings.Builder
+	b.WriteString(strings.Repeat(" ", width-len(values)))
+	for _, v := range values {
+		if v == 0 {
+			b.WriteByte(' ')
+			continue
+		}
+		b.WriteRune(sparkBlocks[(v*(len(sparkBlocks)-1)+peak-1)/peak])
+	}
+	return b.String()
+}
+
+func reverseVideo(s string) string {
+	return "\x1b[7m" + s + "\x1b[0m"
+}
+
+// 字元在終端佔的欄數：控制字元不顯示，中日韓文字和全形符號佔兩欄
+func runeWidth(r rune) int {
+	switch {
+	case r < 0x20 || r == 0x7f:
+		return 0
+	case r >= 0x1100 && r <= 0x115f, r >= 0x2e80 && r <= 0xa4cf, r >= 0xac00 && r <= 0xd7a3,
+		r >= 0xf900 && r <= 0xfaff, r >= 0xfe30 && r <= 0xfe4f, r >= 0xff00 && r <= 0xff60, r >= 0xffe0 && r <= 0xffe6:
+		return 2
+	}
+	return 1
+}
+
+func displayWidth(s string) int {
+	width := 0
+	for _, r := range s {
+		width += runeWidth(r)
+	}
+	return width
+}
+
+// 截斷或補空白到剛好 width 欄。控制字元（封包內容中的轉義序列等）去掉，Tab換成空白
+func fitWidth(s string, width int) string {
+	var b strings.Builder
+	used := 0
+	for _, r := range s {
+		if r == '\t' {
+			r = ' '
+		}
+		w := runeWidth(r)
+		if w == 0 {
+			continue
+		}
+		if used+w > width {
+			break
+		}
+		b.WriteRune(r)
+		used += w
+	}
+	b.WriteString(strings.Repeat(" ", width-used))
+	return b.String()
+}
@@ -0,0 +1,43 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// 進入原始模式前的終端設定，離開TUI時還原
+type terminalState struct {
+	fd  int
+	old unix.Termios
+}
+
+// 把終端切到原始模式：逐鍵讀取、不回顯，Ctrl-C由TUI自己處理。
+// 保留輸出處理，換行仍會轉成CRLF
+func makeRaw(fd int) (*terminalState, error) {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	state := &terminalState{fd: fd, old: *termios}
+	raw := *termios
+	raw.Iflag &^= unix.BRKINT | unix.ICRNL | unix.INPCK | unix.ISTRIP | unix.IXON
+	raw.Lflag &^= unix.ECHO | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (s *terminalState) restore() error {
+	return unix.IoctlSetTermios(s.fd, unix.TCSETS, &s.old)
+}
+
+// 終端的欄數和行數
+func terminalSize(fd int) (width, height int, err error) {
+	size, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(size.Col), int(size.Row), nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+type terminalState struct{}
+
+func makeRaw(fd int) (*terminalState, error) {
+	return nil, errors.New("TUI只支援Linux")
+}
+
+func (s *terminalState) restore() error {
+	return nil
+}
+
+func terminalSize(fd int) (width, height int, err error) {
+	return 0, 0, errors.New("TUI只支援Linux")
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// WebSocket frame的opcode
+const (
+	WS_CONTINUATION = 0x0
+	WS_TEXT         = 0x1
+	WS_BINARY       = 0x2
+	WS_CLOSE        = 0x8
+	WS_PING         = 0x9
+	WS_PONG         = 0xA
+)
+
+// 單一方向的解析狀態
+const (
+	wsStateHTTP   = iota // 等待HTTP Upgrade請求或101回應
+	wsStateFrames        // 解析WebSocket frame
+	wsStateIgnore        // 不是WebSocket連線或已無法解析
+)
+
+// HTTP標頭的長度上限
+const maxWebSocketHTTPHeader = 16 * 1024
+
+var (
+	errWebSocketMalformed   = errors.New("WebSocket格式錯誤")
+	errWebSocketUnsupported = errors.New("不支援的WebSocket擴充（例如permessage-deflate）")
+)
+
+// 單一方向的WebSocket狀態。frame的payload邊收邊解遮罩，大的frame不需要整個暫存。
+type wsDirection struct {
+	state int
+	buf   []byte // 尚未完整的HTTP標頭或frame標頭
+
+	remaining uint64 // 目前frame還沒收到的payload位元組
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+	deliver   bool // 目前frame是否為資料（binary或其後的continuation）
+	message   byte // 目前訊息第一個frame的opcode，continuation沿用
+}
+
+// 一條MQTT over WebSocket連線。HTTP Upgrade之後，資料frame的payload依序接起來就是MQTT位元組流，
+// MQTT封包可以跨多個frame，一個frame也可以有多個MQTT封包。
+type wsConn struct {
+	dirs [2]wsDirection // 0: 客戶端 -> broker，1: broker -> 客戶端
+}
+
+func newWebSocketConn() *wsConn {
+	return &wsConn{}
+}
+
+func (c *wsConn) feed(msg *mqttMessage, data []byte, plaintext func([]byte)) {
+	d := &c.dirs[directionIndex(msg.toBroker)]
+	for len(data) > 0 {
+		switch d.state {
+		case wsStateIgnore:
+			return
+		case wsStateHTTP:
+			data = c.http(msg, d, data)
+		case wsStateFrames:
+			var err error
+			if data, err = d.frames(data, plaintext); err != nil {
+				c.fail(msg, d, err)
+				return
+			}
+		}
+	}
+}
+
+// 處理HTTP Upgrade，回傳標頭之後剩下的位元組
+func (c *wsConn) http(msg *mqttMessage, d *wsDirection, data []byte) []byte {
+	d.buf = append(d.buf, data...)
+	prefix := "GET "
+	if !msg.toBroker {
+		prefix = "HTTP/"
+	}
+	if len(d.buf) >= len(prefix) && !bytes.HasPrefix(d.buf, []byte(prefix)) {
+		// 抓包開始前已完成Upgrade，直接當作frame解析
+		d.state = wsStateFrames
+		rest := d.buf
+		d.buf = nil
+		return rest
+	}
+
+	end := bytes.Index(d.buf, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(d.buf) > maxWebSocketHTTPHeader {
+			c.fail(msg, d, errWebSocketMalformed)
+		}
+		return nil
+	}
+	header, rest := d.buf[:end+4], d.buf[end+4:]
+	d.buf = nil
+
+	reader := bufio.NewReader(bytes.NewReader(header))
+	if msg.toBroker {
+		req, err := http.ReadRequest(reader)
+		if err != nil || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			c.notWebSocket(msg)
+			return nil
+		}
+		if debugOn() {
+			log.Printf("[any] %s -> %s WebSocket升級 path=%s protocol=%s", joinHostPort(msg.srcIP, msg.srcPort),
+				joinHostPort(msg.dstIP, msg.dstPort), req.URL.Path, req.Header.Get("Sec-WebSocket-Protocol"))
+		}
+	} else {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+			c.notWebSocket(msg)
+			return nil
+		}
+		if ext := resp.Header.Get("Sec-WebSocket-Extensions"); ext != "" && debugOn() {
+			log.Printf("[any] %s WebSocket擴充 %s，壓縮的frame無法解析", joinHostPort(msg.srcIP, msg.srcPort), ext)
+		}
+	}
+	d.state = wsStateFrames
+	return rest
+}
+
+// 解析frame，回傳還沒處理的位元組（需要更多資料時為nil）
+func (d *wsDirection) frames(data []byte, plaintext func([]byte)) ([]byte, error) {
+	// 目前frame的payload
+	if d.remaining > 0 {
+		n := len(data)
+		if uint64(n) > d.remaining {
+			n = int(d.remaining)
+		}
+		chunk := data[:n]
+		if d.deliver {
+			if d.masked {
+				chunk = append([]byte(nil), chunk...)
+				for i := range chunk {
+					chunk[i] ^= d.mask[d.maskPos&3]
+					d.maskPos++
+				}
+			}
+			plaintext(chunk)
+		}
+		d.remaining -= uint64(n)
+		return data[n:], nil
+	}
+
+	// 下一個frame的標頭
+	d.buf = append(d.buf, data...)
+	if len(d.buf) < 2 {
+		return nil, nil
+	}
+	first, second := d.buf[0], d.buf[1]
+	opcode := first & 0x0F
+	d.masked = second&0x80 != 0
+	headerLen := 2
+	length := uint64(second & 0x7F)
+	switch length {
+	case 126:
+		headerLen += 2
+	case 127:
+		headerLen += 8
+	}
+	if d.masked {
+		headerLen += 4
+	}
+	if len(d.buf) < headerLen {
+		return nil, nil
+	}
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(d.buf[2:4]))
+	case 127:
+		length = binary.BigEndian.Uint64(d.buf[2:10])
+	}
+	if d.masked {
+		copy(d.mask[:], d.buf[headerLen-4:headerLen])
+	}
+	d.maskPos = 0
+	d.remaining = length
+
+	switch {
+	case opcode >= WS_CLOSE:
+		// 控制frame可以插在分段的訊息中間，不影響目前訊息
+		if length > 125 || first&0x80 == 0 {
+			return nil, errWebSocketMalformed
+		}
+		d.deliver = false
+	case opcode == WS_CONTINUATION:
+		d.deliver = d.message == WS_BINARY
+	case opcode == WS_BINARY || opcode == WS_TEXT:
+		d.message = opcode
+		d.deliver = opcode == WS_BINARY
+	default:
+		return nil, errWebSocketMalformed
+	}
+	if first&0x70 != 0 && d.deliver {
+		// RSV位元表示使用了擴充（通常是permessage-deflate）
+		return nil, errWebSocketUnsupported
+	}
+
+	rest := d.buf[headerLen:]
+	d.buf = nil
+	return rest, nil
+}
+
+func (c *wsConn) fail(msg *mqttMessage, d *wsDirection, err error) {
+	if err == errWebSocketUnsupported {
+		failures.add(failWebSocketUnsupported)
+	} else {
+		failures.add(failWebSocketMalformed)
+	}
+	if debugOn() {
+		log.Printf("[any] %s -> %s WebSocket處理失敗: %v", joinHostPort(msg.srcIP, msg.srcPort), joinHostPort(msg.dstIP, msg.dstPort), err)
+	}
+	d.state = wsStateIgnore
+	d.buf = nil
+}
+
+// 不是WebSocket Upgrade（一般HTTP請求），整條連線不再解析
+func (c *wsConn) notWebSocket(msg *mqttMessage) {
+	if debugOn() {
+		log.Printf("[any] %s -> %s 不是WebSocket連線", joinHostPort(msg.srcIP, msg.srcPort), joinHostPort(msg.dstIP, msg.dstPort))
+	}
+	for i := range c.dirs {
+		c.dirs[i].state = wsStateIgnore
+		c.dirs[i].buf = nil
+	}
+}
+
+// 中間有遺失的位元組，無法再找到frame的邊界
+func (c *wsConn) lost(toBroker bool) {
+	d := &c.dirs[directionIndex(toBroker)]
+	d.state = wsStateIgnore
+	d.buf = nil
+}
+
+// 連線結束，釋放未完成的標頭。msg 為客戶端 -> broker方向。
+// 結束在frame中間時只在debug模式記錄，MQTT層會丟棄不完整的封包
+func (c *wsConn) close(msg *mqttMessage) {
+	for i := range c.dirs {
+		d := &c.dirs[i]
+		if debugOn() && d.state == wsStateFrames && (d.remaining > 0 || len(d.buf) > 0) {
+			log.Printf("[any] %s -> %s WebSocket連線結束時%s的frame不完整", joinHostPort(msg.srcIP, msg.srcPort),
+				joinHostPort(msg.dstIP, msg.dstPort), qosDirectionNames[i])
+		}
+		d.state = wsStateIgnore
+		d.buf = nil
+		d.remaining = 0
+	}
+}
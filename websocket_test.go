@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// 組成一個WebSocket frame，first 為FIN、RSV和opcode，mask 為nil時不遮罩
+func wsFrame(first byte, payload, mask []byte) []byte {
+	second := byte(0)
+	if mask != nil {
+		second = 0x80
+	}
+	var b []byte
+	switch {
+	case len(payload) < 126:
+		b = []byte{first, second | byte(len(payload))}
+	case len(payload) <= 0xFFFF:
+		b = []byte{first, second | 126, byte(len(payload) >> 8), byte(len(payload))}
+	default:
+		b = binary.BigEndian.AppendUint64([]byte{first, second | 127}, uint64(len(payload)))
+	}
+	if mask == nil {
+		return append(b, payload...)
+	}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i&3])
+	}
+	return b
+}
+
+// 把一個方向的位元組交給wsConn，每次最多 step 個位元組，回傳解出的MQTT位元組
+func feedWebSocket(c *wsConn, toBroker bool, data []byte, step int) []byte {
+	msg := &mqttMessage{toBroker: toBroker, srcIP: "10.0.0.1", dstIP: "10.1.153.153", srcPort: 40000, dstPort: 8083}
+	if !toBroker {
+		msg.srcIP, msg.dstIP, msg.srcPort, msg.dstPort = msg.dstIP, msg.srcIP, msg.dstPort, msg.srcPort
+	}
+	var out []byte
+	for len(data) > 0 {
+		n := min(step, len(data))
+		c.feed(msg, data[:n], func(b []byte) {
+			out = append(out, b...)
+		})
+		data = data[n:]
+	}
+	return out
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	publish := testPublish("t/usage", `{"imsi":"208930000000001"}`)
+	medium := testPublish("t/usage", string(bytes.Repeat([]byte("a"), 300)))  // 16位元延伸長度
+	large := testPublish("t/usage", string(bytes.Repeat([]byte("b"), 70000))) // 64位元延伸長度
+	concat := func(frames ...[]byte) []byte { return bytes.Join(frames, nil) }
+
+	tests := []struct {
+		name   string
+		stream []byte
+		want   []byte
+	}{
+		{"未遮罩", wsFrame(0x80|WS_BINARY, publish, nil), publish},
+		{"遮罩", wsFrame(0x80|WS_BINARY, publish, mask), publish},
+		{"126延伸長度", wsFrame(0x80|WS_BINARY, medium, mask), medium},
+		{"127延伸長度", wsFrame(0x80|WS_BINARY, large, nil), large},
+		{
+			"MQTT封包跨frame",
+			concat(wsFrame(WS_BINARY, publish[:5], mask), wsFrame(WS_CONTINUATION, publish[5:12], mask), wsFrame(0x80|WS_CONTINUATION, publish[12:], mask)),
+			publish,
+		},
+		{
+			"一個frame多個MQTT封包",
+			wsFrame(0x80|WS_BINARY, concat(publish, publish), nil),
+			concat(publish, publish),
+		},
+		{
+			"分段之間的ping和pong",
+			concat(wsFrame(WS_BINARY, publish[:5], mask), wsFrame(0x80|WS_PING, []byte("hi"), mask),
+				wsFrame(0x80|WS_PONG, nil, mask), wsFrame(0x80|WS_CONTINUATION, publish[5:], mask)),
+			publish,
+		},
+		{
+			"文字訊息和close不是MQTT資料",
+			concat(wsFrame(WS_TEXT, []byte("abc"), nil), wsFrame(0x80|WS_CONTINUATION, []byte("def"), nil),
+				wsFrame(0x80|WS_BINARY, publish, nil), wsFrame(0x80|WS_CLOSE, []byte{0x03, 0xe8}, nil)),
+			publish,
+		},
+		{"空的frame", concat(wsFrame(0x80|WS_BINARY, nil, mask), wsFrame(0x80|WS_BINARY, publish, mask)), publish},
+	}
+	for _, tt := range tests {
+		for _, step := range []int{1 << 20, 3, 1} {
+			c := newWebSocketConn()
+			if got := feedWebSocket(c, true, tt.stream, step); !bytes.Equal(got, tt.want) {
+				t.Errorf("%s step=%d: %d 個位元組，應為 %d", tt.name, step, len(got), len(tt.want))
+			}
+			if c.dirs[0].state != wsStateFrames {
+				t.Errorf("%s step=%d: 狀態 %d", tt.name, step, c.dirs[0].state)
+			}
+		}
+	}
+}
+
+func TestWebSocketFramesMalformed(t *testing.T) {
+	publish := testPublish("t", "x")
+	tests := []struct {
+		name   string
+		stream []byte
+		reason string
+	}{
+		// RSV1表示permessage-deflate壓縮
+		{"RSV位元", wsFrame(0x80|0x40|WS_BINARY, publish, nil), failWebSocketUnsupported},
+		{"continuation的RSV位元", append(wsFrame(WS_BINARY, publish[:2], nil), wsFrame(0x80|0x20|WS_CONTINUATION, publish[2:], nil)...), failWebSocketUnsupported},
+		{"未定義的opcode", wsFrame(0x80|0x3, publish, nil), failWebSocketMalformed},
+		{"分段的控制frame", wsFrame(WS_PING, nil, nil), failWebSocketMalformed},
+		{"過長的控制frame", wsFrame(0x80|WS_PING, make([]byte, 126), nil), failWebSocketMalformed},
+	}
+	for _, tt := range tests {
+		before := failures.totals()[tt.reason]
+		c := newWebSocketConn()
+		got := feedWebSocket(c, true, append(tt.stream, wsFrame(0x80|WS_BINARY, publish, nil)...), 1<<20)
+		if c.dirs[0].state != wsStateIgnore {
+			t.Errorf("%s: 應停止解析", tt.name)
+		}
+		// 錯誤之後的frame不再解出
+		if bytes.Contains(got, publish) {
+			t.Errorf("%s: 錯誤後仍有資料 %x", tt.name, got)
+		}
+		if after := failures.totals()[tt.reason]; after != before+1 {
+			t.Errorf("%s: %s 計數 %d，應為 %d", tt.name, tt.reason, after, before+1)
+		}
+	}
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	publish := testPublish("t/usage", `{"imsi":"208930000000001"}`)
+	connack := []byte{MQTT_CONNACK << 4, 2, 0, 0}
+	request := "GET /mqtt HTTP/1.1\r\nHost: broker\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Protocol: mqtt\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\nSec-WebSocket-Protocol: mqtt\r\n\r\n"
+
+	for _, step := range []int{1 << 20, 5, 1} {
+		c := newWebSocketConn()
+		// 標頭和第一個frame在同一個TCP段
+		got := feedWebSocket(c, true, append([]byte(request), wsFrame(0x80|WS_BINARY, publish, []byte{1, 2, 3, 4})...), step)
+		if !bytes.Equal(got, publish) {
+			t.Errorf("step=%d: 客戶端 %x，應為 %x", step, got, publish)
+		}
+		got = feedWebSocket(c, false, append([]byte(response), wsFrame(0x80|WS_BINARY, connack, nil)...), step)
+		if !bytes.Equal(got, connack) {
+			t.Errorf("step=%d: broker %x，應為 %x", step, got, connack)
+		}
+	}
+
+	// 抓包開始前已完成Upgrade，直接解析frame
+	c := newWebSocketConn()
+	if got := feedWebSocket(c, false, wsFrame(0x80|WS_BINARY, connack, nil), 1); !bytes.Equal(got, connack) {
+		t.Errorf("已升級的連線 %x，應為 %x", got, connack)
+	}
+
+	// 一般HTTP請求，兩個方向都不再解析
+	c = newWebSocketConn()
+	feedWebSocket(c, true, []byte("GET / HTTP/1.1\r\nHost: broker\r\n\r\n"), 1<<20)
+	if got := feedWebSocket(c, false, []byte("HTTP/1.1 200 OK\r\n\r\n"), 1<<20); got != nil || c.dirs[0].state != wsStateIgnore || c.dirs[1].state != wsStateIgnore {
+		t.Errorf("不是WebSocket: %x %+v", got, c.dirs)
+	}
+
+	// 超過上限還沒有結束的標頭
+	c = newWebSocketConn()
+	feedWebSocket(c, true, append([]byte("GET /"), bytes.Repeat([]byte("a"), maxWebSocketHTTPHeader+1)...), 1024)
+	if c.dirs[0].state != wsStateIgnore || c.dirs[0].buf != nil {
+		t.Error("過長的HTTP標頭應停止解析")
+	}
+}
+
+func TestWebSocketClose(t *testing.T) {
+	publish := testPublish("t", "x")
+	c := newWebSocketConn()
+	frame := wsFrame(0x80|WS_BINARY, publish, nil)
+	feedWebSocket(c, true, frame[:len(frame)-1], 1<<20)
+	feedWebSocket(c, false, frame[:1], 1<<20)
+	c.close(&mqttMessage{toBroker: true})
+	for i, d := range c.dirs {
+		if d.state != wsStateIgnore || d.buf != nil || d.remaining != 0 {
+			t.Errorf("方向%d: 結束後仍有狀態 %+v", i, d)
+		}
+	}
+	if got := feedWebSocket(c, true, frame, 1<<20); got != nil {
+		t.Errorf("結束後不應再解出資料: %x", got)
+	}
+}
+
+func FuzzWebSocketConn(f *testing.F) {
+	mask := []byte{1, 2, 3, 4}
+	f.Add(wsFrame(0x80|WS_BINARY, testPublish("t", "x"), mask), wsFrame(0x80|WS_BINARY, []byte{0x20, 2, 0, 0}, nil))
+	f.Add([]byte("GET / HTTP/1.1\r\nUpgrade: websocket\r\n\r\n"), []byte("HTTP/1.1 101 Switching Protocols\r\n\r\n"))
+	f.Add(wsFrame(WS_BINARY, []byte{0x30}, nil), wsFrame(0x80|WS_BINARY, make([]byte, 300), nil))
+	f.Fuzz(func(t *testing.T, toBroker, toClient []byte) {
+		c := newWebSocketConn()
+		feedWebSocket(c, true, toBroker, 3)
+		feedWebSocket(c, false, toClient, 7)
+		c.close(&mqttMessage{toBroker: true})
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"getMqtt/distinct"
+)
+
+// 統計視窗的類型
+const (
+	windowTumbling = "tumbling" // 不重疊，長度等於統計間隔
+	windowHopping  = "hopping"  // 長度為視窗長度，每個統計間隔前進一次
+	windowSliding  = "sliding"  // 報告和hopping相同；有Prometheus指標時，統計區間之間每秒由報告協程發布一次按目標IP的數值
+)
+
+// 視窗最多切成的格數，避免視窗長度和間隔的最大公因數太小
+const maxWindowPanes = 3600
+
+// 一格時間內按目標IP的統計
+type windowPane struct {
+	start time.Time
+	stats map[string]*PacketStats
+}
+
+// 視窗統計引擎。封包依時間戳放進長度為 gcd(視窗長度, 統計間隔) 的格子，
+// 報告時把視窗涵蓋的格子合併，所以跨格子的獨立IMSI數是精確的，不是各格相加。
+// 每個工作協程的分片各有一個，報告時併入全域的引擎；全域引擎的呼叫者需持有 lock。
+type windowEngine struct {
+	kind      string
+	precision int           // 獨立IMSI集合的精度，見 distinct.New
+	size      time.Duration // 視窗長度
+	pane      time.Duration // 格子長度
+	since     time.Time     // 開始統計的時間，第一個視窗可能不完整
+	floor     time.Time     // 已報告到的時間，晚到的封包算進目前的格子
+	panes     map[int64]*windowPane
+
+	published map[string]int // 上次報告後按目標IP新增的PUBLISH數，視窗重疊時用來累加計數器
+}
+
+func newWindowEngine(cfg *Config, since time.Time) *windowEngine {
+	return &windowEngine{
+		kind:      cfg.WindowType,
+		precision: cfg.imsiPrecision(),
+		size:      cfg.windowSize(),
+		pane:      cfg.windowPane(),
+		since:     since,
+		panes:     make(map[int64]*windowPane),
+
+		published: make(map[string]int),
+	}
+}
+
+func gcdDuration(a, b time.Duration) time.Duration {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// 說明視窗設定，用在啟動訊息
+func (w *windowEngine) String() string {
+	if w.kind == windowTumbling {
+		return fmt.Sprintf("%s %v", w.kind, w.size)
+	}
+	return fmt.Sprintf("%s %v（每 %v 報告）", w.kind, w.size, config.Interval)
+}
+
+// 取得時間 ts 所在的格子，已報告過的時間算進目前的格子
+func (w *windowEngine) paneAt(ts time.Time) *windowPane {
+	if ts.Before(w.floor) {
+		ts = w.floor
+	}
+	start := ts.Truncate(w.pane)
+	key := start.UnixNano()
+	pane := w.panes[key]
+	if pane == nil {
+		pane = &windowPane{start: start, stats: make(map[string]*PacketStats)}
+		w.panes[key] = pane
+	}
+	return pane
+}
+
+// 取得 stats 中目標IP的統計，沒有時建立
+func (w *windowEngine) statFor(stats map[string]*PacketStats, destinationIP, sourceIP string) *PacketStats {
+	stat := stats[destinationIP]
+	if stat == nil {
+		stat = &PacketStats{
+			DestinationIP: destinationIP,
+			SourceIP:      sourceIP,
+			ImsiSet:       distinct.New(w.precision),
+		}
+		stats[destinationIP] = stat
+	}
+	return stat
+}
+
+// 記錄一個帶IMSI的PUBLISH
+func (w *windowEngine) observe(destinationIP, sourceIP, imsi string, ts time.Time) {
+	stat := w.statFor(w.paneAt(ts).stats, destinationIP, sourceIP)
+	stat.ImsiSet.Add(imsi)
+	stat.Count++
+	w.published[destinationIP]++
+}
+
+// 併入工作協程分片的統計，other 之後不再使用
+func (w *windowEngine) merge(other *windowEngine) {
+	for _, pane := range other.panes {
+		target := w.paneAt(pane.start)
+		for ip, stat := range pane.stats {
+			merged := target.stats[ip]
+			if merged == nil {
+				target.stats[ip] = stat
+				continue
+			}
+			merged.Count += stat.Count
+			merged.ImsiSet.Merge(stat.ImsiSet)
+		}
+	}
+	for ip, n := range other.published {
+		w.published[ip] += n
+	}
+}
+
+// 合併 [end-視窗長度, end) 內的格子，回傳實際的開始時間（不早於開始統計的時間）
+func (w *windowEngine) window(end time.Time) (time.Time, map[string]*PacketStats) {
+	start := end.Add(-w.size)
+	stats := make(map[string]*PacketStats)
+	for _, pane := range w.panes {
+		if pane.start.Before(start) || !pane.start.Before(end) {
+			continue
+		}
+		for ip, stat := range pane.stats {
+			merged := w.statFor(stats, ip, stat.SourceIP)
+			merged.Count += stat.Count
+			merged.ImsiSet.Merge(stat.ImsiSet)
+		}
+	}
+	if start.Before(w.since) {
+		start = w.since
+	}
+	return start, stats
+}
+
+// 報告到 end 為止，丟掉之後任何視窗都用不到的格子，回傳上次報告後新增的PUBLISH數
+func (w *windowEngine) advance(end time.Time) map[string]int {
+	if end.After(w.floor) {
+		w.floor = end
+	}
+	oldest := w.floor.Add(-w.size)
+	for key, pane := range w.panes {
+		if !pane.start.Add(w.pane).After(oldest) {
+			delete(w.panes, key)
+		}
+	}
+	published := w.published
+	w.published = make(map[string]int)
+	return published
+}
+
+// 視窗長度，未設定時等於統計間隔
+func (c *Config) windowSize() time.Duration {
+	if c.WindowSize == 0 {
+		return c.Interval
+	}
+	return c.WindowSize
+}
+
+// 格子長度：視窗的開始和結束都落在格子邊界上，sliding另外以秒為單位
+func (c *Config) windowPane() time.Duration {
+	pane := gcdDuration(c.windowSize(), c.Interval)
+	if c.WindowType == windowSliding {
+		pane = gcdDuration(pane, time.Second)
+	}
+	return pane
+}
+
+func (c *Config) validateWindow() error {
+	size := c.windowSize()
+	switch c.WindowType {
+	case windowTumbling:
+		if size != c.Interval {
+			return fmt.Errorf("tumbling視窗的長度等於統計間隔 %v，要用不同的長度請改用 hopping 或 sliding", c.Interval)
+		}
+	case windowHopping, windowSliding:
+		if size < c.Interval {
+			return fmt.Errorf("視窗長度 %v 不能小於統計間隔 %v", size, c.Interval)
+		}
+	default:
+		return fmt.Errorf("不支援的視窗類型: %q（tumbling、hopping、sliding）", c.WindowType)
+	}
+	if pane := c.windowPane(); size/pane > maxWindowPanes {
+		return fmt.Errorf("視窗長度 %v 和統計間隔 %v 的最大公因數 %v 太小，請使用整數秒", size, c.Interval, pane)
+	}
+	return nil
+}